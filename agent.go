@@ -0,0 +1,308 @@
+package gobom
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+
+	"gobom/utils"
+)
+
+// 压测节点，注册到控制节点并执行控制节点下发的任务
+type AgentClient struct {
+	Controller string // 控制节点地址 http://host:port
+	Name       string
+	Id         string
+	Token      string // 控制节点配置的agentToken
+
+	client  *http.Client
+	running map[string]*agentRun // [任务id]正在运行的任务
+	mu      sync.Mutex
+}
+
+type agentRun struct {
+	gobom    *GobomRequest
+	files    []*WorkerFile // 控制节点下发的文件，运行期间替代本地文件
+	stop     chan struct{} // 启动前收到停止命令时关闭
+	stopOnce sync.Once
+}
+
+// 节点上运行中任务引用的文件
+type workerFileSet struct {
+	paths map[uint]string   // [数据文件id]文件名
+	files map[string][]byte // [文件名]内容
+	mu    sync.RWMutex
+}
+
+var agentFiles = &workerFileSet{
+	paths: make(map[uint]string),
+	files: make(map[string][]byte),
+}
+
+func (set *workerFileSet) add(files []*WorkerFile) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for _, v := range files {
+		if v.Id != 0 {
+			set.paths[v.Id] = v.Path
+		}
+		set.files[v.Path] = v.Data
+	}
+}
+
+func (set *workerFileSet) remove(files []*WorkerFile) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for _, v := range files {
+		delete(set.paths, v.Id)
+		delete(set.files, v.Path)
+	}
+}
+
+func (set *workerFileSet) path(id uint) (string, bool) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	path, ok := set.paths[id]
+	return path, ok
+}
+
+func (set *workerFileSet) data(path string) ([]byte, bool) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	data, ok := set.files[path]
+	return data, ok
+}
+
+func NewAgentClient(controller, name string) *AgentClient {
+	return &AgentClient{
+		Controller: controller,
+		Name:       name,
+		client:     &http.Client{Timeout: DEFAULT_REQUEST_TIMEOUT * time.Second},
+		running:    make(map[string]*agentRun),
+	}
+}
+
+// 注册并保持心跳，stop关闭时退出
+func (agent *AgentClient) Run(stop <-chan struct{}) error {
+	if err := agent.register(); err != nil {
+		return err
+	}
+	t := time.NewTicker(DEFAULT_AGENT_HEARTBEAT)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			agent.stopAll()
+			return nil
+		case <-t.C:
+		}
+		var commands []*AgentCommand
+		err := agent.post("/agent/heartbeat", &AgentReqData{
+			AgentId: agent.Id,
+			TaskId:  agent.runningTaskId(),
+		}, &commands)
+		if err == ERR_AGENT_NOT_FOUND {
+			// 控制节点重启后重新注册
+			if err := agent.register(); err != nil {
+				logger.Debug(err)
+			}
+			continue
+		}
+		if err != nil {
+			logger.Debug(err)
+			continue
+		}
+		for _, command := range commands {
+			agent.exec(command)
+		}
+	}
+}
+
+func (agent *AgentClient) register() error {
+	var info Agent
+	if err := agent.post("/agent/register", &AgentReqData{Name: agent.Name}, &info); err != nil {
+		return err
+	}
+	agent.Id = info.Id
+	logger.Debug("agent registered: ", agent.Id)
+	return nil
+}
+
+func (agent *AgentClient) exec(command *AgentCommand) {
+	switch command.Type {
+	case AGENT_CMD_RUN:
+		if command.Worker == nil || command.Worker.Options == nil {
+			return
+		}
+		agent.mu.Lock()
+		if _, ok := agent.running[command.TaskId]; ok {
+			agent.mu.Unlock()
+			return
+		}
+		gobomInterlock.useRules(command.Rules)
+		run := &agentRun{
+			gobom: command.Worker,
+			files: command.Files,
+			stop:  make(chan struct{}),
+		}
+		run.gobom.Report = &Report{collect: true}
+		run.gobom.env = command.Env
+		run.gobom.prepare()
+		agent.running[command.TaskId] = run
+		agent.mu.Unlock()
+		go agent.run(command.TaskId, command.StartAt, run)
+	case AGENT_CMD_SCALE:
+		agent.mu.Lock()
+		run, ok := agent.running[command.TaskId]
+		agent.mu.Unlock()
+		if ok {
+			if _, err := run.gobom.apply(command.Scale); err != nil {
+				logger.Debug(err)
+			}
+		}
+	case AGENT_CMD_PAUSE, AGENT_CMD_RESUME:
+		agent.mu.Lock()
+		run, ok := agent.running[command.TaskId]
+		agent.mu.Unlock()
+		if !ok {
+			return
+		}
+		var err error
+		if command.Type == AGENT_CMD_PAUSE {
+			_, err = run.gobom.pause("")
+		} else {
+			_, err = run.gobom.resume("")
+		}
+		if err != nil {
+			logger.Debug(err)
+		}
+	case AGENT_CMD_STOP:
+		agent.mu.Lock()
+		run, ok := agent.running[command.TaskId]
+		agent.mu.Unlock()
+		if ok {
+			run.close()
+		}
+	}
+}
+
+func (run *agentRun) close() {
+	run.stopOnce.Do(func() {
+		close(run.stop)
+	})
+	run.gobom.Close(CLOSE_ALL)
+}
+
+func (agent *AgentClient) run(taskId string, startAt int64, run *agentRun) {
+	gobom := run.gobom
+	agentFiles.add(run.files)
+	defer func() {
+		agentFiles.remove(run.files)
+		agent.mu.Lock()
+		delete(agent.running, taskId)
+		agent.mu.Unlock()
+		agent.report(taskId, gobom, true)
+	}()
+
+	if wait := time.Duration(startAt-int64(utils.Now())) * time.Millisecond; wait > 0 {
+		select {
+		case <-run.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				agent.report(taskId, gobom, false)
+			}
+		}
+	}()
+
+	gobom.Options.Init()
+	gobom.Dispose(func(err error) error {
+		if err != nil {
+			logger.Debug(err)
+		}
+		return err
+	})
+	close(done)
+}
+
+func (agent *AgentClient) report(taskId string, gobom *GobomRequest, finished bool) {
+	err := agent.post("/agent/report", &AgentReqData{
+		AgentId:  agent.Id,
+		TaskId:   taskId,
+		Finished: finished,
+		Snapshot: gobom.Report.TakeDelta(),
+	}, nil)
+	if err != nil {
+		logger.Debug(err)
+	}
+}
+
+func (agent *AgentClient) runningTaskId() string {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	for taskId := range agent.running {
+		return taskId
+	}
+	return ""
+}
+
+func (agent *AgentClient) stopAll() {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	for _, run := range agent.running {
+		run.close()
+	}
+}
+
+func (agent *AgentClient) post(path string, reqData interface{}, data interface{}) error {
+	bt, err := json.Marshal(reqData)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, agent.Controller+path, bytes.NewReader(bt))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if agent.Token != "" {
+		req.Header.Set("Token", agent.Token)
+	}
+	resp, err := agent.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply := struct {
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Msg == ERR_AGENT_NOT_FOUND.Error() {
+		return ERR_AGENT_NOT_FOUND
+	}
+	if reply.Msg != "" {
+		return errors.New(reply.Msg)
+	}
+	if data != nil && len(reply.Data) != 0 {
+		return json.Unmarshal(reply.Data, data)
+	}
+	return nil
+}
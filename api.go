@@ -1,7 +1,11 @@
 package gobom
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,10 +23,15 @@ type ApiReply struct {
 
 func NewApi() *Api {
 	api := &Api{
-		Http: gin.Default(),
+		Http: gin.New(),
 	}
+	api.Http.Use(gin.LoggerWithFormatter(apiLogFormatter), gin.Recovery())
 	api.Http.Use(func(ctx *gin.Context) {
-		ctx.Header("Access-Control-Allow-Origin", "*")
+		// 只允许配置的来源跨域访问
+		if origin := ctx.GetHeader("Origin"); origin != "" && allowOrigin(origin) {
+			ctx.Header("Access-Control-Allow-Origin", origin)
+			ctx.Header("Vary", "Origin")
+		}
 		ctx.Header("Access-Control-Allow-Headers", "Content-Type,AccessToken,X-CSRF-Token, Authorization, Token")
 		ctx.Header("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
 		ctx.Header("Access-Control-Expose-Headers", "Content-Length, Access-Control-Allow-Origin, Access-Control-Allow-Headers, Content-Type")
@@ -35,14 +44,76 @@ func NewApi() *Api {
 		// 处理请求
 		ctx.Next()
 	})
+	api.Http.Use(Authenticate)
 	api.RegisterRouter()
 	return api
 }
 
+// 访问日志，websocket通过token参数传递的登录令牌不写入日志
+func apiLogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency - param.Latency%time.Second
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		redactToken(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+func redactToken(path string) string {
+	i := strings.IndexByte(path, '?')
+	if i < 0 {
+		return path
+	}
+	query, err := url.ParseQuery(path[i+1:])
+	if err != nil {
+		return path[:i]
+	}
+	if _, ok := query["token"]; !ok {
+		return path
+	}
+	query.Set("token", "***")
+	return path[:i+1] + query.Encode()
+}
+
 func (api *Api) RegisterRouter() {
 	api.Http.Static("/frontend/", "./")
 	api.Http.Any("/ws", TaskWsHandel)
 
+	api.Http.Any("/login", UserHandel)
+	api.Http.Any("/logout", UserHandel)
+	api.Http.Any("/user", UserHandel)
+	api.Http.Any("/user/me", UserHandel)
+	api.Http.Any("/user/password", UserHandel)
+	api.Http.Any("/user/add", UserHandel)
+	api.Http.Any("/user/edit", UserHandel)
+	api.Http.Any("/user/delete", UserHandel)
+
+	api.Http.Any("/audit", AuditHandel)
+
+	api.Http.Any("/rule", TargetRuleHandel)
+	api.Http.Any("/rule/add", TargetRuleHandel)
+	api.Http.Any("/rule/edit", TargetRuleHandel)
+	api.Http.Any("/rule/delete", TargetRuleHandel)
+	api.Http.Any("/rule/check", TargetRuleHandel)
+	api.Http.Any("/environment", EnvironmentHandel)
+	api.Http.Any("/environment/add", EnvironmentHandel)
+	api.Http.Any("/environment/edit", EnvironmentHandel)
+	api.Http.Any("/environment/delete", EnvironmentHandel)
+
+	api.Http.Any("/project", ProjectHandel)
+	api.Http.Any("/project/add", ProjectHandel)
+	api.Http.Any("/project/edit", ProjectHandel)
+	api.Http.Any("/project/delete", ProjectHandel)
+	api.Http.Any("/project/members", ProjectHandel)
+	api.Http.Any("/project/member/set", ProjectHandel)
+	api.Http.Any("/project/member/delete", ProjectHandel)
+
 	api.Http.Any("/task", TaskDataHandel)
 	api.Http.Any("/task/add", TaskDataHandel)
 	api.Http.Any("/task/edit", TaskDataHandel)
@@ -50,12 +121,59 @@ func (api *Api) RegisterRouter() {
 	api.Http.Any("/task/run", TaskDataHandel)
 	api.Http.Any("/task/info", TaskDataHandel)
 	api.Http.Any("/task/stop", TaskDataHandel)
+	api.Http.Any("/task/scale", TaskDataHandel)
+	api.Http.Any("/task/pause", TaskDataHandel)
+	api.Http.Any("/task/resume", TaskDataHandel)
+	api.Http.Any("/task/runs", TaskRunHandel)
+
+	api.Http.Any("/queue", QueueHandel)
+	api.Http.Any("/queue/cancel", QueueHandel)
+
+	api.Http.Any("/schedule", ScheduleHandel)
+	api.Http.Any("/schedule/add", ScheduleHandel)
+	api.Http.Any("/schedule/edit", ScheduleHandel)
+	api.Http.Any("/schedule/delete", ScheduleHandel)
+
+	api.Http.Any("/pipeline", PipelineHandel)
+	api.Http.Any("/pipeline/add", PipelineHandel)
+	api.Http.Any("/pipeline/edit", PipelineHandel)
+	api.Http.Any("/pipeline/delete", PipelineHandel)
+	api.Http.Any("/pipeline/run", PipelineHandel)
+	api.Http.Any("/pipeline/stop", PipelineHandel)
+
+	api.Http.Any("/webhook", WebhookHandel)
+	api.Http.Any("/webhook/add", WebhookHandel)
+	api.Http.Any("/webhook/edit", WebhookHandel)
+	api.Http.Any("/webhook/delete", WebhookHandel)
+	api.Http.Any("/webhook/test", WebhookHandel)
+	api.Http.Any("/webhook/logs", WebhookHandel)
 
 	api.Http.Any("/script", ScriptDataHandel)
 	api.Http.Any("/script/add", ScriptDataHandel)
 	api.Http.Any("/script/delete", ScriptDataHandel)
 	api.Http.Any("/script/edit", ScriptDataHandel)
 	api.Http.Any("/script/test", ScriptDataHandel)
+	api.Http.Any("/script/import/har", ScriptImportHarHandel)
+
+	api.Http.Any("/agent", AgentHandel)
+	api.Http.Any("/agent/register", AgentHandel)
+	api.Http.Any("/agent/heartbeat", AgentHandel)
+	api.Http.Any("/agent/report", AgentHandel)
+
+	api.Http.Any("/datafile", DataFileHandel)
+	api.Http.Any("/datafile/upload", DataFileHandel)
+	api.Http.Any("/datafile/preview", DataFileHandel)
+	api.Http.Any("/datafile/replace", DataFileHandel)
+	api.Http.Any("/datafile/delete", DataFileHandel)
+}
+
+func allowOrigin(origin string) bool {
+	for _, v := range configs().AllowOrigins {
+		if v == "*" || v == origin {
+			return true
+		}
+	}
+	return false
 }
 
 func ApiResponse(ctx *gin.Context, reply ApiReply) {
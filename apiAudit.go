@@ -0,0 +1,338 @@
+package gobom
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AUDIT_SCRIPT_ADD    = "script.add"
+	AUDIT_SCRIPT_EDIT   = "script.edit"
+	AUDIT_SCRIPT_DELETE = "script.delete"
+	AUDIT_SCRIPT_TEST   = "script.test"
+	AUDIT_TASK_ADD      = "task.add"
+	AUDIT_TASK_EDIT     = "task.edit"
+	AUDIT_TASK_DELETE   = "task.delete"
+	AUDIT_TASK_RUN      = "task.run"
+	AUDIT_TASK_STOP     = "task.stop"
+	AUDIT_TASK_SCALE    = "task.scale"
+	AUDIT_TASK_PAUSE    = "task.pause"
+	AUDIT_TASK_RESUME   = "task.resume"
+
+	DEFAULT_AUDIT_LIMIT = 100
+	MAX_AUDIT_LIMIT     = 1000
+	MAX_DIFF_LINES      = 2000 // 超过时不计算逐行差异
+)
+
+// 接口对应的审计动作，不在其中的接口不记录
+var auditActions = map[string]string{
+	"/script/add":        AUDIT_SCRIPT_ADD,
+	"/script/edit":       AUDIT_SCRIPT_EDIT,
+	"/script/delete":     AUDIT_SCRIPT_DELETE,
+	"/script/test":       AUDIT_SCRIPT_TEST,
+	"/script/import/har": AUDIT_SCRIPT_ADD,
+	"/task/add":          AUDIT_TASK_ADD,
+	"/task/edit":         AUDIT_TASK_EDIT,
+	"/task/delete":       AUDIT_TASK_DELETE,
+	"/task/run":          AUDIT_TASK_RUN,
+	"/task/stop":         AUDIT_TASK_STOP,
+	"/task/scale":        AUDIT_TASK_SCALE,
+	"/task/pause":        AUDIT_TASK_PAUSE,
+	"/task/resume":       AUDIT_TASK_RESUME,
+}
+
+// websocket消息对应的审计动作
+var wsAuditActions = map[int]string{
+	WS_TASK_RUN:    AUDIT_TASK_RUN,
+	WS_TASK_STOP:   AUDIT_TASK_STOP,
+	WS_TASK_SCALE:  AUDIT_TASK_SCALE,
+	WS_TASK_PAUSE:  AUDIT_TASK_PAUSE,
+	WS_TASK_RESUME: AUDIT_TASK_RESUME,
+}
+
+// 审计日志，记录谁在什么时候修改或运行了什么
+type AuditData struct {
+	Model
+	UserId    uint   `json:"userId" gorm:"index"`
+	UserName  string `json:"userName"`
+	Ip        string `json:"ip"`
+	Action    string `json:"action" gorm:"index"`
+	TargetId  string `json:"targetId" gorm:"index"` // 脚本id或任务id
+	ProjectId uint   `json:"projectId" gorm:"index"`
+	Url       string `json:"url" gorm:"type:text"`        // 压测地址，多个用换行分隔
+	Before    string `json:"before" gorm:"type:longtext"` // 修改前的脚本或任务
+	After     string `json:"after" gorm:"type:longtext"`  // 修改后的脚本或任务
+	Diff      string `json:"diff" gorm:"type:longtext"`   // 逐行差异，-为删除的行，+为新增的行
+	Detail    string `json:"detail" gorm:"type:text"`     // 调整参数、暂停原因等
+	Error     string `json:"error"`                       // 操作失败的原因，为空表示成功
+}
+
+type AuditReqData struct {
+	ID        uint   `json:"ID" form:"ID"`
+	UserId    uint   `json:"userId" form:"userId"`
+	UserName  string `json:"userName" form:"userName"`
+	Action    string `json:"action" form:"action"` // 动作，script.或task.匹配一类动作
+	TargetId  string `json:"targetId" form:"targetId"`
+	ProjectId uint   `json:"projectId" form:"projectId"`
+	Url       string `json:"url" form:"url"`             // 压测地址包含的内容
+	StartTime string `json:"startTime" form:"startTime"` // 2006-01-02 15:04:05
+	EndTime   string `json:"endTime" form:"endTime"`
+	Failed    bool   `json:"failed" form:"failed"` // 只查询失败的操作
+	Limit     int    `json:"limit" form:"limit"`
+	Offset    int    `json:"offset" form:"offset"`
+}
+
+var auditTable = &AuditData{}
+
+func AuditHandel(ctx *gin.Context) {
+	var reqParam AuditReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	user := currentUser(ctx)
+	switch ctx.FullPath() {
+	case "/audit":
+		if reqParam.ID == 0 {
+			data, err = reqParam.Get(user)
+			return
+		}
+		if err = user.authorizeRecord(auditTable, reqParam.ID, ROLE_VIEWER); err != nil {
+			return
+		}
+		audit := &AuditData{}
+		audit.ID = reqParam.ID
+		data, err = audit.First()
+	}
+}
+
+func newAudit(ctx *gin.Context, action string) *AuditData {
+	return newUserAudit(currentUser(ctx), ctx.ClientIP(), action)
+}
+
+// action为空时返回nil，不记录
+func newUserAudit(user *UserData, ip, action string) *AuditData {
+	if action == "" {
+		return nil
+	}
+	audit := &AuditData{Action: action, Ip: ip}
+	if user != nil {
+		audit.UserId = user.ID
+		audit.UserName = user.Name
+	}
+	return audit
+}
+
+// 记录脚本所属项目和压测地址
+func (audit *AuditData) setScript(scriptData *ScriptData) {
+	if audit == nil || scriptData == nil {
+		return
+	}
+	if scriptData.ID != 0 {
+		audit.TargetId = strconv.FormatUint(uint64(scriptData.ID), 10)
+	}
+	audit.ProjectId = scriptData.ProjectId
+	if opt, err := scriptData.Options(); err == nil {
+		audit.Url = strings.Join(opt.Urls(), "\n")
+	}
+}
+
+// 读取任务并记录所属项目和压测地址，返回任务的配置（不包含运行报告和状态），任务不存在时返回空
+func (audit *AuditData) loadTask(taskId string) string {
+	if audit == nil || taskId == "" {
+		return ""
+	}
+	audit.TargetId = taskId
+	taskData := &TaskData{Task: &Task{TaskId: taskId}}
+	if _, err := taskData.First(); err != nil {
+		return ""
+	}
+	audit.ProjectId = taskData.ProjectId
+	if taskData.Task.Worker != nil {
+		audit.Url = strings.Join(taskData.Task.Worker.Urls(), "\n")
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(taskData.TaskJson), &config); err != nil {
+		return taskData.TaskJson
+	}
+	delete(config, "status")
+	if worker, ok := config["worker"].(map[string]interface{}); ok {
+		delete(worker, "report")
+	}
+	config["name"] = taskData.Name
+	config["projectId"] = taskData.ProjectId
+	config["scriptId"] = taskData.ScriptId
+	config["setupScriptId"] = taskData.SetupScriptId
+	config["teardownScriptId"] = taskData.TeardownScriptId
+	bt, _ := json.Marshal(config)
+	return string(bt)
+}
+
+// 保存审计日志，err为操作的结果
+func (audit *AuditData) Save(err error) {
+	if audit == nil {
+		return
+	}
+	if err != nil {
+		audit.Error = err.Error()
+	}
+	if audit.Before != audit.After {
+		audit.Diff = diffLines(prettyJson(audit.Before), prettyJson(audit.After))
+	}
+	if e := GobomStore.GetDb().Table(GobomStore.GetTableName(auditTable)).Create(audit).Error; e != nil {
+		logger.Error("save audit failed: ", e)
+	}
+}
+
+func (audit *AuditData) First() (*AuditData, error) {
+	if audit.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(auditTable)).First(audit, audit.ID).Error; err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+// 按条件查询审计日志（不包含修改前后的内容），按时间倒序
+func (reqParam *AuditReqData) Get(user *UserData) (list []AuditData, err error) {
+	db := GobomStore.GetDb().Table(GobomStore.GetTableName(auditTable)).Scopes(user.projectScope()).
+		Select("id, created_at, updated_at, deleted_at, user_id, user_name, ip, action, target_id, project_id, url, detail, error")
+	if reqParam.UserId != 0 {
+		db = db.Where("user_id = ?", reqParam.UserId)
+	}
+	if reqParam.UserName != "" {
+		db = db.Where("user_name = ?", reqParam.UserName)
+	}
+	if strings.HasSuffix(reqParam.Action, ".") {
+		db = db.Where("action LIKE ?", reqParam.Action+"%")
+	} else if reqParam.Action != "" {
+		db = db.Where("action = ?", reqParam.Action)
+	}
+	if reqParam.TargetId != "" {
+		db = db.Where("target_id = ?", reqParam.TargetId)
+	}
+	if reqParam.ProjectId != 0 {
+		db = db.Where("project_id = ?", reqParam.ProjectId)
+	}
+	if reqParam.Url != "" {
+		db = db.Where("url LIKE ?", "%"+reqParam.Url+"%")
+	}
+	if reqParam.Failed {
+		db = db.Where("error <> ''")
+	}
+	for _, v := range []struct {
+		value string
+		cond  string
+	}{{reqParam.StartTime, "created_at >= ?"}, {reqParam.EndTime, "created_at <= ?"}} {
+		if v.value == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", v.value, time.Local)
+		if err != nil {
+			return nil, ERR_PARAM
+		}
+		db = db.Where(v.cond, t)
+	}
+	limit := reqParam.Limit
+	if limit <= 0 {
+		limit = DEFAULT_AUDIT_LIMIT
+	}
+	if limit > MAX_AUDIT_LIMIT {
+		limit = MAX_AUDIT_LIMIT
+	}
+	err = db.Order("id desc").Offset(reqParam.Offset).Limit(limit).Find(&list).Error
+	return
+}
+
+// JSON格式化后再比较，便于按行查看差异
+func prettyJson(s string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(s), "", "  "); err != nil {
+		return s
+	}
+	return buf.String()
+}
+
+// 按行比较（最长公共子序列），输出 -删除的行 +新增的行，相同的行以空格开头
+func diffLines(before, after string) string {
+	a := splitLines(before)
+	b := splitLines(after)
+	var out []string
+	if len(a)+len(b) > MAX_DIFF_LINES {
+		for _, line := range a {
+			out = append(out, "-"+line)
+		}
+		for _, line := range b {
+			out = append(out, "+"+line)
+		}
+		return strings.Join(out, "\n")
+	}
+	// lcs[i][j]为a[i:]与b[j:]的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return strings.Join(out, "\n")
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
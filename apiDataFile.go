@@ -0,0 +1,376 @@
+package gobom
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"gobom/utils"
+)
+
+const (
+	DEFAULT_PREVIEW_ROWS = 10
+
+	DATAFILE_TYPE_DATA = ""     // 数据文件（xlsx|csv）
+	DATAFILE_TYPE_CERT = "cert" // 证书文件（PEM格式的证书或私钥），在TLS设置中引用
+)
+
+type DataFile struct {
+	Model
+	Name       string   `json:"name" gorm:"unique_index"`
+	ProjectId  uint     `json:"projectId" gorm:"index"`
+	Path       string   `json:"path"` // 存储在FILE_DATA_PATH下的文件名
+	Type       string   `json:"type"` // 空为数据文件|cert
+	Size       int64    `json:"size"`
+	Rows       int      `json:"rows"` // 数据行数（不包含列名）
+	Columns    []string `json:"columns" gorm:"-"`
+	ColumnJson string   `json:"-" gorm:"type:text"`
+}
+
+type DataFileReqData struct {
+	ID        uint   `json:"ID" form:"ID"`
+	Name      string `json:"name" form:"name"`
+	ProjectId uint   `json:"projectId" form:"projectId"`
+	Rows      int    `json:"rows" form:"rows"` // 预览行数
+}
+
+type DataFilePreview struct {
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+	Total   int        `json:"total"`
+}
+
+var dataFileTable = &DataFile{}
+
+func DataFileHandel(ctx *gin.Context) {
+	var reqParam DataFileReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	dataFile := &DataFile{Name: reqParam.Name, ProjectId: reqParam.ProjectId}
+	dataFile.ID = reqParam.ID
+
+	user := currentUser(ctx)
+	switch ctx.FullPath() {
+	case "/datafile/upload":
+		err = user.authorize(dataFile.ProjectId, ROLE_EDITOR)
+	case "/datafile/replace", "/datafile/delete":
+		err = user.authorizeRecord(dataFileTable, dataFile.ID, ROLE_EDITOR)
+	default:
+		if dataFile.ID != 0 {
+			err = user.authorizeRecord(dataFileTable, dataFile.ID, ROLE_VIEWER)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	switch ctx.FullPath() {
+	case "/datafile":
+		if dataFile.ID == 0 {
+			data, err = dataFile.Get(user.projectScope())
+		} else {
+			data, err = dataFile.First()
+		}
+	case "/datafile/upload":
+		if err = dataFile.Save(ctx); err != nil {
+			return
+		}
+		err = dataFile.Add()
+		data = dataFile
+	case "/datafile/preview":
+		data, err = dataFile.Preview(reqParam.Rows)
+	case "/datafile/replace":
+		if _, err = dataFile.First(); err != nil {
+			return
+		}
+		oldPath, oldType := dataFile.Path, dataFile.Type
+		if err = dataFile.Save(ctx); err != nil {
+			return
+		}
+		if dataFile.Type != oldType {
+			os.Remove(dataFile.filePath())
+			err = ERR_DATAFILE_TYPE
+			return
+		}
+		if err = dataFile.CheckColumnUsed(); err != nil {
+			os.Remove(dataFile.filePath())
+			return
+		}
+		if err = dataFile.Update(); err != nil {
+			os.Remove(dataFile.filePath())
+			return
+		}
+		os.Remove(fmt.Sprintf("%s/%s", FILE_DATA_PATH, oldPath))
+		data = dataFile
+	case "/datafile/delete":
+		err = dataFile.Del()
+	}
+}
+
+// 保存上传的文件并解析列名
+func (dataFile *DataFile) Save(ctx *gin.Context) error {
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
+	switch ext {
+	case ".xlsx", ".csv":
+		dataFile.Type = DATAFILE_TYPE_DATA
+	case ".pem", ".crt", ".cer", ".key":
+		dataFile.Type = DATAFILE_TYPE_CERT
+	default:
+		return ERR_DATAFILE_TYPE
+	}
+	if dataFile.Name == "" {
+		dataFile.Name = fileHeader.Filename
+	}
+	if err := os.MkdirAll(FILE_DATA_PATH, os.ModePerm); err != nil {
+		return err
+	}
+	dataFile.Path = utils.GenerateId() + ext
+	if err := ctx.SaveUploadedFile(fileHeader, dataFile.filePath()); err != nil {
+		return err
+	}
+	dataFile.Size = fileHeader.Size
+	if dataFile.Type == DATAFILE_TYPE_CERT {
+		return dataFile.checkPem()
+	}
+	rows, err := ReadDataFile(dataFile.filePath())
+	if err == nil {
+		err = checkDataRows(rows)
+	}
+	if err != nil {
+		os.Remove(dataFile.filePath())
+		return err
+	}
+	dataFile.Columns = rows[0]
+	dataFile.Rows = len(rows) - 1
+	return nil
+}
+
+// 至少有一行数据，每行的列数不少于列名
+func checkDataRows(rows [][]string) error {
+	if len(rows) == 0 {
+		return ERR_DATAFILE_EMPTY
+	}
+	if len(rows) < 2 {
+		return ERR_DATAFILE_NO_ROWS
+	}
+	for i, row := range rows[1:] {
+		if len(row) < len(rows[0]) {
+			return fmt.Errorf("%s[第%d行]", ERR_DATAFILE_ROW, i+2)
+		}
+	}
+	return nil
+}
+
+func (dataFile *DataFile) Preview(n int) (*DataFilePreview, error) {
+	if _, err := dataFile.First(); err != nil {
+		return nil, err
+	}
+	rows, err := ReadDataFile(dataFile.filePath())
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ERR_DATAFILE_EMPTY
+	}
+	if n <= 0 {
+		n = DEFAULT_PREVIEW_ROWS
+	}
+	data := rows[1:]
+	if len(data) > n {
+		data = data[:n]
+	}
+	return &DataFilePreview{
+		Columns: rows[0],
+		Rows:    data,
+		Total:   len(rows) - 1,
+	}, nil
+}
+
+func (dataFile *DataFile) HasColumn(column string) bool {
+	for _, v := range dataFile.Columns {
+		if v == column {
+			return true
+		}
+	}
+	return false
+}
+
+// 替换文件后，脚本中引用的列必须仍然存在
+func (dataFile *DataFile) CheckColumnUsed() error {
+	scripts, err := (&ScriptData{}).Get()
+	if err != nil {
+		return err
+	}
+	for _, script := range scripts {
+		opt, err := script.Options()
+		if err != nil {
+			continue
+		}
+		for _, v := range opt.FileDataFields() {
+			if v.FileId == dataFile.ID && !dataFile.HasColumn(v.Dynamic) {
+				return fmt.Errorf("脚本[%s]引用的列[%s]在新文件中不存在", script.Name, v.Dynamic)
+			}
+		}
+	}
+	return nil
+}
+
+// 证书文件至少包含一个PEM块
+func (dataFile *DataFile) checkPem() error {
+	bt, err := ioutil.ReadFile(dataFile.filePath())
+	if err == nil {
+		if block, _ := pem.Decode(bt); block == nil {
+			err = ERR_CERT_PEM
+		}
+	}
+	if err != nil {
+		os.Remove(dataFile.filePath())
+	}
+	return err
+}
+
+// 获取引用此文件的脚本
+func (dataFile *DataFile) UsedBy() ([]string, error) {
+	var names []string
+	scripts, err := (&ScriptData{}).Get()
+	if err != nil {
+		return nil, err
+	}
+	for _, script := range scripts {
+		opt, err := script.Options()
+		if err != nil {
+			continue
+		}
+		used := false
+		for _, v := range opt.FileDataFields() {
+			if v.FileId == dataFile.ID {
+				used = true
+				break
+			}
+		}
+		for _, id := range opt.TlsOptions.fileIds() {
+			if id == dataFile.ID {
+				used = true
+			}
+		}
+		if used {
+			names = append(names, script.Name)
+		}
+	}
+	return names, nil
+}
+
+func (dataFile *DataFile) filePath() string {
+	return fmt.Sprintf("%s/%s", FILE_DATA_PATH, dataFile.Path)
+}
+
+// 获取数据文件存储的文件名，节点上使用控制节点下发的文件
+func dataFilePath(id uint) (string, error) {
+	if path, ok := agentFiles.path(id); ok {
+		return path, nil
+	}
+	dataFile := &DataFile{}
+	dataFile.ID = id
+	if _, err := dataFile.First(); err != nil {
+		return "", err
+	}
+	return dataFile.Path, nil
+}
+
+// 读取FILE_DATA_PATH下的文件，节点上使用控制节点下发的内容
+func readStoredFile(path string) ([]byte, error) {
+	if data, ok := agentFiles.data(path); ok {
+		return data, nil
+	}
+	return ioutil.ReadFile(fmt.Sprintf("%s/%s", FILE_DATA_PATH, path))
+}
+
+func (dataFile *DataFile) BeforeSave() (err error) {
+	bt, err := json.Marshal(dataFile.Columns)
+	dataFile.ColumnJson = string(bt)
+	return err
+}
+
+func (dataFile *DataFile) AfterFind() (err error) {
+	if dataFile.ColumnJson == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(dataFile.ColumnJson), &dataFile.Columns)
+}
+
+func (dataFile *DataFile) Add() error {
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(dataFileTable)).Create(dataFile).Error; err != nil {
+		os.Remove(dataFile.filePath())
+		return err
+	}
+	return nil
+}
+
+func (dataFile *DataFile) Del() error {
+	if _, err := dataFile.First(); err != nil {
+		return err
+	}
+	names, err := dataFile.UsedBy()
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("%s：%s", ERR_DATAFILE_IN_USE.Error(), strings.Join(names, ","))
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(dataFileTable)).Delete(dataFile).Error; err != nil {
+		return err
+	}
+	os.Remove(dataFile.filePath())
+	return nil
+}
+
+func (dataFile *DataFile) Update() error {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(dataFileTable)).Save(dataFile).Error
+}
+
+func (dataFile *DataFile) First() (*DataFile, error) {
+	if dataFile.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(dataFileTable)).First(dataFile).Error; err != nil {
+		return nil, ERR_DATAFILE_NOT_FOUND
+	}
+	return dataFile, nil
+}
+
+func (dataFile *DataFile) Get(scopes ...func(db *gorm.DB) *gorm.DB) ([]DataFile, error) {
+	var dataFiles []DataFile
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(dataFileTable)).Scopes(scopes...).Find(&dataFiles).Error; err != nil {
+		return nil, err
+	}
+	return dataFiles, nil
+}
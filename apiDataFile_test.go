@@ -0,0 +1,187 @@
+package gobom
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上传文件，fields为其他表单字段
+func apiUpload(t *testing.T, server *httptest.Server, token, path, fileName, content string, fields map[string]string) *ApiReply {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	part, _ := writer.CreateFormFile("file", fileName)
+	part.Write([]byte(content))
+	writer.Close()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+path, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply := &ApiReply{}
+	json.NewDecoder(resp.Body).Decode(reply)
+	return reply
+}
+
+// FILE_DATA_PATH下的文件名
+func testStoredFiles(t *testing.T) map[string]bool {
+	files := make(map[string]bool)
+	infos, err := ioutil.ReadDir(FILE_DATA_PATH)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		files[info.Name()] = true
+	}
+	return files
+}
+
+func TestDataFileApi(t *testing.T) {
+	initTestDb(t)
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := apiLogin(t, server, DEFAULT_ADMIN_NAME, "admin-password")
+	_, reply := apiCall(t, server, admin, "/project/add", &ProjectData{Name: "datafile"})
+	projectId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	project := map[string]string{"projectId": fmt.Sprint(projectId)}
+	stored := testStoredFiles(t)
+
+	// 上传：解析列名和行数，不支持的类型不保存
+	reply = apiUpload(t, server, admin, "/datafile/upload", "users.csv", "name,age\nalice,1\nbob,2\n", project)
+	if reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	uploaded := reply.Data.(map[string]interface{})
+	id := uint(uploaded["ID"].(float64))
+	path := uploaded["path"].(string)
+	t.Cleanup(func() {
+		for name := range testStoredFiles(t) {
+			if !stored[name] {
+				os.Remove(fmt.Sprintf("%s/%s", FILE_DATA_PATH, name))
+			}
+		}
+	})
+	if uploaded["name"] != "users.csv" || uploaded["rows"].(float64) != 2 || len(uploaded["columns"].([]interface{})) != 2 {
+		t.Errorf("upload: %v", uploaded)
+	}
+	if reply = apiUpload(t, server, admin, "/datafile/upload", "users.txt", "name\n", project); reply.Msg != ERR_DATAFILE_TYPE.Error() {
+		t.Errorf("type: %+v", reply)
+	}
+	if reply = apiUpload(t, server, admin, "/datafile/upload", "empty.csv", "", project); reply.Msg != ERR_DATAFILE_EMPTY.Error() {
+		t.Errorf("empty: %+v", reply)
+	}
+	if reply = apiUpload(t, server, admin, "/datafile/upload", "header.csv", "name,age\n", project); reply.Msg != ERR_DATAFILE_NO_ROWS.Error() {
+		t.Errorf("header only: %+v", reply)
+	}
+	if reply = apiUpload(t, server, admin, "/datafile/upload", "ragged.csv", "name,age\nalice,1\nbob\n", project); !strings.HasPrefix(reply.Msg, ERR_DATAFILE_ROW.Error()) {
+		t.Errorf("ragged: %+v", reply)
+	}
+	if files := testStoredFiles(t); len(files) != len(stored)+1 || !files[path] {
+		t.Errorf("stored: %v", files)
+	}
+
+	// 预览
+	_, reply = apiCall(t, server, admin, "/datafile/preview", &DataFileReqData{ID: id, Rows: 1})
+	preview := reply.Data.(map[string]interface{})
+	if reply.Msg != "" || preview["total"].(float64) != 2 || len(preview["rows"].([]interface{})) != 1 || preview["rows"].([]interface{})[0].([]interface{})[0] != "alice" {
+		t.Errorf("preview: %+v", reply)
+	}
+
+	// 替换：脚本引用的列必须存在，失败时不留下新文件
+	_, reply = apiCall(t, server, admin, "/script/add", map[string]interface{}{
+		"name": "users", "projectId": projectId,
+		"data": fmt.Sprintf(`{"url":"http://127.0.0.1/","sendData":{"dataFieldList":[{"name":"user","type":"file","dynamic":"name","fileId":%d}]}}`, id),
+	})
+	if reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	replace := map[string]string{"ID": fmt.Sprint(id)}
+	if reply = apiUpload(t, server, admin, "/datafile/replace", "users.csv", "user,age\ncarol,3\n", replace); !strings.Contains(reply.Msg, "name") {
+		t.Errorf("missing column: %+v", reply)
+	}
+	if reply = apiUpload(t, server, admin, "/datafile/replace", "users.pem", "-----BEGIN CERTIFICATE-----\nAA==\n-----END CERTIFICATE-----\n", replace); reply.Msg != ERR_DATAFILE_TYPE.Error() {
+		t.Errorf("replace type: %+v", reply)
+	}
+	table := GobomStore.GetTableName(dataFileTable)
+	if err := GobomStore.GetDb().Exec("CREATE TRIGGER datafile_readonly BEFORE UPDATE ON " + table + " BEGIN SELECT RAISE(ABORT, 'readonly'); END").Error; err != nil {
+		t.Fatal(err)
+	}
+	if reply = apiUpload(t, server, admin, "/datafile/replace", "users.csv", "name,age\ncarol,3\n", replace); reply.Msg == "" {
+		t.Error("update failure not reported")
+	}
+	GobomStore.GetDb().Exec("DROP TRIGGER datafile_readonly")
+	if files := testStoredFiles(t); len(files) != len(stored)+1 || !files[path] {
+		t.Errorf("orphaned files: %v", files)
+	}
+	reply = apiUpload(t, server, admin, "/datafile/replace", "users.csv", "name,age\ncarol,3\n", replace)
+	if reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	replaced := reply.Data.(map[string]interface{})
+	if files := testStoredFiles(t); replaced["rows"].(float64) != 1 || files[path] || !files[replaced["path"].(string)] {
+		t.Errorf("replace: %v %v", replaced, files)
+	}
+
+	// 没有编辑权限不能上传和删除
+	_, reply = apiCall(t, server, admin, "/user/add", map[string]string{"name": "viewer", "password": "viewer-password"})
+	if reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	viewer := apiLogin(t, server, "viewer", "viewer-password")
+	if reply = apiUpload(t, server, viewer, "/datafile/upload", "other.csv", "name\nalice\n", project); reply.Msg == "" {
+		t.Error("viewer uploaded file")
+	}
+	if _, reply = apiCall(t, server, viewer, "/datafile/delete", &DataFileReqData{ID: id}); reply.Msg == "" {
+		t.Error("viewer deleted file")
+	}
+
+	// 删除：被脚本引用时拒绝，删除后移除文件
+	if _, reply = apiCall(t, server, admin, "/datafile/delete", &DataFileReqData{ID: id}); !strings.HasPrefix(reply.Msg, ERR_DATAFILE_IN_USE.Error()) || !strings.Contains(reply.Msg, "users") {
+		t.Errorf("in use: %+v", reply)
+	}
+	scripts, _ := (&ScriptData{}).Get()
+	if _, reply = apiCall(t, server, admin, "/script/delete", map[string]interface{}{"ID": scripts[0].ID}); reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	if _, reply = apiCall(t, server, admin, "/datafile/delete", &DataFileReqData{ID: id}); reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	if files := testStoredFiles(t); len(files) != len(stored) {
+		t.Errorf("deleted: %v", files)
+	}
+	if _, reply = apiCall(t, server, admin, "/datafile", &DataFileReqData{ID: id}); reply.Msg == "" {
+		t.Errorf("get deleted: %+v", reply)
+	}
+}
+
+// 运行时读取的文件没有数据行或行缺少列时返回空值
+func TestDataFileValue(t *testing.T) {
+	if v := (&SourceFile{Column: []string{"name"}}).getValue("name"); v != "" {
+		t.Errorf("no rows: %v", v)
+	}
+	sourceFile := &SourceFile{Column: []string{"name", "age"}, Data: [][]string{{"alice", "1"}, {"bob"}}}
+	for _, want := range []string{"1", "", "1"} {
+		if v := sourceFile.getValue("age"); v != want {
+			t.Errorf("age: %v, want %q", v, want)
+		}
+	}
+}
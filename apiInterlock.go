@@ -0,0 +1,352 @@
+package gobom
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 压测地址规则，Host、Cidr、Port至少设置一项，设置的条件都满足时匹配
+type TargetRuleData struct {
+	Model
+	Action  string `json:"action"`  // allow|deny
+	Host    string `json:"host"`    // 主机名，*.example.com匹配所有子域名
+	Cidr    string `json:"cidr"`    // IP段，如10.0.0.0/8，域名解析后匹配
+	Port    int    `json:"port"`    // 端口，0为所有端口
+	Confirm bool   `json:"confirm"` // 允许规则：匹配的地址需要确认后运行（如生产环境）
+	Note    string `json:"note"`
+
+	network *net.IPNet
+}
+
+// 环境的硬限制，按项目的环境名匹配
+type EnvironmentData struct {
+	Model
+	Name          string `json:"name" gorm:"unique_index"`
+	MaxConCurrent uint64 `json:"maxConCurrent"` // 任务的最大并发数，0为不限制
+	MaxRate       uint64 `json:"maxRate"`       // 任务每秒迭代次数上限，0为不限制
+	Proxies       string `json:"proxies"`       // 环境的代理地址，逗号或换行分隔，脚本没有设置代理时使用
+	ProxyRotate   bool   `json:"proxyRotate"`   // 虚拟用户每次新建连接时轮换代理
+}
+
+type TargetRuleReqData struct {
+	ID      uint   `json:"ID" form:"ID"`
+	Action  string `json:"action"`
+	Host    string `json:"host"`
+	Cidr    string `json:"cidr"`
+	Port    int    `json:"port"`
+	Confirm bool   `json:"confirm"`
+	Note    string `json:"note"`
+	Url     string `json:"url" form:"url"` // 检查地址
+}
+
+type EnvironmentReqData struct {
+	ID            uint   `json:"ID" form:"ID"`
+	Name          string `json:"name"`
+	MaxConCurrent uint64 `json:"maxConCurrent"`
+	MaxRate       uint64 `json:"maxRate"`
+	Proxies       string `json:"proxies"`
+	ProxyRotate   bool   `json:"proxyRotate"`
+}
+
+// 检查地址的结果
+type TargetCheckReply struct {
+	Allowed bool   `json:"allowed"`
+	Confirm bool   `json:"confirm"`
+	Error   string `json:"error"`
+}
+
+var targetRuleTable = &TargetRuleData{}
+var environmentTable = &EnvironmentData{}
+
+func TargetRuleHandel(ctx *gin.Context) {
+	var reqParam TargetRuleReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	rule := &TargetRuleData{
+		Action:  reqParam.Action,
+		Host:    reqParam.Host,
+		Cidr:    reqParam.Cidr,
+		Port:    reqParam.Port,
+		Confirm: reqParam.Confirm,
+		Note:    reqParam.Note,
+	}
+	rule.ID = reqParam.ID
+
+	switch ctx.FullPath() {
+	case "/rule":
+		data, err = rule.Get()
+		return
+	case "/rule/check":
+		reply := &TargetCheckReply{}
+		if reply.Confirm, err = gobomInterlock.Check(reqParam.Url); err != nil {
+			reply.Error = err.Error()
+			err = nil
+		}
+		reply.Allowed = reply.Error == ""
+		data = reply
+		return
+	}
+
+	// 修改规则需要系统管理员
+	if err = currentUser(ctx).authorize(0, ROLE_ADMIN); err != nil {
+		return
+	}
+	switch ctx.FullPath() {
+	case "/rule/add":
+		if err = rule.Check(); err != nil {
+			return
+		}
+		err = rule.Add()
+		data = rule
+	case "/rule/edit":
+		old := &TargetRuleData{}
+		old.ID = rule.ID
+		if _, err = old.First(); err != nil {
+			return
+		}
+		rule.Model = old.Model
+		if err = rule.Check(); err != nil {
+			return
+		}
+		err = rule.Update()
+		data = rule
+	case "/rule/delete":
+		err = rule.Del()
+	}
+	if err == nil {
+		err = LoadInterlock()
+	}
+}
+
+func EnvironmentHandel(ctx *gin.Context) {
+	var reqParam EnvironmentReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	env := &EnvironmentData{
+		Name:          reqParam.Name,
+		MaxConCurrent: reqParam.MaxConCurrent,
+		MaxRate:       reqParam.MaxRate,
+		Proxies:       reqParam.Proxies,
+		ProxyRotate:   reqParam.ProxyRotate,
+	}
+	env.ID = reqParam.ID
+
+	if ctx.FullPath() == "/environment" {
+		data, err = env.Get()
+		return
+	}
+	if err = currentUser(ctx).authorize(0, ROLE_ADMIN); err != nil {
+		return
+	}
+	switch ctx.FullPath() {
+	case "/environment/add":
+		if env.Name == "" {
+			err = ERR_PARAM
+			return
+		}
+		if err = env.proxyOptions().Check(); err != nil {
+			return
+		}
+		err = env.Add()
+		data = env
+	case "/environment/edit":
+		old := &EnvironmentData{}
+		old.ID = env.ID
+		if _, err = old.First(); err != nil {
+			return
+		}
+		env.Model = old.Model
+		if err = env.proxyOptions().Check(); err != nil {
+			return
+		}
+		err = env.Update()
+		data = env
+	case "/environment/delete":
+		err = env.Del()
+	}
+}
+
+func (rule *TargetRuleData) Check() error {
+	if rule.Action != RULE_ALLOW && rule.Action != RULE_DENY {
+		return ERR_RULE_ACTION
+	}
+	if rule.Host == "" && rule.Cidr == "" && rule.Port == 0 {
+		return ERR_RULE_EMPTY
+	}
+	if rule.Port < 0 || rule.Port > 65535 {
+		return ERR_PARAM
+	}
+	return rule.compile()
+}
+
+func (rule *TargetRuleData) compile() error {
+	rule.network = nil
+	if rule.Cidr == "" {
+		return nil
+	}
+	_, network, err := net.ParseCIDR(rule.Cidr)
+	if err != nil {
+		// 单个IP
+		ip := net.ParseIP(rule.Cidr)
+		if ip == nil {
+			return ERR_RULE_CIDR
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	rule.network = network
+	return nil
+}
+
+func (rule *TargetRuleData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(targetRuleTable)).Create(rule).Error
+}
+
+func (rule *TargetRuleData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(targetRuleTable)).Save(rule).Error
+}
+
+func (rule *TargetRuleData) Del() (err error) {
+	if rule.ID == 0 {
+		return ERR_PARAM
+	}
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(targetRuleTable)).Delete(rule).Error
+}
+
+func (rule *TargetRuleData) First() (*TargetRuleData, error) {
+	if rule.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(targetRuleTable)).First(rule, rule.ID).Error; err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (rule *TargetRuleData) Get() (list []TargetRuleData, err error) {
+	err = GobomStore.GetDb().Table(GobomStore.GetTableName(targetRuleTable)).Find(&list).Error
+	return
+}
+
+func (env *EnvironmentData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(environmentTable)).Create(env).Error
+}
+
+func (env *EnvironmentData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(environmentTable)).Save(env).Error
+}
+
+func (env *EnvironmentData) Del() (err error) {
+	if env.ID == 0 {
+		return ERR_PARAM
+	}
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(environmentTable)).Delete(env).Error
+}
+
+func (env *EnvironmentData) First() (*EnvironmentData, error) {
+	if env.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(environmentTable)).First(env, env.ID).Error; err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (env *EnvironmentData) Get() (list []EnvironmentData, err error) {
+	err = GobomStore.GetDb().Table(GobomStore.GetTableName(environmentTable)).Find(&list).Error
+	return
+}
+
+// 项目所在环境的限制，没有配置时返回nil
+func projectEnvironment(projectId uint) *EnvironmentData {
+	if projectId == 0 {
+		return nil
+	}
+	project := &ProjectData{}
+	project.ID = projectId
+	if _, err := project.First(); err != nil || project.Environment == "" {
+		return nil
+	}
+	env := &EnvironmentData{}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(environmentTable)).Where("name = ?", project.Environment).First(env).Error; err != nil {
+		return nil
+	}
+	return env
+}
+
+func (env *EnvironmentData) maxConCurrent() uint64 {
+	if env == nil {
+		return 0
+	}
+	return env.MaxConCurrent
+}
+
+func (env *EnvironmentData) maxRate() uint64 {
+	if env == nil {
+		return 0
+	}
+	return env.MaxRate
+}
+
+// 第i个节点的环境限制，到达率按节点数量拆分；并发数由控制节点检查，节点不限制
+func (env *EnvironmentData) share(n, i int) *EnvironmentData {
+	if env == nil {
+		return nil
+	}
+	return &EnvironmentData{Name: env.Name, MaxRate: shareLimit(env.MaxRate, n, i)}
+}
+
+func (env *EnvironmentData) proxyOptions() *ProxyOptions {
+	return &ProxyOptions{Urls: parseProxyList(env.Proxies), Rotate: env.ProxyRotate}
+}
+
+// 没有设置代理的脚本使用环境的代理
+func (env *EnvironmentData) applyProxy(gobom *GobomRequest) {
+	if env == nil || env.Proxies == "" {
+		return
+	}
+	for _, opt := range gobom.allOptions() {
+		if opt.ProxyOptions.empty() {
+			opt.ProxyOptions = *env.proxyOptions()
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package gobom
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	GATE_PASSED = "passed" // 上一阶段正常结束且没有越过阈值时运行
+	GATE_ALWAYS = "always" // 总是运行
+)
+
+// 流水线，按顺序运行多个任务
+type PipelineData struct {
+	Model
+	Name       string           `json:"name" gorm:"unique_index"`
+	ProjectId  uint             `json:"projectId" gorm:"index"`
+	Stages     []*PipelineStage `json:"stages" gorm:"-"`
+	Status     int              `json:"status"`
+	Note       string           `json:"note"`
+	Report     *Report          `json:"report,omitempty" gorm:"-"` // 最近一次运行的合并报告
+	StagesJson string           `json:"-" gorm:"type:longtext"`
+	ReportJson string           `json:"-" gorm:"type:longtext"`
+
+	confirmed bool // 已确认运行受保护的压测地址
+}
+
+type PipelineStage struct {
+	TaskId string `json:"taskId"`
+	Gate   string `json:"gate"` // 运行本阶段的条件 passed|always，第一阶段忽略
+
+	// 最近一次运行的结果
+	Status    int               `json:"status"`
+	Passed    bool              `json:"passed"`    // 正常结束且没有越过阈值
+	TaskRunId uint              `json:"taskRunId"` // 任务运行记录id
+	Variables map[string]string `json:"variables"` // teardown提取的变量，传递给后续阶段
+}
+
+type PipelineReqData struct {
+	ID        uint             `json:"ID" form:"ID"`
+	Name      string           `json:"name"`
+	ProjectId uint             `json:"projectId"`
+	Stages    []*PipelineStage `json:"stages"`
+	Confirm   bool             `json:"confirm"` // 确认运行受保护的压测地址
+}
+
+var pipelineTable = &PipelineData{}
+
+func PipelineHandel(ctx *gin.Context) {
+	var reqParam PipelineReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	pipeline := &PipelineData{
+		Name:      reqParam.Name,
+		ProjectId: reqParam.ProjectId,
+		Stages:    reqParam.Stages,
+	}
+	pipeline.ID = reqParam.ID
+
+	user := currentUser(ctx)
+	switch ctx.FullPath() {
+	case "/pipeline/add":
+		err = user.authorize(pipeline.ProjectId, ROLE_EDITOR)
+	case "/pipeline/edit":
+		if err = user.authorizeRecord(pipelineTable, pipeline.ID, ROLE_EDITOR); err == nil {
+			err = user.authorize(pipeline.ProjectId, ROLE_EDITOR)
+		}
+	case "/pipeline/delete":
+		err = user.authorizeRecord(pipelineTable, pipeline.ID, ROLE_EDITOR)
+	case "/pipeline/run", "/pipeline/stop":
+		err = user.authorizeRecord(pipelineTable, pipeline.ID, ROLE_RUNNER)
+	default:
+		if pipeline.ID != 0 {
+			err = user.authorizeRecord(pipelineTable, pipeline.ID, ROLE_VIEWER)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	switch ctx.FullPath() {
+	case "/pipeline":
+		if pipeline.ID == 0 {
+			data, err = pipeline.Get(user.projectScope())
+		} else {
+			data, err = pipeline.First()
+		}
+	case "/pipeline/add":
+		if err = pipeline.Check(); err != nil {
+			return
+		}
+		err = pipeline.Add()
+		data = pipeline
+	case "/pipeline/edit":
+		err = pipeline.Edit()
+		data = pipeline
+	case "/pipeline/delete":
+		if GetRunPipeline(pipeline.ID) != nil {
+			err = ERR_PIPELINE_RUN
+			return
+		}
+		err = pipeline.Del()
+	case "/pipeline/run":
+		pipeline.confirmed = reqParam.Confirm
+		err = pipeline.Run()
+	case "/pipeline/stop":
+		err = pipeline.Stop()
+	}
+}
+
+func (pipeline *PipelineData) Check() error {
+	if pipeline.Name == "" {
+		return ERR_PARAM
+	}
+	if len(pipeline.Stages) == 0 {
+		return ERR_PIPELINE_EMPTY
+	}
+	for _, stage := range pipeline.Stages {
+		projectId, err := taskProject(stage.TaskId)
+		if err != nil {
+			return err
+		}
+		if projectId != pipeline.ProjectId {
+			return ERR_PROJECT_MISMATCH
+		}
+		if stage.Gate == "" {
+			stage.Gate = GATE_PASSED
+		}
+		if stage.Gate != GATE_PASSED && stage.Gate != GATE_ALWAYS {
+			return ERR_PIPELINE_GATE
+		}
+	}
+	return nil
+}
+
+func (pipeline *PipelineData) BeforeSave() (err error) {
+	bt, err := json.Marshal(pipeline.Stages)
+	if err != nil {
+		return err
+	}
+	pipeline.StagesJson = string(bt)
+	if pipeline.Report != nil {
+		bt, err = json.Marshal(pipeline.Report)
+		pipeline.ReportJson = string(bt)
+	}
+	return err
+}
+
+func (pipeline *PipelineData) AfterFind() (err error) {
+	if GetRunPipeline(pipeline.ID) != nil {
+		pipeline.Status = STATUS_RUN
+	} else if pipeline.Status == STATUS_RUN {
+		pipeline.Status = STATUS_NONE // 服务重启前没有结束的运行
+	}
+	if err = json.Unmarshal([]byte(pipeline.StagesJson), &pipeline.Stages); err != nil {
+		return err
+	}
+	if pipeline.ReportJson != "" {
+		pipeline.Report = &Report{}
+		err = json.Unmarshal([]byte(pipeline.ReportJson), pipeline.Report)
+	}
+	return err
+}
+
+func (pipeline *PipelineData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(pipelineTable)).Create(pipeline).Error
+}
+
+func (pipeline *PipelineData) Edit() (err error) {
+	if GetRunPipeline(pipeline.ID) != nil {
+		return ERR_PIPELINE_RUN
+	}
+	old := &PipelineData{}
+	old.ID = pipeline.ID
+	if _, err = old.First(); err != nil {
+		return err
+	}
+	pipeline.Model = old.Model
+	pipeline.Status = old.Status
+	pipeline.Note = old.Note
+	pipeline.ReportJson = old.ReportJson
+	if err = pipeline.Check(); err != nil {
+		return err
+	}
+	return pipeline.Update()
+}
+
+func (pipeline *PipelineData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(pipelineTable)).Save(pipeline).Error
+}
+
+func (pipeline *PipelineData) Del() (err error) {
+	if pipeline.ID == 0 {
+		return ERR_PARAM
+	}
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(pipelineTable)).Delete(pipeline).Error
+}
+
+func (pipeline *PipelineData) First() (*PipelineData, error) {
+	if pipeline.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(pipelineTable)).First(pipeline, pipeline.ID).Error; err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// 获取流水线列表（不包含报告）
+func (pipeline *PipelineData) Get(scopes ...func(db *gorm.DB) *gorm.DB) (list []PipelineData, err error) {
+	if err = GobomStore.GetDb().Table(GobomStore.GetTableName(pipelineTable)).Scopes(scopes...).Find(&list).Error; err != nil {
+		return
+	}
+	for i := range list {
+		list[i].Report = nil
+	}
+	return
+}
@@ -0,0 +1,204 @@
+package gobom
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// 项目，脚本、任务、数据文件、流水线都属于一个项目
+type ProjectData struct {
+	Model
+	Name        string `json:"name" gorm:"unique_index"`
+	Environment string `json:"environment"` // 压测的环境，如test|staging|production
+	Protected   bool   `json:"protected"`   // 受保护的环境（如生产环境），运行压测需要admin角色
+}
+
+// 项目成员
+type ProjectMemberData struct {
+	Model
+	ProjectId uint   `json:"projectId" gorm:"index"`
+	UserId    uint   `json:"userId" gorm:"index"`
+	Role      string `json:"role"` // viewer|runner|editor|admin
+}
+
+type ProjectReqData struct {
+	ID          uint   `json:"ID" form:"ID"`
+	Name        string `json:"name"`
+	Environment string `json:"environment"`
+	Protected   bool   `json:"protected"`
+	UserId      uint   `json:"userId" form:"userId"` // 成员管理
+	Role        string `json:"role"`
+}
+
+var projectTable = &ProjectData{}
+var projectMemberTable = &ProjectMemberData{}
+
+func ProjectHandel(ctx *gin.Context) {
+	var reqParam ProjectReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	user := currentUser(ctx)
+	project := &ProjectData{
+		Name:        reqParam.Name,
+		Environment: reqParam.Environment,
+		Protected:   reqParam.Protected,
+	}
+	project.ID = reqParam.ID
+
+	switch ctx.FullPath() {
+	case "/project":
+		if project.ID == 0 {
+			data, err = project.Get(user.memberScope())
+			return
+		}
+		if err = user.authorize(project.ID, ROLE_VIEWER); err != nil {
+			return
+		}
+		data, err = project.First()
+	case "/project/add":
+		if err = user.authorize(0, ROLE_ADMIN); err != nil {
+			return
+		}
+		if project.Name == "" {
+			err = ERR_PARAM
+			return
+		}
+		err = project.Add()
+		data = project
+	case "/project/edit":
+		if err = user.authorize(project.ID, ROLE_ADMIN); err != nil {
+			return
+		}
+		old := &ProjectData{}
+		old.ID = project.ID
+		if _, err = old.First(); err != nil {
+			return
+		}
+		// 只有系统管理员可以取消环境保护
+		if old.Protected && !project.Protected && !user.Admin {
+			err = ERR_PERMISSION
+			return
+		}
+		project.Model = old.Model
+		err = project.Update()
+		data = project
+	case "/project/delete":
+		if err = user.authorize(0, ROLE_ADMIN); err != nil {
+			return
+		}
+		err = project.Del()
+	case "/project/members":
+		if err = user.authorize(project.ID, ROLE_VIEWER); err != nil {
+			return
+		}
+		data, err = project.Members()
+	case "/project/member/set":
+		if err = user.authorize(project.ID, ROLE_ADMIN); err != nil {
+			return
+		}
+		err = project.SetMember(reqParam.UserId, reqParam.Role)
+	case "/project/member/delete":
+		if err = user.authorize(project.ID, ROLE_ADMIN); err != nil {
+			return
+		}
+		err = project.DelMember(reqParam.UserId)
+	}
+}
+
+func (project *ProjectData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(projectTable)).Create(project).Error
+}
+
+func (project *ProjectData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(projectTable)).Save(project).Error
+}
+
+// 删除没有任务、脚本、数据文件和流水线的项目
+func (project *ProjectData) Del() (err error) {
+	if project.ID == 0 {
+		return ERR_PARAM
+	}
+	for _, table := range []interface{}{taskTable, scriptTable, dataFileTable, pipelineTable} {
+		var count int
+		if err = GobomStore.GetDb().Table(GobomStore.GetTableName(table)).Where("project_id = ?", project.ID).Count(&count).Error; err != nil {
+			return
+		}
+		if count != 0 {
+			return ERR_PROJECT_NOT_EMPTY
+		}
+	}
+	if err = GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).Where("project_id = ?", project.ID).Delete(&ProjectMemberData{}).Error; err != nil {
+		return
+	}
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(projectTable)).Delete(project).Error
+}
+
+func (project *ProjectData) First() (*ProjectData, error) {
+	if project.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(projectTable)).First(project, project.ID).Error; err != nil {
+		return nil, err
+	}
+	return project, nil
+}
+
+func (project *ProjectData) Get(scopes ...func(db *gorm.DB) *gorm.DB) (list []ProjectData, err error) {
+	err = GobomStore.GetDb().Table(GobomStore.GetTableName(projectTable)).Scopes(scopes...).Find(&list).Error
+	return
+}
+
+func (project *ProjectData) Members() (list []ProjectMemberData, err error) {
+	err = GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).Where("project_id = ?", project.ID).Find(&list).Error
+	return
+}
+
+// 添加成员或修改成员角色
+func (project *ProjectData) SetMember(userId uint, role string) error {
+	if _, ok := roleLevels[role]; !ok {
+		return ERR_ROLE
+	}
+	if _, err := project.First(); err != nil {
+		return err
+	}
+	user := &UserData{}
+	user.ID = userId
+	if _, err := user.First(); err != nil {
+		return err
+	}
+	db := GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable))
+	var member ProjectMemberData
+	if err := db.Where("project_id = ? AND user_id = ?", project.ID, userId).First(&member).Error; err == nil {
+		member.Role = role
+		return GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).Save(&member).Error
+	}
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).Create(&ProjectMemberData{
+		ProjectId: project.ID,
+		UserId:    userId,
+		Role:      role,
+	}).Error
+}
+
+func (project *ProjectData) DelMember(userId uint) error {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).
+		Where("project_id = ? AND user_id = ?", project.ID, userId).Delete(&ProjectMemberData{}).Error
+}
@@ -0,0 +1,57 @@
+package gobom
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type QueueReqData struct {
+	Id     string `json:"id" form:"id"`         // 排队id
+	TaskId string `json:"taskId" form:"taskId"` // 或任务id
+}
+
+func QueueHandel(ctx *gin.Context) {
+	var reqParam QueueReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	switch ctx.FullPath() {
+	case "/queue":
+		data = gobomGuard.Info()
+	case "/queue/cancel":
+		id := reqParam.Id
+		if id == "" {
+			id = reqParam.TaskId
+		}
+		if id == "" {
+			err = ERR_PARAM
+			return
+		}
+		item := gobomGuard.Find(id)
+		if item == nil {
+			err = ERR_QUEUE_NOT_FOUND
+			return
+		}
+		if err = currentUser(ctx).authorizeTask(item.TaskId, ROLE_RUNNER); err != nil {
+			return
+		}
+		err = gobomGuard.Cancel(id)
+	}
+}
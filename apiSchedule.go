@@ -0,0 +1,231 @@
+package gobom
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	SCHEDULE_POLICY_SKIP  = "skip"  // 任务正在运行时跳过本次触发
+	SCHEDULE_POLICY_QUEUE = "queue" // 任务正在运行时等待结束后运行
+)
+
+// 任务运行计划
+type ScheduleData struct {
+	Model
+	Name     string `json:"name"`
+	TaskId   string `json:"taskId" gorm:"index"`
+	Cron     string `json:"cron"`     // cron表达式（分 时 日 月 周），与RunAt二选一
+	RunAt    string `json:"runAt"`    // 单次运行时间 2006-01-02 15:04:05
+	Timezone string `json:"timezone"` // 时区，如Asia/Shanghai，为空时使用服务器时区
+	Policy   string `json:"policy"`   // skip|queue
+	Enabled  bool   `json:"enabled"`
+	Confirm  bool   `json:"confirm"`           // 确认运行受保护的压测地址
+	NextTime string `json:"nextTime" gorm:"-"` // 下一次运行时间
+}
+
+type ScheduleReqData struct {
+	ID       uint   `json:"ID" form:"ID"`
+	Name     string `json:"name"`
+	TaskId   string `json:"taskId" form:"taskId"`
+	Cron     string `json:"cron"`
+	RunAt    string `json:"runAt"`
+	Timezone string `json:"timezone"`
+	Policy   string `json:"policy"`
+	Enabled  bool   `json:"enabled"`
+	Confirm  bool   `json:"confirm"`
+}
+
+var scheduleTable = &ScheduleData{}
+
+func ScheduleHandel(ctx *gin.Context) {
+	var reqParam ScheduleReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	schedule := &ScheduleData{
+		Name:     reqParam.Name,
+		TaskId:   reqParam.TaskId,
+		Cron:     reqParam.Cron,
+		RunAt:    reqParam.RunAt,
+		Timezone: reqParam.Timezone,
+		Policy:   reqParam.Policy,
+		Enabled:  reqParam.Enabled,
+		Confirm:  reqParam.Confirm,
+	}
+	schedule.ID = reqParam.ID
+
+	// 修改计划需要任务的编辑和运行权限
+	user := currentUser(ctx)
+	if schedule.ID != 0 {
+		old := &ScheduleData{}
+		old.ID = schedule.ID
+		if _, err = old.First(); err != nil {
+			return
+		}
+		if ctx.FullPath() == "/schedule" {
+			err = user.authorizeTask(old.TaskId, ROLE_VIEWER)
+		} else {
+			err = user.authorizeSchedule(old.TaskId)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if ctx.FullPath() == "/schedule/add" || ctx.FullPath() == "/schedule/edit" {
+		if err = user.authorizeSchedule(schedule.TaskId); err != nil {
+			return
+		}
+	}
+
+	switch ctx.FullPath() {
+	case "/schedule":
+		if schedule.ID == 0 {
+			data, err = schedule.Get(user.taskScope())
+		} else {
+			data, err = schedule.First()
+		}
+	case "/schedule/add":
+		if err = schedule.Check(); err != nil {
+			return
+		}
+		if err = schedule.Add(); err != nil {
+			return
+		}
+		err = gobomScheduler.Set(schedule)
+		data = schedule
+	case "/schedule/edit":
+		old := &ScheduleData{}
+		old.ID = schedule.ID
+		if _, err = old.First(); err != nil {
+			return
+		}
+		schedule.Model = old.Model
+		if err = schedule.Check(); err != nil {
+			return
+		}
+		if err = schedule.Update(); err != nil {
+			return
+		}
+		err = gobomScheduler.Set(schedule)
+		data = schedule
+	case "/schedule/delete":
+		if err = schedule.Del(); err != nil {
+			return
+		}
+		gobomScheduler.Remove(schedule.ID)
+	}
+}
+
+func (schedule *ScheduleData) Check() error {
+	if schedule.TaskId == "" {
+		return ERR_PARAM
+	}
+	taskData := &TaskData{Task: &Task{TaskId: schedule.TaskId}}
+	if _, err := taskData.First(); err != nil {
+		return err
+	}
+	// 计划运行时无人确认，需要在保存时确认
+	if taskData.Task.Worker != nil {
+		confirm, err := gobomInterlock.CheckUrls(taskData.Task.Worker.Urls())
+		if err != nil {
+			return err
+		}
+		if confirm && !schedule.Confirm {
+			return ERR_TARGET_CONFIRM
+		}
+	}
+	if schedule.Policy == "" {
+		schedule.Policy = SCHEDULE_POLICY_SKIP
+	}
+	if schedule.Policy != SCHEDULE_POLICY_SKIP && schedule.Policy != SCHEDULE_POLICY_QUEUE {
+		return ERR_SCHEDULE_POLICY
+	}
+	_, err := schedule.next(time.Now())
+	return err
+}
+
+func (schedule *ScheduleData) location() (*time.Location, error) {
+	if schedule.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(schedule.Timezone)
+}
+
+// 计算t之后的下一次运行时间，单次运行返回设置的时间（可能已过期）
+func (schedule *ScheduleData) next(t time.Time) (time.Time, error) {
+	loc, err := schedule.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if schedule.Cron != "" {
+		cron, err := ParseCron(schedule.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return cron.Next(t.In(loc)), nil
+	}
+	if schedule.RunAt != "" {
+		return time.ParseInLocation("2006-01-02 15:04:05", schedule.RunAt, loc)
+	}
+	return time.Time{}, ERR_CRON
+}
+
+func (schedule *ScheduleData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(scheduleTable)).Create(schedule).Error
+}
+
+func (schedule *ScheduleData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(scheduleTable)).Save(schedule).Error
+}
+
+func (schedule *ScheduleData) Del() (err error) {
+	if schedule.ID == 0 {
+		return ERR_PARAM
+	}
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(scheduleTable)).Delete(schedule).Error
+}
+
+func (schedule *ScheduleData) First() (*ScheduleData, error) {
+	if schedule.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(scheduleTable)).First(schedule, schedule.ID).Error; err != nil {
+		return nil, err
+	}
+	schedule.NextTime = gobomScheduler.NextTime(schedule.ID)
+	return schedule, nil
+}
+
+func (schedule *ScheduleData) Get(scopes ...func(db *gorm.DB) *gorm.DB) (list []ScheduleData, err error) {
+	db := GobomStore.GetDb().Table(GobomStore.GetTableName(scheduleTable)).Scopes(scopes...)
+	if schedule.TaskId != "" {
+		db = db.Where("task_id = ?", schedule.TaskId)
+	}
+	if err = db.Find(&list).Error; err != nil {
+		return
+	}
+	for i := range list {
+		list[i].NextTime = gobomScheduler.NextTime(list[i].ID)
+	}
+	return
+}
@@ -2,22 +2,34 @@ package gobom
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 )
 
 type ScriptData struct {
 	Model
-	Type     string `json:"type"`
-	Name     string `json:"name" gorm:"unique_index"`
-	Protocol int    `json:"protocol"`
-	Data     string `json:"data" gorm:"type:longtext"`
+	Type      string `json:"type"`
+	Name      string `json:"name" gorm:"unique_index"`
+	ProjectId uint   `json:"projectId" gorm:"index"`
+	Protocol  int    `json:"protocol"`
+	Data      string `json:"data" gorm:"type:longtext"`
 }
 
 var scriptTable = &ScriptData{}
 
+// HAR导入参数，har为HAR文件内容，为空时读取上传的文件（file）
+type ScriptImportHarReqData struct {
+	HarImportOptions
+	Har string `json:"har" form:"har"`
+}
+
 func ScriptDataHandel(ctx *gin.Context) {
 	scriptData := ScriptData{}
 	var msg string
@@ -37,22 +49,71 @@ func ScriptDataHandel(ctx *gin.Context) {
 			return
 		}
 	}
+
+	user := currentUser(ctx)
+	audit := newAudit(ctx, auditActions[ctx.FullPath()])
+	defer func() { audit.Save(err) }()
+	switch ctx.FullPath() {
+	case "/script/add", "/script/test":
+		audit.setScript(&scriptData)
+		audit.After = scriptData.Data
+	case "/script/edit", "/script/delete":
+		old := &ScriptData{}
+		old.ID = scriptData.ID
+		if _, e := old.First(); e == nil {
+			audit.setScript(old)
+			audit.Before = old.Data
+		}
+		if ctx.FullPath() == "/script/edit" {
+			audit.setScript(&scriptData)
+			audit.After = scriptData.Data
+		}
+	}
+
+	switch ctx.FullPath() {
+	case "/script/add":
+		err = user.authorize(scriptData.ProjectId, ROLE_EDITOR)
+	case "/script/edit":
+		if err = user.authorizeRecord(scriptTable, scriptData.ID, ROLE_EDITOR); err == nil {
+			err = user.authorize(scriptData.ProjectId, ROLE_EDITOR)
+		}
+	case "/script/delete":
+		err = user.authorizeRecord(scriptTable, scriptData.ID, ROLE_EDITOR)
+	case "/script/test":
+		err = user.authorizeRun(scriptData.ProjectId)
+	default:
+		if scriptData.ID != 0 {
+			err = user.authorizeRecord(scriptTable, scriptData.ID, ROLE_VIEWER)
+		}
+	}
+	if err != nil {
+		return
+	}
+
 	switch ctx.FullPath() {
 	case "/script":
 		if scriptData.ID == 0 {
-			data, err = scriptData.Get()
+			data, err = scriptData.Get(user.projectScope())
 		} else {
 			data, err = scriptData.First()
 		}
 	case "/script/add":
-		err = scriptData.Add()
+		if err = scriptData.Check(); err != nil {
+			return
+		}
+		if err = scriptData.Add(); err == nil {
+			audit.setScript(&scriptData)
+		}
 	case "/script/delete":
 		err = scriptData.Del()
 	case "/script/edit":
+		if err = scriptData.Check(); err != nil {
+			return
+		}
 		err = scriptData.Update()
 		// 关联此脚本的任务需要重新初始化实例
 		if err == nil {
-			ResetTaskScript(scriptData.ID)
+			err = ResetTaskScript(scriptData.ID)
 		}
 	case "/script/test":
 		err = scriptData.Run()
@@ -60,16 +121,146 @@ func ScriptDataHandel(ctx *gin.Context) {
 
 }
 
-func (scriptData *ScriptData) Run() error {
+// 从浏览器录制的HAR文件导入脚本
+func ScriptImportHarHandel(ctx *gin.Context) {
+	reqData := ScriptImportHarReqData{}
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqData); err != nil {
+		return
+	}
+
+	user := currentUser(ctx)
+	audit := newAudit(ctx, auditActions[ctx.FullPath()])
+	defer func() { audit.Save(err) }()
+	audit.ProjectId = reqData.ProjectId
+	if err = user.authorize(reqData.ProjectId, ROLE_EDITOR); err != nil {
+		return
+	}
+
+	har := []byte(reqData.Har)
+	if len(har) == 0 {
+		fileHeader, e := ctx.FormFile("file")
+		if e != nil {
+			err = ERR_PARAM
+			return
+		}
+		if reqData.Name == "" {
+			reqData.Name = strings.TrimSuffix(fileHeader.Filename, filepath.Ext(fileHeader.Filename))
+		}
+		file, e := fileHeader.Open()
+		if e != nil {
+			err = e
+			return
+		}
+		har, err = ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return
+		}
+	}
+	if reqData.Name == "" {
+		err = ERR_PARAM
+		return
+	}
+
+	result, err := ImportHar(har, &reqData.HarImportOptions)
+	if err != nil {
+		return
+	}
+	audit.setScript(result.Script)
+	audit.After = result.Script.Data
+	if err = result.Script.Check(); err != nil {
+		return
+	}
+	if err = result.Script.Add(); err != nil {
+		return
+	}
+	audit.setScript(result.Script)
+	data = result
+}
+
+func (scriptData *ScriptData) Options() (*Options, error) {
 	var opt Options
 	if scriptData.Data == "" {
-		return ERR_PARAM
+		return nil, ERR_PARAM
 	}
 	if err := json.Unmarshal([]byte(scriptData.Data), &opt); err != nil {
-		return ERR_PARAM_PARSE
+		return nil, ERR_PARAM_PARSE
+	}
+	return &opt, nil
+}
+
+// 校验脚本引用的数据文件及列是否存在
+func (scriptData *ScriptData) Check() error {
+	opt, err := scriptData.Options()
+	if err != nil {
+		return err
+	}
+	if _, err = gobomInterlock.CheckUrls(opt.Urls()); err != nil {
+		return err
+	}
+	if err = opt.TlsOptions.Check(scriptData.ProjectId); err != nil {
+		return err
+	}
+	if err = opt.ConnOptions.Check(); err != nil {
+		return err
+	}
+	if err = opt.ProxyOptions.Check(); err != nil {
+		return err
+	}
+	if err = opt.DnsOptions.Check(); err != nil {
+		return err
+	}
+	dataFiles := make(map[uint]*DataFile)
+	for _, v := range opt.FileDataFields() {
+		if v.FileId == 0 {
+			fileName, column := v.fileField()
+			rows, err := ReadDataFile(fmt.Sprintf("%s/%s", FILE_DATA_PATH, fileName))
+			if err != nil || len(rows) == 0 {
+				return fmt.Errorf("字段[%s]引用的数据文件[%s]无法读取", v.Name, fileName)
+			}
+			if !(&DataFile{Columns: rows[0]}).HasColumn(column) {
+				return fmt.Errorf("字段[%s]引用的列[%s]在数据文件[%s]中不存在", v.Name, column, fileName)
+			}
+			continue
+		}
+		dataFile, ok := dataFiles[v.FileId]
+		if !ok {
+			dataFile = &DataFile{}
+			dataFile.ID = v.FileId
+			if _, err := dataFile.First(); err != nil {
+				return fmt.Errorf("字段[%s]引用的数据文件[%d]不存在", v.Name, v.FileId)
+			}
+			if dataFile.ProjectId != scriptData.ProjectId {
+				return ERR_PROJECT_MISMATCH
+			}
+			dataFiles[v.FileId] = dataFile
+		}
+		if !dataFile.HasColumn(v.Dynamic) {
+			return fmt.Errorf("字段[%s]引用的列[%s]在数据文件[%s]中不存在", v.Name, v.Dynamic, dataFile.Name)
+		}
+	}
+	return nil
+}
+
+func (scriptData *ScriptData) Run() error {
+	opt, err := scriptData.Options()
+	if err != nil {
+		return err
 	}
 	opt.Form = scriptData.Protocol
-	gobomReq, err := NewGomBomRequest(&opt)
+	gobomReq, err := NewGomBomRequest(opt)
 	if err != nil {
 		return err
 	}
@@ -104,9 +295,9 @@ func (scriptData *ScriptData) First() (*ScriptData, error) {
 	return scriptData, nil
 }
 
-func (scriptData *ScriptData) Get() ([]ScriptData, error) {
+func (scriptData *ScriptData) Get(scopes ...func(db *gorm.DB) *gorm.DB) ([]ScriptData, error) {
 	var scripts []ScriptData
-	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(scriptTable)).Find(&scripts).Error; err != nil {
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(scriptTable)).Scopes(scopes...).Find(&scripts).Error; err != nil {
 		return nil, err
 	}
 	return scripts, nil
@@ -3,26 +3,45 @@ package gobom
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/donnie4w/go-logger/logger"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"io"
 	"net/http"
+	"strings"
 )
 
 type TaskData struct {
 	Model
-	Name     string `json:"name" gorm:"unique_index"`
-	Task     *Task  `json:"task" gorm:"EMBEDDED"`
-	ScriptId uint   `json:"scriptId"`
-	TaskJson string `json:"-" gorm:"type:longtext"`
+	Name             string `json:"name" gorm:"unique_index"`
+	ProjectId        uint   `json:"projectId" gorm:"index"`
+	Task             *Task  `json:"task" gorm:"EMBEDDED"`
+	ScriptId         uint   `json:"scriptId"`
+	SetupScriptId    uint   `json:"setupScriptId"`    // 压测开始前执行一次的脚本
+	TeardownScriptId uint   `json:"teardownScriptId"` // 压测结束后执行一次的脚本
+	TaskJson         string `json:"-" gorm:"type:longtext"`
+
+	confirmed bool // 已确认运行受保护的压测地址
 }
 
 type TaskReqData struct {
-	TaskId     string `json:"taskId"`
-	Name       string `json:"name"`
-	ConCurrent uint64 `json:"conCurrent"`
-	Duration   uint64 `json:"duration"`
-	ScriptId   uint   `json:"scriptId"`
+	TaskId     string      `json:"taskId"`
+	Name       string      `json:"name"`
+	ProjectId  uint        `json:"projectId"`
+	ConCurrent uint64      `json:"conCurrent"`
+	Duration   uint64      `json:"duration"`
+	ScriptId   uint        `json:"scriptId"`
+	Scenarios  []*Scenario `json:"scenarios"`
+
+	SetupScriptId    uint `json:"setupScriptId"`
+	TeardownScriptId uint `json:"teardownScriptId"`
+	Distributed      bool `json:"distributed"`
+
+	Thresholds []*Threshold  `json:"thresholds"`
+	Scale      *ScaleReqData `json:"scale"`   // 调整运行中的任务
+	Reason     string        `json:"reason"`  // 暂停/恢复原因
+	Confirm    bool          `json:"confirm"` // 确认运行受保护的压测地址
 }
 
 var taskTable = &TaskData{}
@@ -52,11 +71,52 @@ func TaskDataHandel(ctx *gin.Context) {
 
 	taskData.Name = reqParam.Name
 	taskData.Task.TaskId = reqParam.TaskId
+	user := currentUser(ctx)
+
+	audit := newAudit(ctx, auditActions[ctx.FullPath()])
+	defer func() { audit.Save(err) }()
+	switch ctx.FullPath() {
+	case "/task/edit", "/task/delete":
+		audit.Before = audit.loadTask(reqParam.TaskId)
+	case "/task/run", "/task/stop", "/task/pause", "/task/resume":
+		audit.loadTask(reqParam.TaskId)
+		audit.Detail = reqParam.Reason
+	case "/task/scale":
+		audit.loadTask(reqParam.TaskId)
+		if bt, e := json.Marshal(reqParam.Scale); e == nil {
+			audit.Detail = string(bt)
+		}
+	}
+
+	switch ctx.FullPath() {
+	case "/task/add":
+		err = user.authorize(reqParam.ProjectId, ROLE_EDITOR)
+	case "/task/edit":
+		if err = user.authorizeTask(reqParam.TaskId, ROLE_EDITOR); err == nil {
+			err = user.authorize(reqParam.ProjectId, ROLE_EDITOR)
+		}
+	case "/task/delete":
+		err = user.authorizeTask(reqParam.TaskId, ROLE_EDITOR)
+	case "/task/run", "/task/stop", "/task/scale", "/task/pause", "/task/resume":
+		err = user.authorizeTask(reqParam.TaskId, ROLE_RUNNER)
+	default:
+		if reqParam.TaskId != "" {
+			err = user.authorizeTask(reqParam.TaskId, ROLE_VIEWER)
+		}
+	}
+	if err != nil {
+		return
+	}
+	if ctx.FullPath() == "/task/add" || ctx.FullPath() == "/task/edit" {
+		if err = reqParam.checkProject(); err != nil {
+			return
+		}
+	}
 
 	switch ctx.FullPath() {
 	case "/task":
 		if taskData.Task.TaskId == "" {
-			data, err = taskData.Get()
+			data, err = taskData.Get(user.projectScope())
 		} else {
 			data, err = taskData.First()
 		}
@@ -70,10 +130,17 @@ func TaskDataHandel(ctx *gin.Context) {
 			return
 		}
 		taskData.Task = task
+		taskData.ProjectId = reqParam.ProjectId
 		taskData.ScriptId = reqParam.ScriptId
-		err = taskData.Add()
+		taskData.SetupScriptId = reqParam.SetupScriptId
+		taskData.TeardownScriptId = reqParam.TeardownScriptId
+		if err = taskData.Add(); err == nil {
+			audit.After = audit.loadTask(taskData.Task.TaskId)
+		}
 	case "/task/edit":
-		err = taskData.Edit(reqParam)
+		if err = taskData.Edit(reqParam); err == nil {
+			audit.After = audit.loadTask(taskData.Task.TaskId)
+		}
 	case "/task/delete":
 		if task := GetRunTask(taskData.Task.TaskId); task != nil {
 			err = errors.New("请先停止任务")
@@ -85,11 +152,18 @@ func TaskDataHandel(ctx *gin.Context) {
 			err = errors.New("任务正在运行")
 			return
 		}
+		taskData.confirmed = reqParam.Confirm
 		err = taskData.Run()
 	case "/task/info":
 		//data, err = taskData.Info()
 	case "/task/stop":
 		err = taskData.Stop()
+	case "/task/scale":
+		err = taskData.Scale(reqParam.Scale)
+	case "/task/pause":
+		err = taskData.Pause(reqParam.Reason)
+	case "/task/resume":
+		err = taskData.Resume(reqParam.Reason)
 	}
 }
 
@@ -107,8 +181,15 @@ func (taskData *TaskData) BeforeSave() (err error) {
 
 func (taskData *TaskData) AfterFind() (err error) {
 	defer func() {
-		if task := GetRunTask(taskData.Task.TaskId); task != nil && err == nil {
-			taskData.Task.Status = STATUS_RUN
+		if err != nil {
+			return
+		}
+		if task := GetRunTask(taskData.Task.TaskId); task != nil {
+			taskData.Task.Status = task.GetStatus()
+		} else if gobomGuard.Queued(taskData.Task.TaskId) {
+			taskData.Task.Status = STATUS_WAIT
+		} else if taskData.Task.Status == STATUS_WAIT || taskData.Task.Status == STATUS_RUN || taskData.Task.Status == STATUS_PAUSE {
+			taskData.Task.Status = STATUS_NONE // 服务重启前没有结束的运行
 		}
 	}()
 	return json.Unmarshal([]byte(taskData.TaskJson), taskData.Task)
@@ -124,16 +205,22 @@ func (taskData *TaskData) Edit(reqParam TaskReqData) (err error) {
 		return err
 	}
 	t.Name = reqParam.Name
+	t.ProjectId = reqParam.ProjectId
 	t.Task.Worker.setConCurrent(reqParam.ConCurrent)
 	t.Task.Worker.setDuration(reqParam.Duration)
-	if t.ScriptId != reqParam.ScriptId { // 修改了脚本ID需要重新初始化任务实例
+	t.Task.Distributed = reqParam.Distributed
+	if t.ScriptId != reqParam.ScriptId || reqParam.Scenarios != nil ||
+		t.SetupScriptId != reqParam.SetupScriptId || t.TeardownScriptId != reqParam.TeardownScriptId { // 修改了脚本ID或场景需要重新初始化任务实例
 		task, err := t.InitTask(reqParam)
 		if err != nil {
 			return err
 		}
 		t.Task = task
 		t.ScriptId = reqParam.ScriptId
+		t.SetupScriptId = reqParam.SetupScriptId
+		t.TeardownScriptId = reqParam.TeardownScriptId
 	}
+	t.Task.Worker.Thresholds = reqParam.Thresholds
 	return GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Where("task_id = ?", taskData.Task.TaskId).Save(&t).Error
 }
 
@@ -149,24 +236,116 @@ func (taskData *TaskData) First() (taskDataList *TaskData, err error) {
 	return taskData, GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Where("task_id = ?", taskData.Task.TaskId).First(taskData).Error
 }
 
-func (taskData *TaskData) Get() (taskDataList []TaskData, err error) {
+func (taskData *TaskData) Get(scopes ...func(db *gorm.DB) *gorm.DB) (taskDataList []TaskData, err error) {
 	var taskDataListTemp []TaskData
-	err = GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Find(&taskDataListTemp).Error
+	err = GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Scopes(scopes...).Find(&taskDataListTemp).Error
 	return taskDataListTemp, err
 }
 
 func (taskData *TaskData) Run() (err error) {
-	taskData.First()
-	go func() {
-		if err := taskData.Task.Run(); err != nil {
-			logger.Debug(err)
-		}
-		taskData.Update()
-	}()
+	return taskData.RunBy(TRIGGER_MANUAL, 0)
+}
+
+// 运行任务并记录触发来源
+func (taskData *TaskData) RunBy(trigger string, scheduleId uint) (err error) {
+	return taskData.run(trigger, scheduleId, nil, nil)
+}
 
+// globals为运行前传入的全局变量，finish在运行结束或取消排队后调用（取消排队时task为nil）
+func (taskData *TaskData) run(trigger string, scheduleId uint, globals map[string]string, finish func(task *Task, taskRun *TaskRunData)) (err error) {
+	if _, err = taskData.First(); err != nil {
+		return
+	}
+	task := taskData.Task
+	if task.Worker == nil {
+		return ERR_TASK_WORKER
+	}
+	if err = taskData.checkTarget(); err != nil {
+		return
+	}
+	task.Worker.inherits = globals
+	run := func(taskRun *TaskRunData) {
+		go func() {
+			if !task.Distributed {
+				defer gobomGuard.Release(task.TaskId)
+			}
+			task.runId = taskRun.ID
+			fireHooks(taskHookPayload(HOOK_RUN_START, taskRun))
+			err := task.Run()
+			if err != nil {
+				logger.Debug(err)
+			}
+			taskData.Update()
+			taskRun.Finish(task, err)
+			fireHooks(taskHookPayload(HOOK_RUN_END, taskRun))
+			if taskRun.Status == STATUS_ERROR {
+				fireHooks(taskHookPayload(HOOK_RUN_ABORT, taskRun))
+			}
+			if finish != nil {
+				finish(task, taskRun)
+			}
+		}()
+	}
+	// 分布式任务在压测节点上运行，不占用本机资源
+	if task.Distributed {
+		run(NewTaskRun(task.TaskId, trigger, scheduleId, STATUS_RUN, ""))
+		return
+	}
+
+	var taskRun *TaskRunData
+	ready := make(chan struct{}) // 排队记录保存后才能出队
+	item := &QueueItem{
+		TaskId:     task.TaskId,
+		Trigger:    trigger,
+		ScheduleId: scheduleId,
+		ConCurrent: task.Worker.peakConCurrent(),
+		start: func() {
+			<-ready
+			taskRun.Start()
+			run(taskRun)
+		},
+		cancel: func() {
+			<-ready
+			task.SetStatus(STATUS_STOP)
+			taskRun.Cancel()
+			if finish != nil {
+				finish(nil, taskRun)
+			}
+		},
+	}
+	started, err := gobomGuard.Acquire(item)
+	if err != nil {
+		return
+	}
+	if started {
+		taskRun = NewTaskRun(task.TaskId, trigger, scheduleId, STATUS_RUN, "")
+		run(taskRun)
+		return
+	}
+	taskRun = NewTaskRun(task.TaskId, trigger, scheduleId, STATUS_WAIT, "资源不足，排队等待")
+	task.SetStatus(STATUS_WAIT)
+	close(ready)
 	return
 }
 
+// 运行前检查压测地址和所在环境的限制
+func (taskData *TaskData) checkTarget() error {
+	worker := taskData.Task.Worker
+	confirm, err := gobomInterlock.CheckUrls(worker.Urls())
+	if err != nil {
+		return err
+	}
+	if confirm && !taskData.confirmed {
+		return ERR_TARGET_CONFIRM
+	}
+	worker.env = projectEnvironment(taskData.ProjectId)
+	worker.env.applyProxy(worker)
+	if max := worker.env.maxConCurrent(); max != 0 && worker.peakConCurrent() > max {
+		return ERR_ENV_CONCURRENT
+	}
+	return nil
+}
+
 func (taskData *TaskData) Stop() (err error) {
 	task := GetRunTask(taskData.Task.TaskId)
 	if task == nil {
@@ -176,6 +355,30 @@ func (taskData *TaskData) Stop() (err error) {
 	return
 }
 
+func (taskData *TaskData) Scale(req *ScaleReqData) (err error) {
+	task := GetRunTask(taskData.Task.TaskId)
+	if task == nil {
+		return ERR_TASK_NOT_RUN
+	}
+	return task.Scale(req)
+}
+
+func (taskData *TaskData) Pause(reason string) (err error) {
+	task := GetRunTask(taskData.Task.TaskId)
+	if task == nil {
+		return ERR_TASK_NOT_RUN
+	}
+	return task.Pause(reason)
+}
+
+func (taskData *TaskData) Resume(reason string) (err error) {
+	task := GetRunTask(taskData.Task.TaskId)
+	if task == nil {
+		return ERR_TASK_NOT_RUN
+	}
+	return task.Resume(reason)
+}
+
 func (taskData *TaskData) Info() (data interface{}, err error) {
 	var task *Task
 	task = GetRunTask(taskData.Task.TaskId)
@@ -203,15 +406,76 @@ func (taskData *TaskData) Info() (data interface{}, err error) {
 				Duration:   task.Worker.Duration,
 				ConCurrent: task.Worker.ConCurrent,
 			},
-			Status: task.Status,
+			Status: task.GetStatus(),
 		},
 	}, nil
 }
 
 func (taskData *TaskData) InitTask(reqParam TaskReqData) (task *Task, err error) {
-	var script = &ScriptData{}
 	var opt = &Options{}
-	script.ID = reqParam.ScriptId
+	if reqParam.ScriptId != 0 || len(reqParam.Scenarios) == 0 {
+		if opt, err = GetScriptOptions(reqParam.ScriptId); err != nil {
+			return
+		}
+	}
+
+	for _, scenario := range reqParam.Scenarios {
+		if scenario.Options, err = GetScriptOptions(scenario.ScriptId); err != nil {
+			return
+		}
+	}
+
+	var setup, teardown *Options
+	if reqParam.SetupScriptId != 0 {
+		if setup, err = GetScriptOptions(reqParam.SetupScriptId); err != nil {
+			return
+		}
+	}
+	if reqParam.TeardownScriptId != 0 {
+		if teardown, err = GetScriptOptions(reqParam.TeardownScriptId); err != nil {
+			return
+		}
+	}
+
+	opt.ConCurrent = reqParam.ConCurrent
+	opt.Duration = reqParam.Duration
+	if task, err = NewTask(taskData.Task.TaskId, opt); err != nil {
+		return
+	}
+	task.Worker.Scenarios = reqParam.Scenarios
+	task.Worker.Setup = setup
+	task.Worker.Teardown = teardown
+	task.Distributed = reqParam.Distributed
+	task.Worker.Thresholds = reqParam.Thresholds
+	return
+}
+
+// 任务引用的脚本必须属于任务所在的项目
+func (reqParam *TaskReqData) checkProject() error {
+	scriptIds := []uint{reqParam.ScriptId, reqParam.SetupScriptId, reqParam.TeardownScriptId}
+	for _, scenario := range reqParam.Scenarios {
+		scriptIds = append(scriptIds, scenario.ScriptId)
+	}
+	for _, scriptId := range scriptIds {
+		if scriptId == 0 {
+			continue
+		}
+		script := &ScriptData{}
+		script.ID = scriptId
+		if _, err := script.First(); err != nil {
+			return err
+		}
+		if script.ProjectId != reqParam.ProjectId {
+			return ERR_PROJECT_MISMATCH
+		}
+	}
+	return nil
+}
+
+func GetScriptOptions(scriptId uint) (opt *Options, err error) {
+	var script = &ScriptData{}
+	opt = &Options{}
+	script.ID = scriptId
 	if script, err = script.First(); err != nil {
 		return
 	}
@@ -219,28 +483,62 @@ func (taskData *TaskData) InitTask(reqParam TaskReqData) (task *Task, err error)
 	if err = json.Unmarshal([]byte(script.Data), opt); err != nil {
 		return
 	}
+	return
+}
 
-	opt.ConCurrent = reqParam.ConCurrent
-	opt.Duration = reqParam.Duration
-	return NewTask(taskData.Task.TaskId, opt)
+func (taskData *TaskData) UseScript(scriptId uint) bool {
+	if scriptId == 0 {
+		return false
+	}
+	if taskData.ScriptId == scriptId || taskData.SetupScriptId == scriptId || taskData.TeardownScriptId == scriptId {
+		return true
+	}
+	if taskData.Task == nil || taskData.Task.Worker == nil {
+		return false
+	}
+	for _, scenario := range taskData.Task.Worker.Scenarios {
+		if scenario.ScriptId == scriptId {
+			return true
+		}
+	}
+	return false
 }
 
-func ResetTaskScript(scriptId uint) {
+// 关联脚本的任务重新初始化实例，失败的任务跳过，返回失败的任务名
+func ResetTaskScript(scriptId uint) error {
 	var taskDataList []TaskData
-	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Where("script_id = ?", scriptId).Find(&taskDataList).Error; err == nil {
-		for _, data := range taskDataList {
-			task, err := data.InitTask(TaskReqData{
-				ConCurrent: data.Task.Worker.getConCurrent(),
-				Duration:   data.Task.Worker.getDuration(),
-				ScriptId:   scriptId,
-			})
-			if err != nil {
-				logger.Debug(err)
-				return
-			}
-			data.Task = task
-			data.ScriptId = scriptId
-			GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Save(&data)
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Find(&taskDataList).Error; err != nil {
+		return err
+	}
+	var names []string
+	for _, data := range taskDataList {
+		if !data.UseScript(scriptId) {
+			continue
 		}
+		task, err := data.InitTask(TaskReqData{
+			ConCurrent: data.Task.Worker.getConCurrent(),
+			Duration:   data.Task.Worker.getDuration(),
+			ScriptId:   data.ScriptId,
+			Scenarios:  data.Task.Worker.Scenarios,
+
+			SetupScriptId:    data.SetupScriptId,
+			TeardownScriptId: data.TeardownScriptId,
+			Distributed:      data.Task.Distributed,
+			Thresholds:       data.Task.Worker.Thresholds,
+		})
+		if err != nil {
+			logger.Debug(err)
+			names = append(names, data.Name)
+			continue
+		}
+		data.Task = task
+		if err = GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Save(&data).Error; err != nil {
+			logger.Debug(err)
+			names = append(names, data.Name)
+		}
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("%s：%s", ERR_TASK_RESET.Error(), strings.Join(names, ","))
 	}
+	return nil
 }
@@ -0,0 +1,184 @@
+package gobom
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	TRIGGER_MANUAL   = "manual"   // 手动运行
+	TRIGGER_SCHEDULE = "schedule" // 定时运行
+	TRIGGER_PIPELINE = "pipeline" // 流水线运行
+)
+
+// 任务运行记录
+type TaskRunData struct {
+	Model
+	TaskId     string   `json:"taskId" gorm:"index"`
+	Trigger    string   `json:"trigger" gorm:"column:trigger_source"` // 触发来源
+	ScheduleId uint     `json:"scheduleId"`                           // 定时运行时的计划id
+	Status     int      `json:"status"`
+	Note       string   `json:"note"`
+	StartTime  JSONTime `json:"startTime"`
+	EndTime    JSONTime `json:"endTime"`
+	SuccessNum uint64   `json:"successNum"`
+	FailureNum uint64   `json:"failureNum"`
+	Report     *Report  `json:"report,omitempty" gorm:"-"`
+	ReportJson string   `json:"-" gorm:"type:longtext"`
+}
+
+type TaskRunReqData struct {
+	ID     uint   `json:"ID" form:"ID"`
+	TaskId string `json:"taskId" form:"taskId"`
+}
+
+var taskRunTable = &TaskRunData{}
+
+func TaskRunHandel(ctx *gin.Context) {
+	var reqParam TaskRunReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	taskRun := &TaskRunData{TaskId: reqParam.TaskId}
+	taskRun.ID = reqParam.ID
+
+	user := currentUser(ctx)
+	switch ctx.FullPath() {
+	case "/task/runs":
+		if taskRun.ID == 0 {
+			if taskRun.TaskId != "" {
+				if err = user.authorizeTask(taskRun.TaskId, ROLE_VIEWER); err != nil {
+					return
+				}
+			}
+			data, err = taskRun.Get(user.taskScope())
+			return
+		}
+		if _, err = taskRun.First(); err != nil {
+			return
+		}
+		if err = user.authorizeTask(taskRun.TaskId, ROLE_VIEWER); err != nil {
+			return
+		}
+		data = taskRun
+	}
+}
+
+func (taskRun *TaskRunData) BeforeSave() (err error) {
+	if taskRun.Report == nil {
+		return nil
+	}
+	bt, err := json.Marshal(taskRun.Report)
+	taskRun.ReportJson = string(bt)
+	return err
+}
+
+func (taskRun *TaskRunData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(taskRunTable)).Create(taskRun).Error
+}
+
+func (taskRun *TaskRunData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(taskRunTable)).Save(taskRun).Error
+}
+
+// 获取单条记录（包含报告）
+func (taskRun *TaskRunData) First() (*TaskRunData, error) {
+	if taskRun.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(taskRunTable)).First(taskRun, taskRun.ID).Error; err != nil {
+		return nil, err
+	}
+	if taskRun.ReportJson != "" {
+		taskRun.Report = &Report{}
+		if err := json.Unmarshal([]byte(taskRun.ReportJson), taskRun.Report); err != nil {
+			return nil, err
+		}
+	}
+	return taskRun, nil
+}
+
+// 获取运行记录列表（不包含报告），按时间倒序
+func (taskRun *TaskRunData) Get(scopes ...func(db *gorm.DB) *gorm.DB) (list []TaskRunData, err error) {
+	db := GobomStore.GetDb().Table(GobomStore.GetTableName(taskRunTable)).Scopes(scopes...).Select("id, created_at, updated_at, deleted_at, task_id, trigger_source, schedule_id, status, note, start_time, end_time, success_num, failure_num")
+	if taskRun.TaskId != "" {
+		db = db.Where("task_id = ?", taskRun.TaskId)
+	}
+	err = db.Order("id desc").Find(&list).Error
+	return
+}
+
+// 记录运行开始
+func NewTaskRun(taskId, trigger string, scheduleId uint, status int, note string) *TaskRunData {
+	taskRun := &TaskRunData{
+		TaskId:     taskId,
+		Trigger:    trigger,
+		ScheduleId: scheduleId,
+		Status:     status,
+		Note:       note,
+		StartTime:  JSONTime{time.Now()},
+	}
+	if err := taskRun.Add(); err != nil {
+		logger.Debug(err)
+	}
+	return taskRun
+}
+
+// 排队的运行开始
+func (taskRun *TaskRunData) Start() {
+	taskRun.Status = STATUS_RUN
+	taskRun.Note = ""
+	taskRun.StartTime = JSONTime{time.Now()}
+	if err := taskRun.Update(); err != nil {
+		logger.Debug(err)
+	}
+}
+
+// 取消排队的运行
+func (taskRun *TaskRunData) Cancel() {
+	taskRun.Status = STATUS_STOP
+	taskRun.Note = "取消排队"
+	taskRun.EndTime = JSONTime{time.Now()}
+	if err := taskRun.Update(); err != nil {
+		logger.Debug(err)
+	}
+}
+
+// 记录运行结束
+func (taskRun *TaskRunData) Finish(task *Task, err error) {
+	taskRun.Status = task.GetStatus()
+	taskRun.EndTime = JSONTime{time.Now()}
+	if err != nil {
+		taskRun.Status = STATUS_ERROR
+		taskRun.Note = err.Error()
+	}
+	if report := task.Info(); report != nil {
+		taskRun.Report = report.Copy()
+		taskRun.SuccessNum = taskRun.Report.SuccessNum
+		taskRun.FailureNum = taskRun.Report.FailureNum
+	}
+	if err := taskRun.Update(); err != nil {
+		logger.Debug(err)
+	}
+}
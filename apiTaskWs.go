@@ -21,11 +21,72 @@ const (
 	WS_TASK_RUN
 	WS_TASK_STOP
 	WS_TASK_REPORT
+	WS_TASK_SUBSCRIBE   // 订阅任务，运行中每秒推送增量数据
+	WS_TASK_UNSUBSCRIBE // 取消订阅
+	WS_TASK_DELTA       // 增量数据
+	WS_TASK_STATUS      // 任务状态变化
+	WS_TASK_SUMMARY     // 任务结束时的汇总报告
+	WS_TASK_SCALE       // 调整运行中的任务
+	WS_TASK_PAUSE       // 暂停任务
+	WS_TASK_RESUME      // 恢复任务
+)
+
+const (
+	DEFAULT_WS_QUEUE = 64                // 每个连接最多缓存的待发送消息（连续的增量数据合并为一条）
+	DEFAULT_WS_PING  = 120 * time.Second // 心跳间隔
 )
 
 type TaskWs struct {
 	Conn *websocket.Conn `json:"-"`
 	mu   sync.Mutex
+	user *UserData // 连接时认证的用户
+	ip   string
+
+	queueMu sync.Mutex
+	frames  []*TaskWsData         // 待发送的消息，按放入的顺序发送
+	deltas  map[string]*TaskDelta // [任务id]队列末尾之后没有其他消息的增量数据，连接较慢时合并
+	notify  chan struct{}
+	quit    chan struct{}
+}
+
+// 每秒推送的增量数据
+type TaskDelta struct {
+	TaskId     string             `json:"taskId"`
+	Status     int                `json:"status"`
+	ConCurrent uint64             `json:"conCurrent"`
+	Totals     *TaskTotals        `json:"totals"`   // 截至当前的汇总
+	Delta      *Snapshot          `json:"delta"`    // 上次推送后的增量（首次推送为完整快照）
+	Breaches   []*ThresholdBreach `json:"breaches"` // 新越过的阈值
+}
+
+// 任务结束时推送的汇总报告
+type TaskSummary struct {
+	TaskId string  `json:"taskId"`
+	Status int     `json:"status"`
+	Report *Report `json:"report"`
+}
+
+type TaskTotals struct {
+	SuccessNum  uint64  `json:"successNum"`
+	FailureNum  uint64  `json:"failureNum"`
+	AverageTime uint64  `json:"averageTime"`
+	MaxTime     uint64  `json:"maxTime"`
+	MinTime     uint64  `json:"minTime"`
+	P50Time     uint64  `json:"p50Time"`
+	P90Time     uint64  `json:"p90Time"`
+	P95Time     uint64  `json:"p95Time"`
+	P99Time     uint64  `json:"p99Time"`
+	ErrorRate   float64 `json:"errorRate"`
+}
+
+// 任务订阅关系
+type TaskHub struct {
+	subscribers map[string]map[*TaskWs]bool // [任务id][连接]是否需要完整快照
+	mu          sync.Mutex
+}
+
+var taskHub = &TaskHub{
+	subscribers: make(map[string]map[*TaskWs]bool),
 }
 
 type TaskWsData struct {
@@ -36,7 +97,8 @@ type TaskWsData struct {
 
 var upGrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowOrigin(origin)
 	},
 }
 
@@ -49,12 +111,12 @@ func TaskWsHandel(ctx *gin.Context) {
 
 	defer ws.Close()
 
-	taskWs := &TaskWs{
-		mu: sync.Mutex{},
-	}
-	taskWs.Conn = ws
+	taskWs := NewTaskWs(ws)
+	taskWs.user = currentUser(ctx)
+	taskWs.ip = ctx.ClientIP()
+	defer taskWs.Close()
 
-	go taskWs.Ping()
+	go taskWs.Write()
 
 	for {
 		_, msg, err := ws.ReadMessage()
@@ -77,10 +139,44 @@ func (taskWs *TaskWs) ParseMsg(reqData *TaskWsData) {
 
 	msgData, _ := reqData.Data.(map[string]interface{})
 	taskId, _ := msgData["taskId"].(string)
+	taskIds, _ := msgData["taskIds"].([]interface{})
+	reason, _ := msgData["reason"].(string)
+	confirm, _ := msgData["confirm"].(bool)
+	if taskId != "" {
+		taskIds = append(taskIds, taskId)
+	}
 	taskData := &TaskData{
 		Task: &Task{
 			TaskId: taskId,
 		},
+		confirmed: confirm,
+	}
+
+	audit := newUserAudit(taskWs.user, taskWs.ip, wsAuditActions[reqData.Type])
+	defer func() { audit.Save(err) }()
+	if audit != nil {
+		audit.loadTask(taskId)
+		audit.Detail = reason
+		if reqData.Type == WS_TASK_SCALE {
+			if bt, e := json.Marshal(msgData["scale"]); e == nil {
+				audit.Detail = string(bt)
+			}
+		}
+	}
+
+	switch reqData.Type {
+	case WS_TASK_RUN, WS_TASK_STOP, WS_TASK_PAUSE, WS_TASK_RESUME, WS_TASK_SCALE:
+		err = taskWs.user.authorizeTask(taskId, ROLE_RUNNER)
+	case WS_TASK_REPORT:
+		err = taskWs.user.authorizeTask(taskId, ROLE_VIEWER)
+	}
+	if err != nil {
+		taskWs.Push(&TaskWsData{
+			Type:  reqData.Type,
+			Data:  map[string]string{"taskId": taskId},
+			Error: utils.GetErrString(err),
+		})
+		return
 	}
 
 	switch reqData.Type {
@@ -90,13 +186,44 @@ func (taskWs *TaskWs) ParseMsg(reqData *TaskWsData) {
 	case WS_TASK_STOP:
 		err = taskData.Stop()
 		data = map[string]string{"taskId": taskId}
+	case WS_TASK_PAUSE:
+		err = taskData.Pause(reason)
+		data = map[string]string{"taskId": taskId}
+	case WS_TASK_RESUME:
+		err = taskData.Resume(reason)
+		data = map[string]string{"taskId": taskId}
 	case WS_TASK_REPORT:
 		data, err = taskData.Info()
+	case WS_TASK_SCALE:
+		scale := &ScaleReqData{}
+		if bt, e := json.Marshal(msgData["scale"]); e == nil {
+			err = json.Unmarshal(bt, scale)
+		}
+		if err == nil {
+			err = taskData.Scale(scale)
+		}
+		data = map[string]string{"taskId": taskId}
+	case WS_TASK_SUBSCRIBE:
+		var subscribed []string
+		for _, v := range taskIds {
+			if id, ok := v.(string); ok && id != "" && taskWs.user.authorizeTask(id, ROLE_VIEWER) == nil {
+				taskHub.Subscribe(id, taskWs)
+				subscribed = append(subscribed, id)
+			}
+		}
+		data = map[string][]string{"taskIds": subscribed}
+	case WS_TASK_UNSUBSCRIBE:
+		for _, v := range taskIds {
+			if id, ok := v.(string); ok {
+				taskHub.Unsubscribe(id, taskWs)
+			}
+		}
+		return
 	default:
 		return
 	}
 
-	taskWs.SendMsg(&TaskWsData{
+	taskWs.Push(&TaskWsData{
 		Type:  reqData.Type,
 		Data:  data,
 		Error: utils.GetErrString(err),
@@ -121,16 +248,160 @@ func (taskWs *TaskWs) SendMsg(respData *TaskWsData) error {
 	return nil
 }
 
-func (taskWs *TaskWs) Ping() {
-	for {
-		if taskWs.Conn == nil {
+func NewTaskWs(conn *websocket.Conn) *TaskWs {
+	return &TaskWs{
+		Conn:   conn,
+		deltas: make(map[string]*TaskDelta),
+		notify: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+}
+
+func (taskWs *TaskWs) Close() {
+	taskHub.Remove(taskWs)
+	close(taskWs.quit)
+}
+
+// 放入发送队列，不会阻塞；连续的增量数据合并，超出队列长度时丢弃最早的消息
+func (taskWs *TaskWs) Push(respData *TaskWsData) {
+	taskWs.queueMu.Lock()
+	if delta, ok := respData.Data.(*TaskDelta); ok && respData.Type == WS_TASK_DELTA {
+		if pending, ok := taskWs.deltas[delta.TaskId]; ok {
+			pending.merge(delta)
+			taskWs.queueMu.Unlock()
 			return
 		}
+		taskWs.deltas[delta.TaskId] = delta
+	} else {
+		// 之后的增量数据排在这条消息后面
+		taskWs.deltas = make(map[string]*TaskDelta)
+	}
+	if len(taskWs.frames) >= DEFAULT_WS_QUEUE {
+		if delta, ok := taskWs.frames[0].Data.(*TaskDelta); ok && taskWs.deltas[delta.TaskId] == delta {
+			delete(taskWs.deltas, delta.TaskId)
+		}
+		taskWs.frames = taskWs.frames[1:]
+	}
+	taskWs.frames = append(taskWs.frames, respData)
+	taskWs.queueMu.Unlock()
 
-		time.Sleep(time.Duration(120) * time.Second)
+	select {
+	case taskWs.notify <- struct{}{}:
+	default:
+	}
+}
 
-		if err := taskWs.SendMsg(&TaskWsData{Type: WS_PING}); err != nil {
+// 按顺序发送队列中的消息和心跳，连接关闭时退出
+func (taskWs *TaskWs) Write() {
+	ticker := time.NewTicker(DEFAULT_WS_PING)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-taskWs.quit:
 			return
+		case <-ticker.C:
+			if err := taskWs.SendMsg(&TaskWsData{Type: WS_PING}); err != nil {
+				return
+			}
+			continue
+		case <-taskWs.notify:
 		}
+		taskWs.queueMu.Lock()
+		frames := taskWs.frames
+		taskWs.frames, taskWs.deltas = nil, make(map[string]*TaskDelta)
+		taskWs.queueMu.Unlock()
+
+		for _, frame := range frames {
+			if err := taskWs.SendMsg(frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// 合并较新的增量数据
+func (delta *TaskDelta) merge(newer *TaskDelta) {
+	delta.Status = newer.Status
+	delta.ConCurrent = newer.ConCurrent
+	delta.Totals = newer.Totals
+	delta.Delta.Merge(newer.Delta)
+	delta.Breaches = append(delta.Breaches, newer.Breaches...)
+}
+
+func NewTaskTotals(snapshot *Snapshot) *TaskTotals {
+	errorRate, _ := metric(snapshot, METRIC_ERROR_RATE)
+	return &TaskTotals{
+		SuccessNum:  snapshot.SuccessNum,
+		FailureNum:  snapshot.FailureNum,
+		AverageTime: snapshot.AverageTime(),
+		MaxTime:     snapshot.MaxTime,
+		MinTime:     snapshot.MinTime,
+		P50Time:     snapshot.Percentile(50),
+		P90Time:     snapshot.Percentile(90),
+		P95Time:     snapshot.Percentile(95),
+		P99Time:     snapshot.Percentile(99),
+		ErrorRate:   errorRate,
+	}
+}
+
+func (hub *TaskHub) Subscribe(taskId string, taskWs *TaskWs) {
+	hub.mu.Lock()
+	if hub.subscribers[taskId] == nil {
+		hub.subscribers[taskId] = make(map[*TaskWs]bool)
+	}
+	hub.subscribers[taskId][taskWs] = true
+	hub.mu.Unlock()
+
+	// 任务没有运行时直接推送最近一次的报告
+	if GetRunTask(taskId) == nil {
+		data, err := (&TaskData{Task: &Task{TaskId: taskId}}).Info()
+		if err == nil && data != nil {
+			taskWs.Push(&TaskWsData{Type: WS_TASK_REPORT, Data: data})
+		}
+	}
+}
+
+func (hub *TaskHub) Unsubscribe(taskId string, taskWs *TaskWs) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.subscribers[taskId], taskWs)
+	if len(hub.subscribers[taskId]) == 0 {
+		delete(hub.subscribers, taskId)
+	}
+}
+
+func (hub *TaskHub) Remove(taskWs *TaskWs) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for taskId, conns := range hub.subscribers {
+		delete(conns, taskWs)
+		if len(conns) == 0 {
+			delete(hub.subscribers, taskId)
+		}
+	}
+}
+
+// 推送增量数据，新订阅的连接推送完整快照
+func (hub *TaskHub) PublishDelta(delta *TaskDelta, total *Snapshot) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for taskWs, fresh := range hub.subscribers[delta.TaskId] {
+		data := *delta
+		data.Breaches = append([]*ThresholdBreach(nil), delta.Breaches...)
+		if fresh {
+			data.Delta = total.Copy()
+			hub.subscribers[delta.TaskId][taskWs] = false
+		} else {
+			data.Delta = delta.Delta.Copy()
+		}
+		taskWs.Push(&TaskWsData{Type: WS_TASK_DELTA, Data: &data})
+	}
+}
+
+func (hub *TaskHub) Publish(taskId string, respData *TaskWsData) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for taskWs := range hub.subscribers[taskId] {
+		taskWs.Push(respData)
 	}
 }
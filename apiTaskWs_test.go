@@ -0,0 +1,158 @@
+package gobom
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestTaskWsSubscribe(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	initTestDb(t)
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+	if err := InitAdmin(&AppConfig{AdminPassword: "password"}); err != nil {
+		t.Fatal(err)
+	}
+	login, err := Login(DEFAULT_ADMIN_NAME, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := NewTask("ws-test", &Options{
+		Url:        target.URL,
+		ConCurrent: 2,
+		Duration:   3,
+		Interval:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Worker.Thresholds = []*Threshold{{Metric: METRIC_MAX_TIME, Op: ">=", Value: 0}}
+	if err := (&TaskData{Name: task.TaskId, Task: task}).Add(); err != nil {
+		t.Fatal(err)
+	}
+	go task.Run()
+	for i := 0; GetRunTask(task.TaskId) == nil; i++ {
+		if i > 50 {
+			t.Fatal("task not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?token="+login.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(&TaskWsData{
+		Type: WS_TASK_SUBSCRIBE,
+		Data: map[string]interface{}{"taskIds": []string{task.TaskId}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := NewSnapshot()
+	var deltas, breaches int
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var frame struct {
+			Type int             `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		switch frame.Type {
+		case WS_TASK_DELTA:
+			var delta TaskDelta
+			if err := json.Unmarshal(frame.Data, &delta); err != nil {
+				t.Fatal(err)
+			}
+			deltas++
+			breaches += len(delta.Breaches)
+			merged.Merge(delta.Delta)
+		case WS_TASK_SUMMARY:
+			var summary TaskSummary
+			if err := json.Unmarshal(frame.Data, &summary); err != nil {
+				t.Fatal(err)
+			}
+			report := summary.Report
+			if deltas < 2 {
+				t.Errorf("received %d deltas, want at least 2", deltas)
+			}
+			if merged.SuccessNum != report.SuccessNum || merged.SuccessNum == 0 {
+				t.Errorf("merged deltas %d != summary %d", merged.SuccessNum, report.SuccessNum)
+			}
+			if breaches != 1 || len(report.Breaches) != 1 {
+				t.Errorf("breaches pushed %d, reported %d, want 1", breaches, len(report.Breaches))
+			}
+			return
+		}
+	}
+}
+
+func TestTaskWsTokenLog(t *testing.T) {
+	line := apiLogFormatter(gin.LogFormatterParams{Method: "GET", Path: "/ws?token=secret-token&taskId=1", StatusCode: 101})
+	if strings.Contains(line, "secret-token") || !strings.Contains(line, "taskId=1") {
+		t.Errorf("log line: %s", line)
+	}
+	if path := redactToken("/task?ID=1"); path != "/task?ID=1" {
+		t.Errorf("path without token: %s", path)
+	}
+}
+
+// 消息按放入的顺序发送，只合并连续的增量数据
+func TestTaskWsOrder(t *testing.T) {
+	taskWs := NewTaskWs(nil)
+	newDelta := func(successNum uint64) *TaskWsData {
+		delta := NewSnapshot()
+		delta.SuccessNum = successNum
+		return &TaskWsData{Type: WS_TASK_DELTA, Data: &TaskDelta{TaskId: "ws-order", Delta: delta}}
+	}
+	taskWs.Push(newDelta(1))
+	taskWs.Push(newDelta(2))
+	taskWs.Push(&TaskWsData{Type: WS_TASK_STATUS, Data: map[string]interface{}{"taskId": "ws-order"}})
+	taskWs.Push(newDelta(4))
+	taskWs.Push(&TaskWsData{Type: WS_TASK_SUMMARY, Data: &TaskSummary{TaskId: "ws-order"}})
+	taskWs.Push(newDelta(8))
+
+	want := []struct {
+		typ        int
+		successNum uint64
+	}{{WS_TASK_DELTA, 3}, {WS_TASK_STATUS, 0}, {WS_TASK_DELTA, 4}, {WS_TASK_SUMMARY, 0}, {WS_TASK_DELTA, 8}}
+	if len(taskWs.frames) != len(want) {
+		t.Fatalf("frames: %d, want %d", len(taskWs.frames), len(want))
+	}
+	for i, frame := range taskWs.frames {
+		if frame.Type != want[i].typ {
+			t.Errorf("frame %d: type %d, want %d", i, frame.Type, want[i].typ)
+		}
+		if delta, ok := frame.Data.(*TaskDelta); ok && delta.Delta.SuccessNum != want[i].successNum {
+			t.Errorf("frame %d: success %d, want %d", i, delta.Delta.SuccessNum, want[i].successNum)
+		}
+	}
+
+	// 连接关闭后发送协程和心跳退出
+	taskWs = NewTaskWs(nil)
+	exited := make(chan struct{})
+	go func() {
+		taskWs.Write()
+		close(exited)
+	}()
+	taskWs.Close()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("writer not exited")
+	}
+}
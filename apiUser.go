@@ -0,0 +1,306 @@
+package gobom
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_TOKEN_EXPIRE = 24 * 7 // 登录令牌有效期（小时）
+	DEFAULT_ADMIN_NAME   = "admin"
+)
+
+type UserData struct {
+	Model
+	Name         string `json:"name" gorm:"unique_index"`
+	PasswordHash string `json:"-"`
+	Admin        bool   `json:"admin"` // 系统管理员，管理用户和项目，拥有所有项目的权限
+	Disabled     bool   `json:"disabled"`
+}
+
+// 登录令牌，只保存哈希
+type UserTokenData struct {
+	Model
+	UserId     uint     `json:"userId" gorm:"index"`
+	TokenHash  string   `json:"-" gorm:"unique_index"`
+	ExpireTime JSONTime `json:"expireTime"`
+}
+
+type UserReqData struct {
+	ID          uint   `json:"ID" form:"ID"`
+	Name        string `json:"name" form:"name"`
+	Password    string `json:"password" form:"password"`
+	OldPassword string `json:"oldPassword" form:"oldPassword"`
+	Admin       bool   `json:"admin"`
+	Disabled    bool   `json:"disabled"`
+}
+
+type LoginReply struct {
+	Token      string    `json:"token"`
+	ExpireTime JSONTime  `json:"expireTime"`
+	User       *UserData `json:"user"`
+}
+
+// 当前用户及其在各项目中的角色
+type UserInfo struct {
+	User  *UserData       `json:"user"`
+	Roles map[uint]string `json:"roles"` // [项目id]角色
+}
+
+var userTable = &UserData{}
+var userTokenTable = &UserTokenData{}
+
+func UserHandel(ctx *gin.Context) {
+	var reqParam UserReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	current := currentUser(ctx)
+	user := &UserData{Name: reqParam.Name, Admin: reqParam.Admin, Disabled: reqParam.Disabled}
+	user.ID = reqParam.ID
+
+	switch ctx.FullPath() {
+	case "/login":
+		data, err = Login(reqParam.Name, reqParam.Password)
+		return
+	case "/logout":
+		err = Logout(requestToken(ctx))
+		return
+	case "/user/me":
+		data, err = current.Info()
+		return
+	case "/user/password":
+		if !checkPassword(current.PasswordHash, reqParam.OldPassword) {
+			err = ERR_LOGIN
+			return
+		}
+		if err = current.SetPassword(reqParam.Password); err != nil {
+			return
+		}
+		err = current.ClearOtherTokens(requestToken(ctx))
+		return
+	}
+
+	// 用户管理需要系统管理员
+	if current == nil || !current.Admin {
+		err = ERR_PERMISSION
+		return
+	}
+	switch ctx.FullPath() {
+	case "/user":
+		if user.ID == 0 {
+			data, err = user.Get()
+		} else {
+			data, err = user.First()
+		}
+	case "/user/add":
+		if user.Name == "" {
+			err = ERR_PARAM
+			return
+		}
+		if user.PasswordHash, err = checkedHash(reqParam.Password); err != nil {
+			return
+		}
+		err = user.Add()
+		data = user
+	case "/user/edit":
+		old := &UserData{}
+		old.ID = user.ID
+		if _, err = old.First(); err != nil {
+			return
+		}
+		if old.ID == current.ID && (!user.Admin || user.Disabled) {
+			err = ERR_USER_SELF
+			return
+		}
+		old.Admin = user.Admin
+		old.Disabled = user.Disabled
+		if reqParam.Password != "" {
+			if old.PasswordHash, err = checkedHash(reqParam.Password); err != nil {
+				return
+			}
+		}
+		if err = old.Update(); err != nil {
+			return
+		}
+		if old.Disabled || reqParam.Password != "" {
+			err = old.ClearTokens()
+		}
+		data = old
+	case "/user/delete":
+		if user.ID == 0 {
+			err = ERR_PARAM
+			return
+		}
+		if user.ID == current.ID {
+			err = ERR_USER_SELF
+			return
+		}
+		if err = user.ClearTokens(); err != nil {
+			return
+		}
+		if err = GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).Where("user_id = ?", user.ID).Delete(&ProjectMemberData{}).Error; err != nil {
+			return
+		}
+		err = user.Del()
+	}
+}
+
+func checkedHash(password string) (string, error) {
+	if len(password) < PASSWORD_MIN_LEN {
+		return "", ERR_PASSWORD
+	}
+	return hashPassword(password)
+}
+
+// 登录成功返回新的令牌
+func Login(name, password string) (*LoginReply, error) {
+	var user UserData
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).Where("name = ?", name).First(&user).Error; err != nil {
+		return nil, ERR_LOGIN
+	}
+	if user.Disabled || !checkPassword(user.PasswordHash, password) {
+		return nil, ERR_LOGIN
+	}
+	token, hashed, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	expire := DEFAULT_TOKEN_EXPIRE
+	if configs().TokenExpire > 0 {
+		expire = configs().TokenExpire
+	}
+	userToken := &UserTokenData{
+		UserId:     user.ID,
+		TokenHash:  hashed,
+		ExpireTime: JSONTime{time.Now().Add(time.Duration(expire) * time.Hour)},
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(userTokenTable)).Create(userToken).Error; err != nil {
+		return nil, err
+	}
+	return &LoginReply{Token: token, ExpireTime: userToken.ExpireTime, User: &user}, nil
+}
+
+func Logout(token string) error {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(userTokenTable)).Where("token_hash = ?", hashToken(token)).Delete(&UserTokenData{}).Error
+}
+
+func FindUserByToken(token string) (*UserData, error) {
+	if token == "" {
+		return nil, ERR_AUTH
+	}
+	var userToken UserTokenData
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(userTokenTable)).
+		Where("token_hash = ? AND expire_time > ?", hashToken(token), time.Now()).First(&userToken).Error; err != nil {
+		return nil, ERR_AUTH
+	}
+	user := &UserData{}
+	user.ID = userToken.UserId
+	if _, err := user.First(); err != nil || user.Disabled {
+		return nil, ERR_AUTH
+	}
+	return user, nil
+}
+
+// 没有用户时创建系统管理员，未配置密码时生成随机密码并输出到日志
+func InitAdmin(config *AppConfig) error {
+	var count int
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).Count(&count).Error; err != nil {
+		return err
+	}
+	if count != 0 {
+		return nil
+	}
+	password := config.AdminPassword
+	if password == "" {
+		token, _, err := newToken()
+		if err != nil {
+			return err
+		}
+		password = token[:16]
+		logger.Info("created admin user, name: ", DEFAULT_ADMIN_NAME, " password: ", password)
+	}
+	hashed, err := checkedHash(password)
+	if err != nil {
+		return err
+	}
+	return (&UserData{Name: DEFAULT_ADMIN_NAME, PasswordHash: hashed, Admin: true}).Add()
+}
+
+func (user *UserData) Info() (*UserInfo, error) {
+	if user == nil {
+		return nil, ERR_AUTH
+	}
+	var members []ProjectMemberData
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).Where("user_id = ?", user.ID).Find(&members).Error; err != nil {
+		return nil, err
+	}
+	info := &UserInfo{User: user, Roles: make(map[uint]string)}
+	for _, member := range members {
+		info.Roles[member.ProjectId] = member.Role
+	}
+	return info, nil
+}
+
+func (user *UserData) SetPassword(password string) (err error) {
+	if user.PasswordHash, err = checkedHash(password); err != nil {
+		return
+	}
+	return user.Update()
+}
+
+// 删除用户的所有令牌，强制重新登录
+func (user *UserData) ClearTokens() error {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(userTokenTable)).Where("user_id = ?", user.ID).Delete(&UserTokenData{}).Error
+}
+
+// 删除用户当前令牌以外的令牌，修改密码后其他登录失效
+func (user *UserData) ClearOtherTokens(token string) error {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(userTokenTable)).Where("user_id = ? AND token_hash <> ?", user.ID, hashToken(token)).Delete(&UserTokenData{}).Error
+}
+
+func (user *UserData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).Create(user).Error
+}
+
+func (user *UserData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).Save(user).Error
+}
+
+func (user *UserData) Del() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).Delete(user).Error
+}
+
+func (user *UserData) First() (*UserData, error) {
+	if user.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).First(user, user.ID).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (user *UserData) Get() (list []UserData, err error) {
+	err = GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).Find(&list).Error
+	return
+}
@@ -0,0 +1,287 @@
+package gobom
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// 任务或流水线的通知钩子
+type WebhookData struct {
+	Model
+	Name        string            `json:"name"`
+	TaskId      string            `json:"taskId" gorm:"index"`     // 任务的钩子，与PipelineId二选一
+	PipelineId  uint              `json:"pipelineId" gorm:"index"` // 流水线的钩子
+	ProjectId   uint              `json:"projectId" gorm:"index"`  // 任务或流水线所属的项目
+	Url         string            `json:"url"`
+	Header      map[string]string `json:"header" gorm:"-"`
+	Events      []string          `json:"events" gorm:"-"`       // 触发的事件，为空时所有事件都触发
+	Body        string            `json:"body" gorm:"type:text"` // 请求体模板，{{字段路径}}引用通知内容，为空时发送JSON通知内容
+	ContentType string            `json:"contentType"`           // 默认application/json
+	Retries     *int              `json:"retries"`               // 失败重试次数，0为不重试，为空时使用默认次数
+	Enabled     bool              `json:"enabled"`
+	HeaderJson  string            `json:"-" gorm:"type:text"`
+	EventsJson  string            `json:"-"`
+}
+
+// 通知发送记录
+type WebhookLogData struct {
+	Model
+	WebhookId  uint   `json:"webhookId" gorm:"index"`
+	Event      string `json:"event"`
+	TaskId     string `json:"taskId"`
+	PipelineId uint   `json:"pipelineId"`
+	RunId      uint   `json:"runId"`
+	Url        string `json:"url"`
+	Body       string `json:"body" gorm:"type:text"`
+	Attempts   int    `json:"attempts"`   // 发送次数
+	StatusCode int    `json:"statusCode"` // 最后一次响应状态码
+	Success    bool   `json:"success"`
+	Error      string `json:"error"`
+}
+
+type WebhookReqData struct {
+	ID          uint              `json:"ID" form:"ID"`
+	Name        string            `json:"name"`
+	TaskId      string            `json:"taskId" form:"taskId"`
+	PipelineId  uint              `json:"pipelineId" form:"pipelineId"`
+	Url         string            `json:"url"`
+	Header      map[string]string `json:"header"`
+	Events      []string          `json:"events"`
+	Body        string            `json:"body"`
+	ContentType string            `json:"contentType"`
+	Retries     *int              `json:"retries"`
+	Enabled     bool              `json:"enabled"`
+}
+
+var webhookTable = &WebhookData{}
+var webhookLogTable = &WebhookLogData{}
+
+func WebhookHandel(ctx *gin.Context) {
+	var reqParam WebhookReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	hook := &WebhookData{
+		Name:        reqParam.Name,
+		TaskId:      reqParam.TaskId,
+		PipelineId:  reqParam.PipelineId,
+		Url:         reqParam.Url,
+		Header:      reqParam.Header,
+		Events:      reqParam.Events,
+		Body:        reqParam.Body,
+		ContentType: reqParam.ContentType,
+		Retries:     reqParam.Retries,
+		Enabled:     reqParam.Enabled,
+	}
+	hook.ID = reqParam.ID
+
+	user := currentUser(ctx)
+	switch ctx.FullPath() {
+	case "/webhook":
+		if hook.ID != 0 {
+			err = user.authorizeRecord(webhookTable, hook.ID, ROLE_VIEWER)
+		}
+	case "/webhook/logs":
+		// 所有钩子的发送记录只有系统管理员可以查看
+		err = user.authorizeRecord(webhookTable, hook.ID, ROLE_VIEWER)
+	case "/webhook/edit", "/webhook/delete", "/webhook/test":
+		err = user.authorizeRecord(webhookTable, hook.ID, ROLE_EDITOR)
+	}
+	if err != nil {
+		return
+	}
+
+	switch ctx.FullPath() {
+	case "/webhook":
+		if hook.ID == 0 {
+			var list []WebhookData
+			if list, err = hook.Get(user.projectScope()); err == nil {
+				for i := range list {
+					list[i].redact(user)
+				}
+			}
+			data = list
+		} else if _, err = hook.First(); err == nil {
+			hook.redact(user)
+			data = hook
+		}
+	case "/webhook/add":
+		if err = hook.Check(); err != nil {
+			return
+		}
+		if err = user.authorize(hook.ProjectId, ROLE_EDITOR); err != nil {
+			return
+		}
+		err = hook.Add()
+		data = hook
+	case "/webhook/edit":
+		old := &WebhookData{}
+		old.ID = hook.ID
+		if _, err = old.First(); err != nil {
+			return
+		}
+		hook.Model = old.Model
+		if err = hook.Check(); err != nil {
+			return
+		}
+		if err = user.authorize(hook.ProjectId, ROLE_EDITOR); err != nil {
+			return
+		}
+		err = hook.Update()
+		data = hook
+	case "/webhook/delete":
+		err = hook.Del()
+	case "/webhook/test":
+		if _, err = hook.First(); err != nil {
+			return
+		}
+		// 测试只发送一次，不阻塞接口等待重试
+		data = hook.deliver(&HookPayload{
+			Event:      HOOK_TEST,
+			Time:       hookTime(),
+			TaskId:     hook.TaskId,
+			PipelineId: hook.PipelineId,
+		}, 0)
+	case "/webhook/logs":
+		data, err = (&WebhookLogData{WebhookId: hook.ID}).Get()
+	}
+}
+
+func (hook *WebhookData) Check() error {
+	if (hook.TaskId == "") == (hook.PipelineId == 0) {
+		return ERR_WEBHOOK_TARGET
+	}
+	if hook.TaskId != "" {
+		projectId, err := taskProject(hook.TaskId)
+		if err != nil {
+			return err
+		}
+		hook.ProjectId = projectId
+	} else {
+		pipeline := &PipelineData{}
+		pipeline.ID = hook.PipelineId
+		if _, err := pipeline.First(); err != nil {
+			return err
+		}
+		hook.ProjectId = pipeline.ProjectId
+	}
+	if u, err := url.Parse(hook.Url); err != nil || u.Host == "" {
+		return ERR_URL
+	}
+	if _, err := gobomInterlock.Check(hook.Url); err != nil {
+		return err
+	}
+	for _, event := range hook.Events {
+		if event != HOOK_RUN_START && event != HOOK_RUN_END && event != HOOK_THRESHOLD && event != HOOK_RUN_ABORT {
+			return ERR_WEBHOOK_EVENT
+		}
+	}
+	if hook.Retries != nil && *hook.Retries < 0 {
+		return ERR_PARAM
+	}
+	return nil
+}
+
+// 没有编辑权限的用户看不到请求头的值，可能包含密钥
+func (hook *WebhookData) redact(user *UserData) {
+	if user.authorize(hook.ProjectId, ROLE_EDITOR) == nil {
+		return
+	}
+	for k := range hook.Header {
+		hook.Header[k] = "***"
+	}
+}
+
+func (hook *WebhookData) BeforeSave() (err error) {
+	bt, err := json.Marshal(hook.Header)
+	if err != nil {
+		return err
+	}
+	hook.HeaderJson = string(bt)
+	bt, err = json.Marshal(hook.Events)
+	hook.EventsJson = string(bt)
+	return err
+}
+
+func (hook *WebhookData) AfterFind() (err error) {
+	if hook.HeaderJson != "" {
+		if err = json.Unmarshal([]byte(hook.HeaderJson), &hook.Header); err != nil {
+			return err
+		}
+	}
+	if hook.EventsJson != "" {
+		err = json.Unmarshal([]byte(hook.EventsJson), &hook.Events)
+	}
+	return err
+}
+
+func (hook *WebhookData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(webhookTable)).Create(hook).Error
+}
+
+func (hook *WebhookData) Update() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(webhookTable)).Save(hook).Error
+}
+
+func (hook *WebhookData) Del() (err error) {
+	if hook.ID == 0 {
+		return ERR_PARAM
+	}
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(webhookTable)).Delete(hook).Error
+}
+
+func (hook *WebhookData) First() (*WebhookData, error) {
+	if hook.ID == 0 {
+		return nil, ERR_PARAM
+	}
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(webhookTable)).First(hook, hook.ID).Error; err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+func (hook *WebhookData) Get(scopes ...func(db *gorm.DB) *gorm.DB) (list []WebhookData, err error) {
+	db := GobomStore.GetDb().Table(GobomStore.GetTableName(webhookTable)).Scopes(scopes...)
+	if hook.TaskId != "" {
+		db = db.Where("task_id = ?", hook.TaskId)
+	}
+	if hook.PipelineId != 0 {
+		db = db.Where("pipeline_id = ?", hook.PipelineId)
+	}
+	err = db.Find(&list).Error
+	return
+}
+
+func (hookLog *WebhookLogData) Add() (err error) {
+	return GobomStore.GetDb().Table(GobomStore.GetTableName(webhookLogTable)).Create(hookLog).Error
+}
+
+// 获取发送记录，按时间倒序
+func (hookLog *WebhookLogData) Get() (list []WebhookLogData, err error) {
+	db := GobomStore.GetDb().Table(GobomStore.GetTableName(webhookLogTable))
+	if hookLog.WebhookId != 0 {
+		db = db.Where("webhook_id = ?", hookLog.WebhookId)
+	}
+	err = db.Order("id desc").Limit(DEFAULT_HOOK_LOG_LIMIT).Find(&list).Error
+	return
+}
@@ -0,0 +1,122 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuditDiff(t *testing.T) {
+	if got := diffLines("a\nb\nc", "a\nx\nc\nd"); got != " a\n-b\n+x\n c\n+d" {
+		t.Errorf("diff %q", got)
+	}
+	if got := diffLines(prettyJson(`{"url":"http://a"}`), prettyJson(`{"url":"http://b"}`)); got != " {\n-  \"url\": \"http://a\"\n+  \"url\": \"http://b\"\n }" {
+		t.Errorf("json diff %q", got)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	initTestDb(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := apiLogin(t, server, DEFAULT_ADMIN_NAME, "admin-password")
+	call := func(token, path string, body interface{}) *ApiReply {
+		_, reply := apiCall(t, server, token, path, body)
+		return reply
+	}
+	mustCall := func(token, path string, body interface{}) *ApiReply {
+		reply := call(token, path, body)
+		if reply.Msg != "" {
+			t.Fatalf("%s: %s", path, reply.Msg)
+		}
+		return reply
+	}
+	reply := mustCall(admin, "/project/add", &ProjectData{Name: "audit"})
+	projectId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	reply = mustCall(admin, "/user/add", map[string]string{"name": "viewer", "password": "viewer-password"})
+	viewerId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	mustCall(admin, "/project/member/set", &ProjectReqData{ID: projectId, UserId: viewerId, Role: ROLE_VIEWER})
+	viewer := apiLogin(t, server, "viewer", "viewer-password")
+
+	script := map[string]interface{}{"name": "audit-script", "projectId": projectId, "data": `{"url":"http://typo.example.com/api"}`}
+	mustCall(admin, "/script/add", script)
+	scripts, err := (&ScriptData{}).Get()
+	if err != nil || len(scripts) != 1 {
+		t.Fatal(scripts, err)
+	}
+	script["ID"] = scripts[0].ID
+	script["data"] = `{"url":"` + target.URL + `/api"}`
+	mustCall(admin, "/script/edit", script)
+	mustCall(admin, "/task/add", &TaskReqData{TaskId: "audit-task", Name: "audit-task", ProjectId: projectId, ScriptId: scripts[0].ID, ConCurrent: 1, Duration: 60})
+	if reply := call(viewer, "/task/run", &TaskReqData{TaskId: "audit-task"}); reply.Msg != ERR_PERMISSION.Error() {
+		t.Fatalf("viewer run: %+v", reply)
+	}
+	mustCall(admin, "/task/run", &TaskReqData{TaskId: "audit-task"})
+	for i := 0; GetRunTask("audit-task") == nil; i++ {
+		if i > 100 {
+			t.Fatal("task not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mustCall(admin, "/task/scale", &TaskReqData{TaskId: "audit-task", Scale: &ScaleReqData{ConCurrent: 2}})
+	mustCall(admin, "/task/stop", &TaskReqData{TaskId: "audit-task"})
+	for i := 0; GetRunTask("audit-task") != nil; i++ {
+		if i > 500 {
+			t.Fatal("task not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	list := func(token string, filter *AuditReqData) []interface{} {
+		items, _ := mustCall(token, "/audit", filter).Data.([]interface{})
+		return items
+	}
+	all := list(admin, &AuditReqData{})
+	var actions []string
+	for _, v := range all {
+		actions = append(actions, v.(map[string]interface{})["action"].(string))
+	}
+	want := []string{AUDIT_TASK_STOP, AUDIT_TASK_SCALE, AUDIT_TASK_RUN, AUDIT_TASK_RUN, AUDIT_TASK_ADD, AUDIT_SCRIPT_EDIT, AUDIT_SCRIPT_ADD}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Fatalf("actions %v, want %v", actions, want)
+	}
+	if items := list(viewer, &AuditReqData{Action: "script."}); len(items) != 2 {
+		t.Errorf("script audits: %v", items)
+	}
+	failed := list(admin, &AuditReqData{Failed: true})
+	if len(failed) != 1 || failed[0].(map[string]interface{})["userName"] != "viewer" || failed[0].(map[string]interface{})["error"] != ERR_PERMISSION.Error() {
+		t.Errorf("failed audits: %v", failed)
+	}
+	if items := list(admin, &AuditReqData{Url: "typo.example.com"}); len(items) != 1 || items[0].(map[string]interface{})["action"] != AUDIT_SCRIPT_ADD {
+		t.Errorf("url filter: %v", items)
+	}
+	run := list(admin, &AuditReqData{Action: AUDIT_TASK_RUN, UserName: DEFAULT_ADMIN_NAME})
+	if len(run) != 1 || run[0].(map[string]interface{})["url"] != target.URL+"/api" || run[0].(map[string]interface{})["targetId"] != "audit-task" {
+		t.Errorf("run audits: %v", run)
+	}
+	if items := list(admin, &AuditReqData{StartTime: time.Now().Add(time.Hour).Format("2006-01-02 15:04:05")}); len(items) != 0 {
+		t.Errorf("time filter: %v", items)
+	}
+
+	// 修改脚本的差异
+	edit := list(admin, &AuditReqData{Action: AUDIT_SCRIPT_EDIT})[0].(map[string]interface{})
+	detail := mustCall(viewer, "/audit", &AuditReqData{ID: uint(edit["ID"].(float64))}).Data.(map[string]interface{})
+	diff, _ := detail["diff"].(string)
+	if !strings.Contains(diff, `-  "url": "http://typo.example.com/api"`) || !strings.Contains(diff, `+  "url": "`+target.URL+`/api"`) {
+		t.Errorf("script diff %q", diff)
+	}
+	if detail["ip"] == "" || detail["before"] == detail["after"] {
+		t.Errorf("audit detail: %v", detail)
+	}
+}
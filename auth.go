@@ -0,0 +1,302 @@
+package gobom
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	ROLE_VIEWER = "viewer" // 查看
+	ROLE_RUNNER = "runner" // 运行、停止、调整任务
+	ROLE_EDITOR = "editor" // 编辑脚本、任务、数据文件等
+	ROLE_ADMIN  = "admin"  // 管理项目成员，运行受保护环境的任务
+
+	PASSWORD_ITERATIONS = 100000
+	PASSWORD_MIN_LEN    = 8
+	TOKEN_BYTES         = 32
+
+	CTX_USER = "user" // gin.Context中的当前用户
+)
+
+var roleLevels = map[string]int{
+	ROLE_VIEWER: 1,
+	ROLE_RUNNER: 2,
+	ROLE_EDITOR: 3,
+	ROLE_ADMIN:  4,
+}
+
+// 不需要登录的接口
+var publicRoutes = map[string]bool{
+	"/login":     true,
+	"/frontend/": true,
+}
+
+// 压测节点调用的接口，使用节点令牌认证
+var agentRoutes = map[string]bool{
+	"/agent/register":  true,
+	"/agent/heartbeat": true,
+	"/agent/report":    true,
+}
+
+// 登录认证，令牌可以通过Token/AccessToken/Authorization请求头或token参数（websocket）传递
+func Authenticate(ctx *gin.Context) {
+	path := ctx.FullPath()
+	if publicRoutes[path] || strings.HasPrefix(path, "/frontend/") {
+		ctx.Next()
+		return
+	}
+	if agentRoutes[path] {
+		// 没有配置节点令牌时拒绝所有节点
+		if token := configs().AgentToken; token == "" || subtle.ConstantTimeCompare([]byte(requestToken(ctx)), []byte(token)) != 1 {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, &ApiReply{Msg: ERR_AGENT_TOKEN.Error()})
+			return
+		}
+		ctx.Next()
+		return
+	}
+	user, err := FindUserByToken(requestToken(ctx))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, &ApiReply{Msg: ERR_AUTH.Error()})
+		return
+	}
+	ctx.Set(CTX_USER, user)
+	ctx.Next()
+}
+
+func requestToken(ctx *gin.Context) string {
+	if token := ctx.GetHeader("Token"); token != "" {
+		return token
+	}
+	if token := ctx.GetHeader("AccessToken"); token != "" {
+		return token
+	}
+	if auth := ctx.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ctx.Query("token")
+}
+
+// 当前登录的用户
+func currentUser(ctx *gin.Context) *UserData {
+	if v, ok := ctx.Get(CTX_USER); ok {
+		if user, ok := v.(*UserData); ok {
+			return user
+		}
+	}
+	return nil
+}
+
+// 检查用户在项目中是否拥有role及以上的角色，系统管理员拥有所有权限；
+// 不属于任何项目的数据只有系统管理员可以访问
+func (user *UserData) authorize(projectId uint, role string) error {
+	if user == nil {
+		return ERR_AUTH
+	}
+	if user.Admin {
+		return nil
+	}
+	if projectId == 0 {
+		return ERR_PERMISSION
+	}
+	if roleLevels[user.role(projectId)] < roleLevels[role] {
+		return ERR_PERMISSION
+	}
+	return nil
+}
+
+// 检查用户是否可以在项目中运行压测，受保护的项目（如生产环境）需要admin角色
+func (user *UserData) authorizeRun(projectId uint) error {
+	if err := user.authorize(projectId, ROLE_RUNNER); err != nil {
+		return err
+	}
+	if user.Admin {
+		return nil
+	}
+	project := &ProjectData{}
+	project.ID = projectId
+	if _, err := project.First(); err != nil {
+		return err
+	}
+	if project.Protected {
+		return user.authorize(projectId, ROLE_ADMIN)
+	}
+	return nil
+}
+
+// 检查用户对任务所属项目的权限
+func (user *UserData) authorizeTask(taskId string, role string) error {
+	projectId, err := taskProject(taskId)
+	if err != nil {
+		return err
+	}
+	if role == ROLE_RUNNER {
+		return user.authorizeRun(projectId)
+	}
+	return user.authorize(projectId, role)
+}
+
+// 检查用户对脚本、数据文件、流水线等数据所属项目的权限
+func (user *UserData) authorizeRecord(table interface{}, id uint, role string) error {
+	var record struct{ ProjectId uint }
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(table)).Select("project_id").Where("id = ? AND deleted_at IS NULL", id).Scan(&record).Error; err != nil {
+		return err
+	}
+	if role == ROLE_RUNNER {
+		return user.authorizeRun(record.ProjectId)
+	}
+	return user.authorize(record.ProjectId, role)
+}
+
+// 定时计划会以计划创建者之外的身份运行任务，需要同时拥有编辑和运行权限
+func (user *UserData) authorizeSchedule(taskId string) error {
+	if err := user.authorizeTask(taskId, ROLE_EDITOR); err != nil {
+		return err
+	}
+	return user.authorizeTask(taskId, ROLE_RUNNER)
+}
+
+func taskProject(taskId string) (uint, error) {
+	var record struct{ ProjectId uint }
+	err := GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Select("project_id").Where("task_id = ? AND deleted_at IS NULL", taskId).Scan(&record).Error
+	return record.ProjectId, err
+}
+
+// 用户在项目中的角色，不是成员时为空
+func (user *UserData) role(projectId uint) string {
+	var member ProjectMemberData
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).
+		Where("project_id = ? AND user_id = ?", projectId, user.ID).First(&member).Error; err != nil {
+		return ""
+	}
+	return member.Role
+}
+
+// 用户可以查看的项目，系统管理员返回nil表示所有项目
+func (user *UserData) projectIds() []uint {
+	if user.Admin {
+		return nil
+	}
+	ids := make([]uint, 0)
+	GobomStore.GetDb().Table(GobomStore.GetTableName(projectMemberTable)).Where("user_id = ?", user.ID).Pluck("project_id", &ids)
+	return ids
+}
+
+// 列表查询只返回用户可以查看的项目中的数据
+func (user *UserData) projectScope() func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if user == nil {
+			return db.Where("1 = 0")
+		}
+		if user.Admin {
+			return db
+		}
+		return db.Where("project_id IN (?)", user.projectIds())
+	}
+}
+
+// 项目列表只返回用户是成员的项目
+func (user *UserData) memberScope() func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if user == nil {
+			return db.Where("1 = 0")
+		}
+		if user.Admin {
+			return db
+		}
+		return db.Where("id IN (?)", user.projectIds())
+	}
+}
+
+// 按任务id关联的数据（运行记录、定时计划）只返回用户可以查看的项目中的任务
+func (user *UserData) taskScope() func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if user == nil {
+			return db.Where("1 = 0")
+		}
+		if user.Admin {
+			return db
+		}
+		tasks := GobomStore.GetDb().Table(GobomStore.GetTableName(taskTable)).Select("task_id").Where("project_id IN (?)", user.projectIds())
+		return db.Where("task_id IN (?)", tasks.SubQuery())
+	}
+}
+
+// 密码使用PBKDF2-HMAC-SHA256加盐哈希，格式为 pbkdf2-sha256$迭代次数$盐$哈希
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, PASSWORD_ITERATIONS, sha256.Size, sha256.New)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", PASSWORD_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(hashed, password string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(key, pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New))
+}
+
+// 生成随机令牌，数据库中只保存令牌的哈希
+func newToken() (token, hashed string, err error) {
+	bt := make([]byte, TOKEN_BYTES)
+	if _, err = rand.Read(bt); err != nil {
+		return
+	}
+	token = hex.EncodeToString(bt)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 没有配置节点令牌时随机生成，只在启动时输出一次
+func InitAgentToken(config *AppConfig) error {
+	if config.AgentToken != "" {
+		return nil
+	}
+	token, _, err := newToken()
+	if err != nil {
+		return err
+	}
+	config.AgentToken = token
+	logger.Info("generated agent token: ", token)
+	return nil
+}
+
+func configs() *AppConfig {
+	if config := GetConfigs(); config != nil {
+		return config
+	}
+	return &AppConfig{}
+}
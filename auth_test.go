@@ -0,0 +1,288 @@
+package gobom
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 以JSON请求体调用接口，token为空时不携带令牌
+func apiCall(t *testing.T, server *httptest.Server, token, path string, body interface{}) (int, *ApiReply) {
+	bt, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(bt))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply := &ApiReply{}
+	json.NewDecoder(resp.Body).Decode(reply)
+	return resp.StatusCode, reply
+}
+
+func apiLogin(t *testing.T, server *httptest.Server, name, password string) string {
+	_, reply := apiCall(t, server, "", "/login", map[string]string{"name": name, "password": password})
+	if reply.Msg != "" {
+		t.Fatalf("login %s: %s", name, reply.Msg)
+	}
+	return reply.Data.(map[string]interface{})["token"].(string)
+}
+
+// 随代码发布的配置文件可以被解析
+func TestAuthConfigFile(t *testing.T) {
+	old := appConfig
+	defer func() { appConfig = old }()
+	if err := InitConfig("./config/app.toml"); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfigKeys(t, "./config/app.toml", "allowOrigins", "agentToken", "adminPassword", "tokenExpire")
+	if len(config.AllowOrigins) != 0 || config.AgentToken != "" || config.AdminPassword != "" || config.TokenExpire != 0 {
+		t.Errorf("auth: %+v", config)
+	}
+
+	// 设置的值生效，放在不存在的配置节下时报错
+	path := filepath.Join(t.TempDir(), "app.toml")
+	ioutil.WriteFile(path, []byte("allowOrigins = [\"https://gobom.test\"]\nagentToken = \"agent-token\"\nadminPassword = \"admin-password\"\ntokenExpire = 24\n"), 0644)
+	if err := InitConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if c := GetConfigs(); len(c.AllowOrigins) != 1 || c.AllowOrigins[0] != "https://gobom.test" || c.AgentToken != "agent-token" || c.AdminPassword != "admin-password" || c.TokenExpire != 24 {
+		t.Errorf("values: %+v", c)
+	}
+	appConfig = nil
+	ioutil.WriteFile(path, []byte("[base]\nagentToken = \"agent-token\"\n"), 0644)
+	if err := InitConfig(path); err == nil || !strings.HasPrefix(err.Error(), ERR_CONFIG_KEY.Error()) {
+		t.Errorf("unknown section: %v", err)
+	}
+}
+
+func TestAuthPassword(t *testing.T) {
+	// RFC 7914 PBKDF2-HMAC-SHA256 测试向量，已保存的哈希格式保持兼容
+	if !checkPassword("pbkdf2-sha256$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw", "passwd") {
+		t.Error("test vector not accepted")
+	}
+
+	hashed, err := hashPassword("secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hashed, "secret-password") {
+		t.Error("password not accepted")
+	}
+	if checkPassword(hashed, "secret-passwore") || checkPassword("", "") || checkPassword("pbkdf2-sha256$x$y$z", "") {
+		t.Error("wrong password accepted")
+	}
+	if other, _ := hashPassword("secret-password"); other == hashed {
+		t.Error("password hashed without salt")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	initTestDb(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+
+	call := func(token, path string, body interface{}) (int, *ApiReply) {
+		return apiCall(t, server, token, path, body)
+	}
+	login := func(name, password string) string {
+		return apiLogin(t, server, name, password)
+	}
+
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := call("", "/task", nil); code != http.StatusUnauthorized {
+		t.Fatalf("anonymous request status %d", code)
+	}
+	if code, _ := call("invalid", "/task", nil); code != http.StatusUnauthorized {
+		t.Fatalf("invalid token status %d", code)
+	}
+	if _, reply := call("", "/login", map[string]string{"name": DEFAULT_ADMIN_NAME, "password": "wrong"}); reply.Msg != ERR_LOGIN.Error() {
+		t.Fatalf("wrong password login: %+v", reply)
+	}
+	admin := login(DEFAULT_ADMIN_NAME, "admin-password")
+
+	// 管理员创建用户、项目和成员
+	for _, name := range []string{"viewer", "runner"} {
+		if _, reply := call(admin, "/user/add", map[string]string{"name": name, "password": name + "-password"}); reply.Msg != "" {
+			t.Fatal(reply.Msg)
+		}
+	}
+	if _, reply := call(admin, "/user/add", map[string]string{"name": "short", "password": "short"}); reply.Msg != ERR_PASSWORD.Error() {
+		t.Errorf("short password: %+v", reply)
+	}
+	projects := make(map[string]uint)
+	for _, p := range []*ProjectData{{Name: "test", Environment: "test"}, {Name: "prod", Environment: "production", Protected: true}, {Name: "other"}} {
+		_, reply := call(admin, "/project/add", p)
+		if reply.Msg != "" {
+			t.Fatal(reply.Msg)
+		}
+		projects[p.Name] = uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	}
+	var users []UserData
+	GobomStore.GetDb().Table(GobomStore.GetTableName(userTable)).Find(&users)
+	userIds := make(map[string]uint)
+	for _, user := range users {
+		userIds[user.Name] = user.ID
+	}
+	members := []*ProjectReqData{
+		{ID: projects["test"], UserId: userIds["viewer"], Role: ROLE_VIEWER},
+		{ID: projects["test"], UserId: userIds["runner"], Role: ROLE_RUNNER},
+		{ID: projects["prod"], UserId: userIds["runner"], Role: ROLE_RUNNER},
+	}
+	for _, member := range members {
+		if _, reply := call(admin, "/project/member/set", member); reply.Msg != "" {
+			t.Fatal(reply.Msg)
+		}
+	}
+	if _, reply := call(admin, "/project/member/set", &ProjectReqData{ID: projects["test"], UserId: userIds["viewer"], Role: "owner"}); reply.Msg != ERR_ROLE.Error() {
+		t.Errorf("unknown role: %+v", reply)
+	}
+	for name, projectId := range projects {
+		task, err := NewTask("auth-"+name, &Options{Url: target.URL, ConCurrent: 1, Duration: 60, Interval: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&TaskData{Name: task.TaskId, ProjectId: projectId, Task: task}).Add(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	viewer := login("viewer", "viewer-password")
+	runner := login("runner", "runner-password")
+
+	// 列表只返回成员项目中的数据
+	_, reply := call(viewer, "/task", nil)
+	if list, _ := reply.Data.([]interface{}); len(list) != 1 || list[0].(map[string]interface{})["projectId"].(float64) != float64(projects["test"]) {
+		t.Errorf("viewer task list: %+v", reply)
+	}
+	if _, reply := call(runner, "/project", nil); len(reply.Data.([]interface{})) != 2 {
+		t.Errorf("runner project list: %+v", reply)
+	}
+	if _, reply := call(admin, "/task", nil); len(reply.Data.([]interface{})) != 3 {
+		t.Errorf("admin task list: %+v", reply)
+	}
+	if _, reply := call(viewer, "/task", map[string]string{"taskId": "auth-other"}); reply.Msg != ERR_PERMISSION.Error() {
+		t.Errorf("viewer read other project: %+v", reply)
+	}
+
+	// 运行权限
+	if _, reply := call(viewer, "/task/run", map[string]string{"taskId": "auth-test"}); reply.Msg != ERR_PERMISSION.Error() {
+		t.Errorf("viewer run: %+v", reply)
+	}
+	if _, reply := call(runner, "/task/edit", map[string]interface{}{"taskId": "auth-test", "name": "auth-test", "projectId": projects["test"]}); reply.Msg != ERR_PERMISSION.Error() {
+		t.Errorf("runner edit: %+v", reply)
+	}
+	if _, reply := call(runner, "/task/run", map[string]string{"taskId": "auth-prod"}); reply.Msg != ERR_PERMISSION.Error() {
+		t.Errorf("runner run protected project: %+v", reply)
+	}
+	if _, reply := call(runner, "/task/run", map[string]string{"taskId": "auth-test"}); reply.Msg != "" {
+		t.Fatalf("runner run: %+v", reply)
+	}
+	for i := 0; GetRunTask("auth-test") == nil; i++ {
+		if i > 100 {
+			t.Fatal("task not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, reply := call(viewer, "/task/stop", map[string]string{"taskId": "auth-test"}); reply.Msg != ERR_PERMISSION.Error() {
+		t.Errorf("viewer stop: %+v", reply)
+	}
+	if _, reply := call(runner, "/task/stop", map[string]string{"taskId": "auth-test"}); reply.Msg != "" {
+		t.Errorf("runner stop: %+v", reply)
+	}
+	for i := 0; GetRunTask("auth-test") != nil; i++ {
+		if i > 500 {
+			t.Fatal("task not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 用户管理需要系统管理员，修改密码后令牌失效
+	if _, reply := call(runner, "/user", nil); reply.Msg != ERR_PERMISSION.Error() {
+		t.Errorf("runner list users: %+v", reply)
+	}
+	if _, reply := call(admin, "/user/edit", map[string]interface{}{"ID": userIds["viewer"], "password": "viewer-password2"}); reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	if code, _ := call(viewer, "/user/me", nil); code != http.StatusUnauthorized {
+		t.Errorf("token after password change status %d", code)
+	}
+	if _, reply := call(runner, "/logout", nil); reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	if code, _ := call(runner, "/user/me", nil); code != http.StatusUnauthorized {
+		t.Errorf("token after logout status %d", code)
+	}
+
+	// 压测节点接口使用节点令牌，没有配置令牌时拒绝
+	config := appConfig
+	defer func() { appConfig = config }()
+	appConfig = &AppConfig{}
+	if code, _ := call("", "/agent/register", &AgentReqData{Name: "anonymous"}); code != http.StatusUnauthorized {
+		t.Errorf("agent without configured token status %d", code)
+	}
+	if err := InitAgentToken(appConfig); err != nil || len(appConfig.AgentToken) != 2*TOKEN_BYTES {
+		t.Errorf("generated agent token %q: %v", appConfig.AgentToken, err)
+	}
+	appConfig = &AppConfig{AgentToken: "agent-token"}
+	if code, _ := call("", "/agent/heartbeat", &AgentReqData{AgentId: "unknown"}); code != http.StatusUnauthorized {
+		t.Errorf("agent without token status %d", code)
+	}
+	if code, reply := call("agent-token", "/agent/heartbeat", &AgentReqData{AgentId: "unknown"}); code != http.StatusOK || reply.Msg != ERR_AGENT_NOT_FOUND.Error() {
+		t.Errorf("agent with token: %d %+v", code, reply)
+	}
+}
+
+// 修改密码后其他令牌失效，当前令牌继续有效
+func TestAuthChangePassword(t *testing.T) {
+	initTestDb(t)
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := apiLogin(t, server, DEFAULT_ADMIN_NAME, "admin-password")
+	if _, reply := apiCall(t, server, admin, "/user/add", map[string]string{"name": "runner", "password": "runner-password"}); reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	current := apiLogin(t, server, "runner", "runner-password")
+	other := apiLogin(t, server, "runner", "runner-password")
+
+	if _, reply := apiCall(t, server, current, "/user/password", map[string]string{"oldPassword": "wrong-password", "password": "runner-password-2"}); reply.Msg != ERR_LOGIN.Error() {
+		t.Errorf("wrong old password: %+v", reply)
+	}
+	if code, _ := apiCall(t, server, other, "/user/me", nil); code != http.StatusOK {
+		t.Errorf("token revoked by failed change: %d", code)
+	}
+	if _, reply := apiCall(t, server, current, "/user/password", map[string]string{"oldPassword": "runner-password", "password": "runner-password-2"}); reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	if code, _ := apiCall(t, server, other, "/user/me", nil); code != http.StatusUnauthorized {
+		t.Errorf("other token status %d", code)
+	}
+	if code, reply := apiCall(t, server, current, "/user/me", nil); code != http.StatusOK || reply.Msg != "" {
+		t.Errorf("current token: %d %+v", code, reply)
+	}
+	if code, _ := apiCall(t, server, admin, "/user/me", nil); code != http.StatusOK {
+		t.Errorf("admin token status %d", code)
+	}
+	apiLogin(t, server, "runner", "runner-password-2")
+}
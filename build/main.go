@@ -1,11 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"gobom"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		agent()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "har" {
+		har()
+		return
+	}
 	if err := gobom.InitConfig("./config/app.toml"); err != nil {
 		log.Fatal(err)
 	}
@@ -13,9 +29,123 @@ func main() {
 		log.Fatal(err)
 	}
 	gobom.GobomStore.AutoMigrate(map[string]gobom.TableAutoMigrateConfig{
-		"script": {Model: &gobom.ScriptData{}},
-		"task":   {Model: &gobom.TaskData{}},
+		"script":         {Model: &gobom.ScriptData{}},
+		"task":           {Model: &gobom.TaskData{}},
+		"datafile":       {Model: &gobom.DataFile{}},
+		"schedule":       {Model: &gobom.ScheduleData{}},
+		"task_run":       {Model: &gobom.TaskRunData{}},
+		"pipeline":       {Model: &gobom.PipelineData{}},
+		"webhook":        {Model: &gobom.WebhookData{}},
+		"webhook_log":    {Model: &gobom.WebhookLogData{}},
+		"user":           {Model: &gobom.UserData{}},
+		"user_token":     {Model: &gobom.UserTokenData{}},
+		"project":        {Model: &gobom.ProjectData{}},
+		"project_member": {Model: &gobom.ProjectMemberData{}},
+		"audit":          {Model: &gobom.AuditData{}},
+		"target_rule":    {Model: &gobom.TargetRuleData{}},
+		"environment":    {Model: &gobom.EnvironmentData{}},
 	})
+	if err := gobom.InitAdmin(gobom.GetConfigs()); err != nil {
+		log.Fatal(err)
+	}
+	if err := gobom.InitAgentToken(gobom.GetConfigs()); err != nil {
+		log.Fatal(err)
+	}
+	if err := gobom.LoadInterlock(); err != nil {
+		log.Fatal(err)
+	}
+	gobom.InitResourceGuard(gobom.GetConfigs())
+	if err := gobom.StartScheduler(); err != nil {
+		log.Fatal(err)
+	}
 	api := gobom.NewApi()
 	api.Http.Run(gobom.GetConfigs().ServerPort)
 }
+
+// gobom agent -controller http://127.0.0.1:9600 -name agent1 -token xxx
+func agent() {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	controller := fs.String("controller", "http://127.0.0.1:9600", "控制节点地址")
+	token := fs.String("token", "", "控制节点配置的agentToken")
+	name, _ := os.Hostname()
+	fs.StringVar(&name, "name", name, "节点名称")
+	fs.Parse(os.Args[2:])
+
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+
+	client := gobom.NewAgentClient(*controller, name)
+	client.Token = *token
+	if err := client.Run(stop); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// gobom har -in login.har -name login -include *.example.com -out login.json
+// 输出的脚本可以通过/script/add提交
+func har() {
+	fs := flag.NewFlagSet("har", flag.ExitOnError)
+	in := fs.String("in", "", "HAR文件")
+	out := fs.String("out", "", "输出文件，为空时输出到标准输出")
+	opt := &gobom.HarImportOptions{}
+	fs.StringVar(&opt.Name, "name", "", "脚本名称，默认为HAR文件名")
+	projectId := fs.Uint("project", 0, "项目id")
+	staticTypes := fs.String("static", "", "过滤的响应类型，逗号分隔，为空时使用默认的静态资源类型")
+	include := fs.String("include", "", "只导入这些域名的请求，逗号分隔")
+	exclude := fs.String("exclude", "", "不导入的域名，逗号分隔")
+	fs.BoolVar(&opt.KeepStatic, "keepStatic", false, "不过滤静态资源")
+	fs.BoolVar(&opt.NoThinkTime, "noThinkTime", false, "不保留录制的请求间隔")
+	fs.Parse(os.Args[2:])
+
+	if *in == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if opt.Name == "" {
+		opt.Name = strings.TrimSuffix(filepath.Base(*in), filepath.Ext(*in))
+	}
+	opt.ProjectId = uint(*projectId)
+	opt.StaticTypes = splitList(*staticTypes)
+	opt.IncludeDomains = splitList(*include)
+	opt.ExcludeDomains = splitList(*exclude)
+
+	data, err := ioutil.ReadFile(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := gobom.ImportHar(data, opt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range result.Warnings {
+		log.Println(v)
+	}
+	for name, step := range result.Variables {
+		log.Printf("变量[%s]从[%s]的响应中提取", name, step)
+	}
+	log.Printf("导入%d个请求，过滤%d个", result.Imported, result.Skipped)
+
+	script, _ := json.MarshalIndent(result.Script, "", "  ")
+	if *out == "" {
+		os.Stdout.Write(append(script, '\n'))
+		return
+	}
+	if err = ioutil.WriteFile(*out, script, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
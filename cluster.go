@@ -0,0 +1,592 @@
+package gobom
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/gin-gonic/gin"
+
+	"gobom/utils"
+)
+
+const (
+	AGENT_CMD_RUN = iota + 1
+	AGENT_CMD_STOP
+	AGENT_CMD_SCALE
+	AGENT_CMD_PAUSE
+	AGENT_CMD_RESUME
+)
+
+const (
+	DEFAULT_AGENT_TIMEOUT     = 5 * time.Second        // 超过此时间没有心跳视为离线
+	DEFAULT_AGENT_START_DELAY = 2 * time.Second        // 下发任务后延迟启动，保证所有节点同时开始
+	DEFAULT_AGENT_HEARTBEAT   = 500 * time.Millisecond // 节点心跳间隔
+)
+
+// 控制节点，管理注册的压测节点
+type Cluster struct {
+	agents map[string]*Agent
+	runs   map[string]*clusterRun
+	mu     sync.RWMutex
+}
+
+type Agent struct {
+	Id            string  `json:"id"`
+	Name          string  `json:"name"`
+	Addr          string  `json:"addr"`
+	TaskId        string  `json:"taskId"` // 正在运行的任务
+	Online        bool    `json:"online"`
+	RegisterTime  int64   `json:"registerTime"`
+	LastHeartbeat int64   `json:"lastHeartbeat"`
+	Report        *Report `json:"report"` // 节点在最近一次任务中的统计
+
+	commands []*AgentCommand
+}
+
+type AgentCommand struct {
+	Type    int               `json:"type"`
+	TaskId  string            `json:"taskId"`
+	StartAt int64             `json:"startAt"` // 启动时间（毫秒时间戳）
+	Worker  *GobomRequest     `json:"worker"`  // 分配给节点的压测参数
+	Scale   *ScaleReqData     `json:"scale"`   // 分配给节点的调整参数
+	Files   []*WorkerFile     `json:"files"`   // 压测参数引用的数据文件和证书文件
+	Rules   []*TargetRuleData `json:"rules"`   // 压测地址的允许/禁止规则，节点连接前再检查
+	Env     *EnvironmentData  `json:"env"`     // 分配给节点的环境限制
+}
+
+// 随任务下发的文件，节点上不读取本地的数据库和文件
+type WorkerFile struct {
+	Id   uint   `json:"id"`   // 数据文件id，脚本中通过文件名引用时为0
+	Path string `json:"path"` // FILE_DATA_PATH下的文件名
+	Data []byte `json:"data"`
+}
+
+type AgentReqData struct {
+	AgentId  string    `json:"agentId"`
+	Name     string    `json:"name"`
+	TaskId   string    `json:"taskId"`
+	Finished bool      `json:"finished"` // 节点任务运行结束
+	Snapshot *Snapshot `json:"snapshot"` // 上次上报后的增量统计
+}
+
+type clusterRun struct {
+	taskId     string
+	gobom      *GobomRequest
+	agents     map[string]bool // [节点id]是否结束
+	pausedAt   int64           // 暂停时间，0为没有暂停
+	conCurrent uint64          // 所有节点的目标并发数之和，检查环境限制
+	done       chan struct{}
+	doneOnce   sync.Once
+}
+
+var gobomCluster = NewCluster()
+
+func NewCluster() *Cluster {
+	cluster := &Cluster{
+		agents: make(map[string]*Agent),
+		runs:   make(map[string]*clusterRun),
+	}
+	go cluster.check()
+	return cluster
+}
+
+func AgentHandel(ctx *gin.Context) {
+	var reqParam AgentReqData
+	var msg string
+	var err error
+	var data interface{}
+	defer func() {
+		if err != nil {
+			msg = err.Error()
+		}
+		ctx.JSON(http.StatusOK, &ApiReply{
+			Msg:  msg,
+			Data: data,
+		})
+	}()
+	if err = ctx.ShouldBind(&reqParam); err != nil {
+		if err != io.EOF {
+			return
+		}
+	}
+
+	switch ctx.FullPath() {
+	case "/agent":
+		data = gobomCluster.List()
+	case "/agent/register":
+		data = gobomCluster.Register(reqParam.Name, ctx.ClientIP())
+	case "/agent/heartbeat":
+		data, err = gobomCluster.Heartbeat(reqParam)
+	case "/agent/report":
+		err = gobomCluster.Receive(reqParam)
+	}
+}
+
+func (cluster *Cluster) Register(name, addr string) *Agent {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	agent := &Agent{
+		Id:            utils.GenerateId() + utils.GetRandomStrings(6),
+		Name:          name,
+		Addr:          addr,
+		Online:        true,
+		RegisterTime:  time.Now().Unix(),
+		LastHeartbeat: time.Now().Unix(),
+	}
+	cluster.agents[agent.Id] = agent
+	logger.Debug("agent register: ", agent.Id, name, addr)
+	// 返回副本，注册的节点在锁外会被任务分配修改
+	a := *agent
+	return &a
+}
+
+// 节点心跳，返回待执行的命令
+func (cluster *Cluster) Heartbeat(reqParam AgentReqData) ([]*AgentCommand, error) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	agent, ok := cluster.agents[reqParam.AgentId]
+	if !ok {
+		return nil, ERR_AGENT_NOT_FOUND
+	}
+	agent.Online = true
+	agent.LastHeartbeat = time.Now().Unix()
+	agent.TaskId = reqParam.TaskId
+	commands := agent.commands
+	for _, command := range commands {
+		if command.Type == AGENT_CMD_RUN {
+			agent.TaskId = command.TaskId
+		}
+	}
+	agent.commands = nil
+	return commands, nil
+}
+
+// 接收节点上报的增量统计
+func (cluster *Cluster) Receive(reqParam AgentReqData) error {
+	cluster.mu.RLock()
+	agent, ok := cluster.agents[reqParam.AgentId]
+	run := cluster.runs[reqParam.TaskId]
+	var report *Report
+	if ok {
+		report = agent.Report
+	}
+	cluster.mu.RUnlock()
+	if !ok {
+		return ERR_AGENT_NOT_FOUND
+	}
+	if run == nil {
+		return nil
+	}
+	run.gobom.Report.Merge(reqParam.Snapshot)
+	report.Merge(reqParam.Snapshot)
+	if reqParam.Finished {
+		cluster.finish(run, reqParam.AgentId)
+	}
+	return nil
+}
+
+func (cluster *Cluster) List() []*Agent {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	var list []*Agent
+	for _, agent := range cluster.agents {
+		a := *agent
+		a.commands = nil
+		if agent.Report != nil {
+			a.Report = agent.Report.Copy()
+		}
+		list = append(list, &a)
+	}
+	return list
+}
+
+// 将任务分配到所有在线节点运行，所有节点结束后返回
+func (cluster *Cluster) Dispose(taskId string, gobom *GobomRequest, callback DisposeCallFunc) error {
+	// 规则可能在保存脚本后修改，下发前再检查一次
+	if _, err := gobomInterlock.CheckUrls(gobom.Urls()); err != nil {
+		logger.Debug(err)
+		callback(err)
+		return err
+	}
+	rules := gobomInterlock.getRules()
+
+	agents := cluster.onlineAgents()
+	if len(agents) == 0 {
+		callback(ERR_AGENT_NONE)
+		return ERR_AGENT_NONE
+	}
+
+	gobom.initGlobals()
+	if err := gobom.setup(); err != nil {
+		logger.Debug(err)
+		gobom.teardown()
+		callback(err)
+		return err
+	}
+
+	files, err := gobom.workerFiles()
+	if err != nil {
+		logger.Debug(err)
+		gobom.teardown()
+		callback(err)
+		return err
+	}
+
+	gobom.Report.mu.Lock()
+	gobom.Report.init()
+	gobom.Report.mu.Unlock()
+
+	run := &clusterRun{
+		taskId:     taskId,
+		gobom:      gobom,
+		agents:     make(map[string]bool),
+		conCurrent: gobom.peakConCurrent(),
+		done:       make(chan struct{}),
+	}
+	startAt := int64(utils.Now()) + int64(DEFAULT_AGENT_START_DELAY/time.Millisecond)
+	cluster.mu.Lock()
+	// 下发前已经停止
+	if gobom.isClosed() {
+		cluster.mu.Unlock()
+		gobom.teardown()
+		callback(nil)
+		return nil
+	}
+	cluster.runs[taskId] = run
+	for i, agent := range agents {
+		run.agents[agent.Id] = false
+		agent.TaskId = taskId
+		agent.Report = &Report{}
+		agent.commands = append(agent.commands, &AgentCommand{
+			Type:    AGENT_CMD_RUN,
+			TaskId:  taskId,
+			StartAt: startAt,
+			Worker:  gobom.split(len(agents), i),
+			Files:   files,
+			Rules:   rules,
+			Env:     gobom.env.share(len(agents), i),
+		})
+	}
+	cluster.mu.Unlock()
+	logger.Debug("cluster dispose start, agents: ", len(agents))
+
+	<-run.done
+
+	cluster.mu.Lock()
+	delete(cluster.runs, taskId)
+	cluster.mu.Unlock()
+	gobom.teardown()
+	logger.Debug("cluster dispose out...")
+
+	callback(nil)
+	return nil
+}
+
+func (cluster *Cluster) Stop(taskId string) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	run, ok := cluster.runs[taskId]
+	if !ok {
+		return
+	}
+	cluster.send(run, AGENT_CMD_STOP)
+}
+
+// 按节点数量拆分调整参数并下发，调整记录在控制节点的报告中
+func (cluster *Cluster) Scale(taskId string, req *ScaleReqData) error {
+	if req == nil {
+		return ERR_PARAM
+	}
+	cluster.mu.Lock()
+	run, ok := cluster.runs[taskId]
+	if !ok {
+		cluster.mu.Unlock()
+		return ERR_TASK_NOT_RUN
+	}
+	if err := run.check(req); err != nil {
+		cluster.mu.Unlock()
+		return err
+	}
+	var agentIds []string
+	for agentId, finished := range run.agents {
+		if !finished {
+			agentIds = append(agentIds, agentId)
+		}
+	}
+	sort.Strings(agentIds)
+	n := len(agentIds)
+	for i, agentId := range agentIds {
+		agent, ok := cluster.agents[agentId]
+		if !ok {
+			continue
+		}
+		scale := *req
+		scale.ConCurrent = shareSigned(req.ConCurrent, n, i)
+		if req.Rate != nil {
+			rate := shareLimit(*req.Rate, n, i)
+			scale.Rate = &rate
+		}
+		agent.commands = append(agent.commands, &AgentCommand{
+			Type:   AGENT_CMD_SCALE,
+			TaskId: taskId,
+			Scale:  &scale,
+		})
+	}
+	run.conCurrent = uint64(int64(run.conCurrent) + req.ConCurrent)
+	cluster.mu.Unlock()
+
+	gobom := run.gobom
+	now := time.Now().Unix()
+	if req.ConCurrent != 0 {
+		from := gobom.getConCurrent()
+		gobom.setConCurrent(uint64(int64(from) + req.ConCurrent))
+		gobom.Report.addEvent(&RunEvent{Time: now, Type: EVENT_CONCURRENT, Scenario: req.Scenario, From: from, To: gobom.getConCurrent(), Reason: req.Reason})
+	}
+	if req.Rate != nil {
+		gobom.Report.addEvent(&RunEvent{Time: now, Type: EVENT_RATE, Scenario: req.Scenario, To: *req.Rate, Reason: req.Reason})
+	}
+	if req.Duration != 0 {
+		from := gobom.getDuration()
+		gobom.setDuration(uint64(int64(from) + req.Duration))
+		gobom.Report.addEvent(&RunEvent{Time: now, Type: EVENT_DURATION, Scenario: req.Scenario, From: from, To: gobom.getDuration(), Reason: req.Reason})
+	}
+	return nil
+}
+
+// 下发前检查调整参数和环境限制，节点只检查分配到的部分，调用时需要持有锁
+func (run *clusterRun) check(req *ScaleReqData) error {
+	gobom := run.gobom
+	if req.ConCurrent < 0 && uint64(-req.ConCurrent) >= gobom.getConCurrent() {
+		return ERR_SCALE_CONCURRENT
+	}
+	if req.ConCurrent > 0 {
+		if max := gobom.env.maxConCurrent(); max != 0 && run.conCurrent+uint64(req.ConCurrent) > max {
+			return ERR_ENV_CONCURRENT
+		}
+	}
+	if req.Rate != nil && req.Scenario == "" {
+		if max := gobom.env.maxRate(); max != 0 && (*req.Rate == 0 || *req.Rate > max) {
+			return ERR_ENV_RATE
+		}
+	}
+	if req.Duration < 0 && uint64(-req.Duration) >= gobom.getDuration() {
+		return ERR_SCALE_DURATION
+	}
+	return nil
+}
+
+// 暂停所有节点上的任务，暂停记录在控制节点的报告中
+func (cluster *Cluster) Pause(taskId, reason string) error {
+	cluster.mu.Lock()
+	run, ok := cluster.runs[taskId]
+	if !ok {
+		cluster.mu.Unlock()
+		return ERR_TASK_NOT_RUN
+	}
+	if run.pausedAt != 0 {
+		cluster.mu.Unlock()
+		return ERR_TASK_PAUSED
+	}
+	run.pausedAt = time.Now().Unix()
+	cluster.send(run, AGENT_CMD_PAUSE)
+	cluster.mu.Unlock()
+	run.gobom.Report.addEvent(&RunEvent{Time: run.pausedAt, Type: EVENT_PAUSE, Reason: reason})
+	return nil
+}
+
+func (cluster *Cluster) Resume(taskId, reason string) error {
+	cluster.mu.Lock()
+	run, ok := cluster.runs[taskId]
+	if !ok {
+		cluster.mu.Unlock()
+		return ERR_TASK_NOT_RUN
+	}
+	if run.pausedAt == 0 {
+		cluster.mu.Unlock()
+		return ERR_TASK_NOT_PAUSED
+	}
+	pausedAt := run.pausedAt
+	run.pausedAt = 0
+	cluster.send(run, AGENT_CMD_RESUME)
+	cluster.mu.Unlock()
+	now := time.Now().Unix()
+	run.gobom.Report.addEvent(&RunEvent{Time: now, Type: EVENT_RESUME, From: uint64(pausedAt), To: uint64(now), Reason: reason})
+	return nil
+}
+
+// 向运行任务的节点下发命令，调用时需要持有锁
+func (cluster *Cluster) send(run *clusterRun, typ int) {
+	for agentId := range run.agents {
+		if agent, ok := cluster.agents[agentId]; ok {
+			agent.commands = append(agent.commands, &AgentCommand{
+				Type:   typ,
+				TaskId: run.taskId,
+			})
+		}
+	}
+}
+
+func (cluster *Cluster) onlineAgents() []*Agent {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	var list []*Agent
+	for _, agent := range cluster.agents {
+		if agent.Online && agent.TaskId == "" {
+			list = append(list, agent)
+		}
+	}
+	return list
+}
+
+func (cluster *Cluster) finish(run *clusterRun, agentId string) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	run.agents[agentId] = true
+	for _, finished := range run.agents {
+		if !finished {
+			return
+		}
+	}
+	run.doneOnce.Do(func() {
+		close(run.done)
+	})
+}
+
+// 检查节点健康状态，离线节点上的任务视为结束
+func (cluster *Cluster) check() {
+	for {
+		time.Sleep(time.Second)
+		finished := make(map[*clusterRun][]string)
+		cluster.mu.Lock()
+		for _, agent := range cluster.agents {
+			if agent.Online && time.Since(time.Unix(agent.LastHeartbeat, 0)) > DEFAULT_AGENT_TIMEOUT {
+				agent.Online = false
+				agent.TaskId = ""
+				logger.Debug("agent offline: ", agent.Id, agent.Name)
+				for _, run := range cluster.runs {
+					if _, ok := run.agents[agent.Id]; ok {
+						finished[run] = append(finished[run], agent.Id)
+					}
+				}
+			}
+		}
+		cluster.mu.Unlock()
+		for run, agentIds := range finished {
+			for _, agentId := range agentIds {
+				cluster.finish(run, agentId)
+			}
+		}
+	}
+}
+
+// 按节点数量拆分并发数和到达率，返回第i个节点的压测参数
+func (gobom *GobomRequest) split(n, i int) *GobomRequest {
+	opt := *gobom.Options
+	opt.ConCurrent = share(gobom.getConCurrent(), n, i)
+	worker := &GobomRequest{
+		Options:    &opt,
+		Duration:   new(uint64),
+		ConCurrent: new(uint64),
+		Globals:    gobom.globals,
+	}
+	*worker.Duration = gobom.getDuration()
+	*worker.ConCurrent = opt.ConCurrent
+	for _, v := range gobom.Scenarios {
+		scenario := Scenario{
+			Name:        v.Name,
+			ScriptId:    v.ScriptId,
+			Weight:      v.Weight,
+			ConCurrent:  share(v.ConCurrent, n, i),
+			Rate:        share(v.Rate, n, i),
+			StartOffset: v.StartOffset,
+			Options:     v.Options,
+		}
+		for _, stage := range v.Stages {
+			scenario.Stages = append(scenario.Stages, Stage{
+				Duration: stage.Duration,
+				Target:   share(stage.Target, n, i),
+			})
+		}
+		worker.Scenarios = append(worker.Scenarios, &scenario)
+	}
+	return worker
+}
+
+// 读取节点运行需要的文件（主脚本和场景脚本引用的数据文件、证书文件），setup和teardown在控制节点运行
+func (gobom *GobomRequest) workerFiles() ([]*WorkerFile, error) {
+	optList := []*Options{gobom.Options}
+	for _, v := range gobom.Scenarios {
+		optList = append(optList, v.Options)
+	}
+	var files []*WorkerFile
+	added := make(map[string]bool)
+	add := func(id uint, path string) error {
+		key := fmt.Sprint(id, FILE_PARSE_SEP, path)
+		if added[key] {
+			return nil
+		}
+		data, err := readStoredFile(path)
+		if err != nil {
+			return err
+		}
+		added[key] = true
+		files = append(files, &WorkerFile{Id: id, Path: path, Data: data})
+		return nil
+	}
+	for _, opt := range optList {
+		if opt == nil {
+			continue
+		}
+		ids := opt.TlsOptions.fileIds()
+		for _, v := range opt.FileDataFields() {
+			if v.FileId != 0 {
+				ids = append(ids, v.FileId)
+				continue
+			}
+			fileName, _ := v.fileField()
+			if err := add(0, fileName); err != nil {
+				return nil, err
+			}
+		}
+		for _, id := range ids {
+			path, err := dataFilePath(id)
+			if err != nil {
+				return nil, err
+			}
+			if err := add(id, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// total平均分配到n份，余数分配给前面的节点
+func share(total uint64, n, i int) uint64 {
+	count := total / uint64(n)
+	if uint64(i) < total%uint64(n) {
+		count++
+	}
+	return count
+}
+
+// 限制值的平均分配，不为0的限制分配后至少为1，避免变为不限制
+func shareLimit(total uint64, n, i int) uint64 {
+	if count := share(total, n, i); count != 0 || total == 0 {
+		return count
+	}
+	return 1
+}
+
+// 有符号数量的平均分配
+func shareSigned(total int64, n, i int) int64 {
+	if total < 0 {
+		return -int64(share(uint64(-total), n, i))
+	}
+	return int64(share(uint64(total), n, i))
+}
@@ -0,0 +1,215 @@
+package gobom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gobom/utils"
+)
+
+func TestCluster(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	gin.SetMode(gin.TestMode)
+	controller := httptest.NewServer(NewApi().Http)
+	defer controller.Close()
+
+	config := appConfig
+	appConfig = &AppConfig{AgentToken: "agent-token"}
+	defer func() { appConfig = config }()
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, name := range []string{"agent1", "agent2"} {
+		client := NewAgentClient(controller.URL, name)
+		client.Token = "agent-token"
+		go client.Run(stop)
+	}
+	for i := 0; len(gobomCluster.onlineAgents()) < 2; i++ {
+		if i > 50 {
+			t.Fatal("agents not registered")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	task, err := NewTask("cluster-test", &Options{
+		Url:        target.URL,
+		ConCurrent: 3,
+		Duration:   2,
+		Interval:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Distributed = true
+	if err := task.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := task.Info().Copy()
+	if report.SuccessNum == 0 || report.FailureNum != 0 {
+		t.Fatalf("report success %d, failure %d", report.SuccessNum, report.FailureNum)
+	}
+	var total uint64
+	for _, agent := range gobomCluster.List() {
+		if agent.Report == nil || agent.Report.SuccessNum == 0 {
+			t.Errorf("agent %s has no stats", agent.Name)
+			continue
+		}
+		total += agent.Report.SuccessNum
+	}
+	if total != report.SuccessNum {
+		t.Errorf("agent totals %d != report %d", total, report.SuccessNum)
+	}
+	if task.GetStatus() != STATUS_OVER {
+		t.Errorf("task status %d", task.GetStatus())
+	}
+
+	// 控制节点下发前检查规则，节点使用下发的规则
+	rules := []*TargetRuleData{{Action: RULE_DENY, Cidr: "127.0.0.0/8"}}
+	gobomInterlock.useRules(rules)
+	defer gobomInterlock.setRules(nil)
+	denied, err := NewTask("cluster-denied", &Options{Url: target.URL, ConCurrent: 2, Duration: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied.Distributed = true
+	if err := denied.Run(); err == nil || !strings.HasPrefix(err.Error(), ERR_TARGET_DENIED.Error()) {
+		t.Errorf("denied run: %v", err)
+	}
+	var command AgentCommand
+	bt, _ := json.Marshal(&AgentCommand{Rules: rules})
+	json.Unmarshal(bt, &command)
+	gobomInterlock.setRules(nil)
+	gobomInterlock.useRules(command.Rules)
+	if _, err := NewRequester(&Options{Url: target.URL, Form: FORM_HTTP}); err == nil || !strings.HasPrefix(err.Error(), ERR_TARGET_DENIED.Error()) {
+		t.Errorf("agent rules: %v", err)
+	}
+
+	// 注册返回副本，不与任务分配共享
+	agent := gobomCluster.Register("agent3", "127.0.0.1")
+	agent.TaskId = "copy"
+	for _, a := range gobomCluster.List() {
+		if a.Id == agent.Id && a.TaskId != "" {
+			t.Errorf("register returned shared agent")
+		}
+	}
+	gobomCluster.mu.Lock()
+	delete(gobomCluster.agents, agent.Id)
+	gobomCluster.mu.Unlock()
+}
+
+func TestClusterFiles(t *testing.T) {
+	initTestDb(t)
+	if err := os.MkdirAll(FILE_DATA_PATH, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	users := &DataFile{Name: "users.csv", Path: utils.GenerateId() + "-users.csv"}
+	if err := ioutil.WriteFile(users.filePath(), []byte("name\nalice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(users.filePath())
+	if err := users.Add(); err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCert(t, "gobom ca", nil, 0)
+	caId := addTestCertFile(t, "ca.pem", ca.certPem)
+
+	gobom := &GobomRequest{Options: &Options{
+		SendData:   &SendData{DataFieldList: []*DataField{{Name: "user", Type: TYPE_FILE, Dynamic: "name", FileId: users.ID}}},
+		TlsOptions: TlsOptions{CaFileId: caId},
+	}}
+	files, err := gobom.workerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("files: %d", len(files))
+	}
+
+	// 节点上没有控制节点的数据库和文件，使用下发的内容
+	initTestDb(t)
+	os.Remove(users.filePath())
+	worker := &GobomRequest{}
+	bt, _ := json.Marshal(gobom)
+	json.Unmarshal(bt, worker)
+	if err := worker.Options.SendData.init(); err != ERR_DATAFILE_NOT_FOUND {
+		t.Errorf("without files: %v", err)
+	}
+	worker.Options.SendData.SourceFileMap = nil
+	agentFiles.add(files)
+	if err := worker.Options.SendData.init(); err != nil {
+		t.Fatal(err)
+	}
+	if v := worker.Options.SendData.getFileValue(worker.Options.SendData.DataFieldList[0]); v != "alice" {
+		t.Errorf("value: %v", v)
+	}
+	if _, err := worker.Options.TlsOptions.config(); err != nil {
+		t.Error(err)
+	}
+	agentFiles.remove(files)
+	if _, err := readCertFile(caId); err == nil {
+		t.Error("removed files still used")
+	}
+}
+
+func TestClusterEnv(t *testing.T) {
+	conCurrent, duration := uint64(2), uint64(10)
+	gobom := &GobomRequest{Options: &Options{}, ConCurrent: &conCurrent, Duration: &duration, Report: &Report{}}
+	gobom.env = &EnvironmentData{Name: "staging", MaxConCurrent: 4, MaxRate: 10}
+	cluster := &Cluster{
+		agents: map[string]*Agent{"a": {Id: "a"}, "b": {Id: "b"}},
+		runs:   make(map[string]*clusterRun),
+	}
+	cluster.runs["env"] = &clusterRun{taskId: "env", gobom: gobom, agents: map[string]bool{"a": false, "b": false}, conCurrent: gobom.peakConCurrent()}
+
+	// 下发前检查环境限制，失败时不下发
+	zero, over, rate := uint64(0), uint64(11), uint64(3)
+	for _, c := range []struct {
+		req *ScaleReqData
+		err error
+	}{
+		{&ScaleReqData{ConCurrent: 3}, ERR_ENV_CONCURRENT},
+		{&ScaleReqData{Rate: &zero}, ERR_ENV_RATE},
+		{&ScaleReqData{Rate: &over}, ERR_ENV_RATE},
+	} {
+		if err := cluster.Scale("env", c.req); err != c.err {
+			t.Errorf("%+v: %v, want %v", c.req, err, c.err)
+		}
+	}
+	if len(cluster.agents["a"].commands) != 0 {
+		t.Fatalf("commands sent: %d", len(cluster.agents["a"].commands))
+	}
+	if err := cluster.Scale("env", &ScaleReqData{ConCurrent: 2, Rate: &rate}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := cluster.agents["a"].commands[0].Scale, cluster.agents["b"].commands[0].Scale
+	if a.ConCurrent != 1 || b.ConCurrent != 1 || *a.Rate != 2 || *b.Rate != 1 {
+		t.Errorf("split: %+v %+v", a, b)
+	}
+	if err := cluster.Scale("env", &ScaleReqData{ConCurrent: 1}); err != ERR_ENV_CONCURRENT {
+		t.Errorf("after scale: %v", err)
+	}
+
+	// 节点按拆分后的到达率限制运行，不为0的限制拆分后不会变为不限制
+	if env := gobom.env.share(2, 1); env.MaxRate != 5 || env.MaxConCurrent != 0 {
+		t.Errorf("share: %+v", env)
+	}
+	if env := (&EnvironmentData{MaxRate: 1}).share(2, 1); env.MaxRate != 1 {
+		t.Errorf("share limit: %+v", env)
+	}
+	var command AgentCommand
+	bt, _ := json.Marshal(&AgentCommand{Env: gobom.env.share(2, 0)})
+	json.Unmarshal(bt, &command)
+	if command.Env == nil || command.Env.maxRate() != 5 {
+		t.Errorf("command env: %+v", command.Env)
+	}
+}
@@ -1,20 +1,36 @@
 package gobom
 
 import (
+	"fmt"
+
 	"github.com/BurntSushi/toml"
 )
 
 type AppConfig struct {
 	MysqlSource string `json:"mysqlSource"`
 	ServerPort string `json:"serverPort"`
+
+	MaxConCurrent uint64 `json:"maxConCurrent"` // 服务器同时运行的总并发数，0为不限制
+	MaxTasks      int    `json:"maxTasks"`      // 服务器同时运行的任务数，0为不限制
+	MaxRate       uint64 `json:"maxRate"`       // 服务器每秒迭代次数上限，0为不限制
+
+	AllowOrigins  []string `json:"allowOrigins"`  // 允许跨域访问的来源，*为所有来源
+	AgentToken    string   `json:"agentToken"`    // 压测节点注册、心跳、上报使用的令牌，为空时启动时随机生成
+	AdminPassword string   `json:"adminPassword"` // 首次启动时创建的admin用户密码，为空时随机生成
+	TokenExpire   int      `json:"tokenExpire"`   // 登录令牌有效期（小时），0为默认7天
 }
 
 var appConfig *AppConfig
 
 func InitConfig(path string) error {
-	if _, err := toml.DecodeFile(path, &appConfig); err != nil {
+	meta, err := toml.DecodeFile(path, &appConfig)
+	if err != nil {
 		return err
 	}
+	// 不存在的配置项会被忽略，令牌和密码等设置不能静默失效
+	if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+		return fmt.Errorf("%s%v", ERR_CONFIG_KEY, undecoded)
+	}
 	return nil
 }
 
@@ -0,0 +1,226 @@
+package gobom
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CONN_REUSE         = ""          // 复用连接
+	CONN_PER_REQUEST   = "request"   // 每个请求新建连接
+	CONN_PER_ITERATION = "iteration" // 每次迭代（事务）新建连接
+)
+
+// 连接设置，HTTP/1.1和TCP使用，每个虚拟用户独立的连接，连接数按任务限制
+type ConnOptions struct {
+	DisableKeepAlive bool   `json:"disableKeepAlive" form:"disableKeepAlive"` // 关闭keep-alive：HTTP每个请求后关闭连接，TCP关闭SO_KEEPALIVE
+	NewConn          string `json:"newConn" form:"newConn"`                   // 空为复用连接|request|iteration
+	MaxConns         uint64 `json:"maxConns" form:"maxConns"`                 // 任务（场景）同时打开的最大连接数，0为不限制
+}
+
+// 同一个脚本的虚拟用户共用的连接数限制、DNS缓存，以及代理和本地IP的分配
+type connShared struct {
+	sem      chan struct{} // 不限制连接数时为nil
+	resolver *dnsResolver
+	vus      int // 已分配的虚拟用户数
+	refs     int
+}
+
+var connShareds = struct {
+	shareds map[*Options]*connShared
+	mu      sync.Mutex
+}{shareds: make(map[*Options]*connShared)}
+
+// 虚拟用户打开的连接及统计，统计上报后清零
+type vuConns struct {
+	opt         *Options
+	shared      *connShared
+	proxies     []*url.URL
+	proxy       int // 当前使用的代理
+	resolver    *dnsResolver
+	localIp     net.IP // 绑定的本地IP，为nil时由系统选择
+	conns       map[*managedConn]bool
+	mu          sync.Mutex
+	opened      uint64
+	reused      uint64
+	errors      uint64
+	proxyErrors uint64
+}
+
+// 关闭时释放连接数并从虚拟用户的连接中移除
+type managedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (connOptions *ConnOptions) Check() error {
+	switch connOptions.NewConn {
+	case CONN_REUSE, CONN_PER_REQUEST, CONN_PER_ITERATION:
+		return nil
+	}
+	return ERR_CONN_MODE
+}
+
+// 请求完成后是否关闭连接
+func (connOptions *ConnOptions) closeAfterRequest() bool {
+	return connOptions.DisableKeepAlive || connOptions.NewConn == CONN_PER_REQUEST
+}
+
+func newVuConns(opt *Options) (*vuConns, error) {
+	proxies, err := opt.ProxyOptions.parse()
+	if err != nil {
+		return nil, err
+	}
+	vu := &vuConns{
+		opt:     opt,
+		proxies: proxies,
+		conns:   make(map[*managedConn]bool),
+	}
+	if err = opt.DnsOptions.Check(); err != nil {
+		return nil, err
+	}
+	localIps := opt.DnsOptions.LocalIps
+	if opt.ConnOptions.MaxConns == 0 && len(proxies) < 2 && len(localIps) < 2 && opt.DnsOptions.CacheTtl == 0 {
+		vu.resolver = newDnsResolver(opt.DnsOptions)
+		if len(localIps) != 0 {
+			vu.localIp = net.ParseIP(localIps[0])
+		}
+		return vu, nil
+	}
+	connShareds.mu.Lock()
+	defer connShareds.mu.Unlock()
+	shared, ok := connShareds.shareds[opt]
+	if !ok {
+		shared = &connShared{resolver: newDnsResolver(opt.DnsOptions)}
+		if opt.ConnOptions.MaxConns != 0 {
+			shared.sem = make(chan struct{}, opt.ConnOptions.MaxConns)
+		}
+		connShareds.shareds[opt] = shared
+	}
+	shared.refs++
+	vu.shared = shared
+	vu.resolver = shared.resolver
+	if len(proxies) != 0 {
+		vu.proxy = shared.vus % len(proxies)
+	}
+	if len(localIps) != 0 {
+		vu.localIp = net.ParseIP(localIps[shared.vus%len(localIps)])
+	}
+	shared.vus++
+	return vu, nil
+}
+
+// 建立连接，达到任务的连接数上限时等待其他连接关闭
+func (vu *vuConns) dial(addr string) (net.Conn, error) {
+	var sem chan struct{}
+	if vu.shared != nil {
+		sem = vu.shared.sem
+	}
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-time.After(DEFAULT_REQUEST_TIMEOUT * time.Second):
+			atomic.AddUint64(&vu.errors, 1)
+			return nil, ERR_CONN_LIMIT
+		}
+	}
+	dialer := &net.Dialer{
+		Timeout:   DEFAULT_REQUEST_TIMEOUT * time.Second,
+		LocalAddr: localAddr("tcp", vu.localIp),
+	}
+	if vu.opt.ConnOptions.DisableKeepAlive {
+		dialer.KeepAlive = -1
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	// 使用代理时由代理解析域名，只替换映射的主机
+	if proxy := vu.nextProxy(); proxy != nil {
+		conn, err = dialProxy(dialer, proxy, vu.resolver.mapHost(addr))
+	} else if addr, err = vu.resolver.resolve(addr); err == nil {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		if sem != nil {
+			<-sem
+		}
+		if isProxyError(err) {
+			atomic.AddUint64(&vu.proxyErrors, 1)
+		} else {
+			atomic.AddUint64(&vu.errors, 1)
+		}
+		return nil, err
+	}
+	atomic.AddUint64(&vu.opened, 1)
+	managed := &managedConn{Conn: conn}
+	managed.onClose = func() {
+		if sem != nil {
+			<-sem
+		}
+		vu.mu.Lock()
+		delete(vu.conns, managed)
+		vu.mu.Unlock()
+	}
+	vu.mu.Lock()
+	vu.conns[managed] = true
+	vu.mu.Unlock()
+	return managed, nil
+}
+
+// 新建连接使用的代理，轮换时每次使用下一个
+func (vu *vuConns) nextProxy() *url.URL {
+	if len(vu.proxies) == 0 {
+		return nil
+	}
+	vu.mu.Lock()
+	defer vu.mu.Unlock()
+	proxy := vu.proxies[vu.proxy]
+	if vu.opt.ProxyOptions.Rotate {
+		vu.proxy = (vu.proxy + 1) % len(vu.proxies)
+	}
+	return proxy
+}
+
+// 关闭虚拟用户打开的所有连接
+func (vu *vuConns) closeAll() {
+	vu.mu.Lock()
+	list := make([]*managedConn, 0, len(vu.conns))
+	for conn := range vu.conns {
+		list = append(list, conn)
+	}
+	vu.mu.Unlock()
+	for _, conn := range list {
+		conn.Close()
+	}
+}
+
+// 虚拟用户退出时调用
+func (vu *vuConns) release() {
+	vu.closeAll()
+	if vu.shared == nil {
+		return
+	}
+	connShareds.mu.Lock()
+	defer connShareds.mu.Unlock()
+	if vu.shared.refs--; vu.shared.refs == 0 {
+		delete(connShareds.shareds, vu.opt)
+	}
+}
+
+// 取出统计写入响应
+func (vu *vuConns) fill(response *Response) {
+	response.ConnOpened = atomic.SwapUint64(&vu.opened, 0)
+	response.ConnReused = atomic.SwapUint64(&vu.reused, 0)
+	response.ConnErrors = atomic.SwapUint64(&vu.errors, 0)
+	response.ProxyErrors = atomic.SwapUint64(&vu.proxyErrors, 0)
+}
+
+func (conn *managedConn) Close() error {
+	conn.once.Do(conn.onClose)
+	return conn.Conn.Close()
+}
@@ -0,0 +1,192 @@
+package gobom
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smallnest/goframe"
+)
+
+// 统计新建连接数的TCP回显服务
+func startTestFrameServer(t *testing.T) (string, *int32) {
+	var accepted int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				frameConn := goframe.NewLengthFieldBasedFrameConn(
+					goframe.EncoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4},
+					goframe.DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4, InitialBytesToStrip: 4}, conn)
+				for {
+					data, err := frameConn.ReadFrame()
+					if err != nil {
+						return
+					}
+					frameConn.WriteFrame(data)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), &accepted
+}
+
+func TestConn(t *testing.T) {
+	var accepted int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&accepted, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	// 执行n次，返回服务端新建的连接数和累计的统计
+	run := func(opt *Options, n int) (int32, *Response) {
+		atomic.StoreInt32(&accepted, 0)
+		requester, err := NewRequester(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer requester.close()
+		total := &Response{}
+		for i := 0; i < n; i++ {
+			resp, err := requester.dispose()
+			if err != nil || !resp.IsSuccess {
+				t.Fatalf("%+v: %+v %v", opt.ConnOptions, resp, err)
+			}
+			total.ConnOpened += resp.ConnOpened
+			total.ConnReused += resp.ConnReused
+			total.ConnErrors += resp.ConnErrors
+		}
+		return atomic.LoadInt32(&accepted), total
+	}
+	newOpt := func(connOptions ConnOptions) *Options {
+		return &Options{Url: server.URL, Form: FORM_HTTP, ConnOptions: connOptions}
+	}
+
+	// HTTP：复用、每个请求新建、关闭keep-alive
+	for _, c := range []struct {
+		connOptions    ConnOptions
+		opened, reused uint64
+	}{
+		{ConnOptions{}, 1, 2},
+		{ConnOptions{NewConn: CONN_PER_REQUEST}, 3, 0},
+		{ConnOptions{DisableKeepAlive: true}, 3, 0},
+	} {
+		n, total := run(newOpt(c.connOptions), 3)
+		if uint64(n) != c.opened || total.ConnOpened != c.opened || total.ConnReused != c.reused {
+			t.Errorf("%+v: server %d, %+v", c.connOptions, n, total)
+		}
+	}
+
+	// 每次迭代新建连接，迭代内的步骤复用
+	opt := newOpt(ConnOptions{NewConn: CONN_PER_ITERATION})
+	opt.TransactionOptions.TransactionOptionsDataList = []TransactionOptionsData{
+		{Name: "a", Url: server.URL + "/a"},
+		{Name: "b", Url: server.URL + "/b"},
+	}
+	if n, total := run(opt, 2); n != 2 || total.ConnOpened != 2 || total.ConnReused != 2 {
+		t.Errorf("iteration: server %d, %+v", n, total)
+	}
+
+	// TCP：复用连接，请求地址使用步骤的地址
+	addr, tcpAccepted := startTestFrameServer(t)
+	for _, c := range []struct {
+		newConn        string
+		opened, reused uint64
+	}{
+		{CONN_REUSE, 1, 2},
+		{CONN_PER_REQUEST, 3, 0},
+	} {
+		atomic.StoreInt32(tcpAccepted, 0)
+		tcpOpt := &Options{Url: addr, Form: FORM_TCP, ConnOptions: ConnOptions{NewConn: c.newConn}}
+		tcpOpt.TransactionOptions.TransactionOptionsDataList = []TransactionOptionsData{{Name: "echo", Url: addr, SendData: &SendData{}}}
+		_, total := run(tcpOpt, 3)
+		if n := atomic.LoadInt32(tcpAccepted); uint64(n) != c.opened || total.ConnOpened != c.opened || total.ConnReused != c.reused {
+			t.Errorf("tcp %q: server %d, %+v", c.newConn, n, total)
+		}
+	}
+
+	// 连接失败计入连接错误
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+	requester, err := NewRequester(&Options{Url: closed, Form: FORM_TCP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = requester.dispose(); err == nil {
+		t.Error("dial closed port")
+	}
+	requester.close()
+	requester, _ = NewRequester(&Options{Url: "http://" + closed, Form: FORM_HTTP})
+	if resp, err := requester.dispose(); err == nil || resp.ConnErrors != 1 || resp.ConnOpened != 0 {
+		t.Errorf("http dial: %+v %v", resp, err)
+	}
+	requester.close()
+
+	// 同一个任务的虚拟用户共用连接数上限，连接关闭后等待的虚拟用户才能建立连接
+	opt = newOpt(ConnOptions{MaxConns: 1})
+	vu1, _ := newVuConns(opt)
+	vu2, _ := newVuConns(opt)
+	if vu1.shared == nil || vu1.shared != vu2.shared {
+		t.Fatal("not shared")
+	}
+	conn, err := vu1.dial(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := vu2.dial(server.Listener.Addr().String())
+		dialed <- err
+	}()
+	select {
+	case err := <-dialed:
+		t.Fatalf("dial over limit: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Close()
+	conn.Close()
+	if err := <-dialed; err != nil {
+		t.Error(err)
+	}
+	vu1.release()
+	vu2.release()
+	if len(vu1.conns) != 0 || len(vu2.conns) != 0 || len(connShareds.shareds) != 0 {
+		t.Errorf("not released: %d %d %d", len(vu1.conns), len(vu2.conns), len(connShareds.shareds))
+	}
+
+	if _, err = NewRequester(newOpt(ConnOptions{NewConn: "always"})); err != ERR_CONN_MODE {
+		t.Errorf("mode: %v", err)
+	}
+
+	// 报告统计
+	report := &Report{}
+	report.Push(&Response{IsSuccess: true, ConnOpened: 1})
+	report.Push(&Response{IsSuccess: true, ConnReused: 1})
+	report.Push(&Response{IsSuccess: false, ConnErrors: 1})
+	merged := &Report{}
+	merged.Merge(report.Snapshot())
+	for _, r := range []*Report{report, merged, merged.Copy()} {
+		if r.ConnOpened != 1 || r.ConnReused != 1 || r.ConnErrors != 1 {
+			t.Errorf("report: %d %d %d", r.ConnOpened, r.ConnReused, r.ConnErrors)
+		}
+	}
+}
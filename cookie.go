@@ -0,0 +1,66 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// 每个虚拟用户独立的cookie容器，按照domain/path/expires规则保存响应中的cookie
+type CookieJar struct {
+	jar *cookiejar.Jar
+	mu  sync.Mutex
+}
+
+func NewCookieJar() *CookieJar {
+	jar, _ := cookiejar.New(nil)
+	return &CookieJar{
+		jar: jar,
+	}
+}
+
+// 清空cookie（模拟新用户）
+func (cookieJar *CookieJar) Clear() {
+	cookieJar.mu.Lock()
+	defer cookieJar.mu.Unlock()
+	cookieJar.jar, _ = cookiejar.New(nil)
+}
+
+// 保存响应中的Set-Cookie
+func (cookieJar *CookieJar) Save(uri string, resp *fasthttp.Response) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	header := http.Header{}
+	resp.Header.VisitAllCookie(func(key, value []byte) {
+		header.Add("Set-Cookie", string(value))
+	})
+	if len(header) == 0 {
+		return
+	}
+	cookies := (&http.Response{Header: header}).Cookies()
+	cookieJar.mu.Lock()
+	defer cookieJar.mu.Unlock()
+	cookieJar.jar.SetCookies(u, cookies)
+}
+
+// 将匹配请求地址的cookie写入请求
+func (cookieJar *CookieJar) Fill(uri string, req *fasthttp.Request) {
+	for _, cookie := range cookieJar.Cookies(uri) {
+		req.Header.SetCookie(cookie.Name, cookie.Value)
+	}
+}
+
+func (cookieJar *CookieJar) Cookies(uri string) []*http.Cookie {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	cookieJar.mu.Lock()
+	defer cookieJar.mu.Unlock()
+	return cookieJar.jar.Cookies(u)
+}
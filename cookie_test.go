@@ -0,0 +1,63 @@
+package gobom
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar := NewCookieJar()
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	raw := "HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: session=abc; Path=/\r\n" +
+		"Set-Cookie: admin=1; Path=/admin\r\n" +
+		"Set-Cookie: shared=1; Domain=example.com; Path=/\r\n" +
+		"Set-Cookie: expired=1; Path=/; Expires=Thu, 01 Jan 1970 00:00:00 GMT\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if err := resp.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		t.Fatal(err)
+	}
+	jar.Save("http://api.example.com/login", resp)
+
+	cases := []struct {
+		uri   string
+		names []string
+	}{
+		{"http://api.example.com/user", []string{"session", "shared"}},
+		{"http://api.example.com/admin/list", []string{"admin", "session", "shared"}},
+		{"http://www.example.com/", []string{"shared"}},
+		{"http://other.com/", nil},
+	}
+	for _, c := range cases {
+		got := make(map[string]bool)
+		for _, cookie := range jar.Cookies(c.uri) {
+			got[cookie.Name] = true
+		}
+		if len(got) != len(c.names) {
+			t.Errorf("%s: got %v, want %v", c.uri, got, c.names)
+			continue
+		}
+		for _, name := range c.names {
+			if !got[name] {
+				t.Errorf("%s: missing cookie %s", c.uri, name)
+			}
+		}
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	jar.Fill("http://api.example.com/user", req)
+	if string(req.Header.Cookie("session")) != "abc" {
+		t.Errorf("session cookie not filled: %s", req.Header.Cookie("session"))
+	}
+
+	jar.Clear()
+	if len(jar.Cookies("http://api.example.com/user")) != 0 {
+		t.Error("cookie jar not cleared")
+	}
+}
@@ -0,0 +1,136 @@
+package gobom
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron表达式：分 时 日 月 周，支持 * , - / 以及@hourly等简写
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	if v, ok := cronMacros[expr]; ok {
+		expr = v
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, ERR_CRON
+	}
+	cron := &Cron{}
+	var err error
+	if cron.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cron.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cron.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cron.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cron.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if cron.dow&(1<<7) != 0 { // 7和0都表示周日
+		cron.dow |= 1
+	}
+	cron.domStar = fields[2] == "*" || fields[2] == "?"
+	cron.dowStar = fields[4] == "*" || fields[4] == "?"
+	return cron, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, ERR_CRON
+			}
+			step = n
+			part = part[:i]
+		}
+		start, end := min, max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			start, err1 = strconv.Atoi(bounds[0])
+			end, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, ERR_CRON
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, ERR_CRON
+			}
+			start = n
+			if step == 1 {
+				end = n
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, ERR_CRON
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// 返回t之后（不包含t）的下一次触发时间，使用t的时区；没有匹配的时间时返回零值
+func (cron *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		if cron.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// 日和周都有限制时满足其一即可
+func (cron *Cron) matchDay(t time.Time) bool {
+	dom := cron.dom&(1<<uint(t.Day())) != 0
+	dow := cron.dow&(1<<uint(t.Weekday())) != 0
+	if cron.domStar || cron.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
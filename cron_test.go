@@ -0,0 +1,45 @@
+package gobom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	from := time.Date(2020, 2, 28, 23, 59, 30, 0, shanghai) // 周五
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 2, 29, 0, 0, 0, 0, shanghai)},
+		{"30 2 * * *", time.Date(2020, 2, 29, 2, 30, 0, 0, shanghai)},
+		{"*/15 9-17 * * 1-5", time.Date(2020, 3, 2, 9, 0, 0, 0, shanghai)},
+		{"0 0 31 * *", time.Date(2020, 3, 31, 0, 0, 0, 0, shanghai)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, shanghai)},
+		{"0 3 1 * 0", time.Date(2020, 3, 1, 3, 0, 0, 0, shanghai)}, // 日和周满足其一
+		{"0 0 * * 7", time.Date(2020, 3, 1, 0, 0, 0, 0, shanghai)},
+		{"@hourly", time.Date(2020, 2, 29, 0, 0, 0, 0, shanghai)},
+		{"5,10 0 * * *", time.Date(2020, 2, 29, 0, 5, 0, 0, shanghai)},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if next := cron.Next(from); !next.Equal(c.next) {
+			t.Errorf("%s: next %s, want %s", c.expr, next, c.next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+	cron, _ := ParseCron("0 0 30 2 *")
+	if next := cron.Next(from); !next.IsZero() {
+		t.Errorf("impossible date matched %s", next)
+	}
+}
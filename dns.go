@@ -0,0 +1,152 @@
+package gobom
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS和本地地址设置，HTTP、TCP和WebSocket使用，主机映射优先于DNS解析，解析结果按任务（脚本）缓存
+type DnsOptions struct {
+	Hosts    map[string]string `json:"hosts" form:"hosts"`       // [主机名]IP，不用修改压测机的/etc/hosts
+	CacheTtl int               `json:"cacheTtl" form:"cacheTtl"` // DNS缓存时间（秒），0为不缓存（每次新建连接都解析），-1为任务运行期间一直缓存
+	LocalIps []string          `json:"localIps" form:"localIps"` // 连接绑定的本地IP，按虚拟用户轮流分配，需要与目标地址的IP版本一致
+}
+
+// 同一个脚本的虚拟用户共用的解析缓存
+type dnsResolver struct {
+	hosts map[string]string
+	ttl   time.Duration // 小于0时不过期
+	cache map[string]*dnsEntry
+	mu    sync.Mutex
+}
+
+type dnsEntry struct {
+	ips    []net.IP
+	expire time.Time
+	next   int // 多个IP时新建连接轮流使用
+}
+
+func (dnsOptions *DnsOptions) empty() bool {
+	return len(dnsOptions.Hosts) == 0 && dnsOptions.CacheTtl == 0 && len(dnsOptions.LocalIps) == 0
+}
+
+func (dnsOptions *DnsOptions) Check() error {
+	for host, ip := range dnsOptions.Hosts {
+		if host == "" || net.ParseIP(ip) == nil {
+			return fmt.Errorf("%s[%s]", ERR_DNS_HOST, host)
+		}
+	}
+	if dnsOptions.CacheTtl < -1 {
+		return ERR_DNS_TTL
+	}
+	for _, ip := range dnsOptions.LocalIps {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("%s[%s]", ERR_LOCAL_IP, ip)
+		}
+	}
+	return nil
+}
+
+func newDnsResolver(dnsOptions DnsOptions) *dnsResolver {
+	return &dnsResolver{
+		hosts: dnsOptions.Hosts,
+		ttl:   time.Duration(dnsOptions.CacheTtl) * time.Second,
+		cache: make(map[string]*dnsEntry),
+	}
+}
+
+// 按主机映射替换地址中的主机名
+func (resolver *dnsResolver) mapHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip, ok := resolver.hosts[host]; ok {
+		return net.JoinHostPort(ip, port)
+	}
+	return addr
+}
+
+// 替换压测地址中映射的主机名，支持URL和TCP地址（host:port）
+func (dnsOptions *DnsOptions) mapUrl(raw string) (string, bool) {
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return "", false
+		}
+		ip, ok := dnsOptions.Hosts[u.Hostname()]
+		if !ok {
+			return "", false
+		}
+		if port := u.Port(); port != "" {
+			u.Host = net.JoinHostPort(ip, port)
+		} else if strings.Contains(ip, ":") {
+			u.Host = "[" + ip + "]"
+		} else {
+			u.Host = ip
+		}
+		return u.String(), true
+	}
+	host, port, err := net.SplitHostPort(raw)
+	if err != nil {
+		return "", false
+	}
+	ip, ok := dnsOptions.Hosts[host]
+	if !ok {
+		return "", false
+	}
+	return net.JoinHostPort(ip, port), true
+}
+
+// 解析为IP地址，不缓存时由系统在建立连接时解析
+func (resolver *dnsResolver) resolve(addr string) (string, error) {
+	addr = resolver.mapHost(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || resolver.ttl == 0 || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	resolver.mu.Lock()
+	entry, ok := resolver.cache[host]
+	if ok && (resolver.ttl < 0 || time.Now().Before(entry.expire)) {
+		ip := entry.ips[entry.next%len(entry.ips)]
+		entry.next++
+		resolver.mu.Unlock()
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+	resolver.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_REQUEST_TIMEOUT*time.Second)
+	defer cancel()
+	list, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		return "", &net.DNSError{Err: "no such host", Name: host}
+	}
+	entry = &dnsEntry{expire: time.Now().Add(resolver.ttl), next: 1}
+	for _, v := range list {
+		entry.ips = append(entry.ips, v.IP)
+	}
+	resolver.mu.Lock()
+	resolver.cache[host] = entry
+	resolver.mu.Unlock()
+	return net.JoinHostPort(entry.ips[0].String(), port), nil
+}
+
+// 绑定的本地地址，端口由系统分配
+func localAddr(network string, ip net.IP) net.Addr {
+	if ip == nil {
+		return nil
+	}
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
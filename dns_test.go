@@ -0,0 +1,151 @@
+package gobom
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDns(t *testing.T) {
+	var (
+		clients = make(map[string]int) // [客户端IP]请求数
+		mu      sync.Mutex
+	)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		mu.Lock()
+		clients[host]++
+		mu.Unlock()
+		var sni string
+		if r.TLS != nil {
+			sni = r.TLS.ServerName
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"host": r.Host, "sni": sni})
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ca := newTestCert(t, "gobom ca", nil, 0)
+	cert := newTestCert(t, "gobom.test", ca, x509.ExtKeyUsageServerAuth)
+	https := httptest.NewUnstartedServer(handler)
+	https.TLS = &tls.Config{Certificates: []tls.Certificate{cert.tlsCert()}}
+	https.StartTLS()
+	defer https.Close()
+	h2c, _ := startTestHttp2Server(t)
+	echo, _ := startTestFrameServer(t)
+
+	mapped := func(raw string) string {
+		return strings.Replace(raw, "127.0.0.1", "gobom.test", 1)
+	}
+	hosts := map[string]string{"gobom.test": "127.0.0.1"}
+	call := func(opt *Options) *Response {
+		requester, err := NewRequester(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer requester.close()
+		resp, err := requester.dispose()
+		if err != nil || !resp.IsSuccess {
+			t.Fatalf("%s: %+v %v", opt.Url, resp, err)
+		}
+		return resp
+	}
+
+	// 主机映射：请求头的Host和TLS的SNI保持原来的主机名
+	resp := call(&Options{Url: mapped(server.URL), Form: FORM_HTTP, DnsOptions: DnsOptions{Hosts: hosts}})
+	if host := gjson.GetBytes(resp.Data, "host").String(); host != mapped(server.Listener.Addr().String()) {
+		t.Errorf("host: %s", host)
+	}
+	resp = call(&Options{Url: mapped(https.URL), Form: FORM_HTTP, TlsOptions: TlsOptions{InsecureSkipVerify: true}, DnsOptions: DnsOptions{Hosts: hosts}})
+	if sni := gjson.GetBytes(resp.Data, "sni").String(); sni != "gobom.test" {
+		t.Errorf("sni: %s", sni)
+	}
+	call(&Options{Url: mapped(h2c.URL) + "/echo", Form: FORM_HTTP, HttpOptions: HttpOptions{Method: "POST", Protocol: HTTP_PROTOCOL_H2C}, SendData: &SendData{}, DnsOptions: DnsOptions{Hosts: hosts}})
+	call(&Options{Url: mapped(echo), Form: FORM_TCP, DnsOptions: DnsOptions{Hosts: hosts, CacheTtl: -1}})
+
+	// 本地IP按虚拟用户轮流分配
+	mu.Lock()
+	clients = make(map[string]int)
+	mu.Unlock()
+	opt := &Options{Url: server.URL, Form: FORM_HTTP, DnsOptions: DnsOptions{LocalIps: []string{"127.0.0.1", "127.0.0.2"}}}
+	var requesters []Requester
+	for i := 0; i < 4; i++ {
+		requester, err := NewRequester(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requesters = append(requesters, requester)
+		if _, err = requester.dispose(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, requester := range requesters {
+		requester.close()
+	}
+	mu.Lock()
+	if clients["127.0.0.1"] != 2 || clients["127.0.0.2"] != 2 {
+		t.Errorf("local ips: %v", clients)
+	}
+	mu.Unlock()
+	if len(connShareds.shareds) != 0 {
+		t.Errorf("not released: %d", len(connShareds.shareds))
+	}
+
+	// 缓存：不缓存时交给系统解析，缓存过期后重新解析
+	resolver := newDnsResolver(DnsOptions{})
+	if addr, _ := resolver.resolve("localhost:80"); addr != "localhost:80" {
+		t.Errorf("no cache: %s", addr)
+	}
+	resolver = newDnsResolver(DnsOptions{CacheTtl: 60})
+	addr, err := resolver.resolve("localhost:80")
+	if host, _, _ := net.SplitHostPort(addr); err != nil || !net.ParseIP(host).IsLoopback() {
+		t.Fatalf("resolve: %s %v", addr, err)
+	}
+	resolver.cache["localhost"].ips = []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	if a, b := resolver.resolve("localhost:80"); a != "10.0.0.2:80" {
+		t.Errorf("cached: %s %v", a, b)
+	}
+	if a, _ := resolver.resolve("localhost:80"); a != "10.0.0.1:80" {
+		t.Errorf("round robin: %s", a)
+	}
+	resolver.cache["localhost"].expire = time.Now().Add(-time.Second)
+	if addr, _ = resolver.resolve("localhost:80"); strings.HasPrefix(addr, "10.") {
+		t.Errorf("expired: %s", addr)
+	}
+	resolver = newDnsResolver(DnsOptions{CacheTtl: -1})
+	resolver.resolve("localhost:80")
+	resolver.cache["localhost"].ips = []net.IP{net.ParseIP("10.0.0.1")}
+	resolver.cache["localhost"].expire = time.Now().Add(-time.Second)
+	if addr, _ = resolver.resolve("localhost:80"); addr != "10.0.0.1:80" {
+		t.Errorf("never expire: %s", addr)
+	}
+
+	// 主机映射后的地址同样经过压测地址规则检查
+	opt = &Options{Url: "http://gobom.test/a", DnsOptions: DnsOptions{Hosts: map[string]string{"gobom.test": "10.0.0.1", "tcp.test": "::1"}}}
+	opt.TransactionOptions.TransactionOptionsDataList = []TransactionOptionsData{{Name: "tcp", Url: "tcp.test:9000"}}
+	if urls := strings.Join(opt.Urls(), ","); urls != "http://gobom.test/a,tcp.test:9000,http://10.0.0.1/a,[::1]:9000" {
+		t.Errorf("urls: %s", urls)
+	}
+
+	// 校验
+	for _, c := range []struct {
+		dnsOptions DnsOptions
+		err        error
+	}{
+		{DnsOptions{Hosts: map[string]string{"gobom.test": "gobom.local"}}, ERR_DNS_HOST},
+		{DnsOptions{CacheTtl: -2}, ERR_DNS_TTL},
+		{DnsOptions{LocalIps: []string{"eth0"}}, ERR_LOCAL_IP},
+	} {
+		if _, err := NewRequester(&Options{Url: server.URL, Form: FORM_HTTP, DnsOptions: c.dnsOptions}); err == nil || !strings.HasPrefix(err.Error(), c.err.Error()) {
+			t.Errorf("%+v: %v", c.dnsOptions, err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ var (
 
 	ERR_PARAM       = errors.New("参数错误")
 	ERR_PARAM_PARSE = errors.New("参数解析错误")
+	ERR_CONFIG_KEY  = errors.New("配置文件中有不存在的配置项")
 
 	ERR_URL         = errors.New("URL不能为空")
 	ERR_CONCURRENCY = errors.New("并发数数值过小")
@@ -23,6 +24,90 @@ var (
 	ERR_FILE_OPEN  = errors.New("打开文件数据失败")
 	ERR_FILE_READ  = errors.New("读取文件数据失败")
 
+	ERR_DATAFILE_NOT_FOUND = errors.New("数据文件不存在")
+	ERR_DATAFILE_TYPE      = errors.New("不支持的数据文件类型，仅支持xlsx|csv|pem|crt|cer|key")
+	ERR_DATAFILE_EMPTY     = errors.New("数据文件没有列名")
+	ERR_DATAFILE_NO_ROWS   = errors.New("数据文件没有数据行")
+	ERR_DATAFILE_ROW       = errors.New("数据文件的行缺少列")
+	ERR_DATAFILE_IN_USE    = errors.New("数据文件正在被脚本使用")
+
+	ERR_STEP_TYPE = errors.New("无法识别的步骤类型")
+
+	ERR_AGENT_NONE      = errors.New("没有可用的压测节点")
+	ERR_AGENT_NOT_FOUND = errors.New("压测节点未注册")
+
+	ERR_TASK_NOT_RUN       = errors.New("任务没有运行")
+	ERR_TASK_PAUSED        = errors.New("任务已暂停")
+	ERR_TASK_NOT_PAUSED    = errors.New("任务没有暂停")
+	ERR_SCENARIO_NOT_FOUND = errors.New("场景不存在")
+	ERR_SCALE_CONCURRENT   = errors.New("减少后的并发数不能为0，停止任务请使用stop")
+	ERR_SCALE_DURATION     = errors.New("缩短的时长不能超过剩余时长，停止任务请使用stop")
+
+	ERR_CRON            = errors.New("cron表达式或运行时间错误")
+	ERR_SCHEDULE_POLICY = errors.New("无法识别的计划策略，仅支持skip|queue")
+
+	ERR_TASK_QUEUED      = errors.New("任务正在排队")
+	ERR_QUEUE_NOT_FOUND  = errors.New("排队记录不存在")
+	ERR_GUARD_CONCURRENT = errors.New("并发数超过服务器限制")
+
+	ERR_PIPELINE_EMPTY   = errors.New("流水线没有阶段")
+	ERR_PIPELINE_GATE    = errors.New("无法识别的阶段条件，仅支持passed|always")
+	ERR_PIPELINE_RUN     = errors.New("流水线正在运行")
+	ERR_PIPELINE_NOT_RUN = errors.New("流水线没有运行")
+
+	ERR_WEBHOOK_TARGET = errors.New("钩子必须指定一个任务或流水线")
+	ERR_WEBHOOK_EVENT  = errors.New("无法识别的通知事件")
+
+	ERR_AUTH              = errors.New("请先登录")
+	ERR_LOGIN             = errors.New("用户名或密码错误")
+	ERR_PERMISSION        = errors.New("没有权限")
+	ERR_ROLE              = errors.New("无法识别的角色，仅支持viewer|runner|editor|admin")
+	ERR_AGENT_TOKEN       = errors.New("压测节点令牌错误")
+	ERR_PASSWORD          = errors.New("密码至少8位")
+	ERR_USER_SELF         = errors.New("不能禁用、删除自己或取消自己的管理员权限")
+	ERR_PROJECT_NOT_EMPTY = errors.New("项目中还有任务、脚本、数据文件或流水线")
+	ERR_PROJECT_MISMATCH  = errors.New("引用的数据不属于同一个项目")
+
+	ERR_TARGET_INVALID     = errors.New("无法解析压测地址")
+	ERR_TARGET_VARIABLE    = errors.New("启用允许列表后压测地址的主机不能使用变量")
+	ERR_TARGET_DENIED      = errors.New("压测地址被禁止")
+	ERR_TARGET_NOT_ALLOWED = errors.New("压测地址不在允许列表中")
+	ERR_TARGET_CONFIRM     = errors.New("压测地址受保护，请确认后运行")
+	ERR_ENV_CONCURRENT     = errors.New("并发数超过环境限制")
+	ERR_ENV_RATE           = errors.New("到达率超过环境限制")
+	ERR_RULE_ACTION        = errors.New("无法识别的规则类型，仅支持allow|deny")
+	ERR_RULE_EMPTY         = errors.New("规则至少需要设置主机、IP段或端口")
+	ERR_RULE_CIDR          = errors.New("IP段格式错误")
+
+	ERR_GRPC_DESCRIPTOR = errors.New("无法解析gRPC描述符，请上传.proto文件或FileDescriptorSet")
+	ERR_GRPC_METHOD     = errors.New("gRPC方法不存在或不支持（仅支持一元调用和服务端流式调用）")
+	ERR_GRPC_MESSAGE    = errors.New("无法生成gRPC请求消息")
+
+	ERR_UDP_MODE    = errors.New("无法识别的UDP模式，仅支持空（请求/响应）|send")
+	ERR_UDP_TIMEOUT = errors.New("等待UDP响应超时")
+	ERR_UDP_REFUSED = errors.New("UDP对端不可达")
+
+	ERR_HTTP_PROTOCOL   = errors.New("无法识别的HTTP协议，仅支持空（HTTP/1.1）|h2|h2c")
+	ERR_HTTP2_NEGOTIATE = errors.New("服务端不支持HTTP/2")
+
+	ERR_TLS_VERSION = errors.New("无法识别的TLS版本，仅支持1.0|1.1|1.2|1.3，且最低版本不能高于最高版本")
+	ERR_TLS_CIPHER  = errors.New("无法识别的TLS加密套件")
+	ERR_TLS_CERT    = errors.New("无法加载客户端证书")
+	ERR_TLS_CA      = errors.New("CA证书文件中没有证书")
+	ERR_TLS_FILE    = errors.New("引用的文件不是证书文件")
+	ERR_CERT_PEM    = errors.New("证书文件不是PEM格式")
+
+	ERR_CONN_MODE  = errors.New("无法识别的连接模式，仅支持空（复用）|request|iteration")
+	ERR_CONN_LIMIT = errors.New("连接数达到任务上限")
+	ERR_PROXY_URL  = errors.New("代理地址格式错误，仅支持http://|socks5://")
+	ERR_PROXY      = errors.New("代理连接失败")
+	ERR_DNS_HOST   = errors.New("主机映射的地址不是IP")
+	ERR_DNS_TTL    = errors.New("DNS缓存时间不能小于-1")
+	ERR_LOCAL_IP   = errors.New("绑定的本地地址不是IP")
+	ERR_HAR_PARSE  = errors.New("HAR文件解析失败")
+	ERR_HAR_EMPTY  = errors.New("HAR文件过滤后没有可导入的请求")
+
 	ERR_TASK_CREATE    = errors.New("创建任务实例失败")
 	ERR_TASK_STOP_NONE = errors.New("停止失败，任务没有运行")
+	ERR_TASK_RESET     = errors.New("脚本已保存，以下任务重新初始化失败")
 )
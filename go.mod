@@ -10,9 +10,14 @@ require (
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/golang/protobuf v1.4.1
 	github.com/gorilla/websocket v1.4.2
+	github.com/jhump/protoreflect v1.7.0
 	github.com/jinzhu/gorm v1.9.12
 	github.com/pkg/errors v0.9.1
 	github.com/smallnest/goframe v1.0.0
 	github.com/tidwall/gjson v1.6.0
 	github.com/valyala/fasthttp v1.12.0
+	golang.org/x/crypto v0.0.0-20191205180655-e7c4368fe9dd
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.22.0
 )
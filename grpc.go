@@ -0,0 +1,310 @@
+package gobom
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"gobom/utils"
+)
+
+type GrpcOptions struct {
+	Method     string            `json:"method" form:"method"`         // 方法全名 package.Service/Method
+	ProtoFiles map[string]string `json:"protoFiles" form:"protoFiles"` // [文件名].proto文件内容，文件之间可以import
+	Descriptor []byte            `json:"descriptor" form:"descriptor"` // FileDescriptorSet（protoc --include_imports --descriptor_set_out），base64编码
+}
+
+// gRPC请求，支持一元调用和服务端流式调用，请求消息由SendData的字段按JSON映射生成
+type Grpc struct {
+	startTime          time.Duration
+	endTime            time.Duration
+	err                error
+	opt                *Options
+	files              *protoregistry.Files
+	conn               *grpc.ClientConn
+	response           *Response
+	step               TransactionOptionsData // 当前执行的事务步骤
+	TransactionOptions *TransactionOptions
+}
+
+// 解析后的描述符，按内容缓存，同一个脚本的虚拟用户共用
+var grpcDescriptors = struct {
+	files map[string]*protoregistry.Files
+	mu    sync.Mutex
+}{files: make(map[string]*protoregistry.Files)}
+
+var grpcUnmarshal = protojson.UnmarshalOptions{DiscardUnknown: true}
+var grpcMarshal = protojson.MarshalOptions{UseProtoNames: true}
+
+func NewGrpcRequest(opt *Options) (*Grpc, error) {
+	if opt == nil {
+		return nil, ERR_OPTIONS_NIL
+	}
+	files, err := opt.GrpcOptions.files()
+	if err != nil {
+		return nil, err
+	}
+	g := &Grpc{
+		opt:                opt,
+		files:              files,
+		TransactionOptions: opt.TransactionOptions.Copy(),
+	}
+	// 提前检查所有方法，避免压测开始后每个请求都失败
+	if _, err = g.method(opt.GrpcOptions.Method); err != nil && g.TransactionOptions.Empty() {
+		return nil, err
+	}
+	for _, v := range flattenSteps(opt.TransactionOptions.TransactionOptionsDataList) {
+		if v.Type != STEP_REQUEST {
+			continue
+		}
+		if _, err = g.method(v.GrpcOptions.Method); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *Grpc) dispose() (response *Response, err error) {
+	if !g.TransactionOptions.Empty() {
+		return g.TransactionOptions.Run(func(data TransactionOptionsData) (*Response, error) {
+			g.step = data
+			if err := g.send(); err != nil {
+				return nil, err
+			}
+			return g.recv()
+		})
+	}
+	if err := g.send(); err != nil {
+		return nil, err
+	}
+	return g.recv()
+}
+
+func (g *Grpc) send() (err error) {
+	var (
+		url      = g.opt.Url
+		name     = g.opt.GrpcOptions.Method
+		header   = g.opt.HttpOptions.Header
+		sendData = g.opt.SendData
+	)
+	if !g.step.Empty() {
+		url = g.step.Url
+		name = g.step.GrpcOptions.Method
+		header = g.step.HttpOptions.Header
+		sendData = g.step.SendData
+	}
+	method, err := g.method(name)
+	if err != nil {
+		return err
+	}
+
+	// 同一个虚拟用户复用连接，地址变化时重新连接
+	target := g.TransactionOptions.Render(url)
+	if g.conn == nil || g.conn.Target() != target {
+		g.close()
+		if g.conn, err = grpc.Dial(target, grpc.WithInsecure()); err != nil {
+			return err
+		}
+	}
+
+	req := dynamicpb.NewMessage(method.Input())
+	if err = sendData.init(); err != nil {
+		return err
+	}
+	if bm := sendData.GetSendDataToMap(g.TransactionOptions); bm != nil {
+		bt, err := json.Marshal(bm)
+		if err != nil {
+			return err
+		}
+		if err = grpcUnmarshal.Unmarshal(bt, req); err != nil {
+			return fmt.Errorf("%s：%s", ERR_GRPC_MESSAGE, err)
+		}
+		if !g.step.Empty() {
+			g.TransactionOptions.SetTransactionSendData(g.step.Name, bt)
+		}
+	}
+	md := metadata.MD{}
+	for k, v := range header {
+		md.Set(k, g.TransactionOptions.Render(v))
+	}
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), DEFAULT_REQUEST_TIMEOUT*time.Second)
+	defer cancel()
+
+	g.startTime = utils.Now()
+	fullMethod := fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name())
+	var data []byte
+	if method.IsStreamingServer() {
+		data, g.err = g.stream(ctx, fullMethod, method, req)
+	} else {
+		resp := dynamicpb.NewMessage(method.Output())
+		if g.err = g.conn.Invoke(ctx, fullMethod, req, resp); g.err == nil {
+			data, g.err = grpcMarshal.Marshal(resp)
+		}
+	}
+	g.endTime = utils.Now()
+
+	st := status.Convert(g.err)
+	g.response = &Response{
+		IsSuccess: g.err == nil,
+		ErrCode:   int(st.Code()),
+		Data:      data,
+	}
+	if g.err != nil {
+		g.response.ErrMsg = g.err.Error()
+	}
+	return nil
+}
+
+// 服务端流式调用，读取全部消息后返回JSON数组
+func (g *Grpc) stream(ctx context.Context, fullMethod string, method protoreflect.MethodDescriptor, req proto.Message) ([]byte, error) {
+	stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, fullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	var list []json.RawMessage
+	for {
+		resp := dynamicpb.NewMessage(method.Output())
+		if err = stream.RecvMsg(resp); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		bt, err := grpcMarshal.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, bt)
+	}
+	if list == nil {
+		list = []json.RawMessage{}
+	}
+	return json.Marshal(list)
+}
+
+func (g *Grpc) recv() (response *Response, err error) {
+	g.response.WasteTime = uint64(g.getRequestTime())
+	return g.response, g.err
+}
+
+func (g *Grpc) close() {
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+}
+
+func (g *Grpc) getRequestTime() time.Duration {
+	if g.startTime == 0 || g.endTime == 0 || g.endTime < g.startTime {
+		return time.Duration(0)
+	}
+	return g.endTime - g.startTime
+}
+
+// 查找方法，name为 package.Service/Method（可以以/开头）
+func (g *Grpc) method(name string) (protoreflect.MethodDescriptor, error) {
+	name = strings.TrimPrefix(name, "/")
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("%s[%s]", ERR_GRPC_METHOD, name)
+	}
+	d, err := g.files.FindDescriptorByName(protoreflect.FullName(name[:i] + "." + name[i+1:]))
+	if err != nil {
+		return nil, fmt.Errorf("%s[%s]", ERR_GRPC_METHOD, name)
+	}
+	method, ok := d.(protoreflect.MethodDescriptor)
+	if !ok || method.IsStreamingClient() {
+		return nil, fmt.Errorf("%s[%s]", ERR_GRPC_METHOD, name)
+	}
+	return method, nil
+}
+
+// 解析脚本上传的描述符，优先使用FileDescriptorSet
+func (grpcOptions *GrpcOptions) files() (*protoregistry.Files, error) {
+	key := grpcOptions.key()
+	grpcDescriptors.mu.Lock()
+	defer grpcDescriptors.mu.Unlock()
+	if files, ok := grpcDescriptors.files[key]; ok {
+		return files, nil
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if len(grpcOptions.Descriptor) != 0 {
+		if err := proto.Unmarshal(grpcOptions.Descriptor, set); err != nil {
+			return nil, fmt.Errorf("%s：%s", ERR_GRPC_DESCRIPTOR, err)
+		}
+	} else if len(grpcOptions.ProtoFiles) != 0 {
+		var names []string
+		for name := range grpcOptions.ProtoFiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(grpcOptions.ProtoFiles)}
+		fds, err := parser.ParseFiles(names...)
+		if err != nil {
+			return nil, fmt.Errorf("%s：%s", ERR_GRPC_DESCRIPTOR, err)
+		}
+		seen := make(map[string]bool)
+		var add func(fd *desc.FileDescriptor)
+		add = func(fd *desc.FileDescriptor) {
+			if seen[fd.GetName()] {
+				return
+			}
+			seen[fd.GetName()] = true
+			for _, dep := range fd.GetDependencies() {
+				add(dep)
+			}
+			set.File = append(set.File, fd.AsFileDescriptorProto())
+		}
+		for _, fd := range fds {
+			add(fd)
+		}
+	} else {
+		return nil, ERR_GRPC_DESCRIPTOR
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("%s：%s", ERR_GRPC_DESCRIPTOR, err)
+	}
+	grpcDescriptors.files[key] = files
+	return files, nil
+}
+
+func (grpcOptions *GrpcOptions) key() string {
+	h := sha256.New()
+	h.Write(grpcOptions.Descriptor)
+	var names []string
+	for name := range grpcOptions.ProtoFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%s\x00%s", name, grpcOptions.ProtoFiles[name])
+	}
+	return string(h.Sum(nil))
+}
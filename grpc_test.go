@@ -0,0 +1,193 @@
+package gobom
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/tidwall/gjson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const testGreeterProto = `syntax = "proto3";
+package gobom.test;
+import "common.proto";
+
+service Greeter {
+  rpc Hello (HelloRequest) returns (HelloReply);
+  rpc Count (HelloRequest) returns (stream HelloReply);
+}
+
+message HelloRequest {
+  string name = 1;
+  int32 count = 2;
+}
+`
+
+const testCommonProto = `syntax = "proto3";
+package gobom.test;
+
+message HelloReply {
+  string message = 1;
+  int32 index = 2;
+}
+`
+
+// 使用动态消息的测试服务，metadata中没有token时返回Unauthenticated
+func startTestGrpcServer(t *testing.T, files map[string]string) string {
+	registry, err := (&GrpcOptions{ProtoFiles: files}).files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := registry.FindDescriptorByName("gobom.test.Greeter.Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := d.(protoreflect.MethodDescriptor)
+	newReply := func(message string, index int32) *dynamicpb.Message {
+		reply := dynamicpb.NewMessage(hello.Output())
+		reply.Set(hello.Output().Fields().ByName("message"), protoreflect.ValueOfString(message))
+		reply.Set(hello.Output().Fields().ByName("index"), protoreflect.ValueOfInt32(index))
+		return reply
+	}
+	auth := func(ctx context.Context) error {
+		if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("token")) == 0 || md.Get("token")[0] != "secret" {
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return nil
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "gobom.test.Greeter",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Hello",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := dynamicpb.NewMessage(hello.Input())
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if err := auth(ctx); err != nil {
+					return nil, err
+				}
+				return newReply("hello "+req.Get(hello.Input().Fields().ByName("name")).String(), 0), nil
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Count",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := dynamicpb.NewMessage(hello.Input())
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				if err := auth(stream.Context()); err != nil {
+					return err
+				}
+				count := int32(req.Get(hello.Input().Fields().ByName("count")).Int())
+				for i := int32(0); i < count; i++ {
+					if err := stream.SendMsg(newReply("count", i)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}},
+	}, struct{}{})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+func TestGrpc(t *testing.T) {
+	files := map[string]string{"greeter.proto": testGreeterProto, "common.proto": testCommonProto}
+	addr := startTestGrpcServer(t, files)
+	newOpt := func(method string, fields ...*DataField) *Options {
+		return &Options{
+			Url:         addr,
+			Form:        FORM_GRPC,
+			GrpcOptions: GrpcOptions{Method: method, ProtoFiles: files},
+			HttpOptions: HttpOptions{Header: map[string]string{"token": "secret"}},
+			SendData:    &SendData{DataFieldList: fields},
+		}
+	}
+	call := func(opt *Options) (*Response, error) {
+		requester, err := NewRequester(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer requester.close()
+		return requester.dispose()
+	}
+
+	// 一元调用
+	resp, err := call(newOpt("gobom.test.Greeter/Hello", &DataField{Name: "name", Default: "gobom"}))
+	if err != nil || !resp.IsSuccess || resp.ErrCode != int(codes.OK) || gjson.GetBytes(resp.Data, "message").String() != "hello gobom" {
+		t.Fatalf("unary: %+v %s %v", resp, resp.Data, err)
+	}
+
+	// metadata和状态码
+	opt := newOpt("/gobom.test.Greeter/Hello")
+	opt.HttpOptions.Header = nil
+	resp, err = call(opt)
+	if err == nil || resp == nil || resp.IsSuccess || resp.ErrCode != int(codes.Unauthenticated) {
+		t.Errorf("unauthenticated: %+v %v", resp, err)
+	}
+
+	// 服务端流式调用
+	resp, err = call(newOpt("gobom.test.Greeter/Count", &DataField{Name: "count", Default: 3}))
+	if err != nil || resp == nil || gjson.GetBytes(resp.Data, "#").Int() != 3 || gjson.GetBytes(resp.Data, "2.index").Int() != 2 {
+		t.Errorf("stream: %s %v", resp.Data, err)
+	}
+
+	// 请求字段类型错误
+	if _, err = call(newOpt("gobom.test.Greeter/Hello", &DataField{Name: "count", Default: "x"})); err == nil || !strings.HasPrefix(err.Error(), ERR_GRPC_MESSAGE.Error()) {
+		t.Errorf("invalid message: %v", err)
+	}
+	if _, err = NewRequester(newOpt("gobom.test.Greeter/Bye")); err == nil || !strings.HasPrefix(err.Error(), ERR_GRPC_METHOD.Error()) {
+		t.Errorf("unknown method: %v", err)
+	}
+
+	// FileDescriptorSet
+	fds, err := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(files)}.ParseFiles("greeter.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fds[0].GetDependencies()[0].AsFileDescriptorProto(), fds[0].AsFileDescriptorProto()}}
+	bt, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt = newOpt("gobom.test.Greeter/Hello", &DataField{Name: "name", Default: "set"})
+	opt.GrpcOptions.ProtoFiles = nil
+	opt.GrpcOptions.Descriptor = bt
+	if resp, err = call(opt); err != nil || gjson.GetBytes(resp.Data, "message").String() != "hello set" {
+		t.Errorf("descriptor set: %s %v", resp.Data, err)
+	}
+
+	// 事务步骤使用各自的方法，响应可以被后续步骤引用
+	opt = newOpt("")
+	opt.TransactionOptions.TransactionOptionsDataList = []TransactionOptionsData{
+		{Name: "hello", Url: addr, GrpcOptions: GrpcOptions{Method: "gobom.test.Greeter/Hello"}, HttpOptions: opt.HttpOptions,
+			SendData: &SendData{DataFieldList: []*DataField{{Name: "name", Default: "step"}}}},
+		{Name: "count", Url: addr, GrpcOptions: GrpcOptions{Method: "gobom.test.Greeter/Count"}, HttpOptions: opt.HttpOptions,
+			SendData: &SendData{DataFieldList: []*DataField{{Name: "name", Type: TYPE_RESP, Dynamic: "hello" + FILE_PARSE_SEP + "message"}, {Name: "count", Default: 2}}}},
+	}
+	resp, err = call(opt)
+	if err != nil || !resp.IsSuccess || len(resp.TransactionWasteTime) != 2 {
+		t.Errorf("transaction: %+v %v", resp, err)
+	}
+}
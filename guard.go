@@ -0,0 +1,232 @@
+package gobom
+
+import (
+	"sync"
+	"time"
+
+	"gobom/utils"
+)
+
+// 服务器资源限制，超出限制的运行按先进先出排队
+type ResourceGuard struct {
+	MaxConCurrent uint64 `json:"maxConCurrent"` // 所有运行中任务的并发数之和，0为不限制
+	MaxTasks      int    `json:"maxTasks"`      // 同时运行的任务数，0为不限制
+	MaxRate       uint64 `json:"maxRate"`       // 所有任务每秒迭代次数之和，0为不限制
+
+	running map[string]uint64 // [任务id]占用的并发数
+	queue   []*QueueItem
+	limiter *RateLimiter
+	mu      sync.Mutex
+}
+
+// 排队中的运行
+type QueueItem struct {
+	Id          string `json:"id"`
+	TaskId      string `json:"taskId"`
+	Trigger     string `json:"trigger"`
+	ScheduleId  uint   `json:"scheduleId"`
+	ConCurrent  uint64 `json:"conCurrent"`
+	EnqueueTime int64  `json:"enqueueTime"`
+
+	start  func() // 出队时运行
+	cancel func() // 取消时调用
+}
+
+type GuardInfo struct {
+	MaxConCurrent uint64       `json:"maxConCurrent"`
+	MaxTasks      int          `json:"maxTasks"`
+	MaxRate       uint64       `json:"maxRate"`
+	ConCurrent    uint64       `json:"conCurrent"` // 已占用的并发数
+	Tasks         int          `json:"tasks"`      // 运行中的任务数
+	Queue         []*QueueItem `json:"queue"`
+}
+
+var gobomGuard = NewResourceGuard(0, 0, 0)
+
+func NewResourceGuard(maxConCurrent uint64, maxTasks int, maxRate uint64) *ResourceGuard {
+	guard := &ResourceGuard{
+		MaxConCurrent: maxConCurrent,
+		MaxTasks:      maxTasks,
+		MaxRate:       maxRate,
+		running:       make(map[string]uint64),
+	}
+	if maxRate != 0 {
+		guard.limiter = NewRateLimiter(maxRate)
+	}
+	return guard
+}
+
+// 按配置设置服务器资源限制
+func InitResourceGuard(config *AppConfig) {
+	gobomGuard = NewResourceGuard(config.MaxConCurrent, config.MaxTasks, config.MaxRate)
+}
+
+// 申请运行，资源足够且没有排队时返回true，否则加入队列等待
+func (guard *ResourceGuard) Acquire(item *QueueItem) (bool, error) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	if guard.MaxConCurrent != 0 && item.ConCurrent > guard.MaxConCurrent {
+		return false, ERR_GUARD_CONCURRENT
+	}
+	if _, ok := guard.running[item.TaskId]; ok {
+		return false, ERR_TASK_RUN
+	}
+	for _, v := range guard.queue {
+		if v.TaskId == item.TaskId {
+			return false, ERR_TASK_QUEUED
+		}
+	}
+	if len(guard.queue) == 0 && guard.fit(item.ConCurrent) {
+		guard.running[item.TaskId] = item.ConCurrent
+		return true, nil
+	}
+	item.Id = utils.GenerateId() + utils.GetRandomStrings(6)
+	item.EnqueueTime = time.Now().Unix()
+	guard.queue = append(guard.queue, item)
+	return false, nil
+}
+
+// 任务结束后释放资源，并按顺序启动排队的运行
+func (guard *ResourceGuard) Release(taskId string) {
+	guard.mu.Lock()
+	delete(guard.running, taskId)
+	starts := guard.dequeue()
+	guard.mu.Unlock()
+	for _, item := range starts {
+		item.start()
+	}
+}
+
+// 按顺序取出资源足够的排队运行，调用时持有锁，返回的运行在释放锁后启动
+func (guard *ResourceGuard) dequeue() []*QueueItem {
+	var starts []*QueueItem
+	for len(guard.queue) != 0 && guard.fit(guard.queue[0].ConCurrent) {
+		item := guard.queue[0]
+		guard.queue = guard.queue[1:]
+		guard.running[item.TaskId] = item.ConCurrent
+		starts = append(starts, item)
+	}
+	return starts
+}
+
+// 运行中调整并发数，减少时最少为0，并启动资源足够的排队运行
+func (guard *ResourceGuard) Resize(taskId string, delta int64) error {
+	guard.mu.Lock()
+	n, ok := guard.running[taskId]
+	if !ok {
+		guard.mu.Unlock()
+		return nil
+	}
+	if delta > 0 {
+		defer guard.mu.Unlock()
+		if guard.MaxConCurrent != 0 && guard.used()+uint64(delta) > guard.MaxConCurrent {
+			return ERR_GUARD_CONCURRENT
+		}
+		guard.running[taskId] = n + uint64(delta)
+		return nil
+	}
+	if uint64(-delta) < n {
+		guard.running[taskId] = n - uint64(-delta)
+	} else {
+		guard.running[taskId] = 0
+	}
+	starts := guard.dequeue()
+	guard.mu.Unlock()
+	for _, item := range starts {
+		item.start()
+	}
+	return nil
+}
+
+// 取消排队，id为排队id或任务id
+func (guard *ResourceGuard) Cancel(id string) error {
+	guard.mu.Lock()
+	var item *QueueItem
+	for i, v := range guard.queue {
+		if v.Id == id || v.TaskId == id {
+			item = v
+			guard.queue = append(guard.queue[:i:i], guard.queue[i+1:]...)
+			break
+		}
+	}
+	guard.mu.Unlock()
+	if item == nil {
+		return ERR_QUEUE_NOT_FOUND
+	}
+	if item.cancel != nil {
+		item.cancel()
+	}
+	return nil
+}
+
+// 按排队id或任务id查找排队中的任务
+func (guard *ResourceGuard) Find(id string) *QueueItem {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	for _, v := range guard.queue {
+		if v.Id == id || v.TaskId == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (guard *ResourceGuard) Queued(taskId string) bool {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	for _, v := range guard.queue {
+		if v.TaskId == taskId {
+			return true
+		}
+	}
+	return false
+}
+
+func (guard *ResourceGuard) Info() *GuardInfo {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	return &GuardInfo{
+		MaxConCurrent: guard.MaxConCurrent,
+		MaxTasks:      guard.MaxTasks,
+		MaxRate:       guard.MaxRate,
+		ConCurrent:    guard.used(),
+		Tasks:         len(guard.running),
+		Queue:         append([]*QueueItem{}, guard.queue...),
+	}
+}
+
+func (guard *ResourceGuard) fit(conCurrent uint64) bool {
+	if guard.MaxTasks != 0 && len(guard.running) >= guard.MaxTasks {
+		return false
+	}
+	return guard.MaxConCurrent == 0 || guard.used()+conCurrent <= guard.MaxConCurrent
+}
+
+func (guard *ResourceGuard) used() uint64 {
+	var n uint64
+	for _, v := range guard.running {
+		n += v
+	}
+	return n
+}
+
+// 任务运行时的最大并发数（多场景任务为各场景初始并发数和负载曲线最大值之和）
+func (gobom *GobomRequest) peakConCurrent() uint64 {
+	if len(gobom.Scenarios) == 0 {
+		return gobom.getConCurrent()
+	}
+	var totalWeight, n uint64
+	for _, scenario := range gobom.Scenarios {
+		totalWeight += scenario.Weight
+	}
+	for _, scenario := range gobom.Scenarios {
+		peak := scenario.initSize(gobom.getConCurrent(), totalWeight)
+		for _, stage := range scenario.Stages {
+			if stage.Target > peak {
+				peak = stage.Target
+			}
+		}
+		n += peak
+	}
+	return n
+}
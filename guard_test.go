@@ -0,0 +1,154 @@
+package gobom
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// 配置文件中的项都能对应到AppConfig的字段
+func testConfigKeys(t *testing.T, path string, keys ...string) *AppConfig {
+	t.Helper()
+	config := &AppConfig{}
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undecoded := make(map[string]bool)
+	for _, key := range meta.Undecoded() {
+		undecoded[key.String()] = true
+	}
+	for _, key := range keys {
+		if !meta.IsDefined(key) || undecoded[key] {
+			t.Errorf("config key %s not decoded", key)
+		}
+	}
+	return config
+}
+
+func TestResourceGuardConfigFile(t *testing.T) {
+	config := testConfigKeys(t, "./config/app.toml", "mysqlSource", "serverPort", "maxConCurrent", "maxTasks", "maxRate")
+	if config.MysqlSource == "" || config.ServerPort != ":9600" {
+		t.Errorf("server: %+v", config)
+	}
+	if config.MaxConCurrent != 0 || config.MaxTasks != 0 || config.MaxRate != 0 {
+		t.Errorf("limits: %+v", config)
+	}
+
+	// 设置的限制传入资源守卫
+	path := filepath.Join(t.TempDir(), "app.toml")
+	ioutil.WriteFile(path, []byte("maxConCurrent = 100\nmaxTasks = 2\nmaxRate = 500\n"), 0644)
+	config = testConfigKeys(t, path, "maxConCurrent", "maxTasks", "maxRate")
+	guard := gobomGuard
+	defer func() { gobomGuard = guard }()
+	InitResourceGuard(config)
+	if gobomGuard.MaxConCurrent != 100 || gobomGuard.MaxTasks != 2 || gobomGuard.MaxRate != 500 {
+		t.Errorf("guard: %+v", gobomGuard)
+	}
+}
+
+func TestResourceGuard(t *testing.T) {
+	initTestDb(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	guard := gobomGuard
+	gobomGuard = NewResourceGuard(3, 1, 50)
+	defer func() { gobomGuard = guard }()
+
+	for _, taskId := range []string{"guard-1", "guard-2", "guard-3"} {
+		addTestTask(t, taskId, &Options{Url: server.URL, ConCurrent: 2, Duration: 1, Interval: 10})
+	}
+	addTestTask(t, "guard-big", &Options{Url: server.URL, ConCurrent: 4, Duration: 1})
+	task := func(taskId string) *TaskData {
+		return &TaskData{Task: &Task{TaskId: taskId}}
+	}
+
+	if err := task("guard-big").Run(); err != ERR_GUARD_CONCURRENT {
+		t.Errorf("run task over limit: %v", err)
+	}
+	start := time.Now()
+	for _, taskId := range []string{"guard-1", "guard-2", "guard-3"} {
+		if err := task(taskId).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := task("guard-2").Run(); err != ERR_TASK_QUEUED {
+		t.Errorf("run queued task: %v", err)
+	}
+	info := gobomGuard.Info()
+	if info.Tasks != 1 || info.ConCurrent != 2 || len(info.Queue) != 2 || info.Queue[0].TaskId != "guard-2" {
+		t.Fatalf("unexpected guard info: %+v", info)
+	}
+	if data, _ := task("guard-2").First(); data.Task.Status != STATUS_WAIT {
+		t.Errorf("queued task status %d, want wait", data.Task.Status)
+	}
+	if err := gobomGuard.Cancel("guard-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// guard-1结束后guard-2出队运行
+	for i := 0; gobomGuard.Queued("guard-2") || GetRunTask("guard-2") == nil; i++ {
+		if i > 300 {
+			t.Fatal("queued task not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; GetRunTask("guard-2") != nil || gobomGuard.Info().Tasks != 0; i++ {
+		if i > 300 {
+			t.Fatal("queued task not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := time.Since(start); d < 2*time.Second {
+		t.Errorf("queued task ran concurrently, took %s", d)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	runs, err := (&TaskRunData{}).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]int)
+	for _, run := range runs {
+		status[run.TaskId] = run.Status
+	}
+	if status["guard-1"] != STATUS_OVER || status["guard-2"] != STATUS_OVER || status["guard-3"] != STATUS_STOP {
+		t.Errorf("unexpected run status: %v", status)
+	}
+	// 每秒50次迭代的限制
+	if data, _ := task("guard-1").First(); data.Task.Worker.Report.SuccessNum > 100 {
+		t.Errorf("rate limit exceeded: %d", data.Task.Worker.Report.SuccessNum)
+	}
+}
+
+func TestResourceGuardResize(t *testing.T) {
+	guard := NewResourceGuard(4, 0, 0)
+	if started, err := guard.Acquire(&QueueItem{TaskId: "a", ConCurrent: 3}); !started || err != nil {
+		t.Fatal(started, err)
+	}
+	started := make(chan struct{})
+	if ok, err := guard.Acquire(&QueueItem{TaskId: "b", ConCurrent: 2, start: func() { close(started) }}); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if err := guard.Resize("a", 2); err != ERR_GUARD_CONCURRENT {
+		t.Errorf("resize over limit: %v", err)
+	}
+
+	// 减少全部占用时清零，排队的运行随即出队
+	if err := guard.Resize("a", -5); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("queued run not started after resize")
+	}
+	if info := guard.Info(); info.ConCurrent != 2 || len(info.Queue) != 0 || info.Tasks != 2 {
+		t.Errorf("guard info: %+v", info)
+	}
+}
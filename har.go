@@ -0,0 +1,432 @@
+package gobom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tidwall/gjson"
+)
+
+// 默认过滤的静态资源类型（前缀匹配）
+var DEFAULT_HAR_STATIC_TYPES = []string{
+	"image/", "text/css", "text/javascript", "application/javascript", "application/x-javascript",
+	"font/", "application/font", "application/x-font", "audio/", "video/",
+}
+
+const HAR_MIN_TOKEN_LEN = 8 // 识别为动态值的最短长度
+
+// 不导入的请求头，cookie单独保存，压缩的响应无法提取变量
+var harSkipHeaders = map[string]bool{
+	"host": true, "content-length": true, "connection": true, "cookie": true, "accept-encoding": true,
+}
+
+var harVarRegexp = regexp.MustCompile(`[^\w]+`)
+
+// HAR导入设置
+type HarImportOptions struct {
+	Name           string   `json:"name" form:"name"` // 脚本名称
+	ProjectId      uint     `json:"projectId" form:"projectId"`
+	StaticTypes    []string `json:"staticTypes" form:"staticTypes"`       // 过滤的响应类型（前缀匹配），为空时使用DEFAULT_HAR_STATIC_TYPES
+	KeepStatic     bool     `json:"keepStatic" form:"keepStatic"`         // 不过滤静态资源
+	IncludeDomains []string `json:"includeDomains" form:"includeDomains"` // 只导入这些域名的请求，*.example.com匹配所有子域名，为空时不限制
+	ExcludeDomains []string `json:"excludeDomains" form:"excludeDomains"` // 不导入的域名（如统计、广告）
+	NoThinkTime    bool     `json:"noThinkTime" form:"noThinkTime"`       // 不保留录制的请求间隔
+}
+
+// 导入结果
+type HarImportResult struct {
+	Script    *ScriptData       `json:"script"`
+	Imported  int               `json:"imported"`  // 导入的请求数
+	Skipped   int               `json:"skipped"`   // 过滤的请求数
+	Variables map[string]string `json:"variables"` // 自动识别的动态值，[变量名]提取的步骤
+	Warnings  []string          `json:"warnings"`
+}
+
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // 请求总耗时（毫秒）
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+}
+
+type harRequest struct {
+	Method   string         `json:"method"`
+	Url      string         `json:"url"`
+	Headers  []harNameValue `json:"headers"`
+	Cookies  []harNameValue `json:"cookies"`
+	PostData *harPostData   `json:"postData"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []harNameValue `json:"params"`
+}
+
+type harResponse struct {
+	Status  int            `json:"status"`
+	Headers []harNameValue `json:"headers"`
+	Cookies []harNameValue `json:"cookies"`
+	Content struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+		Encoding string `json:"encoding"`
+	} `json:"content"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// 响应中的动态值
+type harToken struct {
+	value string
+	key   string
+	path  string // 响应数据中的字段路径
+	step  int    // 所在步骤
+	name  string // 变量名，被后续请求引用时分配
+}
+
+// 将HAR转换为HTTP事务脚本，每个请求一个步骤
+func ImportHar(data []byte, importOptions *HarImportOptions) (*HarImportResult, error) {
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("%s：%s", ERR_HAR_PARSE, err)
+	}
+	result := &HarImportResult{Variables: make(map[string]string)}
+	var entries []harEntry
+	for _, entry := range har.Log.Entries {
+		if importOptions.keep(&entry) {
+			entries = append(entries, entry)
+		} else {
+			result.Skipped++
+		}
+	}
+	if len(entries) == 0 {
+		return nil, ERR_HAR_EMPTY
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+
+	opt := &Options{
+		Url:  entries[0].Request.Url,
+		Form: FORM_HTTP,
+		HttpOptions: HttpOptions{
+			Method: entries[0].Request.Method,
+		},
+	}
+	steps := make([]TransactionOptionsData, len(entries))
+	setCookies := make(map[string]bool) // 之前的响应设置的cookie，由会话保存和发送
+	for i, entry := range entries {
+		step := TransactionOptionsData{
+			Name: fmt.Sprintf("%d %s %s", i+1, entry.Request.Method, harPath(entry.Request.Url)),
+			Url:  entry.Request.Url,
+			HttpOptions: HttpOptions{
+				Method: entry.Request.Method,
+				Header: make(map[string]string),
+				Cookie: make(map[string]string),
+			},
+		}
+		for _, v := range entry.Request.Headers {
+			if !strings.HasPrefix(v.Name, ":") && !harSkipHeaders[strings.ToLower(v.Name)] {
+				step.HttpOptions.Header[v.Name] = v.Value
+			}
+		}
+		for _, v := range entry.Request.Cookies {
+			if !setCookies[v.Name] {
+				step.HttpOptions.Cookie[v.Name] = v.Value
+			}
+		}
+		for _, v := range entry.Response.Cookies {
+			setCookies[v.Name] = true
+			opt.HttpOptions.CookieJar = true
+		}
+		if sendData, warning := harSendData(entry.Request.PostData); warning != "" {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("[%s]%s", step.Name, warning))
+		} else if sendData != nil {
+			step.SendData = sendData
+			// 请求体按JSON发送，表单需要改为JSON的Content-Type
+			for k := range step.HttpOptions.Header {
+				if strings.ToLower(k) == "content-type" && !strings.Contains(step.HttpOptions.Header[k], "json") {
+					delete(step.HttpOptions.Header, k)
+					result.Warnings = append(result.Warnings, fmt.Sprintf("[%s]表单请求体转换为JSON发送", step.Name))
+				}
+			}
+		}
+		// 录制的思考时间：本次请求结束到下一个请求开始
+		if i+1 < len(entries) && !importOptions.NoThinkTime {
+			end := entry.StartedDateTime.Add(time.Duration(entry.Time * float64(time.Millisecond)))
+			if gap := entries[i+1].StartedDateTime.Sub(end); gap > 0 {
+				step.Interval = uint64(gap / time.Millisecond)
+			}
+		}
+		steps[i] = step
+	}
+	harVariables(entries, steps, result)
+
+	opt.TransactionOptions.TransactionOptionsDataList = steps
+	result.Imported = len(steps)
+	result.Script = &ScriptData{
+		Name:      importOptions.Name,
+		ProjectId: importOptions.ProjectId,
+		Protocol:  FORM_HTTP,
+		Data:      string(opt.ToByte()),
+	}
+	return result, nil
+}
+
+// 按响应类型和域名过滤
+func (importOptions *HarImportOptions) keep(entry *harEntry) bool {
+	u, err := url.Parse(entry.Request.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, v := range importOptions.ExcludeDomains {
+		if matchHost(strings.ToLower(v), host) {
+			return false
+		}
+	}
+	if len(importOptions.IncludeDomains) != 0 {
+		included := false
+		for _, v := range importOptions.IncludeDomains {
+			included = included || matchHost(strings.ToLower(v), host)
+		}
+		if !included {
+			return false
+		}
+	}
+	if importOptions.KeepStatic {
+		return true
+	}
+	staticTypes := importOptions.StaticTypes
+	if len(staticTypes) == 0 {
+		staticTypes = DEFAULT_HAR_STATIC_TYPES
+	}
+	mimeType := strings.ToLower(entry.Response.Content.MimeType)
+	for _, v := range staticTypes {
+		if v != "" && strings.HasPrefix(mimeType, strings.ToLower(v)) {
+			return false
+		}
+	}
+	return true
+}
+
+func harPath(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// JSON对象和表单的字段转换为压测数据，其他格式无法按字段发送
+func harSendData(postData *harPostData) (*SendData, string) {
+	if postData == nil || (postData.Text == "" && len(postData.Params) == 0) {
+		return nil, ""
+	}
+	sendData := &SendData{}
+	if len(postData.Params) != 0 {
+		for _, v := range postData.Params {
+			sendData.DataFieldList = append(sendData.DataFieldList, &DataField{Name: v.Name, Type: TYPE_STRING, Default: v.Value})
+		}
+		return sendData, ""
+	}
+	if strings.Contains(postData.MimeType, "x-www-form-urlencoded") {
+		values, err := url.ParseQuery(postData.Text)
+		if err != nil {
+			return nil, "无法解析表单请求体，未导入"
+		}
+		for k := range values {
+			sendData.DataFieldList = append(sendData.DataFieldList, &DataField{Name: k, Type: TYPE_STRING, Default: values.Get(k)})
+		}
+		sort.Slice(sendData.DataFieldList, func(i, j int) bool {
+			return sendData.DataFieldList[i].Name < sendData.DataFieldList[j].Name
+		})
+		return sendData, ""
+	}
+	result := gjson.Parse(postData.Text)
+	if !result.IsObject() {
+		return nil, "请求体不是JSON对象，未导入"
+	}
+	result.ForEach(func(key, value gjson.Result) bool {
+		field := &DataField{Name: key.String(), Type: TYPE_STRING, Default: value.Value()}
+		sendData.DataFieldList = append(sendData.DataFieldList, field)
+		return true
+	})
+	return sendData, ""
+}
+
+// 识别在之前的响应中出现、在之后的请求中使用的值，转换为提取变量和模板引用
+func harVariables(entries []harEntry, steps []TransactionOptionsData, result *HarImportResult) {
+	var tokens []*harToken
+	var requests strings.Builder // 已发送的请求数据
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	for i := range entries {
+		// 先替换本步骤请求中引用的之前的值，再收集本步骤响应中的新值
+		harRequestText(&requests, &entries[i])
+		sort.SliceStable(tokens, func(a, b int) bool { return len(tokens[a].value) > len(tokens[b].value) })
+		for _, token := range tokens {
+			if token.name == "" {
+				if !harReplace(&steps[i], token) {
+					continue
+				}
+				token.name = harVarName(token.key, names)
+				step := &steps[token.step]
+				if step.Extract == nil {
+					step.Extract = make(map[string]string)
+				}
+				step.Extract[token.name] = token.path
+				result.Variables[token.name] = step.Name
+			}
+			harReplace(&steps[i], token)
+		}
+		sent := requests.String()
+		for _, token := range harResponseTokens(&entries[i]) {
+			// 请求中已经出现过的值不是服务端生成的
+			if seen[token.value] || strings.Contains(sent, token.value) {
+				continue
+			}
+			seen[token.value] = true
+			token.step = i
+			tokens = append(tokens, token)
+		}
+	}
+}
+
+// 已发送的请求数据，用于排除客户端提供的值
+func harRequestText(b *strings.Builder, entry *harEntry) {
+	b.WriteString(entry.Request.Url)
+	for _, v := range entry.Request.Headers {
+		b.WriteString("\n" + v.Value)
+	}
+	for _, v := range entry.Request.Cookies {
+		b.WriteString("\n" + v.Value)
+	}
+	if entry.Request.PostData != nil {
+		b.WriteString("\n" + entry.Request.PostData.Text)
+		for _, v := range entry.Request.PostData.Params {
+			b.WriteString("\n" + v.Value)
+		}
+	}
+	b.WriteString("\n")
+}
+
+// JSON响应中像令牌、id的字符串值
+func harResponseTokens(entry *harEntry) []*harToken {
+	content := entry.Response.Content
+	if content.Encoding != "" || !strings.Contains(content.MimeType, "json") {
+		return nil
+	}
+	var tokens []*harToken
+	var walk func(prefix string, value gjson.Result)
+	walk = func(prefix string, value gjson.Result) {
+		value.ForEach(func(key, v gjson.Result) bool {
+			path := harEscapePath(key.String())
+			if prefix != "" {
+				path = prefix + "." + path
+			}
+			if v.IsObject() || v.IsArray() {
+				walk(path, v)
+			} else if v.Type == gjson.String && harIsToken(v.String()) {
+				tokens = append(tokens, &harToken{value: v.String(), key: key.String(), path: path})
+			}
+			return true
+		})
+	}
+	walk("", gjson.Parse(content.Text))
+	return tokens
+}
+
+// 足够长、没有空白，并且同时包含字母和数字（或者很长）的值
+func harIsToken(s string) bool {
+	if len(s) < HAR_MIN_TOKEN_LEN {
+		return false
+	}
+	var letter, digit bool
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			return false
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsLetter(r):
+			letter = true
+		}
+	}
+	return letter && digit || len(s) >= 2*HAR_MIN_TOKEN_LEN
+}
+
+func harEscapePath(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		if strings.ContainsRune(`.*?|#@\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// 字段名作为变量名，重复时加序号
+func harVarName(key string, names map[string]bool) string {
+	base := strings.Trim(harVarRegexp.ReplaceAllString(key, "_"), "_")
+	if base == "" || unicode.IsDigit(rune(base[0])) {
+		base = "var" + base
+	}
+	name := base
+	for i := 2; names[name]; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	names[name] = true
+	return name
+}
+
+// 替换步骤中出现的值，token还没有变量名时只检查是否出现
+func harReplace(step *TransactionOptionsData, token *harToken) bool {
+	found := false
+	replace := func(s string) string {
+		if !strings.Contains(s, token.value) {
+			return s
+		}
+		found = true
+		if token.name == "" {
+			return s
+		}
+		return strings.Replace(s, token.value, "{{"+token.name+"}}", -1)
+	}
+	step.Url = replace(step.Url)
+	for k, v := range step.HttpOptions.Header {
+		step.HttpOptions.Header[k] = replace(v)
+	}
+	for k, v := range step.HttpOptions.Cookie {
+		step.HttpOptions.Cookie[k] = replace(v)
+	}
+	// 请求体的字段值不渲染模板，值相同时改为引用变量
+	if step.SendData != nil {
+		for _, field := range step.SendData.DataFieldList {
+			if s, ok := field.Default.(string); ok && s == token.value {
+				found = true
+				if token.name != "" {
+					field.Type, field.Dynamic, field.Default = TYPE_VAR, token.name, nil
+				}
+			}
+		}
+	}
+	return found
+}
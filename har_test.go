@@ -0,0 +1,246 @@
+package gobom
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 录制的请求，start为相对第一个请求的毫秒数
+func testHarEntry(start, cost int, method, url string, headers map[string]string, body, mimeType, respBody string) harEntry {
+	entry := harEntry{
+		StartedDateTime: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(start) * time.Millisecond),
+		Time:            float64(cost),
+	}
+	entry.Request.Method = method
+	entry.Request.Url = url
+	for k, v := range headers {
+		entry.Request.Headers = append(entry.Request.Headers, harNameValue{Name: k, Value: v})
+	}
+	if body != "" {
+		entry.Request.PostData = &harPostData{MimeType: "application/json", Text: body}
+	}
+	entry.Response.Status = 200
+	entry.Response.Content.MimeType = mimeType
+	entry.Response.Content.Text = respBody
+	return entry
+}
+
+func TestHar(t *testing.T) {
+	var (
+		authorized int
+		sessions   int
+		mu         sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/login":
+			// 每次登录生成新的令牌
+			token := fmt.Sprintf("tk%dx%d", time.Now().UnixNano(), authorized)
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s-" + token})
+			fmt.Fprintf(w, `{"data":{"token":%q,"user.id":"u-20260101"}}`, token)
+		default:
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if token != "" && r.URL.Query().Get("token") == token && (r.Method == "GET" || body["token"] == token) {
+				authorized++
+			}
+			if c, err := r.Cookie("sid"); err == nil && c.Value == "s-"+token {
+				sessions++
+			}
+			io.WriteString(w, `{"code":0}`)
+		}
+	}))
+	defer server.Close()
+
+	const token = "eyJhbGciOiJIUzI1NiJ9.abc123"
+	base := server.URL
+	login := testHarEntry(0, 100, "POST", base+"/login", map[string]string{
+		":authority": "gobom.test", "Host": "gobom.test", "Content-Type": "application/json", "Accept-Encoding": "gzip",
+	}, `{"user":"alice","password":"secret-2026","remember":true}`, "application/json; charset=utf-8",
+		`{"data":{"token":"`+token+`","user.id":"u-20260101","echo":"secret-2026","name":"alice"}}`)
+	login.Response.Cookies = []harNameValue{{Name: "sid", Value: "s-" + token}}
+	login.Request.Cookies = []harNameValue{{Name: "theme", Value: "dark"}}
+	entries := []harEntry{
+		login,
+		testHarEntry(150, 20, "GET", base+"/static/app.js", nil, "", "application/javascript", ""),
+		testHarEntry(160, 20, "GET", base+"/logo.png", nil, "", "image/png", ""),
+		testHarEntry(170, 30, "GET", "https://stats.analytics.test/collect", nil, "", "text/plain", ""),
+		testHarEntry(300, 10, "GET", base+"/orders?token="+token+"&user=u-20260101", map[string]string{"Authorization": "Bearer " + token}, "", "application/json", `{"code":0}`),
+		testHarEntry(310, 10, "POST", base+"/orders", map[string]string{"Authorization": "Bearer " + token, "Cookie": "sid=s-" + token}, `{"token":"`+token+`","qty":2}`, "application/json", `{"code":0}`),
+	}
+	entries[5].Request.Url += "?token=" + token
+	entries[5].Request.Cookies = []harNameValue{{Name: "sid", Value: "s-" + token}, {Name: "theme", Value: "dark"}}
+	// 录制顺序与开始时间不一致时按开始时间排序
+	entries[4], entries[5] = entries[5], entries[4]
+	var har harFile
+	har.Log.Entries = entries
+	data, _ := json.Marshal(har)
+
+	result, err := ImportHar(data, &HarImportOptions{Name: "orders", ExcludeDomains: []string{"*.analytics.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 3 || result.Skipped != 3 {
+		t.Fatalf("imported %d skipped %d", result.Imported, result.Skipped)
+	}
+	script := result.Script
+	opt, err := script.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := opt.TransactionOptions.TransactionOptionsDataList
+	if script.Protocol != FORM_HTTP || opt.Url != base+"/login" || !opt.HttpOptions.CookieJar {
+		t.Errorf("script: %+v", opt)
+	}
+
+	// 请求头、cookie、请求体和思考时间
+	if steps[0].Name != "1 POST /login" || steps[2].Name != "3 POST /orders" {
+		t.Errorf("names: %s %s", steps[0].Name, steps[2].Name)
+	}
+	if h := steps[0].HttpOptions.Header; len(h) != 1 || h["Content-Type"] != "application/json" {
+		t.Errorf("headers: %v", h)
+	}
+	if c := steps[2].HttpOptions.Cookie; len(c) != 1 || c["theme"] != "dark" {
+		t.Errorf("cookies: %v", c)
+	}
+	if fields := steps[0].SendData.DataFieldList; len(fields) != 3 || fields[0].Name != "user" || fields[0].Default != "alice" || fields[2].Default != true {
+		t.Errorf("body: %+v", fields)
+	}
+	if steps[0].Interval != 200 || steps[1].Interval != 0 || steps[2].Interval != 0 {
+		t.Errorf("intervals: %d %d %d", steps[0].Interval, steps[1].Interval, steps[2].Interval)
+	}
+
+	// 动态值转换为提取变量，请求中出现过的值不提取
+	if len(result.Variables) != 2 || result.Variables["token"] != steps[0].Name {
+		t.Errorf("variables: %v", result.Variables)
+	}
+	if e := steps[0].Extract; len(e) != 2 || e["token"] != "data.token" || e["user_id"] != `data.user\.id` {
+		t.Errorf("extract: %v", e)
+	}
+	if steps[1].Url != base+"/orders?token={{token}}&user={{user_id}}" || steps[1].HttpOptions.Header["Authorization"] != "Bearer {{token}}" {
+		t.Errorf("template: %s %v", steps[1].Url, steps[1].HttpOptions.Header)
+	}
+	if field := steps[2].SendData.DataFieldList[0]; field.Type != TYPE_VAR || field.Dynamic != "token" {
+		t.Errorf("body variable: %+v", field)
+	}
+
+	// 导入的脚本使用运行时提取的令牌
+	opt.Form = script.Protocol
+	requester, err := NewRequester(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = requester.dispose(); err != nil {
+		t.Fatal(err)
+	}
+	requester.close()
+	mu.Lock()
+	if authorized != 2 || sessions != 2 {
+		t.Errorf("authorized %d sessions %d", authorized, sessions)
+	}
+	mu.Unlock()
+
+	// 过滤选项
+	if result, err = ImportHar(data, &HarImportOptions{KeepStatic: true, IncludeDomains: []string{"127.0.0.1"}, NoThinkTime: true}); err != nil || result.Imported != 5 {
+		t.Fatalf("keep static: %+v %v", result, err)
+	}
+	opt, _ = result.Script.Options()
+	for _, step := range opt.TransactionOptions.TransactionOptionsDataList {
+		if step.Interval != 0 {
+			t.Errorf("think time: %s %d", step.Name, step.Interval)
+		}
+	}
+	if result, err = ImportHar(data, &HarImportOptions{StaticTypes: []string{"application/json"}}); err != nil || result.Imported != 3 {
+		t.Errorf("static types: %+v %v", result, err)
+	}
+	if _, err = ImportHar(data, &HarImportOptions{IncludeDomains: []string{"gobom.test"}}); err != ERR_HAR_EMPTY {
+		t.Errorf("empty: %v", err)
+	}
+	if _, err = ImportHar([]byte("{"), &HarImportOptions{}); err == nil || !strings.HasPrefix(err.Error(), ERR_HAR_PARSE.Error()) {
+		t.Errorf("parse: %v", err)
+	}
+
+	// 接口：JSON提交和上传文件，需要项目的编辑权限
+	initTestDb(t)
+	gin.SetMode(gin.TestMode)
+	api := httptest.NewServer(NewApi().Http)
+	defer api.Close()
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := apiLogin(t, api, DEFAULT_ADMIN_NAME, "admin-password")
+	_, reply := apiCall(t, api, admin, "/project/add", &ProjectData{Name: "har"})
+	projectId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+
+	_, reply = apiCall(t, api, admin, "/script/import/har", &ScriptImportHarReqData{
+		HarImportOptions: HarImportOptions{Name: "har-json", ProjectId: projectId},
+		Har:              string(data),
+	})
+	if reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	imported := reply.Data.(map[string]interface{})
+	if id := imported["script"].(map[string]interface{})["ID"].(float64); id == 0 || imported["imported"].(float64) != 4 {
+		t.Errorf("import: %v", imported)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("projectId", fmt.Sprint(projectId))
+	writer.WriteField("excludeDomains", "*.analytics.test")
+	part, _ := writer.CreateFormFile("file", "checkout.har")
+	part.Write(data)
+	writer.Close()
+	req, _ := http.NewRequest(http.MethodPost, api.URL+"/script/import/har", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+admin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = &ApiReply{}
+	json.NewDecoder(resp.Body).Decode(reply)
+	resp.Body.Close()
+	if reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	scripts, _ := (&ScriptData{}).Get()
+	if len(scripts) != 2 || scripts[1].Name != "checkout" || scripts[1].ProjectId != projectId {
+		t.Errorf("scripts: %+v", scripts)
+	}
+	var audits []AuditData
+	GobomStore.GetDb().Table(GobomStore.GetTableName(&AuditData{})).Where("action = ?", AUDIT_SCRIPT_ADD).Find(&audits)
+	if len(audits) != 2 || audits[0].ProjectId != projectId {
+		t.Errorf("audits: %+v", audits)
+	}
+
+	// 其他项目没有编辑权限
+	_, reply = apiCall(t, api, admin, "/project/add", &ProjectData{Name: "other"})
+	otherId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	_, reply = apiCall(t, api, admin, "/user/add", map[string]string{"name": "viewer", "password": "viewer-password"})
+	if reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	viewer := apiLogin(t, api, "viewer", "viewer-password")
+	_, reply = apiCall(t, api, viewer, "/script/import/har", &ScriptImportHarReqData{
+		HarImportOptions: HarImportOptions{Name: "denied", ProjectId: otherId},
+		Har:              string(data),
+	})
+	if reply.Msg == "" {
+		t.Error("viewer imported script")
+	}
+}
@@ -1,9 +1,12 @@
 package gobom
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -11,8 +14,6 @@ import (
 	"gobom/utils"
 )
 
-var gobomClient fasthttp.Client
-
 type Http struct {
 	startTime          time.Duration
 	endTime            time.Duration
@@ -21,51 +22,72 @@ type Http struct {
 	resultResp         chan<- *Response
 	opt                *Options
 	response           *fasthttp.Response
+	cookieJar          *CookieJar
+	h2                 *http2Pool // HTTP/2连接池，HTTP/1.1时为nil
+	tlsConfig          *tls.Config
+	clients            map[string]*fasthttp.HostClient // 每个虚拟用户独立的连接，[scheme://地址]
+	conns              *vuConns
+	handshakeNum       uint64                 // 上次统计后的TLS握手次数
+	handshakeTime      uint64                 // 上次统计后的TLS握手时间（毫秒）
+	step               TransactionOptionsData // 当前执行的事务步骤
 	TransactionOptions *TransactionOptions
 }
 
 func NewHttpRequest(opt *Options) (*Http, error) {
-	return &Http{
+	switch opt.HttpOptions.Protocol {
+	case HTTP_PROTOCOL_1, HTTP_PROTOCOL_2, HTTP_PROTOCOL_H2C:
+	default:
+		return nil, ERR_HTTP_PROTOCOL
+	}
+	if err := opt.ConnOptions.Check(); err != nil {
+		return nil, err
+	}
+	http := &Http{
 		errRetries:         ERR_RETRIES,
 		opt:                opt,
 		TransactionOptions: opt.TransactionOptions.Copy(),
-	}, nil
+	}
+	if opt.HttpOptions.CookieJar {
+		http.cookieJar = NewCookieJar()
+	}
+	conns, err := newVuConns(opt)
+	if err != nil {
+		return nil, err
+	}
+	http.conns = conns
+	if opt.HttpOptions.Protocol != HTTP_PROTOCOL_1 {
+		pool, err := acquireHttp2Pool(opt)
+		if err != nil {
+			return nil, err
+		}
+		http.h2 = pool
+		return http, nil
+	}
+	config, err := opt.TlsOptions.acquireConfig()
+	if err != nil {
+		return nil, err
+	}
+	http.tlsConfig = config
+	http.clients = make(map[string]*fasthttp.HostClient)
+	return http, nil
 }
 
 func (http *Http) dispose() (response *Response, err error) {
+	if http.cookieJar != nil && http.opt.HttpOptions.ClearCookieJar {
+		http.cookieJar.Clear()
+	}
+	if http.h2 == nil && http.opt.ConnOptions.NewConn == CONN_PER_ITERATION {
+		http.conns.closeAll()
+		http.clients = make(map[string]*fasthttp.HostClient)
+	}
 	if !http.TransactionOptions.Empty() {
-		response := &Response{
-			TransactionWasteTime: make(map[string]uint64),
-		}
-		respTemp := &Response{}
-		isSuccess := true
-		for _, data := range http.TransactionOptions.TransactionOptionsDataList {
-			if err = http.send(); err != nil {
-				err = fmt.Errorf(fmt.Sprint(data.Name, "，错误原因：", err.Error()))
-				isSuccess = false
-				break
-			}
-			respTemp, err = http.recv()
-			if err != nil {
-				err = fmt.Errorf(fmt.Sprint(data.Name, "，错误原因：", err.Error()))
-				isSuccess = false
-				break
-			}
-			if respTemp.Data != nil {
-				http.TransactionOptions.SetTransactionResponse(data.Name, respTemp.Data)
+		return http.TransactionOptions.Run(func(data TransactionOptionsData) (*Response, error) {
+			http.step = data
+			if err := http.send(); err != nil {
+				return nil, err
 			}
-			if data.Interval != 0 {
-				time.Sleep(time.Duration(data.Interval) * time.Millisecond)
-			}
-			response.TransactionWasteTime[data.Name] = respTemp.WasteTime
-			response.WasteTime += respTemp.WasteTime
-		}
-		response.IsSuccess = isSuccess
-		if err != nil {
-			response.ErrMsg = err.Error()
-		}
-
-		return response, err
+			return http.recv()
+		})
 	}
 	if err := http.send(); err != nil {
 		return nil, err
@@ -85,10 +107,32 @@ func (http *Http) send() (err error) {
 	}()
 
 	http.startTime = utils.Now()
-	gobomClient.ReadTimeout = time.Duration(DEFAULT_REQUEST_TIMEOUT) * time.Second
-	gobomClient.MaxConnsPerHost = DEFAULT_MAX_CONN
-	http.err = gobomClient.DoTimeout(req, resp, time.Duration(DEFAULT_REQUEST_TIMEOUT)*time.Second)
+	if http.h2 != nil {
+		var handshake time.Duration
+		if handshake, http.err = http.h2.do(req, resp); handshake != 0 {
+			http.addHandshake(handshake)
+		}
+		if isProxyError(http.err) {
+			atomic.AddUint64(&http.conns.proxyErrors, 1)
+		}
+	} else {
+		if http.opt.ConnOptions.closeAfterRequest() {
+			req.SetConnectionClose()
+		}
+		// 请求过程中没有新建连接即为复用
+		opened, errors := atomic.LoadUint64(&http.conns.opened), atomic.LoadUint64(&http.conns.errors)+atomic.LoadUint64(&http.conns.proxyErrors)
+		http.err = http.hostClient(req.URI()).DoTimeout(req, resp, time.Duration(DEFAULT_REQUEST_TIMEOUT)*time.Second)
+		if http.err == nil && atomic.LoadUint64(&http.conns.opened) == opened {
+			atomic.AddUint64(&http.conns.reused, 1)
+		}
+		if http.err != nil && atomic.LoadUint64(&http.conns.errors)+atomic.LoadUint64(&http.conns.proxyErrors) == errors {
+			atomic.AddUint64(&http.conns.errors, 1)
+		}
+	}
 	http.response = resp
+	if http.cookieJar != nil && http.err == nil {
+		http.cookieJar.Save(req.URI().String(), resp)
+	}
 
 	return nil
 }
@@ -110,16 +154,69 @@ func (http *Http) recv() (response *Response, err error) {
 	}
 	http.endTime = utils.Now()
 
-	return &Response{
-		WasteTime: uint64(http.getRequestTime()),
-		IsSuccess: isSuccess,
-		ErrCode:   http.response.StatusCode(),
-		ErrMsg:    errMsg,
-		Data:      http.response.Body(),
-	}, http.err
+	response = &Response{
+		WasteTime:     uint64(http.getRequestTime()),
+		IsSuccess:     isSuccess,
+		ErrCode:       http.response.StatusCode(),
+		ErrMsg:        errMsg,
+		Data:          http.response.Body(),
+		HandshakeNum:  atomic.SwapUint64(&http.handshakeNum, 0),
+		HandshakeTime: atomic.SwapUint64(&http.handshakeTime, 0),
+	}
+	http.conns.fill(response)
+	return response, http.err
 }
 
-func (http *Http) close() {}
+func (http *Http) close() {
+	if http.h2 != nil {
+		http.h2.release(http.opt)
+		http.h2 = nil
+	}
+	if http.tlsConfig != nil {
+		http.opt.TlsOptions.releaseConfig()
+		http.tlsConfig = nil
+	}
+	http.conns.release()
+}
+
+func (http *Http) hostClient(uri *fasthttp.URI) *fasthttp.HostClient {
+	isTLS := string(uri.Scheme()) == "https"
+	addr := hostAddr(string(uri.Host()), isTLS)
+	key := string(uri.Scheme()) + "://" + addr
+	hostClient, ok := http.clients[key]
+	if !ok {
+		hostClient = &fasthttp.HostClient{
+			Addr:        addr,
+			ReadTimeout: time.Duration(DEFAULT_REQUEST_TIMEOUT) * time.Second,
+			MaxConns:    DEFAULT_MAX_CONN,
+			Dial: func(addr string) (net.Conn, error) {
+				return http.dial(addr, isTLS)
+			},
+		}
+		http.clients[key] = hostClient
+	}
+	return hostClient
+}
+
+// 由连接完成TLS握手（fasthttp不会再次握手），以统计握手时间
+func (http *Http) dial(addr string, isTLS bool) (net.Conn, error) {
+	conn, err := http.conns.dial(addr)
+	if err != nil || !isTLS {
+		return conn, err
+	}
+	tlsConn, handshake, err := tlsHandshake(conn, http.tlsConfig, addr)
+	if err != nil {
+		atomic.AddUint64(&http.conns.errors, 1)
+		return nil, err
+	}
+	http.addHandshake(handshake)
+	return tlsConn, nil
+}
+
+func (http *Http) addHandshake(handshake time.Duration) {
+	atomic.AddUint64(&http.handshakeNum, 1)
+	atomic.AddUint64(&http.handshakeTime, uint64(handshake/time.Millisecond))
+}
 
 func (http *Http) getRequestTime() time.Duration {
 	if http.startTime == 0 || http.endTime == 0 || http.endTime < http.startTime {
@@ -137,7 +234,7 @@ func (http *Http) fillHttp(req *fasthttp.Request, transactionOptions *Transactio
 		sendData = http.opt.SendData
 	)
 
-	transactionOptionsData := transactionOptions.Get()
+	transactionOptionsData := http.step
 	if !transactionOptionsData.Empty() {
 		sendData = transactionOptionsData.SendData
 		url = transactionOptionsData.Url
@@ -152,15 +249,18 @@ func (http *Http) fillHttp(req *fasthttp.Request, transactionOptions *Transactio
 
 	sendData.init()
 
-	req.SetRequestURI(url)
+	req.SetRequestURI(transactionOptions.Render(url))
 	req.Header.SetMethod(method)
 	req.Header.Set("user-agent", "gobom")
 	req.Header.Set("Content-Type", "application/json")
 	for k, v := range cookie {
-		req.Header.SetCookie(k, v)
+		req.Header.SetCookie(k, transactionOptions.Render(v))
 	}
 	for k, v := range header {
-		req.Header.Set(k, v)
+		req.Header.Set(k, transactionOptions.Render(v))
+	}
+	if http.cookieJar != nil {
+		http.cookieJar.Fill(req.URI().String(), req)
 	}
 	if sendData != nil {
 		if bm, err := json.Marshal(sendData.GetSendDataToMap(transactionOptions)); err == nil {
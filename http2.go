@@ -0,0 +1,327 @@
+package gobom
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+const (
+	HTTP_PROTOCOL_1   = ""    // HTTP/1.1（fasthttp）
+	HTTP_PROTOCOL_2   = "h2"  // HTTP/2 over TLS
+	HTTP_PROTOCOL_H2C = "h2c" // HTTP/2明文（prior knowledge）
+
+	DEFAULT_HTTP2_STREAMS = 100
+)
+
+// HTTP/2连接池，请求和响应与fasthttp互相转换，两种协议使用相同的cookie和统计逻辑
+type http2Pool struct {
+	protocol   string
+	maxStreams int
+	maxConns   int // 每个地址的最大连接数，0为不限制（连接的流都占满时新建连接）
+	conns      map[string][]*http2Conn
+	next       int
+	shared     bool
+	refs       int
+	tlsConfig  *tls.Config
+	transport  *http2.Transport
+	proxies    []*url.URL
+	proxy      int // 下一个连接使用的代理，每个连接轮流使用
+	resolver   *dnsResolver
+	localIps   []net.IP
+	localIp    int // 下一个连接绑定的本地IP
+	mu         sync.Mutex
+}
+
+type http2Conn struct {
+	cc        *http2.ClientConn
+	handshake time.Duration // TLS握手时间
+	err       error         // 建立连接的错误
+	ready     chan struct{} // 连接建立完成后关闭
+	streams   int           // 正在进行的请求数
+}
+
+// 同一个脚本的虚拟用户共用的连接池
+var http2Pools = struct {
+	pools map[*Options]*http2Pool
+	mu    sync.Mutex
+}{pools: make(map[*Options]*http2Pool)}
+
+func acquireHttp2Pool(opt *Options) (*http2Pool, error) {
+	if opt.HttpOptions.Connections != 0 {
+		return newHttp2Pool(opt)
+	}
+	http2Pools.mu.Lock()
+	defer http2Pools.mu.Unlock()
+	pool, ok := http2Pools.pools[opt]
+	if !ok {
+		var err error
+		if pool, err = newHttp2Pool(opt); err != nil {
+			return nil, err
+		}
+		pool.shared = true
+		http2Pools.pools[opt] = pool
+	}
+	pool.refs++
+	return pool, nil
+}
+
+func newHttp2Pool(opt *Options) (*http2Pool, error) {
+	proxies, err := opt.ProxyOptions.parse()
+	if err != nil {
+		return nil, err
+	}
+	if err = opt.DnsOptions.Check(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := opt.TlsOptions.acquireConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	pool := &http2Pool{
+		protocol:   opt.HttpOptions.Protocol,
+		maxStreams: int(opt.HttpOptions.MaxStreams),
+		maxConns:   int(opt.HttpOptions.Connections),
+		conns:      make(map[string][]*http2Conn),
+		tlsConfig:  tlsConfig,
+		transport:  &http2.Transport{AllowHTTP: true},
+		proxies:    proxies,
+		resolver:   newDnsResolver(opt.DnsOptions),
+	}
+	for _, ip := range opt.DnsOptions.LocalIps {
+		pool.localIps = append(pool.localIps, net.ParseIP(ip))
+	}
+	if pool.maxStreams == 0 {
+		pool.maxStreams = DEFAULT_HTTP2_STREAMS
+	}
+	return pool, nil
+}
+
+func (pool *http2Pool) release(opt *Options) {
+	if pool.shared {
+		http2Pools.mu.Lock()
+		defer http2Pools.mu.Unlock()
+		if pool.refs--; pool.refs > 0 {
+			return
+		}
+		delete(http2Pools.pools, opt)
+	}
+	opt.TlsOptions.releaseConfig()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for addr, list := range pool.conns {
+		for _, c := range list {
+			<-c.ready
+			if c.cc != nil {
+				c.cc.Close()
+			}
+		}
+		delete(pool.conns, addr)
+	}
+}
+
+// 发送请求，新建TLS连接时返回握手时间
+func (pool *http2Pool) do(req *fasthttp.Request, resp *fasthttp.Response) (time.Duration, error) {
+	scheme := "https"
+	if pool.protocol == HTTP_PROTOCOL_H2C {
+		scheme = "http"
+	}
+	uri := req.URI()
+	host := string(uri.Host())
+	hreq, err := http.NewRequest(string(req.Header.Method()), scheme+"://"+host+string(uri.RequestURI()), bytes.NewReader(req.Body()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.VisitAll(func(key, value []byte) {
+		switch k := string(key); k {
+		case fasthttp.HeaderHost, fasthttp.HeaderContentLength, fasthttp.HeaderConnection, fasthttp.HeaderTransferEncoding:
+		default:
+			hreq.Header.Add(k, string(value))
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_REQUEST_TIMEOUT*time.Second)
+	defer cancel()
+	hreq = hreq.WithContext(ctx)
+
+	c, handshake, err := pool.get(hostAddr(host, scheme == "https"))
+	if err != nil {
+		return handshake, err
+	}
+	defer pool.put(c)
+
+	hresp, err := c.cc.RoundTrip(hreq)
+	if err != nil {
+		return handshake, err
+	}
+	defer hresp.Body.Close()
+	body, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return handshake, err
+	}
+	resp.SetStatusCode(hresp.StatusCode)
+	for k, list := range hresp.Header {
+		for _, v := range list {
+			switch k {
+			case fasthttp.HeaderContentLength:
+			case fasthttp.HeaderSetCookie, fasthttp.HeaderContentType:
+				resp.Header.Set(k, v)
+			default:
+				resp.Header.Add(k, v)
+			}
+		}
+	}
+	resp.SetBody(body)
+	return handshake, nil
+}
+
+// 优先使用有空闲流的连接，都占满时新建连接，达到连接数上限后使用请求最少的连接
+// 建立连接的虚拟用户统计握手时间
+func (pool *http2Pool) get(addr string) (c *http2Conn, handshake time.Duration, err error) {
+	pool.mu.Lock()
+	if c = pool.pick(addr); c == nil {
+		// 正在建立的连接也可以分配流，避免同时启动的虚拟用户各自建立连接
+		c = &http2Conn{ready: make(chan struct{})}
+		pool.conns[addr] = append(pool.conns[addr], c)
+		c.streams++
+		pool.mu.Unlock()
+		c.cc, c.handshake, c.err = pool.dial(addr)
+		close(c.ready)
+		handshake = c.handshake
+	} else {
+		c.streams++
+		pool.mu.Unlock()
+		<-c.ready
+	}
+	if c.err != nil {
+		pool.put(c)
+		return nil, handshake, c.err
+	}
+	return c, handshake, nil
+}
+
+func (pool *http2Pool) pick(addr string) *http2Conn {
+	list := pool.conns[addr][:0]
+	for _, c := range pool.conns[addr] {
+		// 建立失败、已关闭或收到GOAWAY的连接
+		if c.usable() || c.streams != 0 {
+			list = append(list, c)
+		} else if c.cc != nil {
+			c.cc.Close()
+		}
+	}
+	pool.conns[addr] = list
+	// 限制连接数时先建满连接，之后轮流使用
+	if pool.maxConns == 0 || len(list) >= pool.maxConns {
+		for i := range list {
+			c := list[(pool.next+i)%len(list)]
+			if c.streams < pool.maxStreams && c.usable() {
+				pool.next++
+				return c
+			}
+		}
+	}
+	if pool.maxConns == 0 || len(list) < pool.maxConns {
+		return nil
+	}
+	var idle *http2Conn
+	for _, c := range list {
+		if idle == nil || c.streams < idle.streams {
+			idle = c
+		}
+	}
+	return idle
+}
+
+func (pool *http2Pool) put(c *http2Conn) {
+	pool.mu.Lock()
+	c.streams--
+	pool.mu.Unlock()
+}
+
+// 连接建立中或者可以发送新的请求
+func (c *http2Conn) usable() bool {
+	select {
+	case <-c.ready:
+		return c.err == nil && c.cc.CanTakeNewRequest()
+	default:
+		return true
+	}
+}
+
+func (pool *http2Pool) dial(addr string) (*http2.ClientConn, time.Duration, error) {
+	proxy, localIp := pool.nextDial()
+	dialer := &net.Dialer{
+		Timeout:   DEFAULT_REQUEST_TIMEOUT * time.Second,
+		LocalAddr: localAddr("tcp", localIp),
+	}
+	var (
+		conn   net.Conn
+		err    error
+		target = addr
+	)
+	if proxy != nil {
+		conn, err = dialProxy(dialer, proxy, pool.resolver.mapHost(addr))
+	} else if target, err = pool.resolver.resolve(addr); err == nil {
+		conn, err = dialer.Dial("tcp", target)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var handshake time.Duration
+	if pool.protocol == HTTP_PROTOCOL_2 {
+		tlsConn, d, err := tlsHandshake(conn, pool.tlsConfig, addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+			conn.Close()
+			return nil, d, ERR_HTTP2_NEGOTIATE
+		}
+		conn, handshake = tlsConn, d
+	}
+	cc, err := pool.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, handshake, err
+	}
+	return cc, handshake, nil
+}
+
+// 新建连接使用的代理和本地IP
+func (pool *http2Pool) nextDial() (proxy *url.URL, localIp net.IP) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.proxies) != 0 {
+		proxy = pool.proxies[pool.proxy]
+		pool.proxy = (pool.proxy + 1) % len(pool.proxies)
+	}
+	if len(pool.localIps) != 0 {
+		localIp = pool.localIps[pool.localIp]
+		pool.localIp = (pool.localIp + 1) % len(pool.localIps)
+	}
+	return proxy, localIp
+}
+
+// 没有端口时按协议补充默认端口
+func hostAddr(host string, isTLS bool) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if isTLS {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
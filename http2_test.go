@@ -0,0 +1,180 @@
+package gobom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// 同时支持HTTP/1.1和h2c的测试服务，wait为true的请求等待另一个请求到达后再响应
+func startTestHttp2Server(t *testing.T) (*httptest.Server, *int32) {
+	var (
+		conns   int32
+		waiting chan struct{}
+		mu      sync.Mutex
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if gjson.GetBytes(body, "wait").Bool() {
+			mu.Lock()
+			if waiting == nil {
+				ch := make(chan struct{})
+				waiting = ch
+				mu.Unlock()
+				<-ch
+			} else {
+				close(waiting)
+				waiting = nil
+				mu.Unlock()
+			}
+		}
+		w.Header().Set("X-Proto", r.Proto)
+		json.NewEncoder(w).Encode(map[string]interface{}{"proto": r.ProtoMajor, "name": gjson.GetBytes(body, "name").String(), "token": r.Header.Get("token")})
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "h2", Path: "/"})
+	})
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "h2" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	server := httptest.NewUnstartedServer(h2c.NewHandler(mux, &http2.Server{}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+func TestHttp2(t *testing.T) {
+	server, conns := startTestHttp2Server(t)
+	newOpt := func(protocol string, fields ...*DataField) *Options {
+		return &Options{
+			Url:         server.URL + "/echo",
+			Form:        FORM_HTTP,
+			HttpOptions: HttpOptions{Method: "POST", Protocol: protocol, Header: map[string]string{"token": "secret"}},
+			SendData:    &SendData{DataFieldList: fields},
+		}
+	}
+	call := func(requester Requester) *Response {
+		resp, err := requester.dispose()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// 两种引擎返回相同结构的结果
+	for protocol, major := range map[string]int64{HTTP_PROTOCOL_1: 1, HTTP_PROTOCOL_H2C: 2} {
+		requester, err := NewRequester(newOpt(protocol, &DataField{Name: "name", Default: "gobom"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := call(requester)
+		requester.close()
+		if !resp.IsSuccess || resp.ErrCode != http.StatusOK || gjson.GetBytes(resp.Data, "proto").Int() != major ||
+			gjson.GetBytes(resp.Data, "name").String() != "gobom" || gjson.GetBytes(resp.Data, "token").String() != "secret" {
+			t.Errorf("%q: %+v %s", protocol, resp, resp.Data)
+		}
+	}
+
+	// 同一个脚本的虚拟用户共用连接，流占满时新建连接
+	countConns := func(opt *Options, vus int) int32 {
+		atomic.StoreInt32(conns, 0)
+		opt.SendData.init()
+		var wg sync.WaitGroup
+		for i := 0; i < vus; i++ {
+			requester, err := NewRequester(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer requester.close()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if resp, err := requester.dispose(); err != nil || !resp.IsSuccess {
+					t.Errorf("dispose: %+v %v", resp, err)
+				}
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt32(conns)
+	}
+	opt := newOpt(HTTP_PROTOCOL_H2C, &DataField{Name: "wait", Default: true})
+	if n := countConns(opt, 2); n != 1 {
+		t.Errorf("shared connections: %d", n)
+	}
+	opt = newOpt(HTTP_PROTOCOL_H2C, &DataField{Name: "wait", Default: true})
+	opt.HttpOptions.MaxStreams = 1
+	if n := countConns(opt, 2); n != 2 {
+		t.Errorf("max streams: %d", n)
+	}
+	if len(http2Pools.pools) != 0 {
+		t.Errorf("pools not released: %d", len(http2Pools.pools))
+	}
+
+	// 每个虚拟用户独立的连接，轮流使用
+	atomic.StoreInt32(conns, 0)
+	opt = newOpt(HTTP_PROTOCOL_H2C)
+	opt.HttpOptions.Connections = 2
+	requester, err := NewRequester(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		call(requester)
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Errorf("connections per vu: %d", n)
+	}
+	requester.close()
+
+	// cookie
+	opt = newOpt(HTTP_PROTOCOL_H2C)
+	opt.HttpOptions.CookieJar = true
+	opt.TransactionOptions.TransactionOptionsDataList = []TransactionOptionsData{
+		{Name: "login", Url: server.URL + "/login"},
+		{Name: "me", Url: server.URL + "/me"},
+	}
+	if requester, err = NewRequester(opt); err != nil {
+		t.Fatal(err)
+	}
+	if resp := call(requester); !resp.IsSuccess || len(resp.TransactionWasteTime) != 2 {
+		t.Errorf("cookie: %+v", resp)
+	}
+	requester.close()
+
+	// TLS握手失败（证书不受信任）
+	tlsServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	opt = newOpt(HTTP_PROTOCOL_2)
+	opt.Url = tlsServer.URL
+	if requester, err = NewRequester(opt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = requester.dispose(); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("tls: %v", err)
+	}
+	requester.close()
+
+	if _, err = NewRequester(newOpt("spdy")); err != ERR_HTTP_PROTOCOL {
+		t.Errorf("protocol: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package gobom
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+const (
+	RULE_ALLOW = "allow"
+	RULE_DENY  = "deny"
+
+	DEFAULT_RESOLVE_TTL     = time.Minute // 域名解析结果的缓存时间
+	DEFAULT_RESOLVE_TIMEOUT = 3 * time.Second
+)
+
+// 压测地址的安全检查：管理员配置的允许/禁止规则
+// 有允许规则时，压测地址必须匹配其中一条；匹配任意禁止规则的地址不能压测
+type Interlock struct {
+	rules    []*TargetRuleData
+	resolved map[string]*resolvedHost // [主机名]解析结果
+	mu       sync.RWMutex
+}
+
+type resolvedHost struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// 解析后的压测地址
+type target struct {
+	raw  string
+	host string
+	ip   net.IP // 主机为IP时不为nil
+	port int    // 0为未知
+}
+
+var gobomInterlock = &Interlock{}
+
+// 从数据库加载规则，规则修改后调用
+func LoadInterlock() error {
+	var rules []*TargetRuleData
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(targetRuleTable)).Find(&rules).Error; err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			logger.Error("invalid target rule ", rule.ID, ": ", err)
+		}
+	}
+	gobomInterlock.setRules(rules)
+	return nil
+}
+
+func (interlock *Interlock) setRules(rules []*TargetRuleData) {
+	interlock.mu.Lock()
+	defer interlock.mu.Unlock()
+	interlock.rules = rules
+	interlock.resolved = make(map[string]*resolvedHost)
+}
+
+func (interlock *Interlock) getRules() []*TargetRuleData {
+	interlock.mu.RLock()
+	defer interlock.mu.RUnlock()
+	return interlock.rules
+}
+
+// 使用控制节点下发的规则，节点没有数据库
+func (interlock *Interlock) useRules(rules []*TargetRuleData) {
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			logger.Error("invalid target rule ", rule.ID, ": ", err)
+		}
+	}
+	interlock.setRules(rules)
+}
+
+// 检查所有压测地址，返回是否有地址需要确认后运行
+func (interlock *Interlock) CheckUrls(urls []string) (confirm bool, err error) {
+	for _, v := range urls {
+		c, err := interlock.Check(v)
+		if err != nil {
+			return false, err
+		}
+		confirm = confirm || c
+	}
+	return confirm, nil
+}
+
+// 检查压测地址，返回是否需要确认后运行
+func (interlock *Interlock) Check(rawUrl string) (confirm bool, err error) {
+	interlock.mu.RLock()
+	rules := interlock.rules
+	interlock.mu.RUnlock()
+	if len(rules) == 0 {
+		return false, nil
+	}
+
+	t, err := parseTarget(rawUrl)
+	if err != nil {
+		return false, fmt.Errorf("%s[%s]", ERR_TARGET_INVALID, rawUrl)
+	}
+	if strings.Contains(t.host, "{{") {
+		return false, fmt.Errorf("%s[%s]", ERR_TARGET_VARIABLE, rawUrl)
+	}
+	var allowed, hasAllow bool
+	for _, rule := range rules {
+		if rule.Action == RULE_ALLOW {
+			hasAllow = true
+		}
+		if !interlock.match(rule, t) {
+			continue
+		}
+		switch rule.Action {
+		case RULE_DENY:
+			return false, fmt.Errorf("%s[%s]", ERR_TARGET_DENIED, rawUrl)
+		case RULE_ALLOW:
+			allowed = true
+			confirm = confirm || rule.Confirm
+		}
+	}
+	if hasAllow && !allowed {
+		return false, fmt.Errorf("%s[%s]", ERR_TARGET_NOT_ALLOWED, rawUrl)
+	}
+	return confirm, nil
+}
+
+// 规则中设置的条件都满足时匹配
+func (interlock *Interlock) match(rule *TargetRuleData, t *target) bool {
+	if rule.Port != 0 && rule.Port != t.port {
+		return false
+	}
+	if rule.Host != "" && !matchHost(rule.Host, t.host) {
+		return false
+	}
+	if rule.network != nil {
+		ips := []net.IP{t.ip}
+		if t.ip == nil {
+			ips = interlock.resolve(t.host)
+		}
+		for _, ip := range ips {
+			if rule.network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return rule.Host != "" || rule.Port != 0
+}
+
+// 解析域名用于IP段规则，结果缓存一段时间
+func (interlock *Interlock) resolve(host string) []net.IP {
+	interlock.mu.RLock()
+	v, ok := interlock.resolved[host]
+	interlock.mu.RUnlock()
+	if ok && time.Now().Before(v.expire) {
+		return v.ips
+	}
+	resolver := &net.Resolver{}
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_RESOLVE_TIMEOUT)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		logger.Debug(err)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	interlock.mu.Lock()
+	if interlock.resolved != nil {
+		interlock.resolved[host] = &resolvedHost{ips: ips, expire: time.Now().Add(DEFAULT_RESOLVE_TTL)}
+	}
+	interlock.mu.Unlock()
+	return ips
+}
+
+// 主机名匹配，*.example.com匹配example.com的所有子域名
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// 解析压测地址，支持URL（http://host:port/path）和TCP地址（host:port）
+func parseTarget(raw string) (*target, error) {
+	t := &target{raw: raw}
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			// 主机名中的变量会导致解析失败
+			if host := hostOf(raw); strings.Contains(host, "{{") {
+				t.host = host
+				return t, nil
+			}
+			return nil, err
+		}
+		t.host = u.Hostname()
+		if port := u.Port(); port != "" {
+			t.port, _ = strconv.Atoi(port)
+		} else {
+			switch strings.ToLower(u.Scheme) {
+			case "http", "ws":
+				t.port = 80
+			case "https", "wss":
+				t.port = 443
+			}
+		}
+	} else if host, port, err := net.SplitHostPort(raw); err == nil {
+		t.host = host
+		t.port, _ = strconv.Atoi(port)
+	} else {
+		t.host = raw
+	}
+	if t.host == "" {
+		return nil, ERR_URL
+	}
+	t.ip = net.ParseIP(t.host)
+	return t, nil
+}
+
+// scheme://host:port/path 中的host
+func hostOf(raw string) string {
+	s := raw[strings.Index(raw, "://")+3:]
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s = s[i+1:]
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+package gobom
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestInterlockRules(t *testing.T) {
+	rules := []*TargetRuleData{
+		{Action: RULE_DENY, Cidr: "10.0.0.0/8"},
+		{Action: RULE_ALLOW, Host: "*.example.com", Port: 443},
+		{Action: RULE_ALLOW, Cidr: "127.0.0.1", Confirm: true},
+	}
+	for _, rule := range rules {
+		if err := rule.Check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (&TargetRuleData{Action: RULE_ALLOW}).Check(); err != ERR_RULE_EMPTY {
+		t.Errorf("empty rule: %v", err)
+	}
+	if err := (&TargetRuleData{Action: RULE_DENY, Cidr: "10.0.0/8"}).Check(); err != ERR_RULE_CIDR {
+		t.Errorf("invalid cidr: %v", err)
+	}
+	gobomInterlock.setRules(rules)
+	t.Cleanup(func() { gobomInterlock.setRules(nil) })
+	// 不依赖真实的域名解析
+	expire := time.Now().Add(time.Minute)
+	gobomInterlock.resolved["api.example.com"] = &resolvedHost{ips: []net.IP{net.ParseIP("93.184.216.34")}, expire: expire}
+	gobomInterlock.resolved["internal.example.com"] = &resolvedHost{ips: []net.IP{net.ParseIP("10.0.0.5")}, expire: expire}
+
+	cases := []struct {
+		url     string
+		err     error
+		confirm bool
+	}{
+		{"https://api.example.com/login", nil, false},
+		{"wss://API.example.com:443/ws", nil, false},
+		{"http://api.example.com/login", ERR_TARGET_NOT_ALLOWED, false},
+		{"https://example.com/", ERR_TARGET_NOT_ALLOWED, false},
+		{"https://internal.example.com/", ERR_TARGET_DENIED, false},
+		{"http://10.1.2.3:8080/", ERR_TARGET_DENIED, false},
+		{"http://{{host}}/api", ERR_TARGET_VARIABLE, false},
+		{"http://127.0.0.1:8080/api?id={{id}}", nil, true},
+		{"127.0.0.1:9000", nil, true},
+	}
+	for _, c := range cases {
+		confirm, err := gobomInterlock.Check(c.url)
+		if c.err == nil && err != nil || c.err != nil && (err == nil || !strings.HasPrefix(err.Error(), c.err.Error())) {
+			t.Errorf("%s: err %v, want %v", c.url, err, c.err)
+		}
+		if confirm != c.confirm {
+			t.Errorf("%s: confirm %v", c.url, confirm)
+		}
+	}
+	if confirm, err := gobomInterlock.CheckUrls([]string{"https://api.example.com", "127.0.0.1:9000"}); err != nil || !confirm {
+		t.Errorf("check urls: %v %v", confirm, err)
+	}
+	if _, err := NewRequester(&Options{Url: "http://10.1.2.3/", Form: FORM_HTTP}); err == nil || !strings.HasPrefix(err.Error(), ERR_TARGET_DENIED.Error()) {
+		t.Errorf("requester: %v", err)
+	}
+	// 事务步骤和主机映射后的地址
+	step := &Options{Url: "https://api.example.com/", Form: FORM_HTTP}
+	step.TransactionOptions.TransactionOptionsDataList = []TransactionOptionsData{{Name: "step", Url: "http://10.1.2.3/"}}
+	if _, err := NewRequester(step); err == nil || !strings.HasPrefix(err.Error(), ERR_TARGET_DENIED.Error()) {
+		t.Errorf("step: %v", err)
+	}
+	mapped := &Options{Url: "https://api.example.com/", Form: FORM_HTTP, DnsOptions: DnsOptions{Hosts: map[string]string{"api.example.com": "10.1.2.3"}}}
+	if _, err := NewRequester(mapped); err == nil || !strings.HasPrefix(err.Error(), ERR_TARGET_DENIED.Error()) {
+		t.Errorf("mapped: %v", err)
+	}
+}
+
+func TestInterlock(t *testing.T) {
+	initTestDb(t)
+	t.Cleanup(func() { gobomInterlock.setRules(nil) })
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := apiLogin(t, server, DEFAULT_ADMIN_NAME, "admin-password")
+	call := func(path string, body interface{}) *ApiReply {
+		_, reply := apiCall(t, server, admin, path, body)
+		return reply
+	}
+	mustCall := func(path string, body interface{}) *ApiReply {
+		reply := call(path, body)
+		if reply.Msg != "" {
+			t.Fatalf("%s: %s", path, reply.Msg)
+		}
+		return reply
+	}
+	expectErr := func(reply *ApiReply, err error) {
+		t.Helper()
+		if !strings.HasPrefix(reply.Msg, err.Error()) {
+			t.Errorf("got %q, want %q", reply.Msg, err)
+		}
+	}
+
+	mustCall("/user/add", map[string]string{"name": "editor", "password": "editor-password"})
+	if _, reply := apiCall(t, server, apiLogin(t, server, "editor", "editor-password"), "/rule/add", map[string]string{"action": RULE_DENY, "cidr": "127.0.0.1"}); reply.Msg != ERR_PERMISSION.Error() {
+		t.Errorf("editor add rule: %+v", reply)
+	}
+
+	mustCall("/environment/add", &EnvironmentReqData{Name: "staging", MaxConCurrent: 5, MaxRate: 100})
+	reply := mustCall("/project/add", &ProjectData{Name: "interlock", Environment: "staging"})
+	projectId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	mustCall("/script/add", map[string]interface{}{"name": "interlock", "projectId": projectId, "data": `{"url":"` + target.URL + `/api"}`})
+	scripts, err := (&ScriptData{}).Get()
+	if err != nil || len(scripts) != 1 {
+		t.Fatal(scripts, err)
+	}
+	mustCall("/task/add", &TaskReqData{TaskId: "interlock-big", Name: "interlock-big", ProjectId: projectId, ScriptId: scripts[0].ID, ConCurrent: 10, Duration: 60})
+	mustCall("/task/add", &TaskReqData{TaskId: "interlock-small", Name: "interlock-small", ProjectId: projectId, ScriptId: scripts[0].ID, ConCurrent: 2, Duration: 60})
+
+	// 禁止规则在保存脚本和运行时检查
+	reply = mustCall("/rule/add", map[string]interface{}{"action": RULE_DENY, "cidr": "127.0.0.0/8"})
+	ruleId := reply.Data.(map[string]interface{})["ID"]
+	expectErr(call("/script/add", map[string]interface{}{"name": "denied", "projectId": projectId, "data": `{"url":"` + target.URL + `/api"}`}), ERR_TARGET_DENIED)
+	expectErr(call("/script/test", map[string]interface{}{"name": "denied", "projectId": projectId, "data": `{"url":"http://192.0.2.1/","transactionOptions":{"transactionOptionsData":[{"name":"step","url":"` + target.URL + `/api"}]}}`}), ERR_TARGET_DENIED)
+	expectErr(call("/task/run", &TaskReqData{TaskId: "interlock-small"}), ERR_TARGET_DENIED)
+	if check := mustCall("/rule/check", map[string]string{"url": target.URL}).Data.(map[string]interface{}); check["allowed"] != false || !strings.HasPrefix(check["error"].(string), ERR_TARGET_DENIED.Error()) {
+		t.Errorf("check: %v", check)
+	}
+
+	// 受保护的地址需要确认后运行
+	mustCall("/rule/edit", map[string]interface{}{"ID": ruleId, "action": RULE_ALLOW, "cidr": "127.0.0.1", "confirm": true})
+	expectErr(call("/script/add", map[string]interface{}{"name": "not-allowed", "projectId": projectId, "data": `{"url":"http://192.0.2.1/api"}`}), ERR_TARGET_NOT_ALLOWED)
+	expectErr(call("/task/run", &TaskReqData{TaskId: "interlock-small"}), ERR_TARGET_CONFIRM)
+	expectErr(call("/schedule/add", &ScheduleReqData{TaskId: "interlock-small", Cron: "0 0 * * *"}), ERR_TARGET_CONFIRM)
+	mustCall("/schedule/add", &ScheduleReqData{TaskId: "interlock-small", Cron: "0 0 * * *", Confirm: true})
+
+	// 环境限制
+	expectErr(call("/task/run", &TaskReqData{TaskId: "interlock-big", Confirm: true}), ERR_ENV_CONCURRENT)
+	mustCall("/task/run", &TaskReqData{TaskId: "interlock-small", Confirm: true})
+	for i := 0; GetRunTask("interlock-small") == nil; i++ {
+		if i > 100 {
+			t.Fatal("task not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var rate uint64
+	expectErr(call("/task/scale", &TaskReqData{TaskId: "interlock-small", Scale: &ScaleReqData{ConCurrent: 4}}), ERR_ENV_CONCURRENT)
+	expectErr(call("/task/scale", &TaskReqData{TaskId: "interlock-small", Scale: &ScaleReqData{Rate: &rate}}), ERR_ENV_RATE)
+	// 任一限制不通过时不做任何调整，也不占用服务器资源
+	used := gobomGuard.Info().ConCurrent
+	expectErr(call("/task/scale", &TaskReqData{TaskId: "interlock-small", Scale: &ScaleReqData{ConCurrent: 1, Rate: &rate}}), ERR_ENV_RATE)
+	if n := GetRunTask("interlock-small").Worker.getConCurrent(); n != 2 || gobomGuard.Info().ConCurrent != used {
+		t.Errorf("partial scale: concurrency %d, guard %d -> %d", n, used, gobomGuard.Info().ConCurrent)
+	}
+	mustCall("/task/scale", &TaskReqData{TaskId: "interlock-small", Scale: &ScaleReqData{ConCurrent: 3}})
+	rate = 50
+	mustCall("/task/scale", &TaskReqData{TaskId: "interlock-small", Scale: &ScaleReqData{Rate: &rate}})
+	// 任务的到达率默认为环境的上限
+	var events []*RunEvent
+	for _, event := range GetRunTask("interlock-small").Info().Snapshot().Events {
+		if event.Type == EVENT_RATE {
+			events = append(events, event)
+		}
+	}
+	if len(events) != 1 || events[0].From != 100 || events[0].To != 50 {
+		t.Errorf("rate events: %+v", events)
+	}
+	mustCall("/task/stop", &TaskReqData{TaskId: "interlock-small"})
+	for i := 0; GetRunTask("interlock-small") != nil; i++ {
+		if i > 500 {
+			t.Fatal("task not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,9 +1,13 @@
 package gobom
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -18,6 +22,8 @@ const (
 	FORM_HTTP = iota
 	FORM_TCP
 	FORM_WEBSOCKET
+	FORM_GRPC
+	FORM_UDP
 
 	TYPE_INT       = "int"
 	TYPE_STRING    = "string"
@@ -25,6 +31,7 @@ const (
 	TYPE_SEND_DATA = "sendData"
 	TYPE_RESP      = "response"
 	TYPE_RAND      = "rand"
+	TYPE_VAR       = "variable"
 
 	FILE_DATA_PATH = "../store/data"
 	FILE_PARSE_SEP = "---"
@@ -37,11 +44,17 @@ type Options struct {
 	LessenConCurrent uint64 `json:"lessenConCurrent" form:"lessenConCurrent"` // 并发数（负数）
 	Duration         uint64 `json:"duration" form:"duration"`                 // 持续时间（秒）
 	Interval         uint64 `json:"interval" form:"interval"`                 // 请求间隔时间（毫秒）
-	Form             int    `json:"form" form:"form"`                         // http|websocket|tcp
+	Form             int    `json:"form" form:"form"`                         // http|tcp|websocket|grpc|udp
 
 	SendData           *SendData          `json:"sendData"` // 压测数据
 	HttpOptions        HttpOptions        `json:"httpOptions" form:"httpOptions"`
 	TcpOptions         TcpOptions         `json:"tcpOptions" form:"tcpOptions"`
+	GrpcOptions        GrpcOptions        `json:"grpcOptions" form:"grpcOptions"` // 请求头作为gRPC的metadata
+	UdpOptions         UdpOptions         `json:"udpOptions" form:"udpOptions"`
+	TlsOptions         TlsOptions         `json:"tlsOptions" form:"tlsOptions"` // HTTP、TCP和WebSocket共用
+	ConnOptions        ConnOptions        `json:"connOptions" form:"connOptions"`
+	ProxyOptions       ProxyOptions       `json:"proxyOptions" form:"proxyOptions"`
+	DnsOptions         DnsOptions         `json:"dnsOptions" form:"dnsOptions"`
 	TransactionOptions TransactionOptions `json:"transactionOptions" form:"transactionOptions"`
 }
 
@@ -52,9 +65,14 @@ type TcpOptions struct {
 }
 
 type HttpOptions struct {
-	Method string            `json:"method" form:"method"` // 请求方法
-	Cookie map[string]string `json:"cookie" form:"cookie"`
-	Header map[string]string `json:"header" form:"header"`
+	Method         string            `json:"method" form:"method"` // 请求方法
+	Cookie         map[string]string `json:"cookie" form:"cookie"`
+	Header         map[string]string `json:"header" form:"header"`
+	CookieJar      bool              `json:"cookieJar" form:"cookieJar"`           // 开启会话，保存响应中的cookie并在后续请求中发送
+	ClearCookieJar bool              `json:"clearCookieJar" form:"clearCookieJar"` // 每次迭代开始时清空cookie（模拟新用户）
+	Protocol       string            `json:"protocol" form:"protocol"`             // 空为HTTP/1.1|h2|h2c，事务步骤使用脚本的设置
+	MaxStreams     uint32            `json:"maxStreams" form:"maxStreams"`         // HTTP/2每个连接的最大并发流数，默认DEFAULT_HTTP2_STREAMS
+	Connections    uint32            `json:"connections" form:"connections"`       // HTTP/2每个虚拟用户的连接数，0为同一脚本的虚拟用户共用连接
 }
 
 type TransactionOptions struct {
@@ -62,14 +80,24 @@ type TransactionOptions struct {
 	TransactionSendData        map[string][]byte        `json:"-"` // 事务发送的数据
 	TransactionResponse        map[string][]byte        `json:"-"` // 事务响应的数据
 	TransactionIndex           uint64                   `json:"-"`
+	Variables                  map[string]string        `json:"-"` // 虚拟用户提取的变量
+	Globals                    map[string]string        `json:"-"` // 只读的全局变量（setup提取）
 }
 
 type TransactionOptionsData struct {
-	Name        string      `json:"name"`
-	Url         string      `json:"url" form:"url"`           // 请求地址
-	Interval    uint64      `json:"interval" form:"interval"` // 请求间隔时间（毫秒）
-	HttpOptions HttpOptions `json:"httpOptions" form:"httpOptions"`
-	SendData    *SendData   `json:"sendData"` // 压测数据
+	Name            string                   `json:"name"`
+	Url             string                   `json:"url" form:"url"`           // 请求地址
+	Interval        uint64                   `json:"interval" form:"interval"` // 请求间隔时间（毫秒）
+	HttpOptions     HttpOptions              `json:"httpOptions" form:"httpOptions"`
+	GrpcOptions     GrpcOptions              `json:"grpcOptions" form:"grpcOptions"` // 只使用method，描述符使用脚本的
+	SendData        *SendData                `json:"sendData"`                       // 压测数据
+	Type            string                   `json:"type"`                           // 步骤类型 空为请求|group|if|loop|branch
+	Condition       *Condition               `json:"condition"`                      // if：执行条件；loop：循环条件
+	Loop            uint64                   `json:"loop"`                           // loop：循环次数
+	Weight          uint64                   `json:"weight"`                         // branch子步骤的权重
+	ContinueOnError bool                     `json:"continueOnError"`                // 请求失败后继续执行后续步骤
+	Children        []TransactionOptionsData `json:"children"`                       // 控制节点的子步骤
+	Extract         map[string]string        `json:"extract"`                        // [变量名]响应数据中的字段路径
 }
 
 type SendData struct {
@@ -83,6 +111,7 @@ type DataField struct {
 	Len     int64       `json:"len" form:"len"`         // 字段长度 如果字段是int表示len中的随机数
 	Default interface{} `json:"default" form:"default"` // 默认值
 	Dynamic string      `json:"dynamic" form:"dynamic"` // 动态字段名（字段值从文件或其他请求响应中获取）
+	FileId  uint        `json:"fileId" form:"fileId"`   // 数据文件id（设置后dynamic为数据文件中的列名）
 }
 
 type SourceFile struct {
@@ -119,24 +148,65 @@ func (sendData *SendData) init() error {
 	sendData.SourceFileMap = make(map[string]*SourceFile)
 	for _, v := range sendData.DataFieldList {
 		if v.Dynamic != "" && v.Type == TYPE_FILE {
-			fileName, field := sendData.parseField(v.Dynamic)
-			f, err := excelize.OpenFile(fmt.Sprintf("%s/%s", FILE_DATA_PATH, fileName))
+			fileName, _ := v.fileField()
+			if v.FileId != 0 {
+				var err error
+				if fileName, err = dataFilePath(v.FileId); err != nil {
+					logger.Debug(err)
+					return ERR_DATAFILE_NOT_FOUND
+				}
+			}
+			data, err := readStoredFile(fileName)
+			if err != nil {
+				logger.Debug(err)
+				return err
+			}
+			rows, err := ParseDataFile(fileName, data)
 			if err != nil {
 				logger.Debug(err)
 				return err
 			}
-			sheet := f.GetSheetMap()[1] // 获取excel的sheet名称
-			csvData := f.GetRows(sheet)
-			sendData.SourceFileMap[field] = &SourceFile{
+			if len(rows) == 0 {
+				return ERR_FILE_READ
+			}
+			sendData.SourceFileMap[v.sourceKey()] = &SourceFile{
 				Index:  0,
-				Column: csvData[0],
-				Data:   csvData[1:],
+				Column: rows[0],
+				Data:   rows[1:],
 			}
 		}
 	}
 	return nil
 }
 
+// 读取数据文件（xlsx|csv），第一行为列名
+func ReadDataFile(path string) ([][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDataFile(path, data)
+}
+
+// 按文件名的扩展名解析数据文件内容
+func ParseDataFile(name string, data []byte) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".xlsx":
+		f, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		sheet := f.GetSheetMap()[1] // 获取excel的sheet名称
+		return f.GetRows(sheet), nil
+	case ".csv":
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1
+		return reader.ReadAll()
+	default:
+		return nil, ERR_DATAFILE_TYPE
+	}
+}
+
 func (tcpOptions *TcpOptions) init() error {
 	if tcpOptions.CodecType == TYPE_NONE {
 		tcpOptions.CodecType = TYPE_LENGTHFIELDBASEDFRAMECODEC
@@ -187,7 +257,7 @@ func (sendData *SendData) GetSendDataToMap(transactionOptions *TransactionOption
 		case TYPE_STRING:
 			bm[v.Name] = utils.GetRandomStrings(uint64(v.Len))
 		case TYPE_FILE:
-			bm[v.Name] = sendData.getFileValue(v.Dynamic)
+			bm[v.Name] = sendData.getFileValue(v)
 		case TYPE_SEND_DATA:
 			bm[v.Name] = ""
 			if !transactionOptions.Empty() {
@@ -199,6 +269,8 @@ func (sendData *SendData) GetSendDataToMap(transactionOptions *TransactionOption
 				result := gjson.Get(string(sendByte), fields)
 				bm[v.Name] = result.Value()
 			}
+		case TYPE_VAR:
+			bm[v.Name], _ = transactionOptions.GetVariable(v.Dynamic)
 		case TYPE_RESP:
 			bm[v.Name] = ""
 			if !transactionOptions.Empty() {
@@ -228,6 +300,7 @@ func (transactionOptions *TransactionOptions) Copy() *TransactionOptions {
 		TransactionSendData:        transactionOptions.TransactionSendData,
 		TransactionResponse:        transactionOptions.TransactionResponse,
 		TransactionIndex:           0,
+		Globals:                    transactionOptions.Globals,
 	}
 }
 
@@ -290,9 +363,9 @@ func (transactionOptions *TransactionOptions) SetTransactionSendData(key string,
 	transactionOptions.TransactionSendData[key] = val
 }
 
-func (sendData *SendData) getFileValue(key string) interface{} {
-	_, field := sendData.parseField(key)
-	data, ok := sendData.SourceFileMap[field]
+func (sendData *SendData) getFileValue(dataField *DataField) interface{} {
+	_, field := dataField.fileField()
+	data, ok := sendData.SourceFileMap[dataField.sourceKey()]
 	if !ok {
 		return ""
 	} else {
@@ -311,6 +384,58 @@ func (sendData *SendData) parseField(s string) (f1, f2 string) {
 	return info[0], info[1]
 }
 
+// 解析文件字段，返回文件名和列名（通过fileId引用时文件名为空）
+func (dataField *DataField) fileField() (fileName, column string) {
+	if dataField.FileId != 0 {
+		return "", dataField.Dynamic
+	}
+	return (&SendData{}).parseField(dataField.Dynamic)
+}
+
+func (dataField *DataField) sourceKey() string {
+	return fmt.Sprint(dataField.FileId, FILE_PARSE_SEP, dataField.Dynamic)
+}
+
+// 获取脚本请求的所有地址（包括事务步骤）
+func (opt *Options) Urls() []string {
+	var list []string
+	if opt.Url != "" {
+		list = append(list, opt.Url)
+	}
+	for _, v := range flattenSteps(opt.TransactionOptions.TransactionOptionsDataList) {
+		if v.Url != "" {
+			list = append(list, v.Url)
+		}
+	}
+	// 主机映射后实际连接的地址也需要检查
+	for _, v := range list {
+		if mapped, ok := opt.DnsOptions.mapUrl(v); ok {
+			list = append(list, mapped)
+		}
+	}
+	return list
+}
+
+// 获取脚本中所有从数据文件取值的字段
+func (opt *Options) FileDataFields() []*DataField {
+	var list []*DataField
+	sendDataList := []*SendData{opt.SendData}
+	for _, v := range flattenSteps(opt.TransactionOptions.TransactionOptionsDataList) {
+		sendDataList = append(sendDataList, v.SendData)
+	}
+	for _, sendData := range sendDataList {
+		if sendData == nil {
+			continue
+		}
+		for _, v := range sendData.DataFieldList {
+			if v.Type == TYPE_FILE && v.Dynamic != "" {
+				list = append(list, v)
+			}
+		}
+	}
+	return list
+}
+
 func (sourceFile *SourceFile) getValue(field string) (value interface{}) {
 	var (
 		n = -1
@@ -324,11 +449,18 @@ func (sourceFile *SourceFile) getValue(field string) (value interface{}) {
 		return
 	}
 	sourceFile.m.Lock()
-	if sourceFile.Index == uint64(len(sourceFile.Data)) {
+	defer sourceFile.m.Unlock()
+	if len(sourceFile.Data) == 0 {
+		return ""
+	}
+	if sourceFile.Index >= uint64(len(sourceFile.Data)) {
 		sourceFile.Index = 0
 	}
-	value = sourceFile.Data[sourceFile.Index][n]
+	row := sourceFile.Data[sourceFile.Index]
 	sourceFile.Index++
-	sourceFile.m.Unlock()
-	return
+	// 替换前上传的文件可能有缺少列的行
+	if n >= len(row) {
+		return ""
+	}
+	return row[n]
 }
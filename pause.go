@@ -0,0 +1,85 @@
+package gobom
+
+import "time"
+
+const (
+	EVENT_PAUSE  = "pause"  // 暂停
+	EVENT_RESUME = "resume" // 恢复，from为暂停时间，to为恢复时间
+)
+
+// 暂停任务：虚拟用户完成当前迭代后等待，保持连接和会话，定时器停止计时
+func (gobom *GobomRequest) Pause(reason string) error {
+	event, err := gobom.pause(reason)
+	if event != nil {
+		gobom.Report.addEvent(event)
+	}
+	return err
+}
+
+// 恢复暂停的任务，继续同一次运行
+func (gobom *GobomRequest) Resume(reason string) error {
+	event, err := gobom.resume(reason)
+	if event != nil {
+		gobom.Report.addEvent(event)
+	}
+	return err
+}
+
+func (gobom *GobomRequest) pause(reason string) (*RunEvent, error) {
+	gobom.pauseMu.Lock()
+	defer gobom.pauseMu.Unlock()
+	if !gobom.running() {
+		return nil, ERR_TASK_NOT_RUN
+	}
+	if gobom.resumeCh != nil {
+		return nil, ERR_TASK_PAUSED
+	}
+	gobom.resumeCh = make(chan struct{})
+	gobom.pausedAt = time.Now()
+	return &RunEvent{
+		Time:   gobom.pausedAt.Unix(),
+		Type:   EVENT_PAUSE,
+		Reason: reason,
+	}, nil
+}
+
+func (gobom *GobomRequest) resume(reason string) (*RunEvent, error) {
+	gobom.pauseMu.Lock()
+	defer gobom.pauseMu.Unlock()
+	if gobom.resumeCh == nil {
+		return nil, ERR_TASK_NOT_PAUSED
+	}
+	close(gobom.resumeCh)
+	gobom.resumeCh = nil
+	now := time.Now()
+	return &RunEvent{
+		Time:   now.Unix(),
+		Type:   EVENT_RESUME,
+		From:   uint64(gobom.pausedAt.Unix()),
+		To:     uint64(now.Unix()),
+		Reason: reason,
+	}, nil
+}
+
+// 暂停中返回恢复时关闭的chan，没有暂停时返回nil
+func (gobom *GobomRequest) paused() <-chan struct{} {
+	gobom.pauseMu.Lock()
+	defer gobom.pauseMu.Unlock()
+	return gobom.resumeCh
+}
+
+// 虚拟用户在迭代之间检查暂停，收到停止信号时返回false
+func (gobom *GobomRequest) hold(scenario *Scenario) bool {
+	resumeCh := gobom.paused()
+	if resumeCh == nil {
+		return true
+	}
+	select {
+	case <-resumeCh:
+		return true
+	case <-gobom.stop:
+		return false
+	case <-scenario.stop:
+		return false
+	}
+}
@@ -0,0 +1,143 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	task, err := NewTask("pause-test", &Options{
+		Url:        server.URL,
+		ConCurrent: 2,
+		Duration:   2,
+		Interval:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Pause(""); err != ERR_TASK_NOT_RUN {
+		t.Errorf("pause before run: %v", err)
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		task.Run()
+		close(done)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	if err := task.Pause("hold"); err != nil {
+		t.Fatal(err)
+	}
+	if task.GetStatus() != STATUS_PAUSE {
+		t.Errorf("status %d, want pause", task.GetStatus())
+	}
+	time.Sleep(100 * time.Millisecond) // 等待进行中的迭代结束
+	paused := task.Info().Copy().SuccessNum
+	remaining := task.Worker.getDuration()
+	time.Sleep(time.Second)
+	if n := task.Info().Copy().SuccessNum; n != paused {
+		t.Errorf("requests sent while paused: %d -> %d", paused, n)
+	}
+	if d := task.Worker.getDuration(); d != remaining {
+		t.Errorf("timer counted while paused: %d -> %d", remaining, d)
+	}
+	if err := task.Pause(""); err != ERR_TASK_PAUSED {
+		t.Errorf("pause twice: %v", err)
+	}
+	if err := task.Resume("go"); err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+	if d := time.Since(start); d < 2800*time.Millisecond {
+		t.Errorf("run took %s, paused time should not count", d)
+	}
+	report := task.Info().Copy()
+	if report.SuccessNum <= paused {
+		t.Error("no requests after resume")
+	}
+	if len(report.Events) != 2 || report.Events[0].Type != EVENT_PAUSE || report.Events[1].Type != EVENT_RESUME ||
+		report.Events[1].To-report.Events[1].From > 2 {
+		t.Errorf("unexpected events: %v", report.Events)
+	}
+	if task.GetStatus() != STATUS_OVER {
+		t.Errorf("status %d, want over", task.GetStatus())
+	}
+}
+
+func TestStopPaused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	task, err := NewTask("pause-stop-test", &Options{Url: server.URL, ConCurrent: 2, Interval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		task.Run()
+		close(done)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if err := task.Pause(""); err != nil {
+		t.Fatal(err)
+	}
+	task.Stop(CLOSE_ALL)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("paused task did not stop")
+	}
+	if task.GetStatus() != STATUS_STOP {
+		t.Errorf("status %d, want stop", task.GetStatus())
+	}
+}
+
+// 任务已发布为运行中、虚拟用户启动前收到停止：不再启动虚拟用户
+func TestStopBeforeStart(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/setup" {
+			<-release
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	task, err := NewTask("stop-before-start-test", &Options{Url: server.URL, ConCurrent: 2, Interval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Worker.Setup = &Options{Url: server.URL + "/setup"}
+	done := make(chan struct{})
+	go func() {
+		task.Run()
+		close(done)
+	}()
+	for GetRunTask(task.TaskId) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := task.Scale(&ScaleReqData{ConCurrent: 1}); err != ERR_TASK_NOT_RUN {
+		t.Errorf("scale before start: %v", err)
+	}
+	task.Stop(CLOSE_ALL)
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("task stopped before start kept running")
+	}
+	if task.GetStatus() != STATUS_STOP || atomic.LoadInt32(&requests) != 0 {
+		t.Errorf("status %d, requests %d", task.GetStatus(), requests)
+	}
+}
@@ -0,0 +1,157 @@
+package gobom
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	PHASE_SETUP    = "setup"
+	PHASE_TEARDOWN = "teardown"
+)
+
+// 模板引用 {{变量名}}
+var templateRegexp = regexp.MustCompile(`{{\s*([\w.\-]+)\s*}}`)
+
+// setup/teardown执行结果，不计入压测统计
+type PhaseResult struct {
+	Name                 string            `json:"name"`
+	StartTime            string            `json:"startTime"`
+	WasteTime            uint64            `json:"wasteTime"`
+	IsSuccess            bool              `json:"isSuccess"`
+	ErrCode              int               `json:"errCode"`
+	ErrMsg               string            `json:"errMsg"`
+	TransactionWasteTime map[string]uint64 `json:"transactionWasteTime"`
+	Variables            map[string]string `json:"variables"` // 提取的变量
+}
+
+// 执行一次脚本，globals为只读的全局变量
+func RunPhase(name string, opt *Options, globals map[string]string) *PhaseResult {
+	result := &PhaseResult{
+		Name:      name,
+		StartTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	opt.TransactionOptions.Globals = globals
+	requester, err := NewRequester(opt)
+	if err != nil {
+		result.ErrMsg = err.Error()
+		return result
+	}
+	defer requester.close()
+
+	resp, err := requester.dispose()
+	if resp != nil {
+		result.WasteTime = resp.WasteTime
+		result.IsSuccess = resp.IsSuccess
+		result.ErrCode = resp.ErrCode
+		result.ErrMsg = resp.ErrMsg
+		result.TransactionWasteTime = resp.TransactionWasteTime
+		result.Variables = make(map[string]string)
+		for k, v := range resp.Variables {
+			result.Variables[k] = v
+		}
+	}
+	if err != nil {
+		result.IsSuccess = false
+		result.ErrMsg = err.Error()
+	}
+	logger.Debug(name, " over: ", result.IsSuccess, result.ErrMsg)
+	return result
+}
+
+// 初始全局变量与传入的变量合并，传入的变量优先
+func (gobom *GobomRequest) initGlobals() {
+	if len(gobom.inherits) == 0 {
+		gobom.globals = gobom.Globals
+		return
+	}
+	globals := make(map[string]string)
+	for k, v := range gobom.Globals {
+		globals[k] = v
+	}
+	for k, v := range gobom.inherits {
+		globals[k] = v
+	}
+	gobom.globals = globals
+}
+
+// 执行setup，提取的变量作为全局变量提供给所有虚拟用户
+func (gobom *GobomRequest) setup() error {
+	if gobom.Setup == nil {
+		return nil
+	}
+	result := RunPhase(PHASE_SETUP, gobom.Setup, gobom.globals)
+	gobom.Report.setPhase(result)
+	if !result.IsSuccess {
+		return fmt.Errorf("setup失败：%s", result.ErrMsg)
+	}
+	globals := make(map[string]string)
+	for k, v := range gobom.globals {
+		globals[k] = v
+	}
+	for k, v := range result.Variables {
+		globals[k] = v
+	}
+	gobom.globals = globals
+	return nil
+}
+
+func (gobom *GobomRequest) teardown() {
+	if gobom.Teardown == nil {
+		return
+	}
+	gobom.Report.setPhase(RunPhase(PHASE_TEARDOWN, gobom.Teardown, gobom.globals))
+}
+
+// 从步骤响应中提取变量
+func (transactionOptions *TransactionOptions) extract(data TransactionOptionsData, resp *Response) {
+	if len(data.Extract) == 0 || resp == nil || resp.Data == nil {
+		return
+	}
+	for name, path := range data.Extract {
+		result := gjson.GetBytes(resp.Data, path)
+		if result.Exists() {
+			transactionOptions.SetVariable(name, result.String())
+		}
+	}
+}
+
+func (transactionOptions *TransactionOptions) GetVariable(name string) (string, bool) {
+	if transactionOptions == nil {
+		return "", false
+	}
+	if val, ok := transactionOptions.Variables[name]; ok {
+		return val, true
+	}
+	val, ok := transactionOptions.Globals[name]
+	return val, ok
+}
+
+func (transactionOptions *TransactionOptions) SetVariable(name, val string) {
+	if transactionOptions == nil {
+		return
+	}
+	if transactionOptions.Variables == nil {
+		transactionOptions.Variables = make(map[string]string)
+	}
+	transactionOptions.Variables[name] = val
+}
+
+// 替换字符串中的模板引用，未定义的变量保持原样
+func (transactionOptions *TransactionOptions) Render(s string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return templateRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		name := templateRegexp.FindStringSubmatch(match)[1]
+		if val, ok := transactionOptions.GetVariable(name); ok {
+			return val
+		}
+		return match
+	})
+}
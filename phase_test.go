@@ -0,0 +1,61 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetupTeardown(t *testing.T) {
+	var authorized, unauthorized, teardown uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.Write([]byte(`{"data":{"token":"admin-token"}}`))
+		case "/cleanup":
+			atomic.AddUint64(&teardown, 1)
+		default:
+			if r.Header.Get("Authorization") == "Bearer admin-token" {
+				atomic.AddUint64(&authorized, 1)
+			} else {
+				atomic.AddUint64(&unauthorized, 1)
+			}
+		}
+	}))
+	defer server.Close()
+
+	gobomReq, err := NewGomBomRequest(&Options{
+		Url:        server.URL + "/api",
+		ConCurrent: 2,
+		Duration:   1,
+		HttpOptions: HttpOptions{
+			Header: map[string]string{"Authorization": "Bearer {{token}}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobomReq.Setup = &Options{TransactionOptions: TransactionOptions{
+		TransactionOptionsDataList: []TransactionOptionsData{
+			{Name: "login", Url: server.URL + "/login", Extract: map[string]string{"token": "data.token"}},
+		},
+	}}
+	gobomReq.Teardown = &Options{Url: server.URL + "/cleanup"}
+
+	gobomReq.Dispose(func(err error) error { return err })
+
+	report := gobomReq.Info().Copy()
+	if report.Setup == nil || !report.Setup.IsSuccess || report.Setup.Variables["token"] != "admin-token" {
+		t.Fatalf("setup result: %+v", report.Setup)
+	}
+	if report.Teardown == nil || !report.Teardown.IsSuccess || teardown != 1 {
+		t.Fatalf("teardown result: %+v, calls %d", report.Teardown, teardown)
+	}
+	if authorized == 0 || unauthorized != 0 {
+		t.Errorf("authorized %d, unauthorized %d", authorized, unauthorized)
+	}
+	if report.SuccessNum != authorized {
+		t.Errorf("setup/teardown counted in load statistics: %d != %d", report.SuccessNum, authorized)
+	}
+}
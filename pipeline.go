@@ -0,0 +1,207 @@
+package gobom
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+var runPipelines = make(map[uint]*pipelineRun)
+var pipelineMu sync.Mutex
+
+// 运行中的流水线
+type pipelineRun struct {
+	pipeline *PipelineData
+	task     *Task // 当前阶段的任务，开始运行或排队后设置
+	stopped  bool
+	mu       sync.Mutex
+}
+
+func GetRunPipeline(id uint) *pipelineRun {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	return runPipelines[id]
+}
+
+// 运行流水线，所有阶段在后台按顺序运行
+func (pipeline *PipelineData) Run() error {
+	if _, err := pipeline.First(); err != nil {
+		return err
+	}
+	run := &pipelineRun{pipeline: pipeline}
+	pipelineMu.Lock()
+	if _, ok := runPipelines[pipeline.ID]; ok {
+		pipelineMu.Unlock()
+		return ERR_PIPELINE_RUN
+	}
+	runPipelines[pipeline.ID] = run
+	pipelineMu.Unlock()
+
+	pipeline.Status = STATUS_RUN
+	pipeline.Note = ""
+	pipeline.Report = &Report{}
+	for _, stage := range pipeline.Stages {
+		stage.Status = STATUS_NONE
+		stage.Passed = false
+		stage.TaskRunId = 0
+		stage.Variables = nil
+	}
+	if err := pipeline.Update(); err != nil {
+		pipelineMu.Lock()
+		delete(runPipelines, pipeline.ID)
+		pipelineMu.Unlock()
+		return err
+	}
+	pipeline.fireHooks(HOOK_RUN_START)
+	go run.run()
+	return nil
+}
+
+func (pipeline *PipelineData) Stop() error {
+	run := GetRunPipeline(pipeline.ID)
+	if run == nil {
+		return ERR_PIPELINE_NOT_RUN
+	}
+	run.stop()
+	return nil
+}
+
+func (run *pipelineRun) run() {
+	pipeline := run.pipeline
+	variables := make(map[string]string) // 之前所有阶段teardown提取的变量
+	for i, stage := range pipeline.Stages {
+		if run.isStopped() {
+			stage.Status = STATUS_SKIP
+			continue
+		}
+		if i > 0 && stage.Gate != GATE_ALWAYS && !pipeline.Stages[i-1].Passed {
+			stage.Status = STATUS_SKIP
+			continue
+		}
+
+		stage.Status = STATUS_RUN
+		if err := pipeline.Update(); err != nil {
+			logger.Debug(err)
+		}
+		taskRun, err := run.runStage(stage, variables)
+		if err != nil {
+			logger.Debug("pipeline stage: ", pipeline.ID, stage.TaskId, err)
+			stage.Status = STATUS_ERROR
+			pipeline.Note = fmt.Sprintf("阶段%d（%s）：%s", i+1, stage.TaskId, err.Error())
+			continue
+		}
+		stage.TaskRunId = taskRun.ID
+		stage.Status = taskRun.Status
+		if report := taskRun.Report; report != nil {
+			stage.Passed = stage.Status == STATUS_OVER && len(report.Breaches) == 0
+			pipeline.Report.Merge(report.Snapshot())
+			pipeline.Report.addBreach(report.Breaches)
+			if len(report.Breaches) != 0 {
+				payload := taskHookPayload(HOOK_THRESHOLD, taskRun)
+				payload.PipelineId = pipeline.ID
+				fireHooks(payload)
+			}
+			if report.Teardown != nil {
+				stage.Variables = report.Teardown.Variables
+				for k, v := range stage.Variables {
+					variables[k] = v
+				}
+			}
+		}
+		if !stage.Passed && pipeline.Note == "" && !run.isStopped() {
+			pipeline.Note = fmt.Sprintf("阶段%d（%s）没有通过", i+1, stage.TaskId)
+		}
+	}
+	status := STATUS_OVER
+	if run.isStopped() {
+		status = STATUS_STOP
+	} else if pipeline.Note != "" {
+		status = STATUS_ERROR
+	}
+
+	pipeline.Status = status
+	pipeline.Report = pipeline.Report.Copy()
+	if err := pipeline.Update(); err != nil {
+		logger.Debug(err)
+	}
+	pipelineMu.Lock()
+	delete(runPipelines, pipeline.ID)
+	pipelineMu.Unlock()
+	logger.Debug("pipeline over: ", pipeline.ID, status)
+	pipeline.fireHooks(HOOK_RUN_END)
+	if status == STATUS_ERROR {
+		pipeline.fireHooks(HOOK_RUN_ABORT)
+	}
+}
+
+func (pipeline *PipelineData) fireHooks(event string) {
+	payload := &HookPayload{
+		Event:      event,
+		Time:       hookTime(),
+		PipelineId: pipeline.ID,
+		Status:     pipeline.Status,
+		Note:       pipeline.Note,
+	}
+	// 通知异步发送，复制运行中会修改的阶段结果
+	for _, stage := range pipeline.Stages {
+		s := *stage
+		payload.Stages = append(payload.Stages, &s)
+	}
+	if event != HOOK_RUN_START {
+		payload.Metrics = NewTaskTotals(pipeline.Report.Snapshot())
+	}
+	fireHooks(payload)
+}
+
+// 运行一个阶段，等待任务结束后返回运行记录
+func (run *pipelineRun) runStage(stage *PipelineStage, variables map[string]string) (*TaskRunData, error) {
+	globals := make(map[string]string)
+	for k, v := range variables {
+		globals[k] = v
+	}
+	done := make(chan *TaskRunData, 1)
+	taskData := &TaskData{Task: &Task{TaskId: stage.TaskId}, confirmed: run.pipeline.confirmed}
+	err := taskData.run(TRIGGER_PIPELINE, 0, globals, func(task *Task, taskRun *TaskRunData) {
+		done <- taskRun
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 开始运行或排队后才能停止，期间流水线已经停止时在这里停止
+	run.mu.Lock()
+	if run.stopped {
+		cancelTask(taskData.Task)
+	} else {
+		run.task = taskData.Task
+	}
+	run.mu.Unlock()
+	taskRun := <-done
+	run.mu.Lock()
+	run.task = nil
+	run.mu.Unlock()
+	return taskRun, nil
+}
+
+func (run *pipelineRun) isStopped() bool {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	return run.stopped
+}
+
+// 停止流水线，当前阶段的任务停止或取消排队，后续阶段不再运行
+func (run *pipelineRun) stop() {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.stopped = true
+	if run.task != nil {
+		cancelTask(run.task)
+	}
+}
+
+// 取消排队，已经出队时停止任务，任务还没有启动时不再启动
+func cancelTask(task *Task) {
+	if gobomGuard.Cancel(task.TaskId) != nil {
+		task.Stop(CLOSE_ALL)
+	}
+}
@@ -0,0 +1,176 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	initTestDb(t)
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"token":"build-42"}`))
+		}
+	}))
+	defer server.Close()
+
+	addStage := func(taskId, url string, teardown *Options, thresholds []*Threshold) {
+		task, err := NewTask(taskId, &Options{Url: server.URL + url, ConCurrent: 1, Duration: 2, Interval: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.Worker.Teardown = teardown
+		task.Worker.Thresholds = thresholds
+		if err := (&TaskData{Name: taskId, Task: task}).Add(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addStage("pipe-smoke", "/smoke", &Options{TransactionOptions: TransactionOptions{
+		TransactionOptionsDataList: []TransactionOptionsData{
+			{Name: "token", Url: server.URL + "/token", Extract: map[string]string{"build": "token"}},
+		},
+	}}, nil)
+	addStage("pipe-load", "/load/{{build}}", nil, []*Threshold{{Metric: METRIC_AVG_TIME, Op: ">=", Value: 0}})
+	addStage("pipe-soak", "/soak", nil, nil)
+	addStage("pipe-clean", "/clean/{{build}}", nil, nil)
+
+	pipeline := &PipelineData{
+		Name: "release",
+		Stages: []*PipelineStage{
+			{TaskId: "pipe-smoke"},
+			{TaskId: "pipe-load"},
+			{TaskId: "pipe-soak", Gate: GATE_PASSED},
+			{TaskId: "pipe-clean", Gate: GATE_ALWAYS},
+		},
+	}
+	if err := pipeline.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&PipelineData{Name: "bad", Stages: []*PipelineStage{{TaskId: "pipe-smoke", Gate: "never"}}}).Check(); err != ERR_PIPELINE_GATE {
+		t.Errorf("check gate: %v", err)
+	}
+
+	run := func() {
+		if err := (&PipelineData{Model: Model{ID: pipeline.ID}}).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&PipelineData{Model: Model{ID: pipeline.ID}}).Run(); err != ERR_PIPELINE_RUN {
+			t.Errorf("run twice: %v", err)
+		}
+	}
+	wait := func() *PipelineData {
+		for i := 0; GetRunPipeline(pipeline.ID) != nil; i++ {
+			if i > 1500 {
+				t.Fatal("pipeline not finished")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		p := &PipelineData{Model: Model{ID: pipeline.ID}}
+		if _, err := p.First(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	run()
+	p := wait()
+	if p.Status != STATUS_ERROR || p.Note == "" {
+		t.Errorf("pipeline status %d, note %q", p.Status, p.Note)
+	}
+	want := []struct {
+		status int
+		passed bool
+	}{{STATUS_OVER, true}, {STATUS_OVER, false}, {STATUS_SKIP, false}, {STATUS_OVER, true}}
+	var successNum uint64
+	for i, stage := range p.Stages {
+		if stage.Status != want[i].status || stage.Passed != want[i].passed {
+			t.Errorf("stage %s: status %d passed %v", stage.TaskId, stage.Status, stage.Passed)
+		}
+		if stage.TaskRunId != 0 {
+			taskRun := &TaskRunData{}
+			taskRun.ID = stage.TaskRunId
+			if _, err := taskRun.First(); err != nil || taskRun.Trigger != TRIGGER_PIPELINE {
+				t.Errorf("stage %s run: %v %q", stage.TaskId, err, taskRun.Trigger)
+			}
+			successNum += taskRun.SuccessNum
+		}
+	}
+	if p.Stages[0].Variables["build"] != "build-42" {
+		t.Errorf("teardown variables: %v", p.Stages[0].Variables)
+	}
+	mu.Lock()
+	if paths["/load/build-42"] == 0 || paths["/clean/build-42"] == 0 || paths["/soak"] != 0 {
+		t.Errorf("unexpected requests: %v", paths)
+	}
+	mu.Unlock()
+	if p.Report == nil || p.Report.SuccessNum != successNum || len(p.Report.Breaches) != 1 {
+		t.Errorf("combined report: %+v, want %d successes", p.Report, successNum)
+	}
+
+	// 停止后后续阶段不再运行
+	run()
+	for i := 0; GetRunTask("pipe-smoke") == nil; i++ {
+		if i > 100 {
+			t.Fatal("first stage not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := (&PipelineData{Model: Model{ID: pipeline.ID}}).Stop(); err != nil {
+		t.Fatal(err)
+	}
+	p = wait()
+	if p.Status != STATUS_STOP || p.Stages[0].Status != STATUS_STOP || p.Stages[3].Status != STATUS_SKIP {
+		t.Errorf("stopped pipeline: %d, stages %d %d", p.Status, p.Stages[0].Status, p.Stages[3].Status)
+	}
+}
+
+// 阶段任务开始运行前流水线已经停止，任务不再启动
+func TestPipelineStopBeforeStart(t *testing.T) {
+	initTestDb(t)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+	task, err := NewTask("pipe-early", &Options{Url: server.URL, ConCurrent: 1, Duration: 60, Interval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&TaskData{Name: "pipe-early", Task: task}).Add(); err != nil {
+		t.Fatal(err)
+	}
+
+	run := &pipelineRun{pipeline: &PipelineData{}}
+	run.stop()
+	result := make(chan *TaskRunData, 1)
+	go func() {
+		taskRun, err := run.runStage(&PipelineStage{TaskId: "pipe-early"}, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- taskRun
+	}()
+	select {
+	case taskRun := <-result:
+		if taskRun == nil || taskRun.Status != STATUS_STOP {
+			t.Errorf("stage run: %+v", taskRun)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stage task not stopped")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("requests after stop: %d", n)
+	}
+}
@@ -0,0 +1,292 @@
+package gobom
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 测试代理，转发到目标地址，返回代理地址和建立的隧道数
+func startTestProxy(t *testing.T, scheme, username, password string) (string, *int32) {
+	var tunnels int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	handshake := testHttpConnect
+	if scheme == PROXY_SOCKS5 {
+		handshake = testSocks5Connect
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr, ok := handshake(conn, username, password)
+				if !ok {
+					return
+				}
+				target, err := net.Dial("tcp", addr)
+				testProxyReply(conn, scheme, err == nil)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				atomic.AddInt32(&tunnels, 1)
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	user := ""
+	if username != "" {
+		user = username + ":" + password + "@"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, user, listener.Addr()), &tunnels
+}
+
+func testHttpConnect(conn net.Conn, username, password string) (string, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return "", false
+	}
+	if username != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)) {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", false
+	}
+	return req.Host, true
+}
+
+// 连接目标后回复客户端
+func testProxyReply(conn net.Conn, scheme string, ok bool) {
+	switch {
+	case scheme == PROXY_SOCKS5 && ok:
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	case scheme == PROXY_SOCKS5:
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	case ok:
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	default:
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+	}
+}
+
+func testSocks5Connect(conn net.Conn, username, password string) (string, bool) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", false
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return "", false
+	}
+	if username == "" {
+		conn.Write([]byte{0x05, 0x00})
+	} else {
+		conn.Write([]byte{0x05, 0x02})
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			conn.Write([]byte{0x01, 0x01})
+			return "", false
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", false
+	}
+	var host string
+	switch buf[3] {
+	case 0x01:
+		io.ReadFull(conn, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 0x03:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return "", false
+	}
+	io.ReadFull(conn, buf[:2])
+	return net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(buf[:2]))), true
+}
+
+func TestProxy(t *testing.T) {
+	initTestDb(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	h2c, _ := startTestHttp2Server(t)
+	echo, _ := startTestFrameServer(t)
+	httpProxy, httpTunnels := startTestProxy(t, PROXY_HTTP, "gobom", "p@ss")
+	socksProxy, socksTunnels := startTestProxy(t, PROXY_SOCKS5, "gobom", "secret")
+
+	call := func(opt *Options) (*Response, error) {
+		requester, err := NewRequester(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer requester.close()
+		return requester.dispose()
+	}
+
+	// HTTP、HTTP/2和TCP都通过代理连接
+	for _, c := range []struct {
+		name    string
+		opt     *Options
+		tunnels *int32
+	}{
+		{"http connect", &Options{Url: server.URL, Form: FORM_HTTP}, httpTunnels},
+		{"http socks5", &Options{Url: server.URL, Form: FORM_HTTP}, socksTunnels},
+		{"h2c", &Options{Url: h2c.URL + "/echo", Form: FORM_HTTP, HttpOptions: HttpOptions{Method: "POST", Protocol: HTTP_PROTOCOL_H2C}, SendData: &SendData{}}, httpTunnels},
+		{"tcp", &Options{Url: echo, Form: FORM_TCP}, socksTunnels},
+	} {
+		proxy := httpProxy
+		if c.tunnels == socksTunnels {
+			proxy = socksProxy
+		}
+		c.opt.ProxyOptions = ProxyOptions{Urls: []string{proxy}}
+		before := atomic.LoadInt32(c.tunnels)
+		resp, err := call(c.opt)
+		if err != nil || !resp.IsSuccess {
+			t.Errorf("%s: %+v %v", c.name, resp, err)
+		}
+		if n := atomic.LoadInt32(c.tunnels) - before; n != 1 {
+			t.Errorf("%s: tunnels %d", c.name, n)
+		}
+	}
+
+	// 代理错误与目标错误分开统计
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+	for _, proxy := range []string{
+		strings.Replace(httpProxy, "p@ss", "wrong", 1),
+		strings.Replace(socksProxy, "secret", "wrong", 1),
+		"socks5://" + closed,
+	} {
+		resp, err := call(&Options{Url: server.URL, Form: FORM_HTTP, ProxyOptions: ProxyOptions{Urls: []string{proxy}}})
+		if err == nil || !strings.HasPrefix(err.Error(), ERR_PROXY.Error()) || resp.ProxyErrors != 1 || resp.ConnErrors != 0 {
+			t.Errorf("%s: %+v %v", proxy, resp, err)
+		}
+	}
+	resp, err := call(&Options{Url: "http://" + closed, Form: FORM_HTTP, ProxyOptions: ProxyOptions{Urls: []string{socksProxy}}})
+	if err == nil || resp.ProxyErrors != 1 {
+		t.Errorf("target refused: %+v %v", resp, err)
+	}
+
+	// 按虚拟用户分配代理，开启轮换后每次新建连接使用下一个代理
+	httpProxy2, httpTunnels2 := startTestProxy(t, PROXY_HTTP, "", "")
+	count := func(opt *Options, vus, n int) (int32, int32) {
+		first, second := atomic.LoadInt32(httpTunnels), atomic.LoadInt32(httpTunnels2)
+		var requesters []Requester
+		for i := 0; i < vus; i++ {
+			requester, err := NewRequester(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requesters = append(requesters, requester)
+			for j := 0; j < n; j++ {
+				if _, err := requester.dispose(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, requester := range requesters {
+			requester.close()
+		}
+		return atomic.LoadInt32(httpTunnels) - first, atomic.LoadInt32(httpTunnels2) - second
+	}
+	opt := &Options{Url: server.URL, Form: FORM_HTTP, ProxyOptions: ProxyOptions{Urls: []string{httpProxy, httpProxy2}}}
+	if a, b := count(opt, 3, 2); a != 2 || b != 1 {
+		t.Errorf("per vu: %d %d", a, b)
+	}
+	opt = &Options{Url: server.URL, Form: FORM_HTTP, ConnOptions: ConnOptions{NewConn: CONN_PER_REQUEST}, ProxyOptions: ProxyOptions{Urls: []string{httpProxy, httpProxy2}, Rotate: true}}
+	if a, b := count(opt, 1, 4); a != 2 || b != 2 {
+		t.Errorf("rotate: %d %d", a, b)
+	}
+	if len(connShareds.shareds) != 0 {
+		t.Errorf("not released: %d", len(connShareds.shareds))
+	}
+
+	// 代理把响应和目标服务端先发送的数据一起返回时，数据不丢失
+	banner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer banner.Close()
+	go func() {
+		conn, err := banner.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, ok := testHttpConnect(conn, "", ""); ok {
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n220 ready\r\n")
+		}
+	}()
+	proxyUrl, _ := url.Parse("http://" + banner.Addr().String())
+	conn, err := dialProxy(&net.Dialer{}, proxyUrl, "127.0.0.1:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "220 ready\r\n" {
+		t.Errorf("buffered: %q %v", line, err)
+	}
+	conn.Close()
+
+	// 校验
+	for _, v := range []string{"ftp://10.0.0.1", "10.0.0.1:3128", "socks5://"} {
+		if _, err := NewRequester(&Options{Url: server.URL, Form: FORM_HTTP, ProxyOptions: ProxyOptions{Urls: []string{v}}}); err == nil || !strings.HasPrefix(err.Error(), ERR_PROXY_URL.Error()) {
+			t.Errorf("%s: %v", v, err)
+		}
+	}
+	if urls, _ := (&ProxyOptions{Urls: []string{"socks5://10.0.0.1"}}).parse(); urls[0].Host != "10.0.0.1:1080" {
+		t.Errorf("default port: %s", urls[0].Host)
+	}
+
+	// 没有设置代理的脚本使用环境的代理
+	env := &EnvironmentData{Name: "staging", Proxies: httpProxy + ",\n" + httpProxy2, ProxyRotate: true}
+	gobom := &GobomRequest{
+		Options:   &Options{Url: server.URL},
+		Scenarios: []*Scenario{{Name: "own", Options: &Options{Url: server.URL, ProxyOptions: ProxyOptions{Urls: []string{socksProxy}}}}},
+	}
+	env.applyProxy(gobom)
+	if urls := gobom.Options.ProxyOptions.Urls; len(urls) != 2 || urls[1] != httpProxy2 || !gobom.Options.ProxyOptions.Rotate {
+		t.Errorf("environment: %+v", gobom.Options.ProxyOptions)
+	}
+	if urls := gobom.Scenarios[0].Options.ProxyOptions.Urls; len(urls) != 1 || urls[0] != socksProxy {
+		t.Errorf("script: %+v", gobom.Scenarios[0].Options.ProxyOptions)
+	}
+	(*EnvironmentData)(nil).applyProxy(gobom)
+
+	// 报告统计
+	report := &Report{}
+	report.Push(&Response{IsSuccess: false, ProxyErrors: 1})
+	report.Push(&Response{IsSuccess: false, ConnErrors: 1})
+	merged := &Report{}
+	merged.Merge(report.Snapshot())
+	for _, r := range []*Report{report, merged, merged.Copy()} {
+		if r.ProxyErrors != 1 || r.ConnErrors != 1 {
+			t.Errorf("report: %d %d", r.ProxyErrors, r.ConnErrors)
+		}
+	}
+}
@@ -12,19 +12,213 @@ type Report struct {
 	AverageTime               uint64              `json:"averageTime"`   // 平均每个请求消耗时长(成功请求)
 	SuccessNum                uint64              `json:"successNum"`    // 成功请求数
 	FailureNum                uint64              `json:"failureNum"`    // 失败请求数
+	TimeoutNum                uint64              `json:"timeoutNum"`    // 等待响应超时的请求数（计入失败）
+	LostNum                   uint64              `json:"lostNum"`       // 丢包数（计入失败）
+	HandshakeNum              uint64              `json:"handshakeNum"`  // TLS握手次数
+	HandshakeTime             uint64              `json:"handshakeTime"` // TLS握手平均时间（毫秒）
+	ConnOpened                uint64              `json:"connOpened"`    // 新建的连接数
+	ConnReused                uint64              `json:"connReused"`    // 复用连接的请求数
+	ConnErrors                uint64              `json:"connErrors"`    // 连接错误数
+	ProxyErrors               uint64              `json:"proxyErrors"`   // 代理连接错误数（不计入连接错误数）
 	SuccessNumMap             map[string]uint64   `json:"successNumMap"` // 成功请求数时间线
 	FailureNumMap             map[string]uint64   `json:"failureNumMap"` // 失败请求数时间线
 	ErrCode                   map[int]int         `json:"errCode"`       // [错误码]错误个数
 	ErrCodeMsg                map[int]string      `json:"errCodeMsg"`    // [错误码]错误码描述
 	EveryReqWasteTime         []uint64            `json:"-"`             // 每一个请求/事务 消耗的时间记录
 	EveryTransactionWasteTime []map[string]uint64 `json:"-"`             // 每一个事务中的每个步骤消耗的时间记录
+	Scenarios                 map[string]*Report  `json:"scenarios"`     // [场景名]场景报告
+	Setup                     *PhaseResult        `json:"setup"`         // setup执行结果（不计入统计）
+	Teardown                  *PhaseResult        `json:"teardown"`      // teardown执行结果（不计入统计）
+	Breaches                  []*ThresholdBreach  `json:"breaches"`      // 越过的阈值
+	Events                    []*RunEvent         `json:"events"`        // 运行中的调整记录
+	P50Time                   uint64              `json:"p50Time"`       // 耗时百分位(成功请求)
+	P90Time                   uint64              `json:"p90Time"`
+	P95Time                   uint64              `json:"p95Time"`
+	P99Time                   uint64              `json:"p99Time"`
 
-	mu sync.Mutex
+	mu             sync.Mutex
+	snapshot       *Snapshot // 可合并的统计快照
+	collect        bool      // 是否收集增量快照（压测节点上报使用）
+	handshakeTotal uint64    // TLS握手总时间
+	delta          *Snapshot // 上次取出后的增量快照
 }
 
 func (report *Report) ReceivingResults(resultResp <-chan *Response, ReportWg *sync.WaitGroup) {
 	defer ReportWg.Done()
 
+	report.mu.Lock()
+	report.init()
+	report.mu.Unlock()
+
+	for data := range resultResp {
+		report.mu.Lock()
+		report.record(data)
+		report.mu.Unlock()
+	}
+
+}
+
+// 统计一个请求结果
+func (report *Report) Push(data *Response) {
+	if report == nil || data == nil {
+		return
+	}
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.init()
+	report.record(data)
+}
+
+// 合并快照（控制节点合并压测节点上报的结果使用）
+func (report *Report) Merge(snapshot *Snapshot) {
+	if report == nil || snapshot == nil {
+		return
+	}
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.init()
+	report.merge(snapshot)
+}
+
+func (report *Report) record(data *Response) {
+	now := time.Now()
+	curDate := now.Format("2006-01-02 15:04:05")
+	report.add(data, curDate)
+	report.snapshot.Add(data, now)
+	if data.Scenario != "" {
+		scenarioReport := report.scenario(data.Scenario)
+		scenarioReport.add(data, curDate)
+		scenarioReport.snapshot.Add(data, now)
+	}
+	if report.collect {
+		if report.delta == nil {
+			report.delta = NewSnapshot()
+		}
+		report.delta.Add(data, now)
+		if data.Scenario != "" {
+			report.delta.Scenario(data.Scenario).Add(data, now)
+		}
+	}
+}
+
+func (report *Report) merge(snapshot *Snapshot) {
+	report.mergeFields(snapshot)
+	report.snapshot.Merge(snapshot)
+	if report.collect {
+		if report.delta == nil {
+			report.delta = NewSnapshot()
+		}
+		report.delta.Merge(snapshot)
+	}
+}
+
+// 按快照更新报告中的统计字段，场景报告的快照与报告快照中的场景共用，不需要重复合并
+func (report *Report) mergeFields(snapshot *Snapshot) {
+	report.TotalTime += snapshot.TotalTime
+	report.SuccessNum += snapshot.SuccessNum
+	report.FailureNum += snapshot.FailureNum
+	report.TimeoutNum += snapshot.TimeoutNum
+	report.LostNum += snapshot.LostNum
+	report.HandshakeNum += snapshot.HandshakeNum
+	report.handshakeTotal += snapshot.HandshakeTime
+	report.HandshakeTime = report.getAvgHandshakeTime()
+	report.ConnOpened += snapshot.ConnOpened
+	report.ConnReused += snapshot.ConnReused
+	report.ConnErrors += snapshot.ConnErrors
+	report.ProxyErrors += snapshot.ProxyErrors
+	report.MaxTime, report.MinTime = maxMin(report.MaxTime, report.MinTime, snapshot.MaxTime, snapshot.MinTime)
+	for sec, point := range snapshot.Series {
+		curDate := time.Unix(sec, 0).Format("2006-01-02 15:04:05")
+		if point.SuccessNum != 0 {
+			report.SuccessNumMap[curDate] += point.SuccessNum
+		}
+		if point.FailureNum != 0 {
+			report.FailureNumMap[curDate] += point.FailureNum
+		}
+	}
+	for code, errStat := range snapshot.Errors {
+		report.ErrCode[code] += int(errStat.Count)
+		if _, ok := report.ErrCodeMsg[code]; !ok {
+			report.ErrCodeMsg[code] = errStat.Msg
+		}
+	}
+	report.AverageTime = report.getAvgTime()
+	for name, v := range snapshot.Scenarios {
+		report.scenario(name).mergeFields(v)
+	}
+}
+
+func (report *Report) scenario(name string) *Report {
+	if report.Scenarios == nil {
+		report.Scenarios = make(map[string]*Report)
+	}
+	scenarioReport, ok := report.Scenarios[name]
+	if !ok {
+		scenarioReport = &Report{snapshot: report.snapshot.Scenario(name)}
+		scenarioReport.init()
+		report.Scenarios[name] = scenarioReport
+	}
+	return scenarioReport
+}
+
+// 返回当前统计快照的副本
+func (report *Report) Snapshot() *Snapshot {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.init()
+	return report.snapshot.Copy()
+}
+
+// 取出上次调用后的增量快照
+func (report *Report) TakeDelta() *Snapshot {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	delta := report.delta
+	report.delta = nil
+	return delta
+}
+
+// 开始收集增量快照
+func (report *Report) Collect() {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.collect = true
+	report.delta = nil
+}
+
+// 取出增量快照，同时返回当前快照的副本
+func (report *Report) Progress() (delta, total *Snapshot) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.init()
+	delta = report.delta
+	report.delta = nil
+	if delta == nil {
+		delta = NewSnapshot()
+	}
+	return delta, report.snapshot.Copy()
+}
+
+func (report *Report) addEvent(event *RunEvent) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.init()
+	report.snapshot.Events = append(report.snapshot.Events, event)
+	if report.collect {
+		if report.delta == nil {
+			report.delta = NewSnapshot()
+		}
+		report.delta.Events = append(report.delta.Events, event)
+	}
+}
+
+func (report *Report) addBreach(breaches []*ThresholdBreach) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Breaches = append(report.Breaches, breaches...)
+}
+
+func (report *Report) init() {
 	if report.SuccessNumMap == nil {
 		report.SuccessNumMap = make(map[string]uint64)
 	}
@@ -49,41 +243,55 @@ func (report *Report) ReceivingResults(resultResp <-chan *Response, ReportWg *sy
 		report.EveryTransactionWasteTime = make([]map[string]uint64, 0)
 	}
 
-	for data := range resultResp {
-		report.mu.Lock()
+	if report.snapshot == nil {
+		report.snapshot = NewSnapshot()
+	}
+}
 
-		curDate := time.Now().Format("2006-01-02 15:04:05")
-		if data.IsSuccess {
-			report.TotalTime += data.WasteTime
-			report.SuccessNum++
-			report.SuccessNumMap[curDate]++
-
-			if data.WasteTime > report.MaxTime {
-				report.MaxTime = data.WasteTime
-			}
-			if report.MinTime == 0 || (data.WasteTime != 0 && data.WasteTime < report.MinTime) {
-				report.MinTime = data.WasteTime
-			}
-
-			report.EveryReqWasteTime = append(report.EveryReqWasteTime, data.WasteTime)
-
-			if data.TransactionWasteTime != nil {
-				report.EveryTransactionWasteTime = append(report.EveryTransactionWasteTime, data.TransactionWasteTime)
-			}
-		} else {
-			report.FailureNum++
-			report.FailureNumMap[curDate]++
-			report.ErrCode[data.ErrCode]++
-
-			if _, ok := report.ErrCodeMsg[data.ErrCode]; !ok {
-				report.ErrCodeMsg[data.ErrCode] = data.ErrMsg
-			}
+func (report *Report) add(data *Response, curDate string) {
+	if data.Timeout {
+		report.TimeoutNum++
+	}
+	if data.Lost {
+		report.LostNum++
+	}
+	if data.HandshakeNum != 0 {
+		report.HandshakeNum += data.HandshakeNum
+		report.handshakeTotal += data.HandshakeTime
+		report.HandshakeTime = report.getAvgHandshakeTime()
+	}
+	report.ConnOpened += data.ConnOpened
+	report.ConnReused += data.ConnReused
+	report.ConnErrors += data.ConnErrors
+	report.ProxyErrors += data.ProxyErrors
+	if data.IsSuccess {
+		report.TotalTime += data.WasteTime
+		report.SuccessNum++
+		report.SuccessNumMap[curDate]++
+
+		if data.WasteTime > report.MaxTime {
+			report.MaxTime = data.WasteTime
+		}
+		if report.MinTime == 0 || (data.WasteTime != 0 && data.WasteTime < report.MinTime) {
+			report.MinTime = data.WasteTime
 		}
 
-		report.AverageTime = report.getAvgTime()
-		report.mu.Unlock()
+		report.EveryReqWasteTime = append(report.EveryReqWasteTime, data.WasteTime)
+
+		if data.TransactionWasteTime != nil {
+			report.EveryTransactionWasteTime = append(report.EveryTransactionWasteTime, data.TransactionWasteTime)
+		}
+	} else {
+		report.FailureNum++
+		report.FailureNumMap[curDate]++
+		report.ErrCode[data.ErrCode]++
+
+		if _, ok := report.ErrCodeMsg[data.ErrCode]; !ok {
+			report.ErrCodeMsg[data.ErrCode] = data.ErrMsg
+		}
 	}
 
+	report.AverageTime = report.getAvgTime()
 }
 
 func (report *Report) Copy() *Report {
@@ -94,6 +302,7 @@ func (report *Report) Copy() *Report {
 	failureNumMap := make(map[string]uint64)
 	errCode := make(map[int]int)
 	errCodeMsg := make(map[int]string)
+	everyReqWasteTime := make([]uint64, len(report.EveryReqWasteTime))
 	everyTransactionWasteTime := make([]map[string]uint64, len(report.EveryTransactionWasteTime))
 
 	for k, v := range report.SuccessNumMap {
@@ -112,6 +321,8 @@ func (report *Report) Copy() *Report {
 		errCodeMsg[k] = v
 	}
 
+	copy(everyReqWasteTime, report.EveryReqWasteTime)
+
 	for k, v := range report.EveryTransactionWasteTime {
 		everyTransactionWasteTime[k] = make(map[string]uint64)
 		for kk, vv := range v {
@@ -119,6 +330,26 @@ func (report *Report) Copy() *Report {
 		}
 	}
 
+	var scenarios map[string]*Report
+	if report.Scenarios != nil {
+		scenarios = make(map[string]*Report)
+		for k, v := range report.Scenarios {
+			scenarios[k] = v.Copy()
+		}
+	}
+
+	// 从数据库读取的报告没有快照，保留已有的统计结果
+	snapshot := report.snapshot
+	if snapshot == nil {
+		snapshot = &Snapshot{Events: report.Events}
+	}
+	var copied *Snapshot
+	p50, p90, p95, p99 := report.P50Time, report.P90Time, report.P95Time, report.P99Time
+	if report.snapshot != nil {
+		copied = report.snapshot.Copy()
+		p50, p90, p95, p99 = snapshot.Percentile(50), snapshot.Percentile(90), snapshot.Percentile(95), snapshot.Percentile(99)
+	}
+
 	return &Report{
 		TotalTime:                 report.TotalTime,
 		MaxTime:                   report.MaxTime,
@@ -126,13 +357,50 @@ func (report *Report) Copy() *Report {
 		AverageTime:               report.AverageTime,
 		SuccessNum:                report.SuccessNum,
 		FailureNum:                report.FailureNum,
+		TimeoutNum:                report.TimeoutNum,
+		LostNum:                   report.LostNum,
+		HandshakeNum:              report.HandshakeNum,
+		HandshakeTime:             report.HandshakeTime,
+		ConnOpened:                report.ConnOpened,
+		ConnReused:                report.ConnReused,
+		ConnErrors:                report.ConnErrors,
+		ProxyErrors:               report.ProxyErrors,
 		SuccessNumMap:             successNumMap,
 		FailureNumMap:             failureNumMap,
 		ErrCode:                   errCode,
 		ErrCodeMsg:                errCodeMsg,
-		EveryReqWasteTime:         report.EveryReqWasteTime,
+		EveryReqWasteTime:         everyReqWasteTime,
 		EveryTransactionWasteTime: everyTransactionWasteTime,
+		Scenarios:                 scenarios,
+		Breaches:                  append([]*ThresholdBreach(nil), report.Breaches...),
+		Events:                    append([]*RunEvent(nil), snapshot.Events...),
+		Setup:                     report.Setup,
+		Teardown:                  report.Teardown,
+		P50Time:                   p50,
+		P90Time:                   p90,
+		P95Time:                   p95,
+		P99Time:                   p99,
+		snapshot:                  copied,
+		handshakeTotal:            report.handshakeTotal,
+	}
+}
+
+func (report *Report) setPhase(result *PhaseResult) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	switch result.Name {
+	case PHASE_SETUP:
+		report.Setup = result
+	case PHASE_TEARDOWN:
+		report.Teardown = result
+	}
+}
+
+func (report *Report) getAvgHandshakeTime() uint64 {
+	if report.HandshakeNum == 0 {
+		return 0
 	}
+	return report.handshakeTotal / report.HandshakeNum
 }
 
 func (report *Report) getAvgTime() uint64 {
@@ -16,15 +16,33 @@ type Requester interface {
 }
 
 type GobomRequest struct {
-	Options    *Options `json:"options"`
-	Report     *Report  `json:"report"`
-	Duration   *uint64  `json:"duration"`
-	ConCurrent *uint64  `json:"conCurrent"`
-
-	wg         sync.WaitGroup
-	stop       chan bool
-	stopStatus bool // 标识stop chan是否关闭
-	resultResp chan *Response
+	Options    *Options          `json:"options"`
+	Report     *Report           `json:"report"`
+	Duration   *uint64           `json:"duration"`
+	ConCurrent *uint64           `json:"conCurrent"`
+	Scenarios  []*Scenario       `json:"scenarios"`  // 多场景任务，所有场景同时运行
+	Setup      *Options          `json:"setup"`      // 压测开始前执行一次的脚本
+	Teardown   *Options          `json:"teardown"`   // 压测结束后执行一次的脚本
+	Globals    map[string]string `json:"globals"`    // 初始全局变量
+	Thresholds []*Threshold      `json:"thresholds"` // 阈值，越过时推送告警或停止任务
+
+	wg          sync.WaitGroup
+	stop        chan bool     // 创建后不再替换，接口随时可能读取
+	done        chan struct{} // 全部关闭时close
+	closeOnce   sync.Once
+	prepareOnce sync.Once
+	runMu       sync.Mutex       // 保护started、stopStatus，启动和调整虚拟用户、关闭stop时持有
+	started     bool             // 虚拟用户已启动，可以调整和暂停
+	stopStatus  bool             // 标识stop chan是否关闭
+	main        *Scenario        // 未配置多场景时，使用Options作为唯一场景
+	limiter     *RateLimiter     // 任务的到达率，默认不限制
+	env         *EnvironmentData // 所在环境的限制，为nil时不限制
+	resumeCh    chan struct{}    // 暂停中不为nil，恢复时关闭
+	pausedAt    time.Time
+	pauseMu     sync.Mutex
+	globals     map[string]string // 运行时的全局变量（初始全局变量 + 传入的变量 + setup提取的变量）
+	inherits    map[string]string // 运行前传入的全局变量（流水线上一阶段传递）
+	resultResp  chan *Response
 }
 
 type Response struct {
@@ -34,6 +52,16 @@ type Response struct {
 	ErrMsg               string            `json:"errMsg"`               // 错误提示
 	Data                 []byte            `json:"report"`               // 响应数据
 	TransactionWasteTime map[string]uint64 `json:"transactionWasteTime"` // 事务中每个步骤消耗时间
+	Scenario             string            `json:"scenario"`             // 所属场景
+	Variables            map[string]string `json:"-"`                    // 事务中提取的变量
+	Timeout              bool              `json:"timeout"`              // 等待响应超时
+	Lost                 bool              `json:"lost"`                 // 丢包（发送失败或对端不可达）
+	HandshakeNum         uint64            `json:"handshakeNum"`         // 新建连接的TLS握手次数
+	HandshakeTime        uint64            `json:"handshakeTime"`        // TLS握手总时间（毫秒）
+	ConnOpened           uint64            `json:"connOpened"`           // 新建的连接数
+	ConnReused           uint64            `json:"connReused"`           // 复用连接的请求数
+	ConnErrors           uint64            `json:"connErrors"`           // 连接错误数（建立失败、读写失败）
+	ProxyErrors          uint64            `json:"proxyErrors"`          // 代理连接错误数（连接代理失败、代理建立隧道失败）
 }
 
 const (
@@ -83,21 +111,83 @@ func (gobom *GobomRequest) Dispose(callback DisposeCallFunc) error {
 		err        error
 	)
 
+	gobom.prepare()
+
+	// 规则可能在保存脚本后修改，运行前再检查一次
+	if _, err = gobomInterlock.CheckUrls(gobom.Urls()); err != nil {
+		logger.Debug(err)
+		callback(err)
+		return err
+	}
+
+	gobom.initGlobals()
+	if err = gobom.setup(); err != nil {
+		logger.Debug(err)
+		gobom.teardown()
+		callback(err)
+		return err
+	}
+	gobom.Options.TransactionOptions.Globals = gobom.globals
+	for _, scenario := range gobom.Scenarios {
+		scenario.Options.TransactionOptions.Globals = gobom.globals
+	}
+
 	gobom.wg = sync.WaitGroup{}
 	gobom.resultResp = make(chan *Response, DEFAULT_RESPONSE_COUNT)
-	gobom.stop = make(chan bool, DEFAULT_STOP_CAP)
+	gobom.main = &Scenario{Options: gobom.Options}
+	gobom.limiter = NewRateLimiter(gobom.env.maxRate())
+	gobom.resumeCh = nil
+
+	if len(gobom.Scenarios) != 0 {
+		var totalWeight uint64
+		for _, scenario := range gobom.Scenarios {
+			totalWeight += scenario.Weight
+		}
+		for _, scenario := range gobom.Scenarios {
+			scenario.init(conCurrent, totalWeight)
+			if duration == 0 && scenario.duration() > gobom.getDuration() {
+				gobom.setDuration(scenario.duration())
+			}
+		}
+		gobom.setConCurrent(0)
+	}
 
-	go gobom.Timer() // 定时器关闭请求
+	timerDone := make(chan struct{})
+	go func() {
+		gobom.Timer() // 定时器关闭请求
+		close(timerDone)
+	}()
 	ReportWg.Add(1)
 	go gobom.Report.ReceivingResults(gobom.resultResp, &ReportWg) // 统计请求数据
 
-	gobom.Start(gobom.getConCurrent())
+	// 启动前已经停止时不再启动虚拟用户
+	gobom.runMu.Lock()
+	if !gobom.isClosed() {
+		gobom.started = true
+		if len(gobom.Scenarios) != 0 {
+			for _, scenario := range gobom.Scenarios {
+				gobom.wg.Add(1)
+				go gobom.launch(scenario)
+			}
+		} else {
+			gobom.Start(gobom.getConCurrent())
+		}
+	}
+	gobom.runMu.Unlock()
 
 	gobom.wg.Wait()
+	gobom.runMu.Lock()
+	gobom.closeOnce.Do(func() {
+		close(gobom.done)
+	})
 	close(gobom.stop)
+	gobom.stopStatus = true
+	gobom.runMu.Unlock()
+	gobom.wg.Wait() // 等待关闭前调整增加的虚拟用户
 	close(gobom.resultResp)
 	ReportWg.Wait()
-	gobom.stopStatus = true
+	<-timerDone // 定时器退出后才能恢复时长
+	gobom.teardown()
 	logger.Debug("dispose out...")
 
 	atomic.StoreUint64(gobom.ConCurrent, conCurrent)
@@ -115,25 +205,37 @@ func (gobom *GobomRequest) AddConcurrentAndStart(count uint64) {
 
 func (gobom *GobomRequest) Start(count uint64) {
 	logger.Debug("signal count：", gobom.getConCurrent())
+	scenario := gobom.main
+	if len(gobom.Scenarios) != 0 {
+		scenario = gobom.Scenarios[0]
+	}
 	for i := uint64(0); i < count; i++ {
-		gobom.wg.Add(1)
-		go func() {
-			defer func() {
-				gobom.wg.Done()
-				gobom.minusConCurrent(1)
-			}()
-			if err := gobom.board(); err != nil {
-				logger.Debug(err)
-				gobom.PushResponse(&Response{
-					IsSuccess: false,
-					ErrCode:   -1,
-					ErrMsg:    err.Error(),
-				})
-			}
-		}()
+		gobom.spawn(scenario)
 	}
 }
 
+// 启动一个虚拟用户
+func (gobom *GobomRequest) spawn(scenario *Scenario) {
+	gobom.wg.Add(1)
+	scenario.addConCurrent(1)
+	go func() {
+		defer func() {
+			gobom.minusConCurrent(1)
+			scenario.minusConCurrent(1)
+			gobom.wg.Done()
+		}()
+		if err := gobom.board(scenario); err != nil {
+			logger.Debug(err)
+			gobom.PushResponse(&Response{
+				IsSuccess: false,
+				ErrCode:   -1,
+				ErrMsg:    err.Error(),
+				Scenario:  scenario.Name,
+			})
+		}
+	}()
+}
+
 func (gobom *GobomRequest) boardTest() (err error) {
 	requester, err := gobom.GetRequester()
 	if err != nil {
@@ -147,9 +249,9 @@ func (gobom *GobomRequest) boardTest() (err error) {
 	return nil
 }
 
-func (gobom *GobomRequest) board() (err error) {
+func (gobom *GobomRequest) board(scenario *Scenario) (err error) {
 
-	requester, err := gobom.GetRequester()
+	requester, err := NewRequester(scenario.Options)
 	if err != nil {
 		return err
 	}
@@ -160,7 +262,28 @@ func (gobom *GobomRequest) board() (err error) {
 		select {
 		case <-gobom.stop:
 			return nil
+		case <-scenario.stop:
+			return nil
 		default:
+			if !gobom.hold(scenario) {
+				return nil
+			}
+			wait := scenario.limiter.Reserve()
+			if w := gobom.limiter.Reserve(); w > wait {
+				wait = w
+			}
+			if w := gobomGuard.limiter.Reserve(); w > wait {
+				wait = w
+			}
+			if wait > 0 {
+				select {
+				case <-gobom.stop:
+					return nil
+				case <-scenario.stop:
+					return nil
+				case <-time.After(wait):
+				}
+			}
 			resp, err := requester.dispose()
 			if err != nil {
 				if err_retries > ERR_RETRIES {
@@ -172,52 +295,90 @@ func (gobom *GobomRequest) board() (err error) {
 				err_retries = 1
 			}
 
+			if resp != nil {
+				resp.Scenario = scenario.Name
+			}
 			gobom.PushResponse(resp)
 
-			if gobom.Options.Interval != 0 {
-				time.Sleep(time.Duration(gobom.Options.Interval) * time.Millisecond)
+			if scenario.Options.Interval != 0 {
+				time.Sleep(time.Duration(scenario.Options.Interval) * time.Millisecond)
 			}
 		}
 	}
 }
 
+// 创建停止信号，在任务发布为运行中之前调用，之后不再替换
+func (gobom *GobomRequest) prepare() {
+	gobom.prepareOnce.Do(func() {
+		gobom.stop = make(chan bool, DEFAULT_STOP_CAP)
+		gobom.done = make(chan struct{})
+	})
+}
+
+// 虚拟用户已启动并且没有关闭
+func (gobom *GobomRequest) running() bool {
+	gobom.runMu.Lock()
+	defer gobom.runMu.Unlock()
+	return gobom.started && !gobom.isClosed()
+}
+
+// 关闭count个虚拟用户，启动前调用时任务不再启动
 func (gobom *GobomRequest) Close(count uint64) {
+	gobom.prepare()
+	gobom.runMu.Lock()
+	defer gobom.runMu.Unlock()
+	gobom.close(count)
+}
+
+// 调用时持有runMu
+func (gobom *GobomRequest) close(count uint64) {
 	if gobom.stopStatus {
 		return
 	}
 	if count == CLOSE_ALL || count >= gobom.getConCurrent() {
 		count = gobom.getConCurrent()
+		gobom.closeOnce.Do(func() {
+			close(gobom.done)
+		})
 	}
 	var i uint64
 	for i = 0; i < count; i++ {
 		gobom.stop <- true
 	}
 	logger.Debug("close signal count: ", i)
-	gobom.minusConCurrent(count)
-	//for {
-	//	// 外层逻辑需要确保压测逻辑全部结束在返回
-	//	if gobom.stopStatus == true {
-	//		return
-	//	}
-	//	time.Sleep(time.Duration(100) * time.Millisecond)
-	//}
 }
 
+// 定时器，剩余时长为0时关闭请求；时长为0表示不限制，运行中延长时长后开始计时
 func (gobom *GobomRequest) Timer() {
-	if gobom.getDuration() == 0 {
-		return
-	}
+	done := gobom.done
 	t := time.NewTicker(1 * time.Second)
+	defer t.Stop()
 	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if gobom.getDuration() == 0 || gobom.paused() != nil {
+			continue
+		}
+		gobom.minusDuration(1)
 		if gobom.getDuration() == 0 {
 			break
 		}
-		<-t.C
-		gobom.minusDuration(1)
 	}
 	gobom.Close(CLOSE_ALL)
 }
 
+func (gobom *GobomRequest) isClosed() bool {
+	select {
+	case <-gobom.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (gobom *GobomRequest) Info() *Report {
 	return gobom.Report
 }
@@ -266,14 +427,57 @@ func (gobom *GobomRequest) PushResponse(resp *Response) {
 	}
 }
 
+// 任务请求的所有地址（包括多场景、setup和teardown），去除重复
+// 任务中的所有脚本（主脚本、setup、teardown、场景）
+func (gobom *GobomRequest) allOptions() []*Options {
+	var opts []*Options
+	for _, opt := range []*Options{gobom.Options, gobom.Setup, gobom.Teardown} {
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+	}
+	for _, scenario := range gobom.Scenarios {
+		if scenario.Options != nil {
+			opts = append(opts, scenario.Options)
+		}
+	}
+	return opts
+}
+
+func (gobom *GobomRequest) Urls() []string {
+	var list []string
+	seen := make(map[string]bool)
+	for _, opt := range gobom.allOptions() {
+		for _, v := range opt.Urls() {
+			if !seen[v] {
+				seen[v] = true
+				list = append(list, v)
+			}
+		}
+	}
+	return list
+}
+
 func (gobom *GobomRequest) GetRequester() (requester Requester, err error) {
-	switch gobom.Options.Form {
+	return NewRequester(gobom.Options)
+}
+
+func NewRequester(opt *Options) (requester Requester, err error) {
+	// 包括事务步骤和主机映射后的地址，调试脚本时使用未保存的脚本
+	if _, err = gobomInterlock.CheckUrls(opt.Urls()); err != nil {
+		return nil, err
+	}
+	switch opt.Form {
 	case FORM_HTTP:
-		requester, err = NewHttpRequest(gobom.Options)
+		requester, err = NewHttpRequest(opt)
 	case FORM_TCP:
-		requester, err = NewTcpRequest(gobom.Options)
+		requester, err = NewTcpRequest(opt)
 	case FORM_WEBSOCKET:
 		// TODO
+	case FORM_GRPC:
+		requester, err = NewGrpcRequest(opt)
+	case FORM_UDP:
+		requester, err = NewUdpRequest(opt)
 	default:
 		return nil, ERR_FORM
 	}
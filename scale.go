@@ -0,0 +1,144 @@
+package gobom
+
+import "time"
+
+const (
+	EVENT_CONCURRENT = "conCurrent" // 并发数变化
+	EVENT_RATE       = "rate"       // 到达率变化
+	EVENT_DURATION   = "duration"   // 剩余时长变化
+)
+
+// 运行中调整任务的参数
+type ScaleReqData struct {
+	Scenario   string  `json:"scenario"`   // 场景名，多场景任务调整并发数时必填
+	ConCurrent int64   `json:"conCurrent"` // 增加（正数）或减少（负数）的并发数
+	Rate       *uint64 `json:"rate"`       // 目标每秒迭代次数，0为不限制，不设置时不调整
+	Duration   int64   `json:"duration"`   // 延长（正数）或缩短（负数）的剩余时长（秒）
+	Reason     string  `json:"reason"`     // 调整原因
+}
+
+// 运行事件，记录在时间线中
+type RunEvent struct {
+	Time     int64  `json:"time"` // 秒级时间戳，与时间线对应
+	Type     string `json:"type"`
+	Scenario string `json:"scenario"`
+	From     uint64 `json:"from"`
+	To       uint64 `json:"to"`
+	Reason   string `json:"reason"`
+}
+
+// 调整运行中的任务，并将调整记录到报告的时间线中
+func (gobom *GobomRequest) Scale(req *ScaleReqData) error {
+	events, err := gobom.apply(req)
+	for _, event := range events {
+		gobom.Report.addEvent(event)
+	}
+	return err
+}
+
+func (gobom *GobomRequest) apply(req *ScaleReqData) (events []*RunEvent, err error) {
+	if req == nil {
+		return nil, ERR_PARAM
+	}
+	// 持有runMu，保证任务结束时不再启动新的虚拟用户
+	gobom.runMu.Lock()
+	defer gobom.runMu.Unlock()
+	if !gobom.started || gobom.isClosed() {
+		return nil, ERR_TASK_NOT_RUN
+	}
+	var scenario *Scenario
+	if req.Scenario != "" {
+		for _, v := range gobom.Scenarios {
+			if v.Name == req.Scenario {
+				scenario = v
+			}
+		}
+		if scenario == nil {
+			return nil, ERR_SCENARIO_NOT_FOUND
+		}
+	}
+	newEvent := func(typ string, from, to uint64) *RunEvent {
+		return &RunEvent{
+			Time:     time.Now().Unix(),
+			Type:     typ,
+			Scenario: req.Scenario,
+			From:     from,
+			To:       to,
+			Reason:   req.Reason,
+		}
+	}
+
+	// 先检查所有限制，全部通过后再调整，失败时任务没有任何改变
+	var conFrom, conTo, durationTo uint64
+	if req.ConCurrent != 0 {
+		if scenario == nil && len(gobom.Scenarios) != 0 {
+			return nil, ERR_SCENARIO_NOT_FOUND
+		}
+		if scenario != nil {
+			conFrom = scenario.getTarget()
+		} else {
+			conFrom = gobom.getConCurrent()
+		}
+		if req.ConCurrent > 0 {
+			conTo = conFrom + uint64(req.ConCurrent)
+			if max := gobom.env.maxConCurrent(); max != 0 && gobom.targetConCurrent()+uint64(req.ConCurrent) > max {
+				return nil, ERR_ENV_CONCURRENT
+			}
+		} else if uint64(-req.ConCurrent) < conFrom {
+			conTo = conFrom - uint64(-req.ConCurrent)
+		} else {
+			return nil, ERR_SCALE_CONCURRENT
+		}
+	}
+	limiter := gobom.limiter
+	if scenario != nil {
+		limiter = scenario.limiter
+	}
+	// 场景的到达率受任务的到达率限制，只检查任务
+	if req.Rate != nil && scenario == nil {
+		if max := gobom.env.maxRate(); max != 0 && (*req.Rate == 0 || *req.Rate > max) {
+			return nil, ERR_ENV_RATE
+		}
+	}
+	durationFrom := gobom.getDuration()
+	if req.Duration > 0 {
+		durationTo = durationFrom + uint64(req.Duration)
+	} else if req.Duration < 0 && uint64(-req.Duration) < durationFrom {
+		durationTo = durationFrom - uint64(-req.Duration)
+	} else if req.Duration < 0 {
+		return nil, ERR_SCALE_DURATION
+	}
+
+	if req.ConCurrent != 0 {
+		if scenario != nil {
+			gobom.scale(scenario, conTo)
+		} else if conTo > conFrom {
+			gobom.AddConcurrentAndStart(conTo - conFrom)
+		} else {
+			gobom.close(conFrom - conTo)
+		}
+		events = append(events, newEvent(EVENT_CONCURRENT, conFrom, conTo))
+	}
+	if req.Rate != nil {
+		from := limiter.GetRate()
+		limiter.SetRate(*req.Rate)
+		events = append(events, newEvent(EVENT_RATE, from, *req.Rate))
+	}
+	if req.Duration != 0 {
+		gobom.setDuration(durationTo)
+		events = append(events, newEvent(EVENT_DURATION, durationFrom, durationTo))
+	}
+	return events, nil
+}
+
+// 当前所有场景的目标并发数之和
+func (gobom *GobomRequest) targetConCurrent() uint64 {
+	if len(gobom.Scenarios) == 0 {
+		return gobom.getConCurrent()
+	}
+	var n uint64
+	for _, scenario := range gobom.Scenarios {
+		n += scenario.getTarget()
+	}
+	return n
+}
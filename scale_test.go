@@ -0,0 +1,65 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScale(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	gobomReq, err := NewGomBomRequest(&Options{
+		Url:        server.URL,
+		ConCurrent: 1,
+		Duration:   2,
+		Interval:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gobomReq.Scale(&ScaleReqData{ConCurrent: 1}); err != ERR_TASK_NOT_RUN {
+		t.Errorf("scale before run: %v", err)
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		gobomReq.Dispose(func(err error) error { return err })
+		close(done)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	rate := uint64(20)
+	if err := gobomReq.Scale(&ScaleReqData{ConCurrent: 2, Rate: &rate, Duration: 1, Reason: "ramp"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := gobomReq.getConCurrent(); n != 3 {
+		t.Errorf("concurrency %d, want 3", n)
+	}
+	if err := gobomReq.Scale(&ScaleReqData{ConCurrent: -3}); err != ERR_SCALE_CONCURRENT {
+		t.Errorf("scale to zero: %v", err)
+	}
+	if err := gobomReq.Scale(&ScaleReqData{ConCurrent: -1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := gobomReq.getConCurrent(); n != 2 {
+		t.Errorf("concurrency %d, want 2", n)
+	}
+
+	<-done
+	if d := time.Since(start); d < 2500*time.Millisecond || d > 4*time.Second {
+		t.Errorf("run took %s, want about 3s", d)
+	}
+	report := gobomReq.Info().Copy()
+	if len(report.Events) != 4 || report.Events[0].Type != EVENT_CONCURRENT || report.Events[0].To != 3 || report.Events[0].Reason != "ramp" {
+		t.Errorf("unexpected events: %v", report.Events)
+	}
+	// 限制为每秒20次后，总请求数应明显少于不限速时
+	if report.SuccessNum == 0 || report.SuccessNum > 100 {
+		t.Errorf("success num %d out of range", report.SuccessNum)
+	}
+}
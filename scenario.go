@@ -0,0 +1,206 @@
+package gobom
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_SCENARIO_STOP_CAP = 1 << 16
+
+type Scenario struct {
+	Name        string   `json:"name"`
+	ScriptId    uint     `json:"scriptId"`
+	Weight      uint64   `json:"weight"`      // 权重，未设置并发数和到达率时按权重分配任务的并发数
+	ConCurrent  uint64   `json:"conCurrent"`  // 并发数
+	Rate        uint64   `json:"rate"`        // 到达率（每秒迭代次数），为0时不限制
+	StartOffset uint64   `json:"startOffset"` // 启动延迟（秒）
+	Stages      []Stage  `json:"stages"`      // 负载曲线，按阶段线性调整并发数
+	Options     *Options `json:"options"`     // 场景脚本
+
+	size       uint64 // 初始并发数
+	target     uint64 // 期望的并发数
+	conCurrent uint64 // 正在运行的并发数
+	stop       chan bool
+	limiter    *RateLimiter
+	mu         sync.Mutex // 调整并发数时加锁
+}
+
+type Stage struct {
+	Duration uint64 `json:"duration"` // 阶段持续时间（秒）
+	Target   uint64 `json:"target"`   // 阶段结束时的并发数
+}
+
+// 按固定间隔放行请求，用于控制到达率
+type RateLimiter struct {
+	rate     uint64
+	interval time.Duration
+	next     time.Time
+	mu       sync.Mutex
+}
+
+func NewRateLimiter(rate uint64) *RateLimiter {
+	limiter := &RateLimiter{}
+	limiter.SetRate(rate)
+	return limiter
+}
+
+func (limiter *RateLimiter) SetRate(rate uint64) {
+	if limiter == nil {
+		return
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.rate = rate
+	if rate == 0 {
+		limiter.interval = 0
+		return
+	}
+	limiter.interval = time.Second / time.Duration(rate)
+}
+
+func (limiter *RateLimiter) GetRate() uint64 {
+	if limiter == nil {
+		return 0
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.rate
+}
+
+// 预约下一次请求，返回需要等待的时间
+func (limiter *RateLimiter) Reserve() time.Duration {
+	if limiter == nil {
+		return 0
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.interval == 0 {
+		return 0
+	}
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	wait := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(limiter.interval)
+	return wait
+}
+
+// 初始化场景运行数据，total为任务的并发数，totalWeight为所有场景的权重之和
+func (scenario *Scenario) init(total, totalWeight uint64) {
+	scenario.size = scenario.initSize(total, totalWeight)
+	scenario.target = 0
+	scenario.conCurrent = 0
+	scenario.stop = make(chan bool, DEFAULT_SCENARIO_STOP_CAP)
+	scenario.limiter = NewRateLimiter(scenario.Rate)
+}
+
+// 初始并发数：未设置时按到达率或权重计算
+func (scenario *Scenario) initSize(total, totalWeight uint64) uint64 {
+	if scenario.ConCurrent != 0 {
+		return scenario.ConCurrent
+	}
+	if scenario.Rate != 0 {
+		return scenario.Rate
+	}
+	if totalWeight != 0 {
+		return total * scenario.Weight / totalWeight
+	}
+	return 0
+}
+
+// 场景运行时长（启动延迟 + 负载曲线时长）
+func (scenario *Scenario) duration() uint64 {
+	duration := scenario.StartOffset
+	for _, stage := range scenario.Stages {
+		duration += stage.Duration
+	}
+	return duration
+}
+
+func (scenario *Scenario) getTarget() uint64 {
+	scenario.mu.Lock()
+	defer scenario.mu.Unlock()
+	return scenario.target
+}
+
+func (scenario *Scenario) getConCurrent() uint64 {
+	return atomic.LoadUint64(&scenario.conCurrent)
+}
+
+func (scenario *Scenario) addConCurrent(count uint64) {
+	atomic.AddUint64(&scenario.conCurrent, count)
+}
+
+func (scenario *Scenario) minusConCurrent(count uint64) {
+	if atomic.LoadUint64(&scenario.conCurrent) == 0 {
+		return
+	}
+	atomic.AddUint64(&scenario.conCurrent, ^uint64(count-1))
+}
+
+// 启动场景：等待启动延迟，启动初始并发，然后按负载曲线调整并发数
+func (gobom *GobomRequest) launch(scenario *Scenario) {
+	defer gobom.wg.Done()
+	if !gobom.sleep(time.Duration(scenario.StartOffset) * time.Second) {
+		return
+	}
+	gobom.scale(scenario, scenario.size)
+	for _, stage := range scenario.Stages {
+		start := scenario.getTarget()
+		for i := uint64(1); i <= stage.Duration; i++ {
+			if !gobom.sleep(time.Second) {
+				return
+			}
+			if stage.Target >= start {
+				gobom.scale(scenario, start+(stage.Target-start)*i/stage.Duration)
+			} else {
+				gobom.scale(scenario, start-(start-stage.Target)*i/stage.Duration)
+			}
+		}
+		if stage.Duration == 0 {
+			gobom.scale(scenario, stage.Target)
+		}
+	}
+}
+
+// 调整场景并发数到target
+func (gobom *GobomRequest) scale(scenario *Scenario, target uint64) {
+	scenario.mu.Lock()
+	defer scenario.mu.Unlock()
+	if gobom.isClosed() {
+		return
+	}
+	if target > scenario.target {
+		count := target - scenario.target
+		gobom.addConCurrent(count)
+		for i := uint64(0); i < count; i++ {
+			gobom.spawn(scenario)
+		}
+	} else {
+		for i := target; i < scenario.target; i++ {
+			scenario.stop <- true
+		}
+	}
+	scenario.target = target
+}
+
+// 等待d时间（暂停的时间不计入），任务关闭时返回false
+func (gobom *GobomRequest) sleep(d time.Duration) bool {
+	if d != 0 {
+		select {
+		case <-gobom.done:
+			return false
+		case <-time.After(d):
+		}
+	}
+	if resumeCh := gobom.paused(); resumeCh != nil {
+		select {
+		case <-gobom.done:
+			return false
+		case <-resumeCh:
+		}
+	}
+	return !gobom.isClosed()
+}
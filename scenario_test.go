@@ -0,0 +1,81 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScenario(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer server.Close()
+
+	gobomReq, err := NewGomBomRequest(&Options{
+		ConCurrent: 4,
+		Duration:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobomReq.Scenarios = []*Scenario{
+		{Name: "browse", Weight: 3, Options: &Options{Url: server.URL + "/browse"}},
+		{Name: "checkout", Weight: 1, Rate: 5, StartOffset: 1, Options: &Options{Url: server.URL + "/checkout"}},
+	}
+
+	start := time.Now()
+	gobomReq.Dispose(func(err error) error { return err })
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("dispose did not stop after duration: %s", time.Since(start))
+	}
+
+	report := gobomReq.Info().Copy()
+	browse, checkout := report.Scenarios["browse"], report.Scenarios["checkout"]
+	if browse == nil || checkout == nil {
+		t.Fatalf("missing scenario report: %v", report.Scenarios)
+	}
+	if browse.SuccessNum+checkout.SuccessNum != report.SuccessNum {
+		t.Errorf("scenario totals %d+%d != %d", browse.SuccessNum, checkout.SuccessNum, report.SuccessNum)
+	}
+	// checkout starts after 1s and is limited to 5 iterations per second
+	if checkout.SuccessNum == 0 || checkout.SuccessNum > 10 {
+		t.Errorf("checkout success num %d out of range", checkout.SuccessNum)
+	}
+	if gobomReq.Scenarios[0].size != 3 {
+		t.Errorf("browse concurrency %d, want 3", gobomReq.Scenarios[0].size)
+	}
+}
+
+func TestScenarioStages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	gobomReq, err := NewGomBomRequest(&Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenario := &Scenario{
+		Name:    "ramp",
+		Options: &Options{Url: server.URL, Interval: 100},
+		Stages:  []Stage{{Duration: 2, Target: 4}, {Duration: 1, Target: 0}},
+	}
+	gobomReq.Scenarios = []*Scenario{scenario}
+
+	done := make(chan struct{})
+	go func() {
+		gobomReq.Dispose(func(err error) error { return err })
+		close(done)
+	}()
+
+	time.Sleep(2500 * time.Millisecond)
+	if n := scenario.getConCurrent(); n != 4 {
+		t.Errorf("concurrency after ramp up %d, want 4", n)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("dispose did not stop after stages")
+	}
+}
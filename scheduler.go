@@ -0,0 +1,139 @@
+package gobom
+
+import (
+	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+// 定时运行任务，计划保存在数据库中，服务启动时加载
+type Scheduler struct {
+	entries map[uint]*scheduleEntry
+	mu      sync.Mutex
+}
+
+type scheduleEntry struct {
+	schedule *ScheduleData
+	next     time.Time // 下一次运行时间，零值表示不再触发
+	queued   bool      // 等待任务结束后运行
+}
+
+var gobomScheduler = &Scheduler{
+	entries: make(map[uint]*scheduleEntry),
+}
+
+// 加载数据库中的计划并开始调度；停机期间错过的周期计划不补跑，未触发的单次计划启动后立即运行
+func StartScheduler() error {
+	var list []ScheduleData
+	if err := GobomStore.GetDb().Table(GobomStore.GetTableName(scheduleTable)).Where("enabled = ?", true).Find(&list).Error; err != nil {
+		return err
+	}
+	for i := range list {
+		if err := gobomScheduler.Set(&list[i]); err != nil {
+			logger.Debug("schedule ", list[i].ID, err)
+		}
+	}
+	go gobomScheduler.loop()
+	return nil
+}
+
+func (scheduler *Scheduler) Set(schedule *ScheduleData) error {
+	s := *schedule
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	queued := false
+	if entry, ok := scheduler.entries[s.ID]; ok {
+		queued = entry.queued
+		delete(scheduler.entries, s.ID)
+	}
+	if !s.Enabled {
+		return nil
+	}
+	next, err := s.next(time.Now())
+	if err != nil {
+		return err
+	}
+	if next.IsZero() && !queued {
+		return nil
+	}
+	scheduler.entries[s.ID] = &scheduleEntry{
+		schedule: &s,
+		next:     next,
+		queued:   queued,
+	}
+	return nil
+}
+
+func (scheduler *Scheduler) Remove(id uint) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	delete(scheduler.entries, id)
+}
+
+func (scheduler *Scheduler) NextTime(id uint) string {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	if entry, ok := scheduler.entries[id]; ok && !entry.next.IsZero() {
+		return entry.next.Format("2006-01-02 15:04:05 MST")
+	}
+	return ""
+}
+
+func (scheduler *Scheduler) loop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for now := range t.C {
+		scheduler.tick(now)
+	}
+}
+
+func (scheduler *Scheduler) tick(now time.Time) {
+	var runs, skips, finished []*ScheduleData
+	scheduler.mu.Lock()
+	for id, entry := range scheduler.entries {
+		schedule := entry.schedule
+		due := !entry.next.IsZero() && !entry.next.After(now)
+		if due {
+			if schedule.Cron != "" {
+				entry.next, _ = schedule.next(now)
+			} else {
+				entry.next = time.Time{}
+				finished = append(finished, schedule)
+			}
+		}
+		if due || entry.queued {
+			if GetRunTask(schedule.TaskId) == nil && !gobomGuard.Queued(schedule.TaskId) {
+				entry.queued = false
+				runs = append(runs, schedule)
+			} else if due && schedule.Policy == SCHEDULE_POLICY_QUEUE {
+				entry.queued = true
+			} else if due {
+				skips = append(skips, schedule)
+			}
+		}
+		if entry.next.IsZero() && !entry.queued {
+			delete(scheduler.entries, id)
+		}
+	}
+	scheduler.mu.Unlock()
+
+	for _, schedule := range runs {
+		logger.Debug("schedule trigger: ", schedule.ID, schedule.TaskId)
+		taskData := &TaskData{Task: &Task{TaskId: schedule.TaskId}, confirmed: schedule.Confirm}
+		if err := taskData.RunBy(TRIGGER_SCHEDULE, schedule.ID); err != nil {
+			NewTaskRun(schedule.TaskId, TRIGGER_SCHEDULE, schedule.ID, STATUS_ERROR, err.Error())
+		}
+	}
+	for _, schedule := range skips {
+		NewTaskRun(schedule.TaskId, TRIGGER_SCHEDULE, schedule.ID, STATUS_SKIP, "任务正在运行，跳过本次触发")
+	}
+	// 单次计划触发后禁用
+	for _, schedule := range finished {
+		s := *schedule
+		s.Enabled = false
+		if err := s.Update(); err != nil {
+			logger.Debug(err)
+		}
+	}
+}
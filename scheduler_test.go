@@ -0,0 +1,147 @@
+package gobom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 测试使用sqlite数据库
+func initTestDb(t *testing.T) {
+	if err := InitDb("sqlite3", filepath.Join(t.TempDir(), "gobom.db")); err != nil {
+		t.Fatal(err)
+	}
+	configs := map[string]TableAutoMigrateConfig{
+		"script":         {Model: &ScriptData{}},
+		"task":           {Model: &TaskData{}},
+		"datafile":       {Model: &DataFile{}},
+		"schedule":       {Model: &ScheduleData{}},
+		"task_run":       {Model: &TaskRunData{}},
+		"pipeline":       {Model: &PipelineData{}},
+		"webhook":        {Model: &WebhookData{}},
+		"webhook_log":    {Model: &WebhookLogData{}},
+		"user":           {Model: &UserData{}},
+		"user_token":     {Model: &UserTokenData{}},
+		"project":        {Model: &ProjectData{}},
+		"project_member": {Model: &ProjectMemberData{}},
+		"audit":          {Model: &AuditData{}},
+		"target_rule":    {Model: &TargetRuleData{}},
+		"environment":    {Model: &EnvironmentData{}},
+	}
+	for name, v := range configs {
+		if err := GobomStore.GetDb().Table(name).AutoMigrate(v.Model).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	GobomStore.TableConfigs = configs
+	t.Cleanup(GobomStore.Close)
+}
+
+func addTestTask(t *testing.T, taskId string, opt *Options) {
+	task, err := NewTask(taskId, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&TaskData{Name: taskId, Task: task}).Add(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	initTestDb(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	addTestTask(t, "schedule-test", &Options{Url: server.URL, ConCurrent: 1, Duration: 2, Interval: 10})
+
+	scheduler := &Scheduler{entries: make(map[uint]*scheduleEntry)}
+	now := time.Now()
+	once := &ScheduleData{
+		TaskId:  "schedule-test",
+		RunAt:   now.Add(-time.Minute).Format("2006-01-02 15:04:05"), // 停机期间错过的单次计划
+		Policy:  SCHEDULE_POLICY_SKIP,
+		Enabled: true,
+	}
+	skip := &ScheduleData{TaskId: "schedule-test", Cron: "* * * * *", Policy: SCHEDULE_POLICY_SKIP, Enabled: true}
+	queue := &ScheduleData{TaskId: "schedule-test", Cron: "* * * * *", Policy: SCHEDULE_POLICY_QUEUE, Enabled: true}
+	for _, schedule := range []*ScheduleData{once, skip, queue} {
+		if err := schedule.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if err := schedule.Add(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scheduler.Set(once)
+	scheduler.tick(now)
+	for i := 0; GetRunTask("schedule-test") == nil; i++ {
+		if i > 100 {
+			t.Fatal("scheduled task not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := scheduler.entries[once.ID]; ok {
+		t.Error("one-shot schedule still active")
+	}
+	saved := &ScheduleData{}
+	saved.ID = once.ID
+	if saved.First(); saved.Enabled {
+		t.Error("one-shot schedule not disabled")
+	}
+
+	// 任务运行中：skip策略跳过，queue策略等待结束后运行
+	scheduler.Set(skip)
+	scheduler.Set(queue)
+	scheduler.tick(now.Add(2 * time.Minute))
+	if !scheduler.entries[queue.ID].queued {
+		t.Fatal("trigger not queued")
+	}
+	for i := 0; GetRunTask("schedule-test") != nil; i++ {
+		if i > 500 {
+			t.Fatal("scheduled task not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond) // 等待运行记录保存
+	scheduler.tick(now.Add(2 * time.Minute))
+	if scheduler.entries[queue.ID].queued {
+		t.Fatal("queued trigger not started")
+	}
+	for i := 0; GetRunTask("schedule-test") == nil; i++ {
+		if i > 100 {
+			t.Fatal("queued task not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	(&TaskData{Task: &Task{TaskId: "schedule-test"}}).Stop()
+	for i := 0; GetRunTask("schedule-test") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	runs, err := (&TaskRunData{TaskId: "schedule-test"}).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("got %d runs, want 3", len(runs))
+	}
+	// 倒序：queue运行、skip记录、单次运行
+	if runs[0].ScheduleId != queue.ID || runs[0].Status != STATUS_STOP ||
+		runs[1].ScheduleId != skip.ID || runs[1].Status != STATUS_SKIP ||
+		runs[2].ScheduleId != once.ID || runs[2].Status != STATUS_OVER || runs[2].SuccessNum == 0 {
+		t.Errorf("unexpected runs: %+v", runs)
+	}
+	for _, run := range runs {
+		if run.Trigger != TRIGGER_SCHEDULE {
+			t.Errorf("run %d trigger %q", run.ID, run.Trigger)
+		}
+	}
+	detail := &TaskRunData{}
+	detail.ID = runs[2].ID
+	if _, err := detail.First(); err != nil || detail.Report == nil || detail.Report.SuccessNum != runs[2].SuccessNum {
+		t.Errorf("run report not saved: %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package gobom
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	HISTOGRAM_LINEAR = 100  // 100毫秒以内每毫秒一个桶
+	HISTOGRAM_GROWTH = 1.01 // 超过后每个桶的宽度增长1%（百分位误差不超过1%）
+)
+
+// 可合并的统计快照，Merge满足结合律，计数精确，百分位误差在直方图精度内
+type Snapshot struct {
+	SuccessNum    uint64                 `json:"successNum"`
+	FailureNum    uint64                 `json:"failureNum"`
+	TimeoutNum    uint64                 `json:"timeoutNum"`    // 等待响应超时的请求数
+	LostNum       uint64                 `json:"lostNum"`       // 丢包数
+	HandshakeNum  uint64                 `json:"handshakeNum"`  // TLS握手次数
+	HandshakeTime uint64                 `json:"handshakeTime"` // TLS握手总时间（毫秒）
+	ConnOpened    uint64                 `json:"connOpened"`    // 新建的连接数
+	ConnReused    uint64                 `json:"connReused"`    // 复用连接的请求数
+	ConnErrors    uint64                 `json:"connErrors"`    // 连接错误数
+	ProxyErrors   uint64                 `json:"proxyErrors"`   // 代理连接错误数
+	TotalTime     uint64                 `json:"totalTime"`     // 成功请求总耗时（毫秒）
+	MaxTime       uint64                 `json:"maxTime"`
+	MinTime       uint64                 `json:"minTime"` // 为0表示没有数据
+	Histogram     *Histogram             `json:"histogram"`
+	Steps         map[string]*StepStat   `json:"steps"`     // [步骤名]步骤统计
+	Errors        map[int]*ErrorStat     `json:"errors"`    // [错误码]错误统计
+	Series        map[int64]*SeriesPoint `json:"series"`    // [秒级时间戳]时间线
+	Scenarios     map[string]*Snapshot   `json:"scenarios"` // [场景名]场景统计
+	Events        []*RunEvent            `json:"events"`    // 运行中的调整记录
+}
+
+type Histogram struct {
+	Count   uint64         `json:"count"`
+	Buckets map[int]uint64 `json:"buckets"` // [桶序号]数量
+}
+
+type StepStat struct {
+	Count     uint64     `json:"count"`
+	TotalTime uint64     `json:"totalTime"`
+	MaxTime   uint64     `json:"maxTime"`
+	MinTime   uint64     `json:"minTime"`
+	Histogram *Histogram `json:"histogram"`
+}
+
+type ErrorStat struct {
+	Count uint64 `json:"count"`
+	Msg   string `json:"msg"`
+}
+
+type SeriesPoint struct {
+	SuccessNum uint64 `json:"successNum"`
+	FailureNum uint64 `json:"failureNum"`
+	TotalTime  uint64 `json:"totalTime"`
+}
+
+func NewSnapshot() *Snapshot {
+	return &Snapshot{
+		Histogram: NewHistogram(),
+		Steps:     make(map[string]*StepStat),
+		Errors:    make(map[int]*ErrorStat),
+		Series:    make(map[int64]*SeriesPoint),
+	}
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{
+		Buckets: make(map[int]uint64),
+	}
+}
+
+// 统计一个请求结果
+func (snapshot *Snapshot) Add(data *Response, now time.Time) {
+	point := snapshot.point(now.Unix())
+	if data.Timeout {
+		snapshot.TimeoutNum++
+	}
+	if data.Lost {
+		snapshot.LostNum++
+	}
+	snapshot.HandshakeNum += data.HandshakeNum
+	snapshot.HandshakeTime += data.HandshakeTime
+	snapshot.ConnOpened += data.ConnOpened
+	snapshot.ConnReused += data.ConnReused
+	snapshot.ConnErrors += data.ConnErrors
+	snapshot.ProxyErrors += data.ProxyErrors
+	if data.IsSuccess {
+		snapshot.SuccessNum++
+		snapshot.TotalTime += data.WasteTime
+		snapshot.MaxTime, snapshot.MinTime = maxMin(snapshot.MaxTime, snapshot.MinTime, data.WasteTime, data.WasteTime)
+		snapshot.Histogram.Add(data.WasteTime, 1)
+		point.SuccessNum++
+		point.TotalTime += data.WasteTime
+		for name, wasteTime := range data.TransactionWasteTime {
+			step, ok := snapshot.Steps[name]
+			if !ok {
+				step = &StepStat{Histogram: NewHistogram()}
+				snapshot.Steps[name] = step
+			}
+			step.Count++
+			step.TotalTime += wasteTime
+			step.MaxTime, step.MinTime = maxMin(step.MaxTime, step.MinTime, wasteTime, wasteTime)
+			step.Histogram.Add(wasteTime, 1)
+		}
+	} else {
+		snapshot.FailureNum++
+		point.FailureNum++
+		errStat, ok := snapshot.Errors[data.ErrCode]
+		if !ok {
+			errStat = &ErrorStat{Msg: data.ErrMsg}
+			snapshot.Errors[data.ErrCode] = errStat
+		}
+		errStat.Count++
+	}
+}
+
+// 合并other到当前快照
+func (snapshot *Snapshot) Merge(other *Snapshot) {
+	if other == nil {
+		return
+	}
+	snapshot.SuccessNum += other.SuccessNum
+	snapshot.FailureNum += other.FailureNum
+	snapshot.TimeoutNum += other.TimeoutNum
+	snapshot.LostNum += other.LostNum
+	snapshot.HandshakeNum += other.HandshakeNum
+	snapshot.HandshakeTime += other.HandshakeTime
+	snapshot.ConnOpened += other.ConnOpened
+	snapshot.ConnReused += other.ConnReused
+	snapshot.ConnErrors += other.ConnErrors
+	snapshot.ProxyErrors += other.ProxyErrors
+	snapshot.TotalTime += other.TotalTime
+	snapshot.MaxTime, snapshot.MinTime = maxMin(snapshot.MaxTime, snapshot.MinTime, other.MaxTime, other.MinTime)
+	snapshot.Histogram.Merge(other.Histogram)
+	for name, v := range other.Steps {
+		step, ok := snapshot.Steps[name]
+		if !ok {
+			step = &StepStat{Histogram: NewHistogram()}
+			snapshot.Steps[name] = step
+		}
+		step.Count += v.Count
+		step.TotalTime += v.TotalTime
+		step.MaxTime, step.MinTime = maxMin(step.MaxTime, step.MinTime, v.MaxTime, v.MinTime)
+		step.Histogram.Merge(v.Histogram)
+	}
+	for code, v := range other.Errors {
+		errStat, ok := snapshot.Errors[code]
+		if !ok {
+			errStat = &ErrorStat{}
+			snapshot.Errors[code] = errStat
+		}
+		errStat.Count += v.Count
+		if errStat.Msg == "" {
+			errStat.Msg = v.Msg
+		}
+	}
+	for sec, v := range other.Series {
+		point := snapshot.point(sec)
+		point.SuccessNum += v.SuccessNum
+		point.FailureNum += v.FailureNum
+		point.TotalTime += v.TotalTime
+	}
+	for name, v := range other.Scenarios {
+		snapshot.Scenario(name).Merge(v)
+	}
+	snapshot.Events = append(snapshot.Events, other.Events...)
+}
+
+// 返回场景的快照，不存在时创建
+func (snapshot *Snapshot) Scenario(name string) *Snapshot {
+	if snapshot.Scenarios == nil {
+		snapshot.Scenarios = make(map[string]*Snapshot)
+	}
+	scenario, ok := snapshot.Scenarios[name]
+	if !ok {
+		scenario = NewSnapshot()
+		snapshot.Scenarios[name] = scenario
+	}
+	return scenario
+}
+
+func (snapshot *Snapshot) Copy() *Snapshot {
+	s := NewSnapshot()
+	s.Merge(snapshot)
+	return s
+}
+
+func (snapshot *Snapshot) AverageTime() uint64 {
+	if snapshot.SuccessNum == 0 {
+		return 0
+	}
+	return snapshot.TotalTime / snapshot.SuccessNum
+}
+
+// 百分位耗时，p取值0-100
+func (snapshot *Snapshot) Percentile(p float64) uint64 {
+	if snapshot == nil {
+		return 0
+	}
+	return snapshot.Histogram.Percentile(p)
+}
+
+func (snapshot *Snapshot) point(sec int64) *SeriesPoint {
+	point, ok := snapshot.Series[sec]
+	if !ok {
+		point = &SeriesPoint{}
+		snapshot.Series[sec] = point
+	}
+	return point
+}
+
+func (histogram *Histogram) Add(value, count uint64) {
+	histogram.Count += count
+	histogram.Buckets[bucketIndex(value)] += count
+}
+
+func (histogram *Histogram) Merge(other *Histogram) {
+	if other == nil {
+		return
+	}
+	histogram.Count += other.Count
+	for k, v := range other.Buckets {
+		histogram.Buckets[k] += v
+	}
+}
+
+func (histogram *Histogram) Percentile(p float64) uint64 {
+	if histogram == nil || histogram.Count == 0 {
+		return 0
+	}
+	indexes := make([]int, 0, len(histogram.Buckets))
+	for k := range histogram.Buckets {
+		indexes = append(indexes, k)
+	}
+	sort.Ints(indexes)
+	rank := uint64(math.Ceil(p / 100 * float64(histogram.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+	var n uint64
+	for _, k := range indexes {
+		n += histogram.Buckets[k]
+		if n >= rank {
+			return bucketValue(k)
+		}
+	}
+	return bucketValue(indexes[len(indexes)-1])
+}
+
+func bucketIndex(value uint64) int {
+	if value < HISTOGRAM_LINEAR {
+		return int(value)
+	}
+	return HISTOGRAM_LINEAR + int(math.Log(float64(value)/HISTOGRAM_LINEAR)/math.Log(HISTOGRAM_GROWTH))
+}
+
+// 桶的下界
+func bucketValue(index int) uint64 {
+	if index < HISTOGRAM_LINEAR {
+		return uint64(index)
+	}
+	return uint64(math.Ceil(HISTOGRAM_LINEAR * math.Pow(HISTOGRAM_GROWTH, float64(index-HISTOGRAM_LINEAR))))
+}
+
+// 合并最大值和最小值，最小值为0表示没有数据
+func maxMin(max, min, otherMax, otherMin uint64) (uint64, uint64) {
+	if otherMax > max {
+		max = otherMax
+	}
+	if min == 0 || (otherMin != 0 && otherMin < min) {
+		min = otherMin
+	}
+	return max, min
+}
@@ -0,0 +1,107 @@
+package gobom
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSnapshotMerge(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var all []uint64
+	parts := make([]*Snapshot, 3)
+	for i := range parts {
+		parts[i] = NewSnapshot()
+		for j := 0; j < 1000; j++ {
+			wasteTime := uint64(rand.Intn(5000) + 1)
+			all = append(all, wasteTime)
+			parts[i].Add(&Response{
+				WasteTime:            wasteTime,
+				IsSuccess:            true,
+				TransactionWasteTime: map[string]uint64{"login": wasteTime / 2},
+			}, now.Add(time.Duration(j%4)*time.Second))
+		}
+		parts[i].Add(&Response{ErrCode: 500, ErrMsg: "server error"}, now)
+		parts[i].Scenario("browse").Add(&Response{WasteTime: 10, IsSuccess: true}, now)
+	}
+
+	// (a+b)+c == a+(b+c)
+	left := parts[0].Copy()
+	left.Merge(parts[1])
+	left.Merge(parts[2])
+	bc := parts[1].Copy()
+	bc.Merge(parts[2])
+	right := parts[0].Copy()
+	right.Merge(bc)
+	if !reflect.DeepEqual(left, right) {
+		t.Fatal("merge is not associative")
+	}
+
+	if left.SuccessNum != 3000 || left.FailureNum != 3 || left.Errors[500].Count != 3 {
+		t.Errorf("unexpected counts: %d %d %d", left.SuccessNum, left.FailureNum, left.Errors[500].Count)
+	}
+	if left.Steps["login"].Count != 3000 || left.Scenarios["browse"].SuccessNum != 3 {
+		t.Errorf("unexpected step or scenario counts")
+	}
+	var series uint64
+	for _, point := range left.Series {
+		series += point.SuccessNum
+	}
+	if series != 3000 {
+		t.Errorf("series success num %d, want 3000", series)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	for _, p := range []float64{50, 90, 99} {
+		exact := all[int(p/100*float64(len(all)))-1]
+		got := left.Percentile(p)
+		if float64(got) < float64(exact)*0.98 || float64(got) > float64(exact)*1.02 {
+			t.Errorf("p%v = %d, exact %d", p, got, exact)
+		}
+	}
+
+	// 序列化后合并结果不变
+	bt, err := json.Marshal(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	if err := json.Unmarshal(bt, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	viaJson := parts[0].Copy()
+	viaJson.Merge(parts[1])
+	viaJson.Merge(&decoded)
+	if !reflect.DeepEqual(left, viaJson) {
+		t.Error("merge of decoded snapshot differs")
+	}
+}
+
+func TestReportMerge(t *testing.T) {
+	snapshot := NewSnapshot()
+	snapshot.Add(&Response{WasteTime: 20, IsSuccess: true}, time.Now())
+	snapshot.Add(&Response{ErrCode: 1, ErrMsg: "timeout"}, time.Now())
+	snapshot.Scenario("checkout").Add(&Response{WasteTime: 20, IsSuccess: true}, time.Now())
+
+	report := &Report{}
+	report.Merge(snapshot)
+	report.Merge(snapshot)
+	info := report.Copy()
+	if info.SuccessNum != 2 || info.FailureNum != 2 || info.ErrCode[1] != 2 || info.AverageTime != 20 {
+		t.Errorf("unexpected report: %+v", info)
+	}
+	if info.Scenarios["checkout"].SuccessNum != 2 || report.Snapshot().Scenarios["checkout"].SuccessNum != 2 {
+		t.Error("scenario not merged")
+	}
+}
+
+func TestReportCopyWithoutSnapshot(t *testing.T) {
+	report := &Report{SuccessNum: 3, P99Time: 120, Events: []*RunEvent{{Type: EVENT_PAUSE}}}
+	c := report.Copy()
+	if c.SuccessNum != 3 || c.P99Time != 120 || len(c.Events) != 1 {
+		t.Errorf("unexpected copy: %+v", c)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"gobom/utils"
 	"strconv"
 	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
 )
 
 const (
@@ -13,6 +16,8 @@ const (
 	STATUS_OVER
 	STATUS_STOP
 	STATUS_ERROR
+	STATUS_PAUSE
+	STATUS_SKIP // 定时触发时任务正在运行，跳过本次运行
 )
 
 var runTasks = make(map[string]*Task)
@@ -43,9 +48,13 @@ func DelRunTask(taskId string) {
 }
 
 type Task struct {
-	TaskId string        `json:"taskId" gorm:"unique_index"`
-	Worker *GobomRequest `json:"worker" gorm:"-"`
-	Status int           `json:"status" gorm:"DEFAULT:0;"`
+	TaskId      string        `json:"taskId" gorm:"unique_index"`
+	Worker      *GobomRequest `json:"worker" gorm:"-"`
+	Status      int           `json:"status" gorm:"DEFAULT:0;"`
+	Distributed bool          `json:"distributed" gorm:"-"` // 分布式运行，并发数平均分配到所有在线的压测节点
+
+	runId    uint       // 运行记录id，通过TaskData运行时设置
+	statusMu sync.Mutex // 保护Status，推送协程和接口同时读写
 }
 
 func NewTask(taskId string, opt *Options) (task *Task, err error) {
@@ -59,7 +68,7 @@ func NewTask(taskId string, opt *Options) (task *Task, err error) {
 	return &Task{
 		TaskId: taskId,
 		Worker: gobomReq,
-		Status: STATUS_WAIT,
+		Status: STATUS_NONE,
 	}, nil
 }
 
@@ -71,10 +80,20 @@ func (task *Task) Run() error {
 		return ERR_TASK_RUN
 
 	}
-	task.SetStatus(STATUS_RUN)
+	task.Worker.prepare()
+	// 启动前已经停止时保留停止状态
+	if !task.Worker.isClosed() {
+		task.SetStatus(STATUS_RUN)
+	}
 	SetRunTask(task)
 	task.Worker.Options.Init()
-	return task.Worker.Dispose(func(err error) error {
+	done := make(chan struct{})
+	watched := make(chan struct{}) // 最后一次阈值检查完成后返回，保证运行记录包含所有越过的阈值
+	go func() {
+		task.watch(done)
+		close(watched)
+	}()
+	callback := func(err error) error {
 		if err != nil {
 			task.SetStatus(STATUS_ERROR)
 		}
@@ -82,14 +101,29 @@ func (task *Task) Run() error {
 			task.SetStatus(STATUS_OVER)
 		}
 		DelRunTask(task.TaskId)
+		close(done)
 		return err
-	})
+	}
+	var err error
+	if task.Distributed {
+		err = gobomCluster.Dispose(task.TaskId, task.Worker, callback)
+	} else {
+		err = task.Worker.Dispose(callback)
+	}
+	<-watched
+	return err
 }
 
 func (task *Task) Stop(count uint64) {
 	if task == nil || task.Worker == nil {
 		return
 	}
+	if task.Distributed {
+		task.SetStatus(STATUS_STOP)
+		task.Worker.Close(CLOSE_ALL) // 还没有下发时不再下发
+		gobomCluster.Stop(task.TaskId)
+		return
+	}
 	if count == CLOSE_ALL || count >= task.Worker.getConCurrent() {
 		task.SetStatus(STATUS_STOP)
 		DelRunTask(task.TaskId)
@@ -97,6 +131,65 @@ func (task *Task) Stop(count uint64) {
 	task.Worker.Close(count)
 }
 
+func (task *Task) Pause(reason string) error {
+	if task == nil || task.Worker == nil {
+		return ERR_TASK_WORKER
+	}
+	var err error
+	if task.Distributed {
+		err = gobomCluster.Pause(task.TaskId, reason)
+	} else {
+		err = task.Worker.Pause(reason)
+	}
+	if err == nil {
+		task.SetStatus(STATUS_PAUSE)
+	}
+	return err
+}
+
+func (task *Task) Resume(reason string) error {
+	if task == nil || task.Worker == nil {
+		return ERR_TASK_WORKER
+	}
+	var err error
+	if task.Distributed {
+		err = gobomCluster.Resume(task.TaskId, reason)
+	} else {
+		err = task.Worker.Resume(reason)
+	}
+	if err == nil {
+		task.SetStatus(STATUS_RUN)
+	}
+	return err
+}
+
+// 调整运行中的任务
+func (task *Task) Scale(req *ScaleReqData) error {
+	if task == nil || task.Worker == nil {
+		return ERR_TASK_WORKER
+	}
+	if task.Distributed {
+		return gobomCluster.Scale(task.TaskId, req)
+	}
+	if req != nil && req.ConCurrent > 0 {
+		if err := gobomGuard.Resize(task.TaskId, req.ConCurrent); err != nil {
+			return err
+		}
+	}
+	// 调整失败时任务没有任何改变，退还申请的并发数；减少并发数成功后再释放
+	err := task.Worker.Scale(req)
+	if err != nil {
+		if req != nil && req.ConCurrent > 0 {
+			gobomGuard.Resize(task.TaskId, -req.ConCurrent)
+		}
+		return err
+	}
+	if req.ConCurrent < 0 {
+		gobomGuard.Resize(task.TaskId, req.ConCurrent)
+	}
+	return nil
+}
+
 func (task *Task) Info() *Report {
 	if task == nil || task.Worker == nil {
 		return nil
@@ -105,9 +198,90 @@ func (task *Task) Info() *Report {
 }
 
 func (task *Task) GetStatus() int {
+	task.statusMu.Lock()
+	defer task.statusMu.Unlock()
 	return task.Status
 }
 
+// 状态变化时推送，持有锁推送保证订阅者按修改顺序收到
 func (task *Task) SetStatus(status int) {
+	task.statusMu.Lock()
+	defer task.statusMu.Unlock()
+	if task.Status == status {
+		return
+	}
 	task.Status = status
+	taskHub.Publish(task.TaskId, &TaskWsData{
+		Type: WS_TASK_STATUS,
+		Data: map[string]interface{}{"taskId": task.TaskId, "status": status},
+	})
+}
+
+// 每秒推送增量数据并检查阈值，任务结束后推送汇总报告
+func (task *Task) watch(done <-chan struct{}) {
+	for _, threshold := range task.Worker.Thresholds {
+		threshold.breached = false
+	}
+	task.Worker.Report.Collect()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			task.push()
+			taskHub.Publish(task.TaskId, &TaskWsData{
+				Type: WS_TASK_SUMMARY,
+				Data: &TaskSummary{
+					TaskId: task.TaskId,
+					Status: task.GetStatus(),
+					Report: task.Info().Copy(),
+				},
+			})
+			return
+		case <-t.C:
+			task.push()
+		}
+	}
+}
+
+func (task *Task) push() {
+	delta, total := task.Worker.Report.Progress()
+	breaches := checkThresholds(task.Worker.Thresholds, total)
+	if len(breaches) != 0 {
+		task.Worker.Report.addBreach(breaches)
+		task.fireHooks(HOOK_THRESHOLD, total, breaches, "")
+		for _, breach := range breaches {
+			if breach.Abort && task.GetStatus() == STATUS_RUN {
+				logger.Debug("threshold breached, stop task: ", task.TaskId, breach.Metric)
+				task.fireHooks(HOOK_RUN_ABORT, total, breaches, "越过阈值"+breach.Metric+"，停止任务")
+				go task.Stop(CLOSE_ALL)
+				break
+			}
+		}
+	}
+	taskHub.PublishDelta(&TaskDelta{
+		TaskId:     task.TaskId,
+		Status:     task.GetStatus(),
+		ConCurrent: task.Worker.getConCurrent(),
+		Totals:     NewTaskTotals(total),
+		Delta:      delta,
+		Breaches:   breaches,
+	}, total)
+}
+
+// 运行中的通知，没有运行记录时不发送
+func (task *Task) fireHooks(event string, total *Snapshot, breaches []*ThresholdBreach, note string) {
+	if task.runId == 0 {
+		return
+	}
+	fireHooks(&HookPayload{
+		Event:    event,
+		Time:     hookTime(),
+		TaskId:   task.TaskId,
+		RunId:    task.runId,
+		Status:   task.GetStatus(),
+		Note:     note,
+		Metrics:  NewTaskTotals(total),
+		Breaches: breaches,
+	})
 }
@@ -2,8 +2,12 @@ package gobom
 
 import (
 	"fmt"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestTask(t *testing.T) {
@@ -27,3 +31,55 @@ func TestTask(t *testing.T) {
 	task.Run()
 
 }
+
+// 编辑脚本后重新初始化的任务保留阈值，失败的任务不影响其他任务
+func TestTaskScriptReset(t *testing.T) {
+	initTestDb(t)
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := apiLogin(t, server, DEFAULT_ADMIN_NAME, "admin-password")
+	mustCall := func(path string, body interface{}) *ApiReply {
+		_, reply := apiCall(t, server, admin, path, body)
+		if reply.Msg != "" {
+			t.Fatalf("%s: %s", path, reply.Msg)
+		}
+		return reply
+	}
+	reply := mustCall("/project/add", &ProjectData{Name: "reset"})
+	projectId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	script := map[string]interface{}{"name": "reset-main", "projectId": projectId, "data": `{"url":"http://127.0.0.1/old"}`}
+	mustCall("/script/add", script)
+	mustCall("/script/add", map[string]interface{}{"name": "reset-setup", "projectId": projectId, "data": `{"url":"http://127.0.0.1/setup"}`})
+	scripts, err := (&ScriptData{}).Get()
+	if err != nil || len(scripts) != 2 {
+		t.Fatal(scripts, err)
+	}
+	mainId, setupId := scripts[0].ID, scripts[1].ID
+
+	// 第一个任务的setup脚本被删除，重新初始化失败
+	mustCall("/task/add", &TaskReqData{TaskId: "reset-broken", Name: "reset-broken", ProjectId: projectId, ScriptId: mainId, SetupScriptId: setupId, ConCurrent: 1, Duration: 60})
+	thresholds := []*Threshold{{Metric: "errorRate", Op: ">", Value: 0.1, Abort: true}}
+	mustCall("/task/add", &TaskReqData{TaskId: "reset-task", Name: "reset-task", ProjectId: projectId, ScriptId: mainId, ConCurrent: 2, Duration: 60, Thresholds: thresholds})
+	mustCall("/script/delete", map[string]interface{}{"ID": setupId})
+
+	script["ID"] = mainId
+	script["data"] = `{"url":"http://127.0.0.1/new"}`
+	if _, reply = apiCall(t, server, admin, "/script/edit", script); !strings.HasPrefix(reply.Msg, ERR_TASK_RESET.Error()) || !strings.Contains(reply.Msg, "reset-broken") || strings.Contains(reply.Msg, "reset-task") {
+		t.Fatalf("edit: %+v", reply)
+	}
+	taskData, err := (&TaskData{Task: &Task{TaskId: "reset-task"}}).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := taskData.Task.Worker
+	if worker.Options.Url != "http://127.0.0.1/new" || worker.getConCurrent() != 2 {
+		t.Errorf("script not reset: %+v", worker.Options)
+	}
+	if len(worker.Thresholds) != 1 || *worker.Thresholds[0] != *thresholds[0] {
+		t.Errorf("thresholds: %+v", worker.Thresholds)
+	}
+}
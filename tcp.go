@@ -1,11 +1,11 @@
 package gobom
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
-	"fmt"
 	"net"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/smallnest/goframe"
@@ -21,19 +21,15 @@ type Tcp struct {
 	resultResp         chan<- *Response
 	opt                *Options
 	frameConn          goframe.FrameConn
+	target             string                       // 当前请求的地址
+	frameConns         map[string]goframe.FrameConn // 虚拟用户复用的连接，[地址]
+	conns              *vuConns
+	tlsConfig          *tls.Config            // 开启TLS时不为nil
+	handshake          time.Duration          // 本次请求新建连接的TLS握手时间
+	step               TransactionOptionsData // 当前执行的事务步骤
 	TransactionOptions *TransactionOptions
 }
 
-type TcpPools struct {
-	connPools map[string]chan goframe.FrameConn
-	mu        sync.RWMutex
-}
-
-var tcoPools = &TcpPools{
-	connPools: make(map[string]chan goframe.FrameConn),
-	mu:        sync.RWMutex{},
-}
-
 const (
 	TYPE_NONE = iota
 	TYPE_LINEBASEDFRAMECODEC
@@ -42,38 +38,7 @@ const (
 	TYPE_LENGTHFIELDBASEDFRAMECODEC
 )
 
-func (tcpPools *TcpPools) get(name, url string) (frameConn goframe.FrameConn, err error) {
-	tcpPools.mu.Lock()
-	connChan, ok := tcpPools.connPools[name]
-	tcpPools.mu.Unlock()
-	if !ok {
-		tcpPools.mu.Lock()
-		tcpPools.connPools[name] = make(chan goframe.FrameConn, 1024)
-		tcpPools.mu.Unlock()
-		frameConn, err = newFrameConn(url)
-	} else {
-		select {
-		case frameConn = <-connChan:
-		case <-time.After(5 * time.Second):
-			frameConn, err = newFrameConn(url)
-		}
-	}
-	return frameConn, err
-}
-
-func (tcpPools *TcpPools) put(name string, frameConn goframe.FrameConn) {
-	tcpPools.mu.Lock()
-	defer tcpPools.mu.Unlock()
-	if connChan, ok := tcpPools.connPools[name]; ok {
-		connChan <- frameConn
-	}
-}
-
-func newFrameConn(url string) (frameConn goframe.FrameConn, err error) {
-	conn, err := net.Dial("tcp", url)
-	if err != nil {
-		return nil, err
-	}
+func newFrameConn(conn net.Conn) goframe.FrameConn {
 	encoderConfig := goframe.EncoderConfig{
 		ByteOrder:                       binary.BigEndian,
 		LengthFieldLength:               4,
@@ -87,89 +52,78 @@ func newFrameConn(url string) (frameConn goframe.FrameConn, err error) {
 		LengthAdjustment:    0,
 		InitialBytesToStrip: 4,
 	}
-	return goframe.NewLengthFieldBasedFrameConn(encoderConfig, decoderConfig, conn), nil
+	return goframe.NewLengthFieldBasedFrameConn(encoderConfig, decoderConfig, conn)
 }
 
 func NewTcpRequest(opt *Options) (*Tcp, error) {
 	if opt == nil {
 		return nil, ERR_OPTIONS_NIL
 	}
+	if err := opt.ConnOptions.Check(); err != nil {
+		return nil, err
+	}
 	tcp := &Tcp{
 		errRetries:         ERR_RETRIES,
 		opt:                opt,
+		frameConns:         make(map[string]goframe.FrameConn),
 		TransactionOptions: opt.TransactionOptions.Copy(),
 	}
+	conns, err := newVuConns(opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.TlsOptions.Enable {
+		config, err := opt.TlsOptions.acquireConfig()
+		if err != nil {
+			conns.release()
+			return nil, err
+		}
+		tcp.tlsConfig = config
+	}
+	tcp.conns = conns
 	return tcp, nil
 }
 
 func (tcp *Tcp) dispose() (response *Response, err error) {
-
+	if tcp.opt.ConnOptions.NewConn == CONN_PER_ITERATION {
+		tcp.closeAll()
+	}
 	if !tcp.TransactionOptions.Empty() {
-		response := &Response{
-			TransactionWasteTime: make(map[string]uint64),
-		}
-		respTemp := &Response{}
-		isSuccess := true
-		for _, data := range tcp.TransactionOptions.TransactionOptionsDataList {
-			if err = tcp.send(); err != nil {
-				err = fmt.Errorf(fmt.Sprint(data.Name, "，错误原因：", err.Error()))
-				isSuccess = false
-				break
-			}
-			respTemp, err = tcp.recv()
-			if err != nil {
-				err = fmt.Errorf(fmt.Sprint(data.Name, "，错误原因：", err.Error()))
-				isSuccess = false
-				break
-			} else {
-				tcoPools.put(data.Name, tcp.frameConn)
+		return tcp.TransactionOptions.Run(func(data TransactionOptionsData) (*Response, error) {
+			tcp.step = data
+			if err := tcp.send(); err != nil {
+				return nil, err
 			}
-			if respTemp.Data != nil {
-				tcp.TransactionOptions.SetTransactionResponse(data.Name, respTemp.Data)
-			}
-			if data.Interval != 0 {
-				time.Sleep(time.Duration(data.Interval) * time.Millisecond)
-			}
-			response.TransactionWasteTime[data.Name] = respTemp.WasteTime
-			response.WasteTime += respTemp.WasteTime
-		}
-		response.IsSuccess = isSuccess
-		if err != nil {
-			response.ErrMsg = err.Error()
-		}
-
-		return response, err
+			return tcp.recv()
+		})
 	}
 
 	if err = tcp.send(); err != nil {
 		return nil, err
 	}
-	response, err = tcp.recv()
-	if err == nil {
-		tcoPools.put(tcp.opt.Url, tcp.frameConn)
-	}
-	return
+	return tcp.recv()
 }
 
 func (tcp *Tcp) send() (err error) {
-	var frameConn goframe.FrameConn
 	var transactionData TransactionOptionsData
+	url := tcp.opt.Url
 	if !tcp.TransactionOptions.Empty() {
-		transactionData = tcp.TransactionOptions.Get()
+		transactionData = tcp.step
 		transactionData.SendData.init()
-		frameConn, err = tcoPools.get(transactionData.Name, transactionData.Url)
-	} else {
-		frameConn, err = tcoPools.get(tcp.opt.Url, tcp.opt.Url)
+		url = transactionData.Url
 	}
+	tcp.target = tcp.TransactionOptions.Render(url)
+	tcp.handshake = 0
+	frameConn, err := tcp.conn(tcp.target)
 	if err != nil {
 		return err
 	}
-	frameConn, err = newFrameConn(tcp.opt.Url)
 
 	tcp.startTime = utils.Now()
 	frameConn.Conn().SetReadDeadline(time.Now().Add(DEFAULT_REQUEST_TIMEOUT * time.Second))
 	frameConn.Conn().SetWriteDeadline(time.Now().Add(DEFAULT_REQUEST_TIMEOUT * time.Second))
 	if err := frameConn.WriteFrame(tcp.getSendData(transactionData)); err != nil {
+		tcp.fail()
 		return err
 	}
 	tcp.frameConn = frameConn
@@ -177,6 +131,43 @@ func (tcp *Tcp) send() (err error) {
 	return nil
 }
 
+// 获取复用的连接，没有时新建
+func (tcp *Tcp) conn(addr string) (goframe.FrameConn, error) {
+	if frameConn, ok := tcp.frameConns[addr]; ok {
+		atomic.AddUint64(&tcp.conns.reused, 1)
+		return frameConn, nil
+	}
+	conn, err := tcp.conns.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp.tlsConfig != nil {
+		if conn, tcp.handshake, err = tlsHandshake(conn, tcp.tlsConfig, addr); err != nil {
+			atomic.AddUint64(&tcp.conns.errors, 1)
+			return nil, err
+		}
+	}
+	frameConn := newFrameConn(conn)
+	tcp.frameConns[addr] = frameConn
+	return frameConn, nil
+}
+
+// 读写失败的连接不再复用
+func (tcp *Tcp) fail() {
+	atomic.AddUint64(&tcp.conns.errors, 1)
+	if frameConn, ok := tcp.frameConns[tcp.target]; ok {
+		frameConn.Close()
+		delete(tcp.frameConns, tcp.target)
+	}
+}
+
+func (tcp *Tcp) closeAll() {
+	for addr, frameConn := range tcp.frameConns {
+		frameConn.Close()
+		delete(tcp.frameConns, addr)
+	}
+}
+
 func (tcp *Tcp) recv() (response *Response, err error) {
 	isSuccess := true
 	errMsg := ""
@@ -187,17 +178,32 @@ func (tcp *Tcp) recv() (response *Response, err error) {
 	if err != nil {
 		isSuccess = false
 		errMsg = err.Error()
+		tcp.fail()
+	} else if tcp.opt.ConnOptions.NewConn == CONN_PER_REQUEST {
+		tcp.frameConn.Close()
+		delete(tcp.frameConns, tcp.target)
 	}
-	return &Response{
+	response = &Response{
 		WasteTime: uint64(tcp.getRequestTime()),
 		IsSuccess: isSuccess,
 		ErrMsg:    errMsg,
 		Data:      data,
-	}, err
+	}
+	if tcp.handshake != 0 {
+		response.HandshakeNum = 1
+		response.HandshakeTime = uint64(tcp.handshake / time.Millisecond)
+	}
+	tcp.conns.fill(response)
+	return response, err
 }
 
 func (tcp *Tcp) close() {
-
+	tcp.closeAll()
+	if tcp.tlsConfig != nil {
+		tcp.opt.TlsOptions.releaseConfig()
+		tcp.tlsConfig = nil
+	}
+	tcp.conns.release()
 }
 
 func (tcp *Tcp) getRequestTime() time.Duration {
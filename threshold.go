@@ -0,0 +1,93 @@
+package gobom
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	METRIC_AVG_TIME    = "avgTime"
+	METRIC_MAX_TIME    = "maxTime"
+	METRIC_P50_TIME    = "p50Time"
+	METRIC_P90_TIME    = "p90Time"
+	METRIC_P95_TIME    = "p95Time"
+	METRIC_P99_TIME    = "p99Time"
+	METRIC_ERROR_RATE  = "errorRate" // 失败率（百分比）
+	METRIC_FAILURE_NUM = "failureNum"
+)
+
+// 阈值，指标满足 metric op value 时视为越过阈值
+type Threshold struct {
+	Metric string  `json:"metric"`
+	Op     string  `json:"op"` // >|>=|<|<=|==|!=
+	Value  float64 `json:"value"`
+	Abort  bool    `json:"abort"` // 越过阈值时停止任务
+
+	breached bool
+}
+
+type ThresholdBreach struct {
+	Metric string  `json:"metric"`
+	Op     string  `json:"op"`
+	Value  float64 `json:"value"`
+	Actual float64 `json:"actual"` // 越过阈值时的指标值
+	Abort  bool    `json:"abort"`
+	Time   int64   `json:"time"`
+}
+
+// 检查阈值，返回新越过的阈值（每个阈值只返回一次）
+func checkThresholds(thresholds []*Threshold, snapshot *Snapshot) []*ThresholdBreach {
+	var breaches []*ThresholdBreach
+	for _, threshold := range thresholds {
+		if threshold.breached {
+			continue
+		}
+		actual, ok := metric(snapshot, threshold.Metric)
+		if !ok {
+			continue
+		}
+		condition := &Condition{
+			Op:    threshold.Op,
+			Value: strconv.FormatFloat(threshold.Value, 'f', -1, 64),
+		}
+		if !condition.compare(strconv.FormatFloat(actual, 'f', -1, 64)) {
+			continue
+		}
+		threshold.breached = true
+		breaches = append(breaches, &ThresholdBreach{
+			Metric: threshold.Metric,
+			Op:     threshold.Op,
+			Value:  threshold.Value,
+			Actual: actual,
+			Abort:  threshold.Abort,
+			Time:   time.Now().Unix(),
+		})
+	}
+	return breaches
+}
+
+func metric(snapshot *Snapshot, name string) (float64, bool) {
+	switch name {
+	case METRIC_AVG_TIME:
+		return float64(snapshot.AverageTime()), true
+	case METRIC_MAX_TIME:
+		return float64(snapshot.MaxTime), true
+	case METRIC_P50_TIME:
+		return float64(snapshot.Percentile(50)), true
+	case METRIC_P90_TIME:
+		return float64(snapshot.Percentile(90)), true
+	case METRIC_P95_TIME:
+		return float64(snapshot.Percentile(95)), true
+	case METRIC_P99_TIME:
+		return float64(snapshot.Percentile(99)), true
+	case METRIC_ERROR_RATE:
+		total := snapshot.SuccessNum + snapshot.FailureNum
+		if total == 0 {
+			return 0, true
+		}
+		return float64(snapshot.FailureNum) * 100 / float64(total), true
+	case METRIC_FAILURE_NUM:
+		return float64(snapshot.FailureNum), true
+	}
+	return 0, false
+}
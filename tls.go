@@ -0,0 +1,225 @@
+package gobom
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// TLS设置，HTTP根据地址的https使用，TCP和WebSocket需要开启Enable，事务步骤使用脚本的设置
+type TlsOptions struct {
+	Enable             bool     `json:"enable" form:"enable"`                         // TCP使用TLS连接
+	ServerName         string   `json:"serverName" form:"serverName"`                 // SNI，默认为地址的主机名
+	InsecureSkipVerify bool     `json:"insecureSkipVerify" form:"insecureSkipVerify"` // 不校验服务端证书（测试环境使用）
+	MinVersion         string   `json:"minVersion" form:"minVersion"`                 // 1.0|1.1|1.2|1.3
+	MaxVersion         string   `json:"maxVersion" form:"maxVersion"`
+	CipherSuites       []string `json:"cipherSuites" form:"cipherSuites"`           // 加密套件名称，如TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256，TLS1.3的套件不可配置
+	SessionResumption  bool     `json:"sessionResumption" form:"sessionResumption"` // 会话复用，每个虚拟用户独立的会话缓存
+	CertFileId         uint     `json:"certFileId" form:"certFileId"`               // 客户端证书（数据文件）
+	KeyFileId          uint     `json:"keyFileId" form:"keyFileId"`                 // 客户端私钥，为0时从证书文件中读取
+	CaFileId           uint     `json:"caFileId" form:"caFileId"`                   // CA证书，设置后只信任其中的证书
+}
+
+// 同一个脚本的虚拟用户共用的TLS配置，证书文件只读取一次
+type tlsShared struct {
+	config *tls.Config
+	refs   int
+}
+
+var tlsShareds = struct {
+	shareds map[*TlsOptions]*tlsShared
+	mu      sync.Mutex
+}{shareds: make(map[*TlsOptions]*tlsShared)}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (tlsOptions *TlsOptions) empty() bool {
+	return !tlsOptions.Enable && tlsOptions.ServerName == "" && !tlsOptions.InsecureSkipVerify &&
+		tlsOptions.MinVersion == "" && tlsOptions.MaxVersion == "" && len(tlsOptions.CipherSuites) == 0 &&
+		!tlsOptions.SessionResumption && tlsOptions.CertFileId == 0 && tlsOptions.KeyFileId == 0 && tlsOptions.CaFileId == 0
+}
+
+// 校验版本、加密套件和引用的证书文件
+func (tlsOptions *TlsOptions) Check(projectId uint) error {
+	if _, _, err := tlsOptions.versions(); err != nil {
+		return err
+	}
+	if _, err := tlsOptions.cipherSuites(); err != nil {
+		return err
+	}
+	if tlsOptions.KeyFileId != 0 && tlsOptions.CertFileId == 0 {
+		return ERR_TLS_CERT
+	}
+	for _, id := range tlsOptions.fileIds() {
+		dataFile := &DataFile{}
+		dataFile.ID = id
+		if _, err := dataFile.First(); err != nil {
+			return err
+		}
+		if dataFile.Type != DATAFILE_TYPE_CERT {
+			return fmt.Errorf("%s[%s]", ERR_TLS_FILE, dataFile.Name)
+		}
+		if dataFile.ProjectId != projectId {
+			return ERR_PROJECT_MISMATCH
+		}
+	}
+	_, err := tlsOptions.config()
+	return err
+}
+
+// 获取虚拟用户使用的TLS配置，开启会话复用时复制一份使用独立的会话缓存，虚拟用户退出时调用releaseConfig
+func (tlsOptions *TlsOptions) acquireConfig() (*tls.Config, error) {
+	tlsShareds.mu.Lock()
+	defer tlsShareds.mu.Unlock()
+	shared, ok := tlsShareds.shareds[tlsOptions]
+	if !ok {
+		config, err := tlsOptions.config()
+		if err != nil {
+			return nil, err
+		}
+		shared = &tlsShared{config: config}
+		tlsShareds.shareds[tlsOptions] = shared
+	}
+	shared.refs++
+	config := shared.config
+	if tlsOptions.SessionResumption {
+		config = config.Clone()
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return config, nil
+}
+
+func (tlsOptions *TlsOptions) releaseConfig() {
+	tlsShareds.mu.Lock()
+	defer tlsShareds.mu.Unlock()
+	shared, ok := tlsShareds.shareds[tlsOptions]
+	if !ok {
+		return
+	}
+	if shared.refs--; shared.refs == 0 {
+		delete(tlsShareds.shareds, tlsOptions)
+	}
+}
+
+// 生成TLS配置，使用时不能修改
+func (tlsOptions *TlsOptions) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         tlsOptions.ServerName,
+		InsecureSkipVerify: tlsOptions.InsecureSkipVerify,
+	}
+	var err error
+	if config.MinVersion, config.MaxVersion, err = tlsOptions.versions(); err != nil {
+		return nil, err
+	}
+	if config.CipherSuites, err = tlsOptions.cipherSuites(); err != nil {
+		return nil, err
+	}
+	if tlsOptions.CertFileId != 0 {
+		certPem, err := readCertFile(tlsOptions.CertFileId)
+		if err != nil {
+			return nil, err
+		}
+		keyPem := certPem
+		if tlsOptions.KeyFileId != 0 {
+			if keyPem, err = readCertFile(tlsOptions.KeyFileId); err != nil {
+				return nil, err
+			}
+		}
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("%s：%s", ERR_TLS_CERT, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if tlsOptions.CaFileId != 0 {
+		caPem, err := readCertFile(tlsOptions.CaFileId)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, ERR_TLS_CA
+		}
+	}
+	return config, nil
+}
+
+func (tlsOptions *TlsOptions) versions() (min, max uint16, err error) {
+	var ok bool
+	if tlsOptions.MinVersion != "" {
+		if min, ok = tlsVersions[tlsOptions.MinVersion]; !ok {
+			return 0, 0, fmt.Errorf("%s[%s]", ERR_TLS_VERSION, tlsOptions.MinVersion)
+		}
+	}
+	if tlsOptions.MaxVersion != "" {
+		if max, ok = tlsVersions[tlsOptions.MaxVersion]; !ok {
+			return 0, 0, fmt.Errorf("%s[%s]", ERR_TLS_VERSION, tlsOptions.MaxVersion)
+		}
+	}
+	if min != 0 && max != 0 && min > max {
+		return 0, 0, ERR_TLS_VERSION
+	}
+	return min, max, nil
+}
+
+func (tlsOptions *TlsOptions) cipherSuites() ([]uint16, error) {
+	if len(tlsOptions.CipherSuites) == 0 {
+		return nil, nil
+	}
+	suites := make(map[string]uint16)
+	for _, v := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[v.Name] = v.ID
+	}
+	var list []uint16
+	for _, name := range tlsOptions.CipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("%s[%s]", ERR_TLS_CIPHER, name)
+		}
+		list = append(list, id)
+	}
+	return list, nil
+}
+
+func (tlsOptions *TlsOptions) fileIds() []uint {
+	var ids []uint
+	for _, id := range []uint{tlsOptions.CertFileId, tlsOptions.KeyFileId, tlsOptions.CaFileId} {
+		if id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func readCertFile(id uint) ([]byte, error) {
+	path, err := dataFilePath(id)
+	if err != nil {
+		return nil, err
+	}
+	return readStoredFile(path)
+}
+
+// 在已建立的连接上进行TLS握手，返回握手时间
+func tlsHandshake(conn net.Conn, config *tls.Config, addr string) (*tls.Conn, time.Duration, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	start := time.Now()
+	tlsConn.SetDeadline(start.Add(DEFAULT_REQUEST_TIMEOUT * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, time.Since(start), nil
+}
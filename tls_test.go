@@ -0,0 +1,306 @@
+package gobom
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallnest/goframe"
+	"github.com/tidwall/gjson"
+	"gobom/utils"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+// 生成证书，parent为nil时生成自签名的CA证书
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		template.DNSNames = []string{cn}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func (testCert *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{testCert.cert.Raw}, PrivateKey: testCert.key}
+}
+
+func addTestCertFile(t *testing.T, name string, content []byte) uint {
+	if err := os.MkdirAll(FILE_DATA_PATH, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	dataFile := &DataFile{Name: name, Path: utils.GenerateId() + "-" + name, Type: DATAFILE_TYPE_CERT}
+	if err := ioutil.WriteFile(dataFile.filePath(), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(dataFile.filePath()) })
+	if err := dataFile.checkPem(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dataFile.Add(); err != nil {
+		t.Fatal(err)
+	}
+	return dataFile.ID
+}
+
+func TestTls(t *testing.T) {
+	initTestDb(t)
+	ca := newTestCert(t, "gobom ca", nil, 0)
+	server := newTestCert(t, "gobom.test", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "gobom client", ca, x509.ExtKeyUsageClientAuth)
+	caId := addTestCertFile(t, "ca.pem", ca.certPem)
+	certId := addTestCertFile(t, "client.pem", client.certPem)
+	keyId := addTestCertFile(t, "client.key", client.keyPem)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCert()},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	}
+
+	// 返回协商结果的HTTPS服务（同时支持HTTP/2）
+	https := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cn string
+		if len(r.TLS.PeerCertificates) != 0 {
+			cn = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"proto": r.ProtoMajor, "version": r.TLS.Version, "cipher": r.TLS.CipherSuite, "sni": r.TLS.ServerName, "cn": cn,
+		})
+	}))
+	https.EnableHTTP2 = true
+	https.TLS = serverConfig.Clone()
+	https.StartTLS()
+	defer https.Close()
+
+	newOpt := func(tlsOptions TlsOptions) *Options {
+		return &Options{Url: https.URL + "/tls", Form: FORM_HTTP, TlsOptions: tlsOptions}
+	}
+	tlsOptions := TlsOptions{
+		ServerName:   "gobom.test",
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		CertFileId:   certId,
+		KeyFileId:    keyId,
+		CaFileId:     caId,
+	}
+	if err := tlsOptions.Check(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTP/1.1：SNI、版本、加密套件、客户端证书，握手只统计新建的连接
+	requester, err := NewRequester(newOpt(tlsOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := requester.dispose()
+	if err != nil || !resp.IsSuccess {
+		t.Fatalf("https: %+v %v", resp, err)
+	}
+	if gjson.GetBytes(resp.Data, "version").Int() != tls.VersionTLS12 || gjson.GetBytes(resp.Data, "cipher").Int() != int64(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) ||
+		gjson.GetBytes(resp.Data, "sni").String() != "gobom.test" || gjson.GetBytes(resp.Data, "cn").String() != "gobom client" {
+		t.Errorf("https: %s", resp.Data)
+	}
+	if resp.HandshakeNum != 1 {
+		t.Errorf("handshake: %d", resp.HandshakeNum)
+	}
+	if resp, err = requester.dispose(); err != nil || resp.HandshakeNum != 0 {
+		t.Errorf("reused connection: %+v %v", resp, err)
+	}
+	requester.close()
+
+	// 不信任服务端证书
+	requester, _ = NewRequester(newOpt(TlsOptions{ServerName: "gobom.test"}))
+	if _, err = requester.dispose(); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("untrusted: %v", err)
+	}
+	requester, _ = NewRequester(newOpt(TlsOptions{InsecureSkipVerify: true}))
+	if resp, err = requester.dispose(); err != nil || gjson.GetBytes(resp.Data, "cn").String() != "" {
+		t.Errorf("insecure: %+v %v", resp, err)
+	}
+
+	// HTTP/2使用相同的设置
+	opt := newOpt(TlsOptions{ServerName: "gobom.test", CaFileId: caId, CertFileId: certId, KeyFileId: keyId})
+	opt.HttpOptions.Protocol = HTTP_PROTOCOL_2
+	requester, _ = NewRequester(opt)
+	if resp, err = requester.dispose(); err != nil || gjson.GetBytes(resp.Data, "proto").Int() != 2 ||
+		gjson.GetBytes(resp.Data, "cn").String() != "gobom client" || resp.HandshakeNum != 1 {
+		t.Errorf("h2: %+v %s %v", resp, resp.Data, err)
+	}
+	requester.close()
+
+	// TCP：每个请求新建连接，开启会话复用后握手使用会话票据
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				frameConn := goframe.NewLengthFieldBasedFrameConn(
+					goframe.EncoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4},
+					goframe.DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4, InitialBytesToStrip: 4}, tlsConn)
+				if _, err := frameConn.ReadFrame(); err != nil {
+					return
+				}
+				frameConn.WriteFrame([]byte(fmt.Sprintf(`{"resumed":%v}`, tlsConn.ConnectionState().DidResume)))
+			}()
+		}
+	}()
+	for _, resumption := range []bool{false, true} {
+		requester, err = NewRequester(&Options{
+			Url:         listener.Addr().String(),
+			Form:        FORM_TCP,
+			TlsOptions:  TlsOptions{Enable: true, ServerName: "gobom.test", CaFileId: caId, MaxVersion: "1.2", SessionResumption: resumption},
+			ConnOptions: ConnOptions{NewConn: CONN_PER_REQUEST},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			resp, err := requester.dispose()
+			if err != nil || resp.HandshakeNum != 1 {
+				t.Fatalf("tcp: %+v %v", resp, err)
+			}
+			if resumed := gjson.GetBytes(resp.Data, "resumed").Bool(); i == 1 && resumed != resumption {
+				t.Errorf("session resumption %v: %v", resumption, resumed)
+			}
+		}
+	}
+
+	// 同一个脚本的虚拟用户共用TLS配置，证书文件只读取一次，会话复用时每个虚拟用户独立的会话缓存
+	vuTls := &TlsOptions{CaFileId: caId}
+	config, err := vuTls.acquireConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caData := &DataFile{}
+	caData.ID = caId
+	caData.First()
+	os.Rename(caData.filePath(), caData.filePath()+".bak")
+	if c, err := vuTls.acquireConfig(); err != nil || c != config {
+		t.Errorf("shared config: %v", err)
+	}
+	os.Rename(caData.filePath()+".bak", caData.filePath())
+	vuTls.SessionResumption = true
+	c1, _ := vuTls.acquireConfig()
+	c2, _ := vuTls.acquireConfig()
+	if c1 == config || c1.ClientSessionCache == nil || c1.ClientSessionCache == c2.ClientSessionCache || c1.RootCAs != config.RootCAs {
+		t.Errorf("session cache: %+v %+v", c1, c2)
+	}
+	for i := 0; i < 4; i++ {
+		vuTls.releaseConfig()
+	}
+	if _, ok := tlsShareds.shareds[vuTls]; ok {
+		t.Error("config not released")
+	}
+
+	// 校验
+	for _, c := range []struct {
+		tlsOptions TlsOptions
+		err        error
+	}{
+		{TlsOptions{MinVersion: "1.4"}, ERR_TLS_VERSION},
+		{TlsOptions{MinVersion: "1.3", MaxVersion: "1.2"}, ERR_TLS_VERSION},
+		{TlsOptions{CipherSuites: []string{"TLS_NULL"}}, ERR_TLS_CIPHER},
+		{TlsOptions{KeyFileId: keyId}, ERR_TLS_CERT},
+		{TlsOptions{CertFileId: caId, KeyFileId: keyId}, ERR_TLS_CERT},
+		{TlsOptions{CaFileId: keyId}, ERR_TLS_CA},
+		{TlsOptions{CaFileId: 1000}, ERR_DATAFILE_NOT_FOUND},
+	} {
+		if err := c.tlsOptions.Check(0); err == nil || !strings.HasPrefix(err.Error(), c.err.Error()) {
+			t.Errorf("%+v: %v, want %v", c.tlsOptions, err, c.err)
+		}
+	}
+	data := &DataFile{Name: "data.csv", Path: "data.csv"}
+	if err := data.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&TlsOptions{CaFileId: data.ID}).Check(0); err == nil || !strings.HasPrefix(err.Error(), ERR_TLS_FILE.Error()) {
+		t.Errorf("data file: %v", err)
+	}
+
+	// 被脚本引用的证书文件不能删除
+	script := &ScriptData{Name: "tls", Data: string(newOpt(tlsOptions).ToByte())}
+	if err := script.Add(); err != nil {
+		t.Fatal(err)
+	}
+	caFile := &DataFile{}
+	caFile.ID = caId
+	if err := caFile.Del(); err == nil || !strings.HasPrefix(err.Error(), ERR_DATAFILE_IN_USE.Error()) {
+		t.Errorf("delete: %v", err)
+	}
+
+	// 握手统计
+	report := &Report{}
+	report.Push(&Response{IsSuccess: true, HandshakeNum: 1, HandshakeTime: 4})
+	report.Push(&Response{IsSuccess: true, HandshakeNum: 1, HandshakeTime: 2})
+	report.Push(&Response{IsSuccess: true})
+	if report.HandshakeNum != 2 || report.HandshakeTime != 3 {
+		t.Errorf("report: %d %d", report.HandshakeNum, report.HandshakeTime)
+	}
+	merged := &Report{}
+	merged.Merge(report.Snapshot())
+	if merged.HandshakeNum != 2 || merged.HandshakeTime != 3 || merged.Copy().HandshakeTime != 3 {
+		t.Errorf("merged: %d %d", merged.HandshakeNum, merged.HandshakeTime)
+	}
+}
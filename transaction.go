@@ -0,0 +1,247 @@
+package gobom
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	STEP_REQUEST = ""       // 请求步骤
+	STEP_GROUP   = "group"  // 顺序执行子步骤
+	STEP_IF      = "if"     // 条件成立时执行子步骤
+	STEP_LOOP    = "loop"   // 循环执行子步骤（loop次数 或 condition成立时）
+	STEP_BRANCH  = "branch" // 按权重随机选择一个子步骤执行
+
+	COND_RESPONSE  = "response" // 步骤响应数据中的字段
+	COND_SEND_DATA = "sendData" // 步骤发送数据中的字段
+	COND_STATUS    = "status"   // 上一个请求步骤的状态码
+	COND_SUCCESS   = "success"  // 上一个请求步骤是否成功 true|false
+	COND_VARIABLE  = "variable" // 变量（虚拟用户提取的变量或全局变量）
+
+	DEFAULT_MAX_LOOP = 1000 // while循环最大次数
+)
+
+type Condition struct {
+	Source string `json:"source"` // 取值来源 response|sendData|variable|status|success
+	Field  string `json:"field"`  // 步骤名---字段路径；variable时为变量名；status|success时为空
+	Op     string `json:"op"`     // ==|!=|>|>=|<|<=|contains|exists
+	Value  string `json:"value"`
+}
+
+type StepFunc func(data TransactionOptionsData) (*Response, error)
+
+type transactionRunner struct {
+	options  *TransactionOptions
+	step     StepFunc
+	response *Response
+	last     *Response // 上一个请求步骤的结果
+}
+
+// 执行一次事务，每个步骤（包括控制节点）的耗时记录在TransactionWasteTime中
+func (transactionOptions *TransactionOptions) Run(step StepFunc) (*Response, error) {
+	runner := &transactionRunner{
+		options: transactionOptions,
+		step:    step,
+		response: &Response{
+			IsSuccess:            true,
+			TransactionWasteTime: make(map[string]uint64),
+		},
+	}
+	err := runner.run(transactionOptions.TransactionOptionsDataList)
+	if err != nil {
+		runner.response.IsSuccess = false
+		runner.response.ErrMsg = err.Error()
+	}
+	runner.response.Variables = transactionOptions.Variables
+	return runner.response, err
+}
+
+func (runner *transactionRunner) run(list []TransactionOptionsData) error {
+	for _, data := range list {
+		begin := runner.response.WasteTime
+		var err error
+		switch data.Type {
+		case STEP_REQUEST:
+			err = runner.request(data)
+		case STEP_GROUP:
+			err = runner.run(data.Children)
+		case STEP_IF:
+			if runner.check(data.Condition) {
+				err = runner.run(data.Children)
+			}
+		case STEP_LOOP:
+			for i := uint64(0); err == nil && runner.loop(data, i); i++ {
+				err = runner.run(data.Children)
+			}
+		case STEP_BRANCH:
+			if child, ok := runner.pick(data.Children); ok {
+				err = runner.run([]TransactionOptionsData{child})
+			}
+		default:
+			err = fmt.Errorf("%s，错误原因：%s", data.Name, ERR_STEP_TYPE.Error())
+		}
+		if data.Type != STEP_REQUEST && data.Name != "" {
+			runner.response.TransactionWasteTime[data.Name] += runner.response.WasteTime - begin
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (runner *transactionRunner) request(data TransactionOptionsData) error {
+	resp, err := runner.step(data)
+	if resp != nil {
+		runner.last = resp
+		if resp.Data != nil {
+			runner.options.SetTransactionResponse(data.Name, resp.Data)
+		}
+		runner.options.extract(data, resp)
+		runner.response.TransactionWasteTime[data.Name] += resp.WasteTime
+		runner.response.WasteTime += resp.WasteTime
+		if !resp.IsSuccess {
+			runner.response.ErrCode = resp.ErrCode
+		}
+		// 超时和丢包的步骤不中断事务，整个事务记为失败
+		if resp.Timeout || resp.Lost {
+			runner.response.IsSuccess = false
+			runner.response.ErrMsg = fmt.Sprint(data.Name, "，错误原因：", resp.ErrMsg)
+			runner.response.Timeout = runner.response.Timeout || resp.Timeout
+			runner.response.Lost = runner.response.Lost || resp.Lost
+		}
+		runner.response.HandshakeNum += resp.HandshakeNum
+		runner.response.HandshakeTime += resp.HandshakeTime
+		runner.response.ConnOpened += resp.ConnOpened
+		runner.response.ConnReused += resp.ConnReused
+		runner.response.ConnErrors += resp.ConnErrors
+		runner.response.ProxyErrors += resp.ProxyErrors
+	} else if err != nil {
+		runner.last = &Response{IsSuccess: false, ErrCode: -1}
+	}
+	if err != nil && !data.ContinueOnError {
+		return fmt.Errorf(fmt.Sprint(data.Name, "，错误原因：", err.Error()))
+	}
+	if data.Interval != 0 {
+		time.Sleep(time.Duration(data.Interval) * time.Millisecond)
+	}
+	return nil
+}
+
+func (runner *transactionRunner) loop(data TransactionOptionsData, i uint64) bool {
+	if data.Loop != 0 && i >= data.Loop {
+		return false
+	}
+	if data.Condition != nil {
+		return i < DEFAULT_MAX_LOOP && runner.check(data.Condition)
+	}
+	return data.Loop != 0
+}
+
+// 按权重选择子步骤，权重为0的子步骤不会被选中
+func (runner *transactionRunner) pick(children []TransactionOptionsData) (TransactionOptionsData, bool) {
+	var total uint64
+	for _, v := range children {
+		total += v.Weight
+	}
+	if total == 0 {
+		return TransactionOptionsData{}, false
+	}
+	n := uint64(rand.Int63n(int64(total)))
+	for _, v := range children {
+		if n < v.Weight {
+			return v, true
+		}
+		n -= v.Weight
+	}
+	return TransactionOptionsData{}, false
+}
+
+func (runner *transactionRunner) check(condition *Condition) bool {
+	if condition == nil {
+		return true
+	}
+	var value string
+	switch condition.Source {
+	case COND_RESPONSE, COND_SEND_DATA:
+		name, field := (&SendData{}).parseField(condition.Field)
+		var data []byte
+		if condition.Source == COND_RESPONSE {
+			data = runner.options.GetTransactionResponse(name)
+		} else {
+			data = runner.options.GetTransactionSendData(name)
+		}
+		if data != nil {
+			value = gjson.GetBytes(data, field).String()
+		}
+	case COND_VARIABLE:
+		value, _ = runner.options.GetVariable(condition.Field)
+	case COND_STATUS:
+		if runner.last != nil {
+			value = strconv.Itoa(runner.last.ErrCode)
+		}
+	case COND_SUCCESS:
+		if runner.last != nil {
+			value = strconv.FormatBool(runner.last.IsSuccess)
+		}
+	}
+	return condition.compare(value)
+}
+
+func (condition *Condition) compare(value string) bool {
+	if condition.Op == "exists" {
+		return value != ""
+	}
+	if condition.Op == "contains" {
+		return strings.Contains(value, condition.Value)
+	}
+	a, errA := strconv.ParseFloat(value, 64)
+	b, errB := strconv.ParseFloat(condition.Value, 64)
+	if errA == nil && errB == nil {
+		switch condition.Op {
+		case "==", "":
+			return a == b
+		case "!=":
+			return a != b
+		case ">":
+			return a > b
+		case ">=":
+			return a >= b
+		case "<":
+			return a < b
+		case "<=":
+			return a <= b
+		}
+		return false
+	}
+	switch condition.Op {
+	case "==", "":
+		return value == condition.Value
+	case "!=":
+		return value != condition.Value
+	case ">":
+		return value > condition.Value
+	case ">=":
+		return value >= condition.Value
+	case "<":
+		return value < condition.Value
+	case "<=":
+		return value <= condition.Value
+	}
+	return false
+}
+
+// 展开所有步骤（包括控制节点的子步骤）
+func flattenSteps(list []TransactionOptionsData) []TransactionOptionsData {
+	var steps []TransactionOptionsData
+	for _, v := range list {
+		steps = append(steps, v)
+		steps = append(steps, flattenSteps(v.Children)...)
+	}
+	return steps
+}
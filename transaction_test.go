@@ -0,0 +1,90 @@
+package gobom
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransactionControlFlow(t *testing.T) {
+	transactionOptions := &TransactionOptions{
+		TransactionOptionsDataList: []TransactionOptionsData{
+			{Name: "login"},
+			{Name: "checkLogin", Type: STEP_IF, Condition: &Condition{Source: COND_RESPONSE, Field: "login---code", Op: "==", Value: "0"}, Children: []TransactionOptionsData{
+				{Name: "profile"},
+			}},
+			{Name: "skipped", Type: STEP_IF, Condition: &Condition{Source: COND_STATUS, Op: "!=", Value: "200"}, Children: []TransactionOptionsData{
+				{Name: "never"},
+			}},
+			{Name: "repeat", Type: STEP_LOOP, Loop: 3, Children: []TransactionOptionsData{
+				{Name: "list"},
+			}},
+			{Name: "mix", Type: STEP_BRANCH, Children: []TransactionOptionsData{
+				{Name: "browse", Weight: 1},
+				{Name: "checkout", Weight: 0},
+			}},
+		},
+	}
+
+	calls := make(map[string]int)
+	response, err := transactionOptions.Run(func(data TransactionOptionsData) (*Response, error) {
+		calls[data.Name]++
+		return &Response{IsSuccess: true, ErrCode: 200, WasteTime: 10, Data: []byte(`{"code":0}`)}, nil
+	})
+	if err != nil || !response.IsSuccess {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"login": 1, "profile": 1, "list": 3, "browse": 1}
+	for name, n := range want {
+		if calls[name] != n {
+			t.Errorf("step %s called %d times, want %d", name, calls[name], n)
+		}
+	}
+	if calls["never"] != 0 || calls["checkout"] != 0 {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+	if response.TransactionWasteTime["repeat"] != 30 || response.TransactionWasteTime["list"] != 30 {
+		t.Errorf("loop node waste time: %v", response.TransactionWasteTime)
+	}
+	if _, ok := response.TransactionWasteTime["skipped"]; !ok {
+		t.Error("control node missing from step statistics")
+	}
+	if response.WasteTime != 60 {
+		t.Errorf("waste time %d, want 60", response.WasteTime)
+	}
+}
+
+func TestTransactionWhileAndError(t *testing.T) {
+	transactionOptions := &TransactionOptions{
+		TransactionOptionsDataList: []TransactionOptionsData{
+			{Name: "poll", Type: STEP_LOOP, Condition: &Condition{Source: COND_SUCCESS, Op: "!=", Value: "true"}, Children: []TransactionOptionsData{
+				{Name: "status", ContinueOnError: true},
+			}},
+			{Name: "fail"},
+			{Name: "after"},
+		},
+	}
+
+	n := 0
+	response, err := transactionOptions.Run(func(data TransactionOptionsData) (*Response, error) {
+		if data.Name == "status" {
+			n++
+			if n < 3 {
+				return &Response{IsSuccess: false, ErrCode: 500}, errors.New("busy")
+			}
+		}
+		if data.Name == "fail" {
+			return &Response{IsSuccess: false, ErrCode: 502}, errors.New("bad gateway")
+		}
+		return &Response{IsSuccess: true, ErrCode: 200}, nil
+	})
+	if n != 3 {
+		t.Errorf("while loop ran %d times, want 3", n)
+	}
+	if err == nil || response.IsSuccess || response.ErrCode != 502 {
+		t.Errorf("expected failure at step fail, got %v %+v", err, response)
+	}
+	if _, ok := response.TransactionWasteTime["after"]; ok {
+		t.Error("steps after a failed step should not run")
+	}
+}
@@ -0,0 +1,191 @@
+package gobom
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"gobom/utils"
+)
+
+const (
+	UDP_MODE_REQUEST = ""     // 请求/响应：等待响应，统计响应时间
+	UDP_MODE_SEND    = "send" // 只发送：不等待响应，只统计发送速率
+
+	UDP_MAX_PACKET = 65535
+
+	ERR_CODE_TIMEOUT = -2 // 等待响应超时
+	ERR_CODE_LOST    = -3 // 发送失败或对端不可达
+)
+
+type UdpOptions struct {
+	Mode        string `json:"mode" form:"mode"`               // 空为请求/响应|send
+	Timeout     uint64 `json:"timeout" form:"timeout"`         // 等待响应的超时时间（毫秒），默认DEFAULT_REQUEST_TIMEOUT秒
+	Correlation string `json:"correlation" form:"correlation"` // 关联id在数据中的字段路径，设置后只接收关联id相同的响应
+}
+
+// UDP请求，发送的数据为SendData生成的JSON
+type Udp struct {
+	startTime          time.Duration
+	endTime            time.Duration
+	opt                *Options
+	conn               net.Conn
+	target             string // 当前socket的地址
+	buf                []byte
+	step               TransactionOptionsData // 当前执行的事务步骤
+	TransactionOptions *TransactionOptions
+}
+
+func NewUdpRequest(opt *Options) (*Udp, error) {
+	if opt == nil {
+		return nil, ERR_OPTIONS_NIL
+	}
+	if opt.UdpOptions.Mode != UDP_MODE_REQUEST && opt.UdpOptions.Mode != UDP_MODE_SEND {
+		return nil, ERR_UDP_MODE
+	}
+	return &Udp{
+		opt:                opt,
+		TransactionOptions: opt.TransactionOptions.Copy(),
+	}, nil
+}
+
+func (udp *Udp) dispose() (response *Response, err error) {
+	if !udp.TransactionOptions.Empty() {
+		return udp.TransactionOptions.Run(func(data TransactionOptionsData) (*Response, error) {
+			udp.step = data
+			return udp.request()
+		})
+	}
+	return udp.request()
+}
+
+// 超时和丢包是压测的结果，计入报告后继续压测
+func (udp *Udp) request() (response *Response, err error) {
+	if err = udp.send(); err != nil {
+		response, err = udp.fail(err)
+	} else {
+		response, err = udp.recv()
+	}
+	if response != nil && (response.Timeout || response.Lost) {
+		err = nil
+	}
+	return
+}
+
+func (udp *Udp) send() (err error) {
+	var (
+		url      = udp.opt.Url
+		sendData = udp.opt.SendData
+	)
+	if !udp.step.Empty() {
+		url = udp.step.Url
+		sendData = udp.step.SendData
+	}
+
+	// 同一个虚拟用户复用socket，地址变化时重新创建
+	target := udp.TransactionOptions.Render(url)
+	if udp.conn == nil || udp.target != target {
+		udp.close()
+		if udp.conn, err = net.Dial("udp", target); err != nil {
+			return err
+		}
+		udp.target = target
+	}
+
+	var payload []byte
+	if err = sendData.init(); err != nil {
+		return err
+	}
+	if bm := sendData.GetSendDataToMap(udp.TransactionOptions); bm != nil {
+		if payload, err = json.Marshal(bm); err != nil {
+			return err
+		}
+		if !udp.step.Empty() {
+			udp.TransactionOptions.SetTransactionSendData(udp.step.Name, payload)
+		}
+	}
+	udp.buf = payload
+
+	udp.startTime = utils.Now()
+	udp.conn.SetWriteDeadline(time.Now().Add(DEFAULT_REQUEST_TIMEOUT * time.Second))
+	_, err = udp.conn.Write(payload)
+	udp.endTime = utils.Now()
+	return err
+}
+
+func (udp *Udp) recv() (response *Response, err error) {
+	if udp.opt.UdpOptions.Mode == UDP_MODE_SEND {
+		return &Response{
+			WasteTime: uint64(udp.getRequestTime()),
+			IsSuccess: true,
+		}, nil
+	}
+
+	// 关联id不同的是之前超时请求的响应，丢弃后继续等待
+	var id string
+	if path := udp.opt.UdpOptions.Correlation; path != "" {
+		id = gjson.GetBytes(udp.buf, path).String()
+	}
+	timeout := time.Duration(DEFAULT_REQUEST_TIMEOUT) * time.Second
+	if udp.opt.UdpOptions.Timeout != 0 {
+		timeout = time.Duration(udp.opt.UdpOptions.Timeout) * time.Millisecond
+	}
+	udp.conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, UDP_MAX_PACKET)
+	for {
+		n, err := udp.conn.Read(buf)
+		udp.endTime = utils.Now()
+		if err != nil {
+			return udp.fail(err)
+		}
+		data := buf[:n]
+		if id != "" && gjson.GetBytes(data, udp.opt.UdpOptions.Correlation).String() != id {
+			continue
+		}
+		return &Response{
+			WasteTime: uint64(udp.getRequestTime()),
+			IsSuccess: true,
+			Data:      append([]byte(nil), data...),
+		}, nil
+	}
+}
+
+// 超时和丢包记录为失败的请求
+func (udp *Udp) fail(err error) (*Response, error) {
+	response := &Response{
+		WasteTime: uint64(udp.getRequestTime()),
+		ErrCode:   -1,
+		ErrMsg:    err.Error(),
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		response.ErrCode = ERR_CODE_TIMEOUT
+		response.ErrMsg = ERR_UDP_TIMEOUT.Error()
+		response.Timeout = true
+	} else if opErr, ok := err.(*net.OpError); ok {
+		// 连接或读写失败，对端不可达（ICMP port unreachable）时返回connection refused
+		response.ErrCode = ERR_CODE_LOST
+		response.Lost = true
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.ECONNREFUSED {
+			response.ErrMsg = ERR_UDP_REFUSED.Error()
+		}
+	}
+	return response, err
+}
+
+func (udp *Udp) close() {
+	if udp.conn != nil {
+		udp.conn.Close()
+		udp.conn = nil
+	}
+}
+
+func (udp *Udp) getRequestTime() time.Duration {
+	if udp.startTime == 0 || udp.endTime == 0 || udp.endTime < udp.startTime {
+		return time.Duration(0)
+	}
+	return udp.endTime - udp.startTime
+}
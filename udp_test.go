@@ -0,0 +1,142 @@
+package gobom
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// 回显服务：drop为true时不响应，stale为true时先回复一个关联id不同的包
+func startTestUdpServer(t *testing.T) (string, <-chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	received := make(chan []byte, 100)
+	go func() {
+		buf := make([]byte, UDP_MAX_PACKET)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			data := append([]byte(nil), buf[:n]...)
+			received <- data
+			if gjson.GetBytes(data, "drop").Bool() {
+				continue
+			}
+			if gjson.GetBytes(data, "stale").Bool() {
+				conn.WriteTo([]byte(`{"seq":"old"}`), addr)
+			}
+			conn.WriteTo(data, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), received
+}
+
+func TestUdp(t *testing.T) {
+	addr, received := startTestUdpServer(t)
+	newOpt := func(udpOptions UdpOptions, fields ...*DataField) *Options {
+		return &Options{Url: addr, Form: FORM_UDP, UdpOptions: udpOptions, SendData: &SendData{DataFieldList: fields}}
+	}
+	call := func(opt *Options) (*Response, error) {
+		requester, err := NewRequester(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer requester.close()
+		return requester.dispose()
+	}
+
+	// 只发送
+	resp, err := call(newOpt(UdpOptions{Mode: UDP_MODE_SEND}, &DataField{Name: "name", Default: "fire"}))
+	if err != nil || !resp.IsSuccess || resp.Data != nil {
+		t.Fatalf("send: %+v %v", resp, err)
+	}
+	select {
+	case data := <-received:
+		if gjson.GetBytes(data, "name").String() != "fire" {
+			t.Errorf("received %s", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not received")
+	}
+
+	// 请求/响应
+	resp, err = call(newOpt(UdpOptions{}, &DataField{Name: "name", Default: "echo"}))
+	if err != nil || !resp.IsSuccess || gjson.GetBytes(resp.Data, "name").String() != "echo" {
+		t.Errorf("request: %+v %v", resp, err)
+	}
+
+	// 按关联id匹配响应
+	resp, err = call(newOpt(UdpOptions{Correlation: "seq"}, &DataField{Name: "seq", Default: "new"}, &DataField{Name: "stale", Default: true}))
+	if err != nil || gjson.GetBytes(resp.Data, "seq").String() != "new" {
+		t.Errorf("correlation: %s %v", resp.Data, err)
+	}
+
+	// 超时
+	resp, err = call(newOpt(UdpOptions{Timeout: 50}, &DataField{Name: "drop", Default: true}))
+	if err != nil || resp.IsSuccess || !resp.Timeout || resp.ErrCode != ERR_CODE_TIMEOUT {
+		t.Errorf("timeout: %+v %v", resp, err)
+	}
+	timeout := resp
+
+	// 对端不可达
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	opt := newOpt(UdpOptions{Timeout: 1000}, &DataField{Name: "name", Default: "lost"})
+	opt.Url = closed.LocalAddr().String()
+	resp, err = call(opt)
+	if err != nil || resp.IsSuccess || !resp.Lost || resp.ErrMsg != ERR_UDP_REFUSED.Error() {
+		t.Errorf("lost: %+v %v", resp, err)
+	}
+
+	// 连接失败计为丢包
+	opt = newOpt(UdpOptions{}, &DataField{Name: "name", Default: "dial"})
+	opt.Url = "127.0.0.1:99999"
+	if resp, err = call(opt); err != nil || resp.IsSuccess || !resp.Lost || resp.ErrCode != ERR_CODE_LOST {
+		t.Errorf("dial: %+v %v", resp, err)
+	}
+
+	// 事务：超时和丢包的步骤计入事务的响应，后续步骤继续执行
+	opt = newOpt(UdpOptions{Timeout: 50})
+	opt.TransactionOptions = TransactionOptions{
+		TransactionOptionsDataList: []TransactionOptionsData{
+			{Name: "drop", Url: addr, SendData: &SendData{DataFieldList: []*DataField{{Name: "drop", Default: true}}}},
+			{Name: "lost", Url: closed.LocalAddr().String(), SendData: &SendData{DataFieldList: []*DataField{{Name: "name", Default: "lost"}}}},
+			{Name: "echo", Url: addr, SendData: &SendData{DataFieldList: []*DataField{{Name: "name", Default: "echo"}}}},
+		},
+	}
+	transaction, err := call(opt)
+	if err != nil || transaction.IsSuccess || !transaction.Timeout || !transaction.Lost || transaction.ErrMsg == "" {
+		t.Errorf("transaction: %+v %v", transaction, err)
+	}
+	if _, ok := transaction.TransactionWasteTime["echo"]; !ok {
+		t.Errorf("transaction stopped: %v", transaction.TransactionWasteTime)
+	}
+
+	if _, err = NewRequester(newOpt(UdpOptions{Mode: "stream"})); err != ERR_UDP_MODE {
+		t.Errorf("mode: %v", err)
+	}
+
+	// 超时和丢包计入报告
+	report := &Report{}
+	report.Push(timeout)
+	report.Push(resp)
+	report.Push(&Response{IsSuccess: true})
+	report.Push(transaction)
+	if report.TimeoutNum != 2 || report.LostNum != 2 || report.FailureNum != 3 {
+		t.Errorf("report: timeout %d lost %d failure %d", report.TimeoutNum, report.LostNum, report.FailureNum)
+	}
+	merged := &Report{}
+	merged.Merge(report.Snapshot())
+	if merged.TimeoutNum != 2 || merged.LostNum != 2 {
+		t.Errorf("merged: timeout %d lost %d", merged.TimeoutNum, merged.LostNum)
+	}
+}
@@ -0,0 +1,200 @@
+package gobom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	HOOK_RUN_START = "run.start"        // 运行开始
+	HOOK_RUN_END   = "run.end"          // 运行结束
+	HOOK_THRESHOLD = "threshold.breach" // 越过阈值
+	HOOK_RUN_ABORT = "run.abort"        // 出错或越过阈值而中止
+	HOOK_TEST      = "test"             // 测试发送
+
+	DEFAULT_HOOK_RETRIES   = 3
+	DEFAULT_HOOK_TIMEOUT   = 5 // 请求超时（秒）
+	DEFAULT_HOOK_LOG_LIMIT = 100
+)
+
+// 重试间隔，第n次重试等待 hookBackoff * 2^(n-1)
+var hookBackoff = time.Second
+
+var hookClient = &http.Client{Timeout: DEFAULT_HOOK_TIMEOUT * time.Second}
+
+// 通知内容
+type HookPayload struct {
+	Event      string             `json:"event"`
+	Time       string             `json:"time"`
+	TaskId     string             `json:"taskId,omitempty"`
+	PipelineId uint               `json:"pipelineId,omitempty"`
+	RunId      uint               `json:"runId,omitempty"` // 任务运行记录id
+	Status     int                `json:"status"`
+	Note       string             `json:"note,omitempty"`
+	Metrics    *TaskTotals        `json:"metrics,omitempty"` // 汇总指标
+	Breaches   []*ThresholdBreach `json:"breaches,omitempty"`
+	Stages     []*PipelineStage   `json:"stages,omitempty"` // 流水线各阶段的结果
+}
+
+func hookTime() string {
+	return time.Now().Format("2006-01-02 15:04:05")
+}
+
+// 任务运行的通知内容
+func taskHookPayload(event string, taskRun *TaskRunData) *HookPayload {
+	payload := &HookPayload{
+		Event:  event,
+		Time:   hookTime(),
+		TaskId: taskRun.TaskId,
+		RunId:  taskRun.ID,
+		Status: taskRun.Status,
+		Note:   taskRun.Note,
+	}
+	if taskRun.Report != nil {
+		payload.Metrics = NewTaskTotals(taskRun.Report.Snapshot())
+		payload.Breaches = taskRun.Report.Breaches
+	}
+	return payload
+}
+
+// 发送通知到任务或流水线配置的钩子，不阻塞调用方
+func fireHooks(payload *HookPayload) {
+	go func() {
+		var hooks []WebhookData
+		db := GobomStore.GetDb().Table(GobomStore.GetTableName(webhookTable)).Where("enabled = ?", true)
+		if payload.PipelineId != 0 {
+			db = db.Where("pipeline_id = ?", payload.PipelineId)
+		} else {
+			db = db.Where("task_id = ?", payload.TaskId)
+		}
+		if err := db.Find(&hooks).Error; err != nil {
+			logger.Debug(err)
+			return
+		}
+		for i := range hooks {
+			if hooks[i].accept(payload.Event) {
+				go hooks[i].deliver(payload, hooks[i].retries())
+			}
+		}
+	}()
+}
+
+func (hook *WebhookData) accept(event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, v := range hook.Events {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (hook *WebhookData) retries() int {
+	if hook.Retries == nil {
+		return DEFAULT_HOOK_RETRIES
+	}
+	return *hook.Retries
+}
+
+// 发送通知，失败时按指数退避重试retries次，结果保存到发送记录
+func (hook *WebhookData) deliver(payload *HookPayload, retries int) *WebhookLogData {
+	hookLog := &WebhookLogData{
+		WebhookId:  hook.ID,
+		Event:      payload.Event,
+		TaskId:     payload.TaskId,
+		PipelineId: payload.PipelineId,
+		RunId:      payload.RunId,
+		Url:        hook.Url,
+	}
+	body, err := hook.render(payload)
+	if err != nil {
+		hookLog.Error = err.Error()
+	} else {
+		hookLog.Body = body
+		for backoff := hookBackoff; ; backoff *= 2 {
+			hookLog.Attempts++
+			hookLog.StatusCode, err = hook.send(body)
+			if err == nil {
+				hookLog.Success = true
+				hookLog.Error = ""
+				break
+			}
+			hookLog.Error = err.Error()
+			if hookLog.Attempts > retries {
+				break
+			}
+			time.Sleep(backoff)
+		}
+	}
+	logger.Debug("webhook ", hook.ID, payload.Event, " success: ", hookLog.Success, hookLog.Error)
+	if err := hookLog.Add(); err != nil {
+		logger.Debug(err)
+	}
+	return hookLog
+}
+
+func (hook *WebhookData) send(body string) (int, error) {
+	// 规则可能在保存钩子后修改，发送前再检查一次
+	if _, err := gobomInterlock.Check(hook.Url); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.Url, strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", hook.contentType())
+	for k, v := range hook.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("响应状态码%d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (hook *WebhookData) contentType() string {
+	if hook.ContentType == "" {
+		return "application/json"
+	}
+	return hook.ContentType
+}
+
+// 生成请求体，模板中的{{字段路径}}替换为通知内容中的值（如{{taskId}}、{{metrics.p99Time}}），
+// JSON请求体中的字符串值会转义
+func (hook *WebhookData) render(payload *HookPayload) (string, error) {
+	bt, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	if hook.Body == "" {
+		return string(bt), nil
+	}
+	escape := strings.Contains(hook.contentType(), "json")
+	return templateRegexp.ReplaceAllStringFunc(hook.Body, func(match string) string {
+		result := gjson.GetBytes(bt, templateRegexp.FindStringSubmatch(match)[1])
+		if !result.Exists() {
+			return ""
+		}
+		if !escape || result.Type != gjson.String {
+			return result.String()
+		}
+		bt, _ := json.Marshal(result.String())
+		return string(bt[1 : len(bt)-1])
+	}), nil
+}
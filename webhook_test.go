@@ -0,0 +1,236 @@
+package gobom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWebhookRender(t *testing.T) {
+	payload := &HookPayload{
+		Event:   HOOK_RUN_END,
+		TaskId:  "order",
+		Status:  STATUS_ERROR,
+		Note:    `setup失败："login" timeout`,
+		Metrics: &TaskTotals{SuccessNum: 10, P99Time: 35},
+	}
+	hook := &WebhookData{Body: `{"text":"{{taskId}} {{event}}: {{note}}, p99 {{metrics.p99Time}}ms{{missing}}"}`}
+	body, err := hook.render(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg struct{ Text string }
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		t.Fatalf("invalid json body %s: %v", body, err)
+	}
+	if want := `order run.end: setup失败："login" timeout, p99 35ms`; msg.Text != want {
+		t.Errorf("got %q, want %q", msg.Text, want)
+	}
+
+	hook = &WebhookData{Body: "status={{status}}&note={{note}}", ContentType: "text/plain"}
+	if body, _ = hook.render(payload); body != `status=5&note=setup失败："login" timeout` {
+		t.Errorf("plain body %q", body)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	initTestDb(t)
+	backoff := hookBackoff
+	hookBackoff = 10 * time.Millisecond
+	defer func() { hookBackoff = backoff }()
+
+	var mu sync.Mutex
+	var events []*HookPayload
+	var chat []string
+	flaky := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/events":
+			payload := &HookPayload{}
+			json.Unmarshal(body, payload)
+			events = append(events, payload)
+		case "/chat":
+			if flaky++; flaky <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			chat = append(chat, string(body))
+		case "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	task, err := NewTask("hook-task", &Options{Url: server.URL + "/api", ConCurrent: 1, Duration: 3, Interval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Worker.Thresholds = []*Threshold{{Metric: METRIC_AVG_TIME, Op: ">=", Value: 0, Abort: true}}
+	if err := (&TaskData{Name: "hook-task", Task: task}).Add(); err != nil {
+		t.Fatal(err)
+	}
+	one, zero := 1, 0
+	hooks := []*WebhookData{
+		{TaskId: "hook-task", Url: server.URL + "/events", Enabled: true},
+		{TaskId: "hook-task", Url: server.URL + "/chat", Events: []string{HOOK_RUN_END}, Enabled: true,
+			Body: `{"msgtype":"text","text":{"content":"任务{{taskId}}结束，状态{{status}}，成功{{metrics.successNum}}次"}}`},
+		{TaskId: "hook-task", Url: server.URL + "/down", Events: []string{HOOK_RUN_START}, Retries: &one, Enabled: true},
+		{TaskId: "hook-task", Url: server.URL + "/events", Enabled: false},
+		{TaskId: "hook-task", Url: server.URL + "/down", Events: []string{HOOK_RUN_START}, Retries: &zero, Enabled: true},
+	}
+	for _, hook := range hooks {
+		if err := hook.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if err := hook.Add(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (&WebhookData{TaskId: "hook-task", PipelineId: 1, Url: server.URL}).Check(); err != ERR_WEBHOOK_TARGET {
+		t.Errorf("check target: %v", err)
+	}
+	if err := (&WebhookData{TaskId: "hook-task", Url: server.URL, Events: []string{"run.pause"}}).Check(); err != ERR_WEBHOOK_EVENT {
+		t.Errorf("check event: %v", err)
+	}
+
+	if err := (&TaskData{Task: &Task{TaskId: "hook-task"}}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	var logs []WebhookLogData
+	for i := 0; len(logs) < 7; i++ {
+		if i > 500 {
+			t.Fatalf("got %d delivery logs, want 7", len(logs))
+		}
+		time.Sleep(10 * time.Millisecond)
+		logs, _ = (&WebhookLogData{}).Get()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	got := make(map[string]*HookPayload)
+	for _, payload := range events {
+		got[payload.Event] = payload
+		if payload.TaskId != "hook-task" || payload.RunId == 0 {
+			t.Errorf("unexpected payload: %+v", payload)
+		}
+	}
+	if len(events) != 4 || got[HOOK_RUN_START] == nil || got[HOOK_THRESHOLD] == nil || got[HOOK_RUN_ABORT] == nil || got[HOOK_RUN_END] == nil {
+		t.Fatalf("unexpected events: %d %v", len(events), got)
+	}
+	if end := got[HOOK_RUN_END]; end.Status != STATUS_STOP || end.Metrics == nil || end.Metrics.SuccessNum == 0 || len(end.Breaches) != 1 {
+		t.Errorf("run end payload: %+v", end)
+	}
+	if len(chat) != 1 {
+		t.Fatalf("chat messages: %v", chat)
+	}
+	var msg struct {
+		Text struct{ Content string }
+	}
+	if err := json.Unmarshal([]byte(chat[0]), &msg); err != nil || msg.Text.Content != "任务hook-task结束，状态4，成功"+
+		strconv.FormatUint(got[HOOK_RUN_END].Metrics.SuccessNum, 10)+"次" {
+		t.Errorf("chat message %s: %v", chat[0], err)
+	}
+	for _, hookLog := range logs {
+		switch hookLog.WebhookId {
+		case hooks[1].ID:
+			if !hookLog.Success || hookLog.Attempts != 3 || hookLog.StatusCode != http.StatusOK {
+				t.Errorf("retried delivery log: %+v", hookLog)
+			}
+		case hooks[2].ID:
+			if hookLog.Success || hookLog.Attempts != 2 || hookLog.StatusCode != http.StatusInternalServerError || hookLog.Error == "" {
+				t.Errorf("failed delivery log: %+v", hookLog)
+			}
+		case hooks[3].ID:
+			t.Error("disabled hook delivered")
+		case hooks[4].ID:
+			if hookLog.Success || hookLog.Attempts != 1 {
+				t.Errorf("no retry delivery log: %+v", hookLog)
+			}
+		}
+	}
+	// 测试发送不重试
+	if hookLog := hooks[2].deliver(&HookPayload{Event: HOOK_TEST}, 0); hookLog.Attempts != 1 {
+		t.Errorf("test delivery: %+v", hookLog)
+	}
+}
+
+// 钩子地址受压测地址规则限制，没有编辑权限的用户看不到请求头的值
+func TestWebhookApi(t *testing.T) {
+	initTestDb(t)
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(NewApi().Http)
+	defer server.Close()
+	if err := InitAdmin(&AppConfig{AdminPassword: "admin-password"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := apiLogin(t, server, DEFAULT_ADMIN_NAME, "admin-password")
+	mustCall := func(path string, body interface{}) *ApiReply {
+		_, reply := apiCall(t, server, admin, path, body)
+		if reply.Msg != "" {
+			t.Fatalf("%s: %s", path, reply.Msg)
+		}
+		return reply
+	}
+	reply := mustCall("/project/add", &ProjectData{Name: "hook"})
+	projectId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	reply = mustCall("/user/add", map[string]string{"name": "viewer", "password": "viewer-password"})
+	viewerId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	mustCall("/project/member/set", &ProjectReqData{ID: projectId, UserId: viewerId, Role: ROLE_VIEWER})
+	viewer := apiLogin(t, server, "viewer", "viewer-password")
+	mustCall("/script/add", map[string]interface{}{"name": "hook-script", "projectId": projectId, "data": `{"url":"http://127.0.0.1/api"}`})
+	scripts, err := (&ScriptData{}).Get()
+	if err != nil || len(scripts) != 1 {
+		t.Fatal(scripts, err)
+	}
+	mustCall("/task/add", &TaskReqData{TaskId: "hook-api", Name: "hook-api", ProjectId: projectId, ScriptId: scripts[0].ID, ConCurrent: 1, Duration: 60})
+
+	reply = mustCall("/webhook/add", &WebhookReqData{TaskId: "hook-api", Url: "http://10.1.2.3/hook", Header: map[string]string{"Authorization": "Bearer secret"}, Enabled: true})
+	hookId := uint(reply.Data.(map[string]interface{})["ID"].(float64))
+	header := func(token string) (string, string) {
+		_, one := apiCall(t, server, token, "/webhook", &WebhookReqData{ID: hookId})
+		_, list := apiCall(t, server, token, "/webhook", &WebhookReqData{})
+		if one.Msg != "" || list.Msg != "" || len(list.Data.([]interface{})) != 1 {
+			t.Fatalf("get: %+v %+v", one, list)
+		}
+		get := func(data interface{}) string {
+			value, _ := data.(map[string]interface{})["header"].(map[string]interface{})["Authorization"].(string)
+			return value
+		}
+		return get(one.Data), get(list.Data.([]interface{})[0])
+	}
+	if one, list := header(admin); one != "Bearer secret" || list != "Bearer secret" {
+		t.Errorf("editor header: %q %q", one, list)
+	}
+	if one, list := header(viewer); one != "***" || list != "***" {
+		t.Errorf("viewer header: %q %q", one, list)
+	}
+
+	// 禁止的地址不能保存，保存后禁止的地址不再发送
+	gobomInterlock.setRules([]*TargetRuleData{{Action: RULE_DENY, Cidr: "10.0.0.0/8"}})
+	t.Cleanup(func() { gobomInterlock.setRules(nil) })
+	for _, rule := range gobomInterlock.getRules() {
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, reply = apiCall(t, server, admin, "/webhook/add", &WebhookReqData{TaskId: "hook-api", Url: "http://10.9.9.9/hook", Enabled: true}); !strings.HasPrefix(reply.Msg, ERR_TARGET_DENIED.Error()) {
+		t.Errorf("denied add: %+v", reply)
+	}
+	if _, reply = apiCall(t, server, admin, "/webhook/test", &WebhookReqData{ID: hookId}); reply.Msg != "" {
+		t.Fatal(reply.Msg)
+	}
+	if hookLog := reply.Data.(map[string]interface{}); hookLog["success"] != false || !strings.HasPrefix(hookLog["error"].(string), ERR_TARGET_DENIED.Error()) {
+		t.Errorf("denied send: %v", hookLog)
+	}
+}